@@ -19,6 +19,7 @@ import (
 	"os"
 
 	"github.com/titou10/csi-driver-truenas-scale/pkg/csi"
+	"github.com/titou10/csi-driver-truenas-scale/pkg/tns"
 	"k8s.io/klog/v2"
 )
 
@@ -28,6 +29,15 @@ var (
 	mountPermissions      = flag.Uint64("mount-permissions", 0, "mounted folder permissions")
 	driverName            = flag.String("drivername", csi.DefaultDriverName, "name of the driver")
 	defaultOnDeletePolicy = flag.String("default-ondelete-policy", "", "default policy for deleting datasets when deleting a volume")
+	volumeUsageThreshold  = flag.Int("volume-usage-threshold", csi.DefaultVolumeUsageThreshold, "percentage of the quota used above which a volume is reported abnormal. 0 disables the check")
+	jobTimeout            = flag.Duration("job-timeout", tns.DefaultJobTimeout, "maximum time to wait for a Truenas job (eg replication) to complete. 0 means no limit")
+	backendsConfig        = flag.String("backends-config", "", "file with the credentials of the Truenas Scale servers, used by the calls that receive no secret (eg GetCapacity)")
+	healthCheckTTL        = flag.Duration("health-check-ttl", csi.DefaultHealthCheckTTL, "time during which the result of the health check of a Truenas Scale server (pool, service, root dataset) is reused by CreateVolume. 0 disables the cache")
+	abortJobsOnCancel     = flag.Bool("abort-jobs-on-cancel", false, "abort the Truenas jobs (eg replication) when the request waiting for them is cancelled or times out")
+	mountTimeout          = flag.Duration("mount-timeout", csi.DefaultMountTimeout, "maximum time for the mount of a NFS or SMB share on a node, the mount process is killed after it. 0 means no limit")
+	mountOptionsAllow     = flag.String("mount-options-allow", "", "comma separated names of the only mount options the volumes may use (eg nfsvers,hard,noatime). Empty allows all")
+	mountOptionsDeny      = flag.String("mount-options-deny", "", "comma separated names of the mount options the volumes may not use (eg nolock,soft)")
+	nodePlugin            = flag.Bool("node-plugin", false, "run as the node plugin of the DaemonSet: the stale NFS mounts of the node are cleaned up at startup")
 )
 
 func main() {
@@ -49,6 +59,15 @@ func handle() {
 		Endpoint:              *endpoint,
 		MountPermissions:      *mountPermissions,
 		DefaultOnDeletePolicy: *defaultOnDeletePolicy,
+		AbortJobsOnCancel:     *abortJobsOnCancel,
+		JobTimeout:            *jobTimeout,
+		VolumeUsageThreshold:  *volumeUsageThreshold,
+		BackendsConfig:        *backendsConfig,
+		HealthCheckTTL:        *healthCheckTTL,
+		MountTimeout:          *mountTimeout,
+		MountOptionsAllow:     *mountOptionsAllow,
+		MountOptionsDeny:      *mountOptionsDeny,
+		NodePlugin:            *nodePlugin,
 	}
 	d := csi.NewDriver(&driverOptions)
 	d.Run(false)
@@ -0,0 +1,192 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	tns "github.com/titou10/csi-driver-truenas-scale/pkg/tns"
+	"sigs.k8s.io/yaml"
+)
+
+// Some CSI calls (eg ListVolumes) receive neither a volume id nor secrets.
+// The Truenas Scale servers and their root datasets are learnt from the calls that receive them (CreateVolume, DeleteVolume...)
+// or from the --backends-config file. The ones learnt from the calls are lost when the controller restarts.
+// The credentials come only from the --backends-config file: the secret of a call belongs to the storage class
+// of the call, it must not be used for the volumes of the other storage classes of the server
+
+// backend is a root dataset of a Truenas Scale server known by the driver
+type backend struct {
+	tnsWsUrl    string
+	rootDataset string
+	creds       *tns.Credentials // from --backends-config, nil when not configured
+}
+
+// backendRootDatasetsKey is the key of the root datasets of a server in the --backends-config file
+const backendRootDatasetsKey = "rootDatasets"
+
+type backendKey struct {
+	tnsWsUrl    string
+	rootDataset string
+}
+
+type backendRegistry struct {
+	mu       sync.Mutex
+	servers  map[string]*tns.Credentials     // tnsWsUrl -> credentials of the root datasets without their own
+	backends map[backendKey]*tns.Credentials // (tnsWsUrl, rootDataset) -> credentials of the root dataset, nil if it has none
+}
+
+func newBackendRegistry() *backendRegistry {
+	return &backendRegistry{
+		servers:  make(map[string]*tns.Credentials),
+		backends: make(map[backendKey]*tns.Credentials),
+	}
+}
+
+// record remembers the root dataset of the server. The credentials of the call are not kept
+func (r *backendRegistry) record(tnsWsUrl string, rootDataset string) {
+	if tnsWsUrl == "" || rootDataset == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := backendKey{tnsWsUrl: tnsWsUrl, rootDataset: rootDataset}
+	if _, ok := r.backends[key]; !ok {
+		r.backends[key] = nil
+	}
+}
+
+// credentials returns the configured credentials of the root dataset, or else the ones of its server, nil if none is configured
+func (r *backendRegistry) credentials(tnsWsUrl string, rootDataset string) *tns.Credentials {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.credentialsLocked(backendKey{tnsWsUrl: tnsWsUrl, rootDataset: rootDataset})
+}
+
+func (r *backendRegistry) credentialsLocked(key backendKey) *tns.Credentials {
+	if creds := r.backends[key]; creds != nil {
+		return creds
+	}
+	return r.servers[key.tnsWsUrl]
+}
+
+// list returns the known root datasets with their credentials, sorted by url and root dataset
+func (r *backendRegistry) list() []backend {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	backends := make([]backend, 0, len(r.backends))
+	for key := range r.backends {
+		backends = append(backends, backend{tnsWsUrl: key.tnsWsUrl, rootDataset: key.rootDataset, creds: r.credentialsLocked(key)})
+	}
+	sort.Slice(backends, func(i, j int) bool {
+		if backends[i].tnsWsUrl != backends[j].tnsWsUrl {
+			return backends[i].tnsWsUrl < backends[j].tnsWsUrl
+		}
+		return backends[i].rootDataset < backends[j].rootDataset
+	})
+	return backends
+}
+
+// seed registers the credentials and the root datasets known at startup (--backends-config)
+func (r *backendRegistry) seed(configs []*backendConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range configs {
+		if len(c.rootDatasets) == 0 {
+			r.servers[c.tnsWsUrl] = c.creds
+			continue
+		}
+		for _, rootDataset := range c.rootDatasets {
+			r.backends[backendKey{tnsWsUrl: c.tnsWsUrl, rootDataset: rootDataset}] = c.creds
+		}
+	}
+}
+
+// backendConfig is an entry of a server in the --backends-config file
+type backendConfig struct {
+	tnsWsUrl     string
+	creds        *tns.Credentials
+	rootDatasets []string // the credentials are only used for them, for the root datasets without their own when empty
+}
+
+// loadBackendsConfig reads the file given with --backends-config. It maps the urls of the
+// Truenas Scale servers to the same keys as the secret referenced by the storage classes,
+// and to the comma separated list of the root datasets of their storage classes.
+// A server shared by storage classes with different credentials has a list of entries:
+//
+//	"wss://truenas.local/api/current":
+//	  apiKey: 1-xxxxxxxx
+//	  tlsInsecureSkipVerify: "true"
+//	  rootDatasets: tank/k8s,tank/k8s-ssd
+//	"wss://shared.local/api/current":
+//	  - apiKey: 2-xxxxxxxx
+//	    rootDatasets: tank/team-a
+//	  - apiKey: 3-xxxxxxxx
+//	    rootDatasets: tank/team-b
+func loadBackendsConfig(path string) ([]*backendConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backends config: %w", err)
+	}
+
+	var config map[string]json.RawMessage
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse backends config %s: %w", path, err)
+	}
+
+	var configs []*backendConfig
+	for tnsWsUrl, raw := range config {
+		var entries []map[string]string
+		if err := json.Unmarshal(raw, &entries); err != nil {
+			var entry map[string]string
+			if err := json.Unmarshal(raw, &entry); err != nil {
+				return nil, fmt.Errorf("failed to parse %s in backends config %s: %w", tnsWsUrl, path, err)
+			}
+			entries = []map[string]string{entry}
+		}
+
+		declared := make(map[string]bool)
+		for _, secrets := range entries {
+			c, err := getTnsCredentials(secrets)
+			if err != nil {
+				return nil, fmt.Errorf("invalid credentials for %s in backends config %s: %w", tnsWsUrl, path, err)
+			}
+			rootDatasets := splitList(secrets[backendRootDatasetsKey])
+			if len(rootDatasets) == 0 {
+				rootDatasets = []string{""}
+			}
+			for _, rootDataset := range rootDatasets {
+				if declared[rootDataset] {
+					if rootDataset == "" {
+						return nil, fmt.Errorf("several entries without %s for %s in backends config %s", backendRootDatasetsKey, tnsWsUrl, path)
+					}
+					return nil, fmt.Errorf("root dataset %s declared twice for %s in backends config %s", rootDataset, tnsWsUrl, path)
+				}
+				declared[rootDataset] = true
+			}
+			configs = append(configs, &backendConfig{tnsWsUrl: tnsWsUrl, creds: c, rootDatasets: splitList(secrets[backendRootDatasetsKey])})
+		}
+	}
+	return configs, nil
+}
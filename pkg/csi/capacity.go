@@ -0,0 +1,123 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// capacityPolicy is the policy of the storage class applied to the capacity requested for the volumes
+type capacityPolicy struct {
+	roundUp         bool    // Round up the requests below MinimumDatasetSize instead of refusing them
+	granularity     int64   // Round up the requests to a multiple of it. 0: none
+	maxVolumeSize   int64   // 0: no limit
+	overcommitRatio float64 // Maximum ratio of the capacity of the volumes to the space of the root dataset. 0: no limit
+}
+
+// getCapacityPolicy returns the capacity policy of the storage class parameters (case-insensitive)
+func getCapacityPolicy(parameters map[string]string) (*capacityPolicy, error) {
+	policy := &capacityPolicy{}
+	for k, v := range parameters {
+		var err error
+		switch strings.ToLower(k) {
+		case paramCapacityRoundUp:
+			policy.roundUp, err = strconv.ParseBool(v)
+		case paramCapacityGranularity:
+			policy.granularity, err = parseSize(v)
+		case paramMaxVolumeSize:
+			policy.maxVolumeSize, err = parseSize(v)
+		case paramOvercommitRatio:
+			policy.overcommitRatio, err = strconv.ParseFloat(v, 64)
+			if err == nil && policy.overcommitRatio <= 0 {
+				err = strconv.ErrRange
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid value %q for parameter %q", v, k)
+		}
+	}
+
+	if policy.maxVolumeSize > 0 && policy.maxVolumeSize < MinimumDatasetSize {
+		return nil, status.Errorf(codes.InvalidArgument, "%s (%d) is less than minimum size (%d)", paramMaxVolumeSize, policy.maxVolumeSize, MinimumDatasetSize)
+	}
+	return policy, nil
+}
+
+// parseSize parses a positive quantity, eg 1Gi or 500M
+func parseSize(v string) (int64, error) {
+	q, err := resource.ParseQuantity(v)
+	if err != nil {
+		return 0, err
+	}
+	if q.Sign() <= 0 {
+		return 0, strconv.ErrRange
+	}
+	return q.Value(), nil
+}
+
+// volumeSize returns the size of the volume created for the capacity range of a CreateVolume request
+func (p *capacityPolicy) volumeSize(capacityRange *csi.CapacityRange) (int64, error) {
+	size := capacityRange.GetRequiredBytes()
+	if size < MinimumDatasetSize {
+		if !p.roundUp {
+			return 0, status.Errorf(codes.OutOfRange, "Required capacity (%d) is less than minimum size (%d)", size, MinimumDatasetSize)
+		}
+		size = MinimumDatasetSize
+	}
+	if p.granularity > 0 {
+		size = roundUpSize(size, p.granularity)
+	}
+
+	if p.maxVolumeSize > 0 && size > p.maxVolumeSize {
+		return 0, status.Errorf(codes.OutOfRange, "Capacity (%d) is more than %s (%d)", size, paramMaxVolumeSize, p.maxVolumeSize)
+	}
+	if limit := capacityRange.GetLimitBytes(); limit > 0 && size > limit {
+		return 0, status.Errorf(codes.OutOfRange, "Capacity (%d) is more than the limit of the request (%d)", size, limit)
+	}
+	return size, nil
+}
+
+// minimumVolumeSize returns the smallest capacity that can be requested for the volumes of the protocol:
+// any size with roundUp, MinimumDatasetSize otherwise. The zvols of the block volumes are aligned on zvolSizeAlignment
+func (p *capacityPolicy) minimumVolumeSize(protocol string) int64 {
+	size := MinimumDatasetSize
+	if p.roundUp {
+		size = 1
+	}
+	if isBlockProtocol(protocol) {
+		size = roundUpSize(size, zvolSizeAlignment)
+	}
+	return size
+}
+
+// checkOvercommit checks that a new volume of the given size keeps the capacity of the volumes of the root dataset
+// (provisioned) below its space multiplied by the overcommit ratio
+func (p *capacityPolicy) checkOvercommit(provisioned int64, space int64, size int64) error {
+	if p.overcommitRatio <= 0 {
+		return nil
+	}
+	if maxCapacity := float64(space) * p.overcommitRatio; float64(provisioned+size) > maxCapacity {
+		return status.Errorf(codes.ResourceExhausted, "Capacity of the volumes (%d) would be more than the space of the root dataset (%d) x %s (%g)", provisioned+size, space, paramOvercommitRatio, p.overcommitRatio)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	tns "github.com/titou10/csi-driver-truenas-scale/pkg/tns"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const gib int64 = 1073741824
+
+func TestGetCapacityPolicy(t *testing.T) {
+	tests := []struct {
+		params   map[string]string
+		expected *capacityPolicy
+		code     codes.Code
+	}{
+		{params: map[string]string{}, expected: &capacityPolicy{}},
+		{
+			params:   map[string]string{"capacityRoundUp": "true", "capacityGranularity": "512Mi", "MaxVolumeSize": "100Gi", "overcommitRatio": "1.5"},
+			expected: &capacityPolicy{roundUp: true, granularity: gib / 2, maxVolumeSize: 100 * gib, overcommitRatio: 1.5},
+		},
+		{params: map[string]string{"maxVolumeSize": "2G"}, expected: &capacityPolicy{maxVolumeSize: 2000000000}},
+		{params: map[string]string{"capacityRoundUp": "maybe"}, code: codes.InvalidArgument},
+		{params: map[string]string{"capacityGranularity": "0"}, code: codes.InvalidArgument},
+		{params: map[string]string{"capacityGranularity": "big"}, code: codes.InvalidArgument},
+		{params: map[string]string{"maxVolumeSize": "-1Gi"}, code: codes.InvalidArgument},
+		{params: map[string]string{"maxVolumeSize": "100Mi"}, code: codes.InvalidArgument},
+		{params: map[string]string{"overcommitRatio": "0"}, code: codes.InvalidArgument},
+		{params: map[string]string{"overcommitRatio": "two"}, code: codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		policy, err := getCapacityPolicy(test.params)
+		assert.Equal(t, test.code, status.Code(err), test.params)
+		assert.Equal(t, test.expected, policy, test.params)
+	}
+}
+
+func TestCapacityPolicyVolumeSize(t *testing.T) {
+	tests := []struct {
+		desc     string
+		policy   capacityPolicy
+		required int64
+		limit    int64
+		expected int64
+		code     codes.Code
+	}{
+		{desc: "Default policy", required: 2 * gib, expected: 2 * gib},
+		{desc: "Below the minimum", required: 100 * 1048576, code: codes.OutOfRange},
+		{desc: "No required bytes", required: 0, code: codes.OutOfRange},
+		{desc: "Rounded up to the minimum", policy: capacityPolicy{roundUp: true}, required: 100 * 1048576, expected: gib},
+		{desc: "Rounded up to the granularity", policy: capacityPolicy{granularity: gib}, required: gib + 1, expected: 2 * gib},
+		{desc: "Rounded up to the minimum then to the granularity", policy: capacityPolicy{roundUp: true, granularity: 3 * gib}, required: 1, expected: 3 * gib},
+		{desc: "Maximum size", policy: capacityPolicy{maxVolumeSize: 10 * gib}, required: 10 * gib, expected: 10 * gib},
+		{desc: "Above the maximum size", policy: capacityPolicy{maxVolumeSize: 10 * gib}, required: 10*gib + 1, code: codes.OutOfRange},
+		{desc: "Rounded up above the maximum size", policy: capacityPolicy{granularity: 4 * gib, maxVolumeSize: 10 * gib}, required: 9 * gib, code: codes.OutOfRange},
+		{desc: "Rounded up above the limit", policy: capacityPolicy{granularity: 4 * gib}, required: 3 * gib, limit: 3 * gib, code: codes.OutOfRange},
+	}
+
+	for _, test := range tests {
+		size, err := test.policy.volumeSize(&csi.CapacityRange{RequiredBytes: test.required, LimitBytes: test.limit})
+		assert.Equal(t, test.code, status.Code(err), test.desc)
+		assert.Equal(t, test.expected, size, test.desc)
+	}
+}
+
+func TestCapacityPolicyMinimumVolumeSize(t *testing.T) {
+	assert.Equal(t, MinimumDatasetSize, (&capacityPolicy{}).minimumVolumeSize(protocolNFS))
+	assert.Equal(t, MinimumDatasetSize, (&capacityPolicy{}).minimumVolumeSize(protocolISCSI))
+	assert.Equal(t, int64(1), (&capacityPolicy{roundUp: true}).minimumVolumeSize(protocolNFS))
+	assert.Equal(t, zvolSizeAlignment, (&capacityPolicy{roundUp: true}).minimumVolumeSize(protocolNVMEOF))
+}
+
+func TestGetCapacityMinimumVolumeSize(t *testing.T) {
+	f := newFakeTruenas(t)
+	cs := newTestControllerServer()
+	f.setResult("pool.dataset.get_instance", map[string]interface{}{
+		"id": testRootDataset, "name": testRootDataset, "available": map[string]interface{}{"parsed": float64(100 * gib)},
+	})
+	cs.Driver.backends.seed([]*backendConfig{{tnsWsUrl: f.url(), creds: &tns.Credentials{ApiKey: "1-abc"}, rootDatasets: []string{testRootDataset}}})
+
+	tests := []struct {
+		params   map[string]string
+		expected int64
+	}{
+		{params: map[string]string{}, expected: MinimumDatasetSize},
+		{params: map[string]string{"capacityRoundUp": "true"}, expected: 1},
+		{params: map[string]string{"capacityRoundUp": "true", "protocol": "iSCSI"}, expected: zvolSizeAlignment},
+	}
+	for _, test := range tests {
+		params := map[string]string{"tnsWsUrl": f.url(), "rootDataset": testRootDataset}
+		for k, v := range test.params {
+			params[k] = v
+		}
+		res, err := cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{Parameters: params})
+		if assert.NoError(t, err, test.params) {
+			assert.Equal(t, test.expected, res.GetMinimumVolumeSize().GetValue(), test.params)
+			assert.Equal(t, 100*gib, res.GetAvailableCapacity(), test.params)
+		}
+	}
+}
+
+func TestCapacityPolicyCheckOvercommit(t *testing.T) {
+	// No ratio: no limit
+	assert.NoError(t, (&capacityPolicy{}).checkOvercommit(100*gib, 10*gib, 10*gib))
+
+	policy := &capacityPolicy{overcommitRatio: 2}
+	assert.NoError(t, policy.checkOvercommit(15*gib, 10*gib, 5*gib))
+	err := policy.checkOvercommit(15*gib, 10*gib, 5*gib+1)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	policy = &capacityPolicy{overcommitRatio: 0.5}
+	assert.Equal(t, codes.ResourceExhausted, status.Code(policy.checkOvercommit(0, 10*gib, 6*gib)))
+}
+
+func TestCreateVolumeCapacityPolicy(t *testing.T) {
+	cs := newTestControllerServer()
+	request := func(requiredBytes int64, params map[string]string) *csi.CreateVolumeRequest {
+		req := newCreateVolumeRequest(params)
+		req.CapacityRange.RequiredBytes = requiredBytes
+		return req
+	}
+
+	_, err := cs.CreateVolume(context.Background(), request(100*1048576, nil))
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+	_, err = cs.CreateVolume(context.Background(), request(20*gib, map[string]string{"maxVolumeSize": "10Gi"}))
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+	_, err = cs.CreateVolume(context.Background(), request(gib, map[string]string{"overcommitRatio": "-1"}))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// The capacity is rounded up to the minimum size, the size of the dataset
+	f := newFakeTruenas(t)
+	res, err := f.createVolume(cs, request(100*1048576, map[string]string{"capacityRoundUp": "true"}))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(MinimumDatasetSize), res.GetVolume().GetCapacityBytes())
+	assert.Equal(t, float64(MinimumDatasetSize), f.datasetCreated(t)["refquota"])
+}
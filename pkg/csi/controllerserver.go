@@ -16,7 +16,10 @@ package csi
 
 import (
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	tns "github.com/titou10/csi-driver-truenas-scale/pkg/tns"
 
@@ -25,6 +28,7 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 
 	"k8s.io/klog/v2"
 )
@@ -44,7 +48,8 @@ type nfsVolume struct {
 	onDelete      string // on delete strategy
 	size          int64  // size of volume
 	dsName        string // dataset name witout root dataset
-	pvName        string // pv name given by k8s
+	pvName        string // pv name given by k8s. Also the name of the iSCSI target
+	protocol      string // nfs, smb, iscsi or nvmeof
 }
 
 // nfsSnapshot is an internal representation of a volume snapshot created by the provisioner.
@@ -57,6 +62,9 @@ type nfsSnapshot struct {
 	snapshotName   string // Ssnapshot name
 }
 
+// pv names generated by the external-provisioner: pvc-<uid>
+var pvNameRegexp = regexp.MustCompile(`pvc-[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+
 // Ordering of elements in the CSI volume id.
 // Adding a new element should always go at the end
 // before totalIDElements
@@ -67,6 +75,7 @@ const (
 	idPvName
 	idArchivePrefix
 	idOnDelete
+	idProtocol      // Optional: not set for nfs, as in the ids created by the previous versions
 	totalIDElements // Always last
 )
 
@@ -88,17 +97,21 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, status.Error(codes.InvalidArgument, "CreateVolume name must be provided")
 	}
 
-	if err := isValidVolumeCapabilities(req.GetVolumeCapabilities()); err != nil {
-		return nil, status.Error(codes.InvalidArgument, err.Error())
-	}
-
 	var tnsWsUrl = ""
 	var rootDataset = ""
 	var archivePrefix = DefaultDSArchivePrefix
 	var onDelete = cs.Driver.defaultOnDeletePolicy
 	var dsNameTemplate = DefaultDsNameTemplate
+	var protocol = protocolNFS
+	var shareProtocol = ""
+	var cloneMode = cloneModeCopy
+	var autoStartService = false
+	var nfsServer = ""
+	var nfsServerSelection = ""
+	var space tns.SpaceOptions
+	var blockOpts blockOptions
+	var smbOpts tns.SMBShareOptions
 
-	reqCapacity := req.GetCapacityRange().GetRequiredBytes()
 	parameters := req.GetParameters()
 
 	klog.V(4).Infof("Parameters: %v", parameters)
@@ -131,14 +144,91 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		case paramShareAllowedHosts:
 		case paramShareAllowedNetworks:
 			// no op
+		case paramEncryption, paramEncryptionKeySource, paramEncryptionAlgorithm:
+			// validated by getEncryptionOptions
 		case mountPermissionsField:
 			// only used in node mount
 
 		case paramDsArchivePrefix:
 			archivePrefix = v
 
+		case paramProtocol:
+			protocol = strings.ToLower(v)
+		case paramShareProtocol:
+			shareProtocol = strings.ToLower(v)
+		case paramCloneMode:
+			cloneMode = strings.ToLower(v)
+		case paramQuotaMode:
+			space.QuotaMode = strings.ToLower(v)
+		case paramReservationMode:
+			space.ReservationMode = strings.ToLower(v)
+		case paramCapacityRoundUp, paramCapacityGranularity, paramMaxVolumeSize, paramOvercommitRatio:
+			// validated by getCapacityPolicy
+		case paramNfsServer:
+			if _, err := parseNfsServers(v); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid value for parameter %q: %v", k, err)
+			}
+			nfsServer = v
+		case paramNfsServerSelection:
+			nfsServerSelection = strings.ToLower(v)
+		case paramAutoStartService:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid value %q for parameter %q", v, k)
+			}
+			autoStartService = b
+
+		case paramSmbShareAcl:
+			acl, err := parseSmbShareAcl(v)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid value for parameter %q: %v", k, err)
+			}
+			smbOpts.Acl = acl
+		case paramSmbHostsAllow:
+			smbOpts.HostsAllow = splitList(v)
+		case paramSmbHostsDeny:
+			smbOpts.HostsDeny = splitList(v)
+		case paramSmbBrowsable:
+			browsable, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid value %q for parameter %q", v, k)
+			}
+			smbOpts.Browsable = &browsable
+
+		case paramIscsiPortalID:
+			id, err := strconv.Atoi(v)
+			if err != nil || id <= 0 {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid value %q for parameter %q", v, k)
+			}
+			blockOpts.iscsiPortalID = id
+		case paramIscsiInitiatorGroupID:
+			id, err := strconv.Atoi(v)
+			if err != nil || id < 0 {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid value %q for parameter %q", v, k)
+			}
+			blockOpts.iscsiInitiatorGroupID = id
+		case paramIscsiPortal:
+			blockOpts.iscsiPortal = v
+		case paramZvolSparse:
+			sparse, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid value %q for parameter %q", v, k)
+			}
+			blockOpts.sparse = sparse
+		case paramNvmeofPortID:
+			id, err := strconv.Atoi(v)
+			if err != nil || id <= 0 {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid value %q for parameter %q", v, k)
+			}
+			blockOpts.nvmeofPortID = id
+		case paramNvmeofAddress:
+			blockOpts.nvmeofAddress = v
+
 		default:
-			return nil, status.Errorf(codes.InvalidArgument, "invalid parameter %q in storage class", k)
+			// ds.<property>, validated by getDatasetProperties
+			if !strings.HasPrefix(strings.ToLower(k), paramDsPropertyPrefix) {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid parameter %q in storage class", k)
+			}
 		}
 	}
 
@@ -149,6 +239,56 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, tns.NewCsiError(codes.InvalidArgument, fmt.Errorf("%s is a required parameter", paramRootDataset))
 	}
 
+	if protocol != protocolNFS && !isBlockProtocol(protocol) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s %q: must be %s, %s or %s", paramProtocol, protocol, protocolNFS, protocolISCSI, protocolNVMEOF)
+	}
+	// The datasets are shared with NFS or SMB
+	switch shareProtocol {
+	case "", protocolNFS:
+	case protocolSMB:
+		if protocol != protocolNFS {
+			return nil, status.Errorf(codes.InvalidArgument, "%s is not supported by %s volumes", paramShareProtocol, protocol)
+		}
+		protocol = protocolSMB
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s %q: must be %s or %s", paramShareProtocol, shareProtocol, protocolNFS, protocolSMB)
+	}
+
+	if err := isValidVolumeCapabilities(req.GetVolumeCapabilities(), protocol); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	switch cloneMode {
+	case cloneModeCopy, cloneModeClone, cloneModeClonePromote:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s %q: must be %s, %s or %s", paramCloneMode, cloneMode, cloneModeCopy, cloneModeClone, cloneModeClonePromote)
+	}
+
+	switch space.QuotaMode {
+	case "", tns.QuotaModeRefQuota, tns.QuotaModeQuota:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s %q: must be %s or %s", paramQuotaMode, space.QuotaMode, tns.QuotaModeRefQuota, tns.QuotaModeQuota)
+	}
+	switch space.ReservationMode {
+	case "", tns.ReservationModeNone, tns.ReservationModeRefReservation, tns.ReservationModeReservation:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s %q: must be %s, %s or %s", paramReservationMode, space.ReservationMode, tns.ReservationModeNone, tns.ReservationModeRefReservation, tns.ReservationModeReservation)
+	}
+	if isBlockProtocol(protocol) && space != (tns.SpaceOptions{}) {
+		// The size of a zvol is its volsize, reserved unless zvolSparse is set
+		return nil, status.Errorf(codes.InvalidArgument, "%s and %s are not supported by %s volumes", paramQuotaMode, paramReservationMode, protocol)
+	}
+
+	switch nfsServerSelection {
+	case "", nfsServerSelectionOrdered, nfsServerSelectionSpread:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s %q: must be %s or %s", paramNfsServerSelection, nfsServerSelection, nfsServerSelectionOrdered, nfsServerSelectionSpread)
+	}
+	if (nfsServer != "" || nfsServerSelection != "") && protocol != protocolNFS {
+		// The address of the SMB shares is the host of tnsWsUrl, the block volumes have their own address parameters
+		return nil, status.Errorf(codes.InvalidArgument, "%s and %s are not supported by %s volumes", paramNfsServer, paramNfsServerSelection, protocol)
+	}
+
 	if !isArchivePrefixValid(archivePrefix) {
 		return nil, status.Errorf(codes.FailedPrecondition, "Archive prefix can only contain alpha chars")
 	}
@@ -157,14 +297,63 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, err
 	}
 
-	// DS Minimum Size check
-	if reqCapacity < MinimumDatasetSize {
-		return nil, status.Errorf(codes.InvalidArgument, "Required capacity (%d) is less than minimum size (%d)", reqCapacity, MinimumDatasetSize)
+	// DS Minimum Size check, with the capacity policy of the storage class
+	policy, err := getCapacityPolicy(parameters)
+	if err != nil {
+		return nil, err
+	}
+	reqCapacity, err := policy.volumeSize(req.GetCapacityRange())
+	if err != nil {
+		return nil, err
+	}
+
+	// Parameters of the VolumeAttributesClass of the PVC, if any
+	dsProperties, shareProperties, err := getVolumeModifications(req.GetMutableParameters())
+	if err != nil {
+		return nil, err
+	}
+	// The dataset properties of the storage class, overridden by the ones of the VolumeAttributesClass
+	createProperties, err := getDatasetProperties(parameters)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range dsProperties {
+		createProperties[name] = value
+	}
+
+	if protocol == protocolISCSI && blockOpts.iscsiPortalID == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "%s is a required parameter for %s volumes", paramIscsiPortalID, protocolISCSI)
+	}
+	if protocol == protocolNVMEOF && blockOpts.nvmeofPortID == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "%s is a required parameter for %s volumes", paramNvmeofPortID, protocolNVMEOF)
+	}
+	if isBlockProtocol(protocol) && req.GetVolumeContentSource() != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "volume content source is not supported yet for %s volumes", protocol)
+	}
+	if err := checkVolumeModifications(protocol, createProperties, shareProperties); err != nil {
+		return nil, err
+	}
+
+	encryptionOpts, err := getEncryptionOptions(parameters)
+	if err != nil {
+		return nil, err
+	}
+	if encryptionOpts != nil && isBlockProtocol(protocol) {
+		return nil, status.Errorf(codes.InvalidArgument, "%s is not supported yet for %s volumes", paramEncryption, protocol)
+	}
+	if encryptionOpts != nil && req.GetVolumeContentSource() != nil {
+		// Clones and replicated datasets keep the encryption of their source
+		return nil, status.Errorf(codes.InvalidArgument, "volume content source is not supported yet for encrypted volumes")
 	}
 
-	apiKey, exists := req.GetSecrets()[apiKeySecretNameKey]
-	if !exists || apiKey == "" {
-		return nil, status.Errorf(codes.FailedPrecondition, "Secret with 'apiKey' key not found")
+	creds, err := getTnsCredentials(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	// The passphrase or the key of the encrypted volumes is in the provisioner secret
+	encryption, err := getTnsEncryption(encryptionOpts, req.GetSecrets())
+	if err != nil {
+		return nil, err
 	}
 
 	if acquired := cs.Driver.volumeLocks.TryAcquire(pvName); !acquired {
@@ -174,28 +363,77 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 
 	requestedDsname := buildRequestedDsName(tnsWsUrl, rootDataset, archivePrefix, dsNameTemplate, parameters)
 
-	dsName, nfsSharePath, err := tns.CsiVolumeCreate(tnsWsUrl, apiKey, cs.Driver.name, requestedDsname, reqCapacity, parameters)
-	if err != nil {
-		klog.Errorf("CsiVolumeCreate error: %v", err)
-		return nil, status.Error(codes.Internal, err.Error())
+	// The volume id is stored on the dataset, for ListVolumes
+	nfsVol, csiErr := newNFSVolume(tnsWsUrl, rootDataset, onDelete, archivePrefix, pvName, requestedDsname, reqCapacity, protocol)
+	if csiErr != nil {
+		return nil, status.Error(codes.InvalidArgument, csiErr.Error())
 	}
 
-	nfsVol, err := newNFSVolume(tnsWsUrl, rootDataset, onDelete, archivePrefix, pvName, *dsName, reqCapacity)
-	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, err.Error())
+	cs.Driver.backends.record(tnsWsUrl, rootDataset)
+
+	service := healthServices[protocol]
+	csiErr = cs.Driver.health.check(tnsWsUrl, rootDataset, service, autoStartService, func() *tns.CsiError {
+		return tns.CsiCheckBackendHealth(ctx, tnsWsUrl, creds, rootDataset, service, autoStartService)
+	})
+	if csiErr != nil {
+		klog.Errorf("CsiCheckBackendHealth error: %v", csiErr)
+		return nil, status.Error(csiErr.Code, csiErr.Err.Error())
 	}
 
-	if req.GetVolumeContentSource() != nil {
+	if policy.overcommitRatio > 0 {
+		provisioned, rootSpace, csiErr := tns.CsiGetProvisionedCapacity(ctx, tnsWsUrl, creds, cs.Driver.name, rootDataset, requestedDsname)
+		if csiErr != nil {
+			klog.Errorf("CsiGetProvisionedCapacity error: %v", csiErr)
+			return nil, status.Error(csiErr.Code, csiErr.Err.Error())
+		}
+		if err := policy.checkOvercommit(provisioned, rootSpace, reqCapacity); err != nil {
+			return nil, err
+		}
+	}
+
+	switch protocol {
+	case protocolISCSI:
+		return cs.createIscsiVolume(ctx, nfsVol, creds, parameters, blockOpts, createProperties)
+	case protocolNVMEOF:
+		return cs.createNvmeofVolume(ctx, nfsVol, creds, parameters, blockOpts, createProperties)
+	}
+
+	// A ZFS clone is created before the dataset is shared
+	cloned := req.GetVolumeContentSource() != nil && cloneMode != cloneModeCopy
+	if cloned {
+		if csiErr := cs.cloneFromSource(ctx, req, nfsVol, creds, space, createProperties, parameters, cloneMode == cloneModeClonePromote); csiErr != nil {
+			klog.Errorf("CsiVolumeClone error: %v", csiErr)
+			return nil, status.Error(csiErr.Code, csiErr.Err.Error())
+		}
+	}
+
+	var dsName, nfsSharePath *string
+	if protocol == protocolSMB {
+		// The share is named after the pv
+		dsName, csiErr = tns.CsiSmbVolumeCreate(ctx, tnsWsUrl, creds, cs.Driver.name, requestedDsname, nfsVol.id, pvName, reqCapacity, space, createProperties, encryption, parameters, &smbOpts)
+		if csiErr != nil {
+			klog.Errorf("CsiSmbVolumeCreate error: %v", csiErr)
+			return nil, status.Error(csiErr.Code, csiErr.Err.Error())
+		}
+	} else {
+		dsName, nfsSharePath, csiErr = tns.CsiVolumeCreate(ctx, tnsWsUrl, creds, cs.Driver.name, requestedDsname, nfsVol.id, reqCapacity, space, createProperties, encryption, parameters)
+		if csiErr != nil {
+			klog.Errorf("CsiVolumeCreate error: %v", csiErr)
+			return nil, status.Error(csiErr.Code, csiErr.Err.Error())
+		}
+	}
+
+	if req.GetVolumeContentSource() != nil && !cloned {
 		vs := req.VolumeContentSource
 		switch vs.Type.(type) {
 		case *csi.VolumeContentSource_Snapshot:
-			csiErr := cs.copyFromSnapshot(req, nfsVol, apiKey)
+			csiErr := cs.copyFromSnapshot(ctx, req, nfsVol, creds)
 			if csiErr != nil {
 				// TODO cleanup created DS
 				return nil, status.Error(codes.Internal, csiErr.Error())
 			}
 		case *csi.VolumeContentSource_Volume:
-			csiErr := cs.copyFromVolume(req, nfsVol, apiKey)
+			csiErr := cs.copyFromVolume(ctx, req, nfsVol, creds)
 			if csiErr != nil {
 				// TODO cleanup created DS
 				return nil, status.Error(codes.Internal, csiErr.Error())
@@ -205,21 +443,125 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		}
 	}
 
+	if len(dsProperties) > 0 || len(shareProperties) > 0 {
+		csiErr := tns.CsiVolumeModify(ctx, tnsWsUrl, creds, *dsName, dsProperties, shareProperties)
+		if csiErr != nil {
+			klog.Errorf("CsiVolumeModify error: %v", csiErr)
+			return nil, status.Error(csiErr.Code, csiErr.Err.Error())
+		}
+	}
+
 	// Set parameters on PV
 	parameters[paramTnsWsUrl] = nfsVol.tnsWsUrl
-	parameters[paramNfsSharePath] = *nfsSharePath // Share path use by NodeServer to mount into pods
+	if protocol == protocolSMB {
+		parameters[paramSmbShareName] = pvName // Share name used by NodeServer to mount into pods
+	} else {
+		parameters[paramNfsSharePath] = *nfsSharePath // Share path use by NodeServer to mount into pods
+	}
 	parameters[paramDsName] = *dsName
 
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      nfsVol.id,
-			CapacityBytes: 0, // by setting it to zero, Provisioner will use PVC requested size as PV size
+			CapacityBytes: reqCapacity, // the requested size, possibly rounded up by the capacity policy
 			VolumeContext: parameters,
 			ContentSource: req.GetVolumeContentSource(),
 		},
 	}, nil
 }
 
+// blockOptions are the storage class parameters of the block (iSCSI, NVMe-oF) volumes
+type blockOptions struct {
+	sparse                bool
+	iscsiPortalID         int
+	iscsiInitiatorGroupID int
+	iscsiPortal           string // host[:port] used by the nodes, the host of tnsWsUrl by default
+	nvmeofPortID          int
+	nvmeofAddress         string // host[:port] used by the nodes, the host of tnsWsUrl by default
+}
+
+// createIscsiVolume creates a zvol exposed through its own iSCSI target
+func (cs *ControllerServer) createIscsiVolume(ctx context.Context, nfsVol *nfsVolume, creds *tns.Credentials, parameters map[string]string, opts blockOptions, dsProperties map[string]interface{}) (*csi.CreateVolumeResponse, error) {
+	portal, err := getTargetAddress(nfsVol.tnsWsUrl, opts.iscsiPortal, defaultIscsiPort)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// The size of a zvol must be a multiple of its volblocksize
+	size := roundUpSize(nfsVol.size, zvolSizeAlignment)
+
+	iqn, csiErr := tns.CsiIscsiVolumeCreate(ctx, nfsVol.tnsWsUrl, creds, cs.Driver.name, nfsVol.dsName, nfsVol.id, nfsVol.pvName, size, opts.sparse, opts.iscsiPortalID, opts.iscsiInitiatorGroupID)
+	if csiErr != nil {
+		klog.Errorf("CsiIscsiVolumeCreate error: %v", csiErr)
+		return nil, status.Error(csiErr.Code, csiErr.Err.Error())
+	}
+
+	if len(dsProperties) > 0 {
+		csiErr := tns.CsiVolumeModify(ctx, nfsVol.tnsWsUrl, creds, nfsVol.dsName, dsProperties, nil)
+		if csiErr != nil {
+			klog.Errorf("CsiVolumeModify error: %v", csiErr)
+			return nil, status.Error(csiErr.Code, csiErr.Err.Error())
+		}
+	}
+
+	// Set parameters on PV, used by NodeServer to log in the target
+	parameters[paramTnsWsUrl] = nfsVol.tnsWsUrl
+	parameters[paramDsName] = nfsVol.dsName
+	parameters[paramProtocol] = protocolISCSI
+	parameters[paramIscsiPortal] = portal
+	parameters[paramIscsiIqn] = *iqn
+	parameters[paramIscsiLun] = strconv.Itoa(tns.IscsiLunID)
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      nfsVol.id,
+			CapacityBytes: size,
+			VolumeContext: parameters,
+		},
+	}, nil
+}
+
+// createNvmeofVolume creates a zvol exposed as the namespace of its own NVMe subsystem
+func (cs *ControllerServer) createNvmeofVolume(ctx context.Context, nfsVol *nfsVolume, creds *tns.Credentials, parameters map[string]string, opts blockOptions, dsProperties map[string]interface{}) (*csi.CreateVolumeResponse, error) {
+	address, err := getTargetAddress(nfsVol.tnsWsUrl, opts.nvmeofAddress, defaultNvmeofPort)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// The size of a zvol must be a multiple of its volblocksize
+	size := roundUpSize(nfsVol.size, zvolSizeAlignment)
+
+	nqn, nsid, csiErr := tns.CsiNvmeofVolumeCreate(ctx, nfsVol.tnsWsUrl, creds, cs.Driver.name, nfsVol.dsName, nfsVol.id, nfsVol.pvName, size, opts.sparse, opts.nvmeofPortID)
+	if csiErr != nil {
+		klog.Errorf("CsiNvmeofVolumeCreate error: %v", csiErr)
+		return nil, status.Error(csiErr.Code, csiErr.Err.Error())
+	}
+
+	if len(dsProperties) > 0 {
+		csiErr := tns.CsiVolumeModify(ctx, nfsVol.tnsWsUrl, creds, nfsVol.dsName, dsProperties, nil)
+		if csiErr != nil {
+			klog.Errorf("CsiVolumeModify error: %v", csiErr)
+			return nil, status.Error(csiErr.Code, csiErr.Err.Error())
+		}
+	}
+
+	// Set parameters on PV, used by NodeServer to connect to the subsystem
+	parameters[paramTnsWsUrl] = nfsVol.tnsWsUrl
+	parameters[paramDsName] = nfsVol.dsName
+	parameters[paramProtocol] = protocolNVMEOF
+	parameters[paramNvmeofAddress] = address
+	parameters[paramNvmeofNqn] = *nqn
+	parameters[paramNvmeofNsid] = strconv.Itoa(*nsid)
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      nfsVol.id,
+			CapacityBytes: size,
+			VolumeContext: parameters,
+		},
+	}, nil
+}
+
 // DeleteVolume delete a volume
 func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
@@ -237,9 +579,9 @@ func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 		nfsVol.onDelete = cs.Driver.defaultOnDeletePolicy
 	}
 
-	apiKey, exists := req.GetSecrets()[apiKeySecretNameKey]
-	if !exists || apiKey == "" {
-		return nil, status.Errorf(codes.FailedPrecondition, "Secret with 'apiKey' key not found")
+	creds, err := getTnsCredentials(req.GetSecrets())
+	if err != nil {
+		return nil, err
 	}
 
 	if acquired := cs.Driver.volumeLocks.TryAcquire(volumeID); !acquired {
@@ -247,15 +589,34 @@ func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 	}
 	defer cs.Driver.volumeLocks.Release(volumeID)
 
+	cs.Driver.backends.record(nfsVol.tnsWsUrl, nfsVol.rootDataset)
+
 	if strings.EqualFold(nfsVol.onDelete, retain) {
 		klog.V(2).Infof("DeleteVolume: volume(%s) onDelete is set to retain, Doing nothing", volumeID)
-	} else if strings.EqualFold(nfsVol.onDelete, archive) {
-		if csiErr := tns.CsiVolumeArchive(nfsVol.tnsWsUrl, apiKey, nfsVol.rootDataset, nfsVol.dsName, nfsVol.archivePrefix); csiErr != nil {
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	// The zvol can not be deleted while it is used by an extent or a namespace
+	switch nfsVol.protocol {
+	case protocolISCSI:
+		if csiErr := tns.CsiIscsiTargetDelete(ctx, nfsVol.tnsWsUrl, creds, nfsVol.pvName); csiErr != nil {
+			klog.Errorf("Failed to delete truenas iSCSI target: %s", csiErr)
+			return nil, status.Error(csiErr.Code, csiErr.Err.Error())
+		}
+	case protocolNVMEOF:
+		if csiErr := tns.CsiNvmeofSubsysDelete(ctx, nfsVol.tnsWsUrl, creds, nfsVol.pvName); csiErr != nil {
+			klog.Errorf("Failed to delete truenas NVMe subsystem: %s", csiErr)
+			return nil, status.Error(csiErr.Code, csiErr.Err.Error())
+		}
+	}
+
+	if strings.EqualFold(nfsVol.onDelete, archive) {
+		if csiErr := tns.CsiVolumeArchive(ctx, nfsVol.tnsWsUrl, creds, nfsVol.rootDataset, nfsVol.dsName, nfsVol.archivePrefix); csiErr != nil {
 			klog.Errorf("Failed to archive truenas dataset: %v", err)
 			return nil, status.Error(csiErr.Code, csiErr.Err.Error())
 		}
 	} else {
-		if csiErr := tns.CsiVolumeDelete(nfsVol.tnsWsUrl, apiKey, nfsVol.dsName); csiErr != nil {
+		if csiErr := tns.CsiVolumeDelete(ctx, nfsVol.tnsWsUrl, creds, nfsVol.dsName); csiErr != nil {
 			klog.Errorf("Failed to delete truenas dataset+share+snapshots: %s", csiErr)
 			return nil, status.Error(csiErr.Code, csiErr.Err.Error())
 		}
@@ -271,9 +632,9 @@ func (cs *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 	if len(req.GetSourceVolumeId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot source volume ID must be provided")
 	}
-	apiKey, exists := req.GetSecrets()[apiKeySecretNameKey]
-	if !exists || apiKey == "" {
-		return nil, status.Errorf(codes.FailedPrecondition, "Secret with 'apiKey' key not found")
+	creds, err := getTnsCredentials(req.GetSecrets())
+	if err != nil {
+		return nil, err
 	}
 
 	srcVol, err := getNfsVolFromID(req.GetSourceVolumeId())
@@ -287,7 +648,9 @@ func (cs *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 		return nil, status.Errorf(codes.InvalidArgument, "Volume Snapshot class does not allow extra parameters: %s", vscParams)
 	}
 
-	snapName, restoreSize, csiErr := tns.CsiSnapshotCreate(srcVol.tnsWsUrl, apiKey, srcVol.rootDataset, srcVol.dsName, req.GetName())
+	cs.Driver.backends.record(srcVol.tnsWsUrl, srcVol.rootDataset)
+
+	snapName, restoreSize, csiErr := tns.CsiSnapshotCreate(ctx, srcVol.tnsWsUrl, creds, srcVol.rootDataset, srcVol.dsName, req.GetName())
 	if csiErr != nil {
 		klog.Errorf("CsiSnapshotCreate error: %s", csiErr)
 		return nil, status.Error(csiErr.Code, csiErr.Err.Error())
@@ -312,9 +675,9 @@ func (cs *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteS
 	if len(req.GetSnapshotId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Snapshot ID is required for deletion")
 	}
-	apiKey, exists := req.GetSecrets()[apiKeySecretNameKey]
-	if !exists || apiKey == "" {
-		return nil, status.Errorf(codes.FailedPrecondition, "Secret with 'apiKey' key not found")
+	creds, err := getTnsCredentials(req.GetSecrets())
+	if err != nil {
+		return nil, err
 	}
 
 	snapshot, err := getNfsSnapFromID(req.GetSnapshotId())
@@ -324,7 +687,7 @@ func (cs *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteS
 		return &csi.DeleteSnapshotResponse{}, nil
 	}
 
-	csiErr := tns.CsiSnapshotDelete(snapshot.tnsWsUrl, apiKey, snapshot.snapshotName)
+	csiErr := tns.CsiSnapshotDelete(ctx, snapshot.tnsWsUrl, creds, snapshot.rootDataset, snapshot.snapshotName)
 	if csiErr != nil {
 		klog.Errorf("CsiSnapshotDelete error: %s", csiErr)
 		return nil, status.Error(csiErr.Code, csiErr.Err.Error())
@@ -333,7 +696,7 @@ func (cs *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteS
 	return &csi.DeleteSnapshotResponse{}, nil
 }
 
-func (cs *ControllerServer) ControllerExpandVolume(_ context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+func (cs *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
 	if len(req.GetVolumeId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
@@ -342,9 +705,9 @@ func (cs *ControllerServer) ControllerExpandVolume(_ context.Context, req *csi.C
 		return nil, status.Error(codes.InvalidArgument, "Capacity Range missing in request")
 	}
 
-	apiKey, exists := req.GetSecrets()[apiKeySecretNameKey]
-	if !exists || apiKey == "" {
-		return nil, status.Errorf(codes.FailedPrecondition, "Secret with 'apiKey' key not found")
+	creds, err := getTnsCredentials(req.GetSecrets())
+	if err != nil {
+		return nil, err
 	}
 
 	nfsVol, err := getNfsVolFromID(req.GetVolumeId())
@@ -356,7 +719,21 @@ func (cs *ControllerServer) ControllerExpandVolume(_ context.Context, req *csi.C
 
 	volSizeBytes := req.GetCapacityRange().GetRequiredBytes()
 
-	size, csiErr := tns.CsiVolumeExpand(nfsVol.tnsWsUrl, apiKey, nfsVol.rootDataset, nfsVol.dsName, volSizeBytes)
+	cs.Driver.backends.record(nfsVol.tnsWsUrl, nfsVol.rootDataset)
+
+	if isBlockProtocol(nfsVol.protocol) {
+		size, csiErr := tns.CsiZvolExpand(ctx, nfsVol.tnsWsUrl, creds, nfsVol.dsName, roundUpSize(volSizeBytes, zvolSizeAlignment))
+		if csiErr != nil {
+			klog.Errorf("CsiZvolExpand error: %s", csiErr)
+			return nil, status.Error(csiErr.Code, csiErr.Err.Error())
+		}
+
+		// The node rescans the device and resizes the filesystem
+		klog.V(2).Infof("ControllerExpandVolume(%s) successfully, volsize: %d bytes", req.VolumeId, *size)
+		return &csi.ControllerExpandVolumeResponse{CapacityBytes: *size, NodeExpansionRequired: true}, nil
+	}
+
+	size, csiErr := tns.CsiVolumeExpand(ctx, nfsVol.tnsWsUrl, creds, nfsVol.rootDataset, nfsVol.dsName, volSizeBytes)
 	if csiErr != nil {
 		klog.Errorf("CsiDatasetExpand error: %s", csiErr)
 		return nil, status.Error(csiErr.Code, csiErr.Err.Error())
@@ -366,83 +743,71 @@ func (cs *ControllerServer) ControllerExpandVolume(_ context.Context, req *csi.C
 	return &csi.ControllerExpandVolumeResponse{CapacityBytes: *size}, nil
 }
 
-func (cs *ControllerServer) GetCapacity(_ context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
-
-	// TODO
-	// // GetCapacityRequest does not have secrets. impossible to call tns
+func (cs *ControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	// GetCapacityRequest does not have secrets: the credentials come from the --backends-config file
 	// github issue: https://github.com/container-storage-interface/spec/issues/581
+	var tnsWsUrl = ""
+	var rootDataset = ""
+	var protocol = protocolNFS
 
-	// // Capacity
-	// // klog.Infof(">>>> GetCapacity >>>>>>>>>>>>>")
-	// var tnsWsUrl = ""
-	// var rootDataset = ""
-	// parameters := req.GetParameters()
-	// if parameters == nil {
-	// 	parameters = make(map[string]string)
-	// }
-
-	// // validate parameters (case-insensitive)
-	// for k, v := range parameters {
-	// 	switch strings.ToLower(k) {
-	// 	case paramTnsWsUrl:
-	// 		tnsWsUrl = v
-	// 	case paramRootDataset:
-	// 		rootDataset = v
-	// 	case paramOnDelete:
-	// 	case paramDsNameTemplate:
-	// 	case pvcNamespaceKey:
-	// 	case pvcNameKey:
-	// 	case pvNameKey:
-
-	// 	case paramDSPermissionsMode:
-	// 	case paramDSPermissionsUser:
-	// 	case paramDSPermissionsGroup:
-	// 	case paramShareMaprootUser:
-	// 	case paramShareMaprootGroup:
-	// 	case paramShareMapallUser:
-	// 	case paramShareMapallGroup:
-	// 	case paramShareAllowedHosts:
-	// 	case paramShareAllowedNetworks:
-	// 	case mountPermissionsField:
-	// 	case paramDsArchivePrefix:
-
-	// 	default:
-	// 		return nil, status.Errorf(codes.InvalidArgument, "invalid parameter %q in storage class", k)
-	// 	}
-	// }
-
-	// if tnsWsUrl == "" {
-	// 	return nil, tns.NewCsiError(codes.InvalidArgument, fmt.Errorf("%s is a required parameter", paramTnsWsUrl))
-	// }
-	// if rootDataset == "" {
-	// 	return nil, tns.NewCsiError(codes.InvalidArgument, fmt.Errorf("%s is a required parameter", paramRootDataset))
-	// }
-
-	// apiKey, exists := req.GetSecrets()[apiKeySecretNameKey]
-	// if !exists || apiKey == "" {
-	// 	return nil, status.Errorf(codes.FailedPrecondition, "Secret with 'apiKey' key not found")
-	// }
-
-	// availableCapacity, csiErr := tns.CsiGetCapacity(tnsWsUrl, apiKey, rootDataset)
-	// if csiErr != nil {
-	// 	klog.Errorf("CsiSnapshotCreate error: %s", csiErr)
-	// 	return nil, status.Error(csiErr.Code, csiErr.Err.Error())
-	// }
-	// return &csi.GetCapacityResponse{
-	// 	AvailableCapacity: *availableCapacity,
-	// 	//MaximumVolumeSize: &wrappers.Int64Value{Value: 100 * 1024 * 1024 * 1024},
-	// 	MinimumVolumeSize: &wrappers.Int64Value{Value: MinimumDatasetSize},
-	// }, nil
-}
-
-func (cs *ControllerServer) copyFromSnapshot(req *csi.CreateVolumeRequest, dstVol *nfsVolume, apiKey string) *tns.CsiError {
+	// The other parameters of the storage class are not relevant here (case-insensitive), except the capacity policy
+	for k, v := range req.GetParameters() {
+		switch strings.ToLower(k) {
+		case paramTnsWsUrl:
+			tnsWsUrl = v
+		case paramRootDataset:
+			rootDataset = v
+		case paramProtocol:
+			protocol = strings.ToLower(v)
+		}
+	}
+
+	if tnsWsUrl == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%s is a required parameter", paramTnsWsUrl)
+	}
+	if rootDataset == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%s is a required parameter", paramRootDataset)
+	}
+
+	creds := cs.Driver.backends.credentials(tnsWsUrl, rootDataset)
+	if creds == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "no credentials for Truenas Scale %s %s: it must be declared in the --backends-config file", tnsWsUrl, rootDataset)
+	}
+
+	policy, err := getCapacityPolicy(req.GetParameters())
+	if err != nil {
+		return nil, err
+	}
+
+	cs.Driver.backends.record(tnsWsUrl, rootDataset)
+
+	availableCapacity, csiErr := tns.CsiGetCapacity(ctx, tnsWsUrl, creds, rootDataset)
+	if csiErr != nil {
+		klog.Errorf("CsiGetCapacity error: %s", csiErr)
+		return nil, status.Error(csiErr.Code, csiErr.Err.Error())
+	}
+
+	// A larger volume could not be filled: the pool would be full before
+	maxVolumeSize := *availableCapacity
+	if policy.maxVolumeSize > 0 && policy.maxVolumeSize < maxVolumeSize {
+		maxVolumeSize = policy.maxVolumeSize
+	}
+
+	klog.V(4).Infof("GetCapacity(%s %s): %d bytes available", tnsWsUrl, rootDataset, *availableCapacity)
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: *availableCapacity,
+		MaximumVolumeSize: wrapperspb.Int64(maxVolumeSize),
+		MinimumVolumeSize: wrapperspb.Int64(policy.minimumVolumeSize(protocol)),
+	}, nil
+}
+
+func (cs *ControllerServer) copyFromSnapshot(ctx context.Context, req *csi.CreateVolumeRequest, dstVol *nfsVolume, creds *tns.Credentials) *tns.CsiError {
 	srcSnapshot, err := getNfsSnapFromID(req.VolumeContentSource.GetSnapshot().GetSnapshotId())
 	if err != nil {
 		return tns.NewCsiError(codes.NotFound, err)
 	}
 
-	csiErr := tns.CsiSnapshotClone(srcSnapshot.tnsWsUrl, apiKey, srcSnapshot.rootDataset, srcSnapshot.snapshotName, dstVol.dsName)
+	csiErr := tns.CsiSnapshotClone(ctx, srcSnapshot.tnsWsUrl, creds, srcSnapshot.rootDataset, srcSnapshot.snapshotName, dstVol.dsName)
 	if csiErr != nil {
 		return csiErr
 	}
@@ -451,13 +816,13 @@ func (cs *ControllerServer) copyFromSnapshot(req *csi.CreateVolumeRequest, dstVo
 	return nil
 }
 
-func (cs *ControllerServer) copyFromVolume(req *csi.CreateVolumeRequest, dstVol *nfsVolume, apiKey string) *tns.CsiError {
+func (cs *ControllerServer) copyFromVolume(ctx context.Context, req *csi.CreateVolumeRequest, dstVol *nfsVolume, creds *tns.Credentials) *tns.CsiError {
 	srcVol, err := getNfsVolFromID(req.GetVolumeContentSource().GetVolume().GetVolumeId())
 	if err != nil {
 		return tns.NewCsiError(codes.NotFound, err)
 	}
 
-	csiErr := tns.CsiDatasetClone(srcVol.tnsWsUrl, apiKey, srcVol.rootDataset, srcVol.dsName, dstVol.dsName)
+	csiErr := tns.CsiDatasetClone(ctx, srcVol.tnsWsUrl, creds, srcVol.rootDataset, srcVol.dsName, dstVol.dsName)
 	if csiErr != nil {
 		return csiErr
 	}
@@ -466,11 +831,62 @@ func (cs *ControllerServer) copyFromVolume(req *csi.CreateVolumeRequest, dstVol
 	return nil
 }
 
+// cloneFromSource creates the dataset of the volume as a ZFS clone of the snapshot or of the volume of the content source
+func (cs *ControllerServer) cloneFromSource(ctx context.Context, req *csi.CreateVolumeRequest, dstVol *nfsVolume, creds *tns.Credentials, space tns.SpaceOptions, properties map[string]interface{}, parameters map[string]string, promote bool) *tns.CsiError {
+	var tnsWsUrl, srcName string
+	switch vs := req.GetVolumeContentSource().GetType().(type) {
+	case *csi.VolumeContentSource_Snapshot:
+		srcSnapshot, err := getNfsSnapFromID(vs.Snapshot.GetSnapshotId())
+		if err != nil {
+			return tns.NewCsiError(codes.NotFound, err)
+		}
+		tnsWsUrl, srcName = srcSnapshot.tnsWsUrl, srcSnapshot.snapshotName
+	case *csi.VolumeContentSource_Volume:
+		srcVol, err := getNfsVolFromID(vs.Volume.GetVolumeId())
+		if err != nil {
+			return tns.NewCsiError(codes.NotFound, err)
+		}
+		if isBlockProtocol(srcVol.protocol) {
+			return tns.NewCsiError(codes.InvalidArgument, fmt.Errorf("a %s volume can not be cloned from a %s volume", dstVol.protocol, srcVol.protocol))
+		}
+		tnsWsUrl, srcName = srcVol.tnsWsUrl, srcVol.dsName
+	default:
+		return tns.NewCsiError(codes.InvalidArgument, fmt.Errorf("%v not a proper volume source", req.GetVolumeContentSource()))
+	}
+
+	// A clone is in the pool of its origin
+	if err := checkCloneSource(tnsWsUrl, srcName, dstVol); err != nil {
+		return tns.NewCsiError(codes.InvalidArgument, err)
+	}
+
+	csiErr := tns.CsiVolumeClone(ctx, dstVol.tnsWsUrl, creds, cs.Driver.name, dstVol.rootDataset, srcName, dstVol.dsName, dstVol.id, dstVol.size, space, properties, parameters, promote)
+	if csiErr != nil {
+		return csiErr
+	}
+
+	klog.V(2).Infof("CsiVolumeClone success. cloned %s -> %s", srcName, dstVol.dsName)
+	return nil
+}
+
+// checkCloneSource checks that the volume can be a ZFS clone of srcName (dataset or dataset@snapshot):
+// a clone is created by the server of its origin, in the same pool
+func checkCloneSource(tnsWsUrl string, srcName string, dstVol *nfsVolume) error {
+	if strings.TrimRight(tnsWsUrl, "/") != strings.TrimRight(dstVol.tnsWsUrl, "/") {
+		return fmt.Errorf("%s is on another server (%s): use %s %q", srcName, tnsWsUrl, paramCloneMode, cloneModeCopy)
+	}
+	srcPool, _, _ := strings.Cut(srcName, "/")
+	dstPool, _, _ := strings.Cut(dstVol.dsName, "/")
+	if srcPool != dstPool {
+		return fmt.Errorf("%s is in another pool (%s): use %s %q", srcName, srcPool, paramCloneMode, cloneModeCopy)
+	}
+	return nil
+}
+
 func (cs *ControllerServer) ValidateVolumeCapabilities(_ context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
 	if len(req.GetVolumeId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
-	if err := isValidVolumeCapabilities(req.GetVolumeCapabilities()); err != nil {
+	if err := isValidVolumeCapabilities(req.GetVolumeCapabilities(), getVolumeProtocol(req.GetVolumeId())); err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
@@ -482,15 +898,22 @@ func (cs *ControllerServer) ValidateVolumeCapabilities(_ context.Context, req *c
 	}, nil
 }
 
-// isValidVolumeCapabilities validates the given VolumeCapability array is valid
-func isValidVolumeCapabilities(volCaps []*csi.VolumeCapability) error {
+// isValidVolumeCapabilities validates the given VolumeCapability array is valid for the protocol
+// A block (iSCSI, NVMe-oF) volume can only be written from one node
+func isValidVolumeCapabilities(volCaps []*csi.VolumeCapability, protocol string) error {
 	if len(volCaps) == 0 {
 		return fmt.Errorf("volume capabilities missing in request")
 	}
 	for _, c := range volCaps {
-		if c.GetBlock() != nil {
+		if c.GetBlock() != nil && !isBlockProtocol(protocol) {
 			return fmt.Errorf("block volume capability not supported")
 		}
+		if isBlockProtocol(protocol) {
+			switch mode := c.GetAccessMode().GetMode(); mode {
+			case csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER, csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+				return fmt.Errorf("access mode %s not supported by %s volumes", mode, protocol)
+			}
+		}
 	}
 	return nil
 }
@@ -511,27 +934,356 @@ func (cs *ControllerServer) ControllerUnpublishVolume(_ context.Context, _ *csi.
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
-func (cs *ControllerServer) ControllerGetVolume(_ context.Context, x *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	klog.Infof("))))))))))))) ControllerGetVolume: %v", x)
-	return nil, status.Error(codes.Unimplemented, "")
+// ControllerGetVolume returns the capacity of the volume and its condition
+// The request has no secrets: the credentials of the root dataset come from the --backends-config file
+func (cs *ControllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is empty")
+	}
+	nfsVol, err := getNfsVolFromID(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "failed to get volume for id %v: %v", volumeID, err)
+	}
+
+	creds := cs.Driver.backends.credentials(nfsVol.tnsWsUrl, nfsVol.rootDataset)
+	if creds == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "no credentials for Truenas Scale %s %s: it must be declared in the --backends-config file", nfsVol.tnsWsUrl, nfsVol.rootDataset)
+	}
+
+	var capacity int64
+	var condition *csi.VolumeCondition
+
+	switch nfsVol.protocol {
+	case protocolISCSI:
+		ds, target, csiErr := tns.CsiIscsiVolumeGet(ctx, nfsVol.tnsWsUrl, creds, nfsVol.dsName, nfsVol.pvName)
+		if csiErr != nil {
+			klog.Errorf("CsiIscsiVolumeGet error: %s", csiErr)
+			return nil, status.Error(csiErr.Code, csiErr.Err.Error())
+		}
+		capacity = getZvolSize(ds)
+		condition = getBlockVolumeCondition(nfsVol.dsName, ds, target != nil, fmt.Sprintf("iSCSI target %s", nfsVol.pvName))
+	case protocolNVMEOF:
+		ds, subsys, csiErr := tns.CsiNvmeofVolumeGet(ctx, nfsVol.tnsWsUrl, creds, nfsVol.dsName, nfsVol.pvName)
+		if csiErr != nil {
+			klog.Errorf("CsiNvmeofVolumeGet error: %s", csiErr)
+			return nil, status.Error(csiErr.Code, csiErr.Err.Error())
+		}
+		capacity = getZvolSize(ds)
+		condition = getBlockVolumeCondition(nfsVol.dsName, ds, subsys != nil, fmt.Sprintf("NVMe subsystem %s", nfsVol.pvName))
+	case protocolSMB:
+		ds, share, csiErr := tns.CsiSmbVolumeGet(ctx, nfsVol.tnsWsUrl, creds, nfsVol.dsName)
+		if csiErr != nil {
+			klog.Errorf("CsiSmbVolumeGet error: %s", csiErr)
+			return nil, status.Error(csiErr.Code, csiErr.Err.Error())
+		}
+		if ds != nil {
+			capacity = ds.Capacity()
+		}
+		condition = getSmbVolumeCondition(nfsVol.dsName, ds, share, cs.Driver.volumeUsageThreshold)
+	default:
+		ds, share, csiErr := tns.CsiVolumeGet(ctx, nfsVol.tnsWsUrl, creds, nfsVol.dsName)
+		if csiErr != nil {
+			klog.Errorf("CsiVolumeGet error: %s", csiErr)
+			return nil, status.Error(csiErr.Code, csiErr.Err.Error())
+		}
+		if ds != nil {
+			capacity = ds.Capacity()
+		}
+		condition = getVolumeCondition(nfsVol.dsName, ds, share, cs.Driver.volumeUsageThreshold)
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      volumeID,
+			CapacityBytes: capacity,
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			VolumeCondition: condition,
+		},
+	}, nil
 }
 
-func (cs *ControllerServer) ListVolumes(_ context.Context, x *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	klog.Infof("))))))))))))) ListVolumes: %v", x)
-	return nil, status.Error(codes.Unimplemented, "")
+// getBlockVolumeCondition reports the problems preventing the block volume from being used:
+// missing zvol or missing object exposing it (iSCSI target, NVMe subsystem)
+func getBlockVolumeCondition(dsName string, ds *tns.TNSDataset, exposed bool, exposedBy string) *csi.VolumeCondition {
+	if ds == nil {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("zvol %s does not exist", dsName)}
+	}
+	if !exposed {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("%s does not exist", exposedBy)}
+	}
+	return &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}
 }
 
-func (d *Driver) ControllerModifyVolume(_ context.Context, x *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
-	klog.Infof("))))))))))))) ControllerModifyVolume: %v", x)
-	return nil, status.Error(codes.Unimplemented, "")
+// getZvolSize returns the volsize of the zvol, 0 when it does not exist
+func getZvolSize(ds *tns.TNSDataset) int64 {
+	if ds == nil {
+		return 0
+	}
+	if parsed, ok := ds.VolSize.Parsed.(float64); ok {
+		return int64(parsed)
+	}
+	return 0
 }
-func (cs *ControllerServer) ListSnapshots(_ context.Context, x *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	klog.Infof("))))))))))))) ListSnapshots: %v", x)
-	return nil, status.Error(codes.Unimplemented, "")
+
+// getVolumeCondition reports the problems preventing the volume from being used
+func getVolumeCondition(dsName string, ds *tns.TNSDataset, share *tns.TNSNFSShare, usageThreshold int) *csi.VolumeCondition {
+	if ds == nil {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("dataset %s does not exist", dsName)}
+	}
+
+	problems := []string{}
+	switch {
+	case share == nil:
+		problems = append(problems, fmt.Sprintf("NFS share for %s does not exist", ds.MountPoint))
+	case share.Locked:
+		problems = append(problems, fmt.Sprintf("NFS share for %s is locked", ds.MountPoint))
+	case !share.Enabled:
+		problems = append(problems, fmt.Sprintf("NFS share for %s is disabled", ds.MountPoint))
+	}
+
+	return getDatasetVolumeCondition(ds, problems, usageThreshold)
+}
+
+// getSmbVolumeCondition reports the problems preventing the SMB volume from being used
+func getSmbVolumeCondition(dsName string, ds *tns.TNSDataset, share *tns.TNSSMBShare, usageThreshold int) *csi.VolumeCondition {
+	if ds == nil {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("dataset %s does not exist", dsName)}
+	}
+
+	problems := []string{}
+	switch {
+	case share == nil:
+		problems = append(problems, fmt.Sprintf("SMB share for %s does not exist", ds.MountPoint))
+	case share.Locked:
+		problems = append(problems, fmt.Sprintf("SMB share %s is locked", share.Name))
+	case !share.Enabled:
+		problems = append(problems, fmt.Sprintf("SMB share %s is disabled", share.Name))
+	}
+
+	return getDatasetVolumeCondition(ds, problems, usageThreshold)
+}
+
+// getDatasetVolumeCondition adds the usage of the quota of the dataset to the problems of its share
+// The refquota applies to the data of the dataset, the quota also to its snapshots
+func getDatasetVolumeCondition(ds *tns.TNSDataset, problems []string, usageThreshold int) *csi.VolumeCondition {
+	quota := float64(ds.Capacity())
+	used, okUsed := ds.UsedByDataset.Parsed.(float64)
+	if !okUsed || ds.SpaceOptions().QuotaMode == tns.QuotaModeQuota {
+		used, okUsed = ds.Used.Parsed.(float64)
+	}
+	if usageThreshold > 0 && okUsed && quota > 0 {
+		if usage := used * 100 / quota; usage >= float64(usageThreshold) {
+			problems = append(problems, fmt.Sprintf("%.0f%% of the quota is used (threshold: %d%%)", usage, usageThreshold))
+		}
+	}
+
+	if len(problems) > 0 {
+		return &csi.VolumeCondition{Abnormal: true, Message: strings.Join(problems, ", ")}
+	}
+	return &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}
+}
+
+// ListVolumes lists the datasets created by the driver under the known root datasets, with their configured credentials
+// Root datasets are known once declared in --backends-config or once a volume operation (CreateVolume, DeleteVolume...) has been received for them
+func (cs *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "max entries can not be negative: %d", req.GetMaxEntries())
+	}
+
+	entries := []*csi.ListVolumesResponse_Entry{}
+	for _, b := range cs.Driver.backends.list() {
+		if b.creds == nil {
+			klog.Warningf("ListVolumes: no credentials for %s %s in the --backends-config file, skipped", b.tnsWsUrl, b.rootDataset)
+			continue
+		}
+		// A backend that can not be listed does not hide the volumes of the others
+		datasets, csiErr := tns.CsiVolumeList(ctx, b.tnsWsUrl, b.creds, cs.Driver.name, b.rootDataset)
+		if csiErr != nil {
+			klog.Errorf("CsiVolumeList error for %s %s, skipped: %s", b.tnsWsUrl, b.rootDataset, csiErr)
+			continue
+		}
+		for _, ds := range datasets {
+			nfsVol := getNfsVolFromDataset(b.tnsWsUrl, b.rootDataset, cs.Driver.defaultOnDeletePolicy, &ds)
+			entries = append(entries, &csi.ListVolumesResponse_Entry{
+				Volume: &csi.Volume{
+					VolumeId:      nfsVol.id,
+					CapacityBytes: nfsVol.size,
+				},
+			})
+		}
+	}
+
+	// Entries are sorted by backend, root dataset and dataset name
+	start, end, nextToken, err := paginate(len(entries), req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+
+	klog.V(2).Infof("ListVolumes: returning %d/%d volume(s) from %d", end-start, len(entries), start)
+	return &csi.ListVolumesResponse{
+		Entries:   entries[start:end],
+		NextToken: nextToken,
+	}, nil
+}
+
+// ControllerModifyVolume applies the mutable parameters of a VolumeAttributesClass to the dataset and its NFS share
+func (cs *ControllerServer) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+
+	nfsVol, err := getNfsVolFromID(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found: %v", volumeID, err)
+	}
+
+	dsProperties, shareProperties, err := getVolumeModifications(req.GetMutableParameters())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVolumeModifications(nfsVol.protocol, dsProperties, shareProperties); err != nil {
+		return nil, err
+	}
+
+	creds, err := getTnsCredentials(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+
+	if acquired := cs.Driver.volumeLocks.TryAcquire(volumeID); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer cs.Driver.volumeLocks.Release(volumeID)
+
+	cs.Driver.backends.record(nfsVol.tnsWsUrl, nfsVol.rootDataset)
+
+	csiErr := tns.CsiVolumeModify(ctx, nfsVol.tnsWsUrl, creds, nfsVol.dsName, dsProperties, shareProperties)
+	if csiErr != nil {
+		klog.Errorf("CsiVolumeModify error: %s", csiErr)
+		return nil, status.Error(csiErr.Code, csiErr.Err.Error())
+	}
+
+	klog.V(2).Infof("ControllerModifyVolume(%s) successfully, parameters: %v", volumeID, req.GetMutableParameters())
+	return &csi.ControllerModifyVolumeResponse{}, nil
+}
+
+// ListSnapshots lists the snapshots of the volumes, under the root datasets of the known backends
+// When the snapshot id or the source volume id is given, only the snapshots of its backend and root dataset are listed
+func (cs *ControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "max entries can not be negative: %d", req.GetMaxEntries())
+	}
+
+	type scope struct {
+		tnsWsUrl     string
+		creds        *tns.Credentials
+		rootDataset  string
+		dsName       string
+		snapshotName string
+	}
+	scopes := []scope{}
+
+	switch {
+	case req.GetSnapshotId() != "":
+		snapshot, err := getNfsSnapFromID(req.GetSnapshotId())
+		if err != nil {
+			// An invalid ID should be treated as doesn't exist
+			klog.Warningf("failed to get nfs snapshot for id %v: %v", req.GetSnapshotId(), err)
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		creds := cs.Driver.backends.credentials(snapshot.tnsWsUrl, snapshot.rootDataset)
+		if creds == nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "no credentials for Truenas Scale %s %s: it must be declared in the --backends-config file", snapshot.tnsWsUrl, snapshot.rootDataset)
+		}
+		scopes = append(scopes, scope{tnsWsUrl: snapshot.tnsWsUrl, creds: creds, rootDataset: snapshot.rootDataset, snapshotName: snapshot.snapshotName})
+
+	case req.GetSourceVolumeId() != "":
+		srcVol, err := getNfsVolFromID(req.GetSourceVolumeId())
+		if err != nil {
+			klog.Warningf("failed to get nfs volume for id %v: %v", req.GetSourceVolumeId(), err)
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		creds := cs.Driver.backends.credentials(srcVol.tnsWsUrl, srcVol.rootDataset)
+		if creds == nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "no credentials for Truenas Scale %s %s: it must be declared in the --backends-config file", srcVol.tnsWsUrl, srcVol.rootDataset)
+		}
+		scopes = append(scopes, scope{tnsWsUrl: srcVol.tnsWsUrl, creds: creds, rootDataset: srcVol.rootDataset, dsName: srcVol.dsName})
+
+	default:
+		for _, b := range cs.Driver.backends.list() {
+			if b.creds == nil {
+				klog.Warningf("ListSnapshots: no credentials for %s %s in the --backends-config file, skipped", b.tnsWsUrl, b.rootDataset)
+				continue
+			}
+			scopes = append(scopes, scope{tnsWsUrl: b.tnsWsUrl, creds: b.creds, rootDataset: b.rootDataset})
+		}
+	}
+
+	entries := []*csi.ListSnapshotsResponse_Entry{}
+	for _, sc := range scopes {
+		snapshots, datasets, csiErr := tns.CsiSnapshotList(ctx, sc.tnsWsUrl, sc.creds, cs.Driver.name, sc.rootDataset, sc.dsName, sc.snapshotName)
+		if csiErr != nil {
+			klog.Errorf("CsiSnapshotList error: %s", csiErr)
+			return nil, status.Error(csiErr.Code, csiErr.Err.Error())
+		}
+		for _, snapshot := range snapshots {
+			ds := datasets[snapshot.Dataset]
+			srcVol := getNfsVolFromDataset(sc.tnsWsUrl, sc.rootDataset, cs.Driver.defaultOnDeletePolicy, &ds)
+			entries = append(entries, &csi.ListSnapshotsResponse_Entry{
+				Snapshot: getCsiSnapshot(srcVol, &snapshot),
+			})
+		}
+	}
+
+	// Entries are sorted by backend, root dataset and snapshot name
+	start, end, nextToken, err := paginate(len(entries), req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+
+	klog.V(2).Infof("ListSnapshots: returning %d/%d snapshot(s) from %d", end-start, len(entries), start)
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries[start:end],
+		NextToken: nextToken,
+	}, nil
+}
+
+// getCsiSnapshot converts a Truenas Scale snapshot of a volume to a CSI snapshot
+func getCsiSnapshot(srcVol *nfsVolume, tnsSnapshot *tns.TNSSnapshot) *csi.Snapshot {
+	snapshot := &nfsSnapshot{
+		tnsWsUrl:       srcVol.tnsWsUrl,
+		rootDataset:    srcVol.rootDataset,
+		sourceDsName:   srcVol.dsName,
+		sourceVolumeId: srcVol.id,
+		snapshotName:   tnsSnapshot.Name,
+	}
+	snapshot.id = getSnapshotIDFromNfsSnapshot(snapshot)
+
+	var size int64
+	if parsed, ok := tnsSnapshot.Properties.Referenced.Parsed.(float64); ok {
+		size = int64(parsed)
+	}
+
+	// The raw value of the creation is the number of seconds since the epoch
+	var creationTime *timestamppb.Timestamp
+	if seconds, err := strconv.ParseInt(tnsSnapshot.Properties.Creation.RawValue, 10, 64); err == nil {
+		creationTime = timestamppb.New(time.Unix(seconds, 0))
+	}
+
+	return &csi.Snapshot{
+		SnapshotId:     snapshot.id,
+		SourceVolumeId: srcVol.id,
+		SizeBytes:      size,
+		CreationTime:   creationTime,
+		ReadyToUse:     true,
+	}
 }
 
 // newNFSVolume Convert VolumeCreate parameters to an nfsVolume
-func newNFSVolume(tnsWsUrl, rootDataset, onDelete, archivePrefix string, pvName string, dsName string, size int64) (*nfsVolume, *tns.CsiError) {
+func newNFSVolume(tnsWsUrl, rootDataset, onDelete, archivePrefix string, pvName string, dsName string, size int64, protocol string) (*nfsVolume, *tns.CsiError) {
 
 	vol := &nfsVolume{
 		tnsWsUrl:      tnsWsUrl,
@@ -541,6 +1293,7 @@ func newNFSVolume(tnsWsUrl, rootDataset, onDelete, archivePrefix string, pvName
 		size:          size,
 		dsName:        dsName,
 		pvName:        pvName,
+		protocol:      protocol,
 	}
 
 	vol.id = getVolumeIDFromNfsVol(vol)
@@ -556,14 +1309,27 @@ func getVolumeIDFromNfsVol(vol *nfsVolume) string {
 	idElements[idPvName] = strings.Trim(vol.pvName, "/")
 	idElements[idArchivePrefix] = strings.Trim(vol.archivePrefix, "/")
 	idElements[idOnDelete] = vol.onDelete
+	if vol.protocol == "" || vol.protocol == protocolNFS {
+		// Same id as the previous versions
+		idElements = idElements[:idProtocol]
+	} else {
+		idElements[idProtocol] = vol.protocol
+	}
 	return strings.Join(idElements, separator)
 }
 
-// <tnsWsUrl>#<rootDataset>#<dsName>#<pvName>#<archiveprefix>#<onDelete>
+// <tnsWsUrl>#<rootDataset>#<dsName>#<pvName>#<archiveprefix>#<onDelete>[#<protocol>]
 // wss://truenas.server/websocket # POOL-ZFS02/CSI # POOL-ZFS02/CSI/tns-csi-aaa-pvc-73f86722-fcae-46e3-baa7-d9bd78f5984f # pvc-73f86722-fcae-46e3-baa7-d9bd78f5984f # ab # delete
 func getNfsVolFromID(id string) (*nfsVolume, error) {
 	var tnsWsUrl, rootDataset, dsName, pvName, archivePrefix, onDelete string
 	segments := strings.Split(id, separator)
+	if len(segments) < idProtocol {
+		return nil, fmt.Errorf("invalid volume id %q: %d elements instead of %d", id, len(segments), idProtocol)
+	}
+	protocol := protocolNFS
+	if len(segments) > idProtocol && segments[idProtocol] != "" {
+		protocol = segments[idProtocol]
+	}
 	tnsWsUrl = segments[0]
 	rootDataset = segments[1]
 	dsName = segments[2]
@@ -578,8 +1344,47 @@ func getNfsVolFromID(id string) (*nfsVolume, error) {
 		onDelete:      onDelete,
 		dsName:        dsName,
 		pvName:        pvName,
+		protocol:      protocol,
 	}, nil
 }
+
+// getVolumeProtocol returns the protocol of the volume, nfs when the id is not valid
+func getVolumeProtocol(volumeID string) string {
+	if nfsVol, err := getNfsVolFromID(volumeID); err == nil {
+		return nfsVol.protocol
+	}
+	return protocolNFS
+}
+
+// getNfsVolFromDataset returns the volume of a dataset created by the driver
+// The volume id is the one stored on the dataset by CreateVolume. For datasets created by older versions
+// of the driver, it is rebuilt with the pv name found in the dataset name and the default values
+func getNfsVolFromDataset(tnsWsUrl, rootDataset, defaultOnDelete string, ds *tns.TNSDataset) *nfsVolume {
+	protocol := protocolNFS
+	size := ds.Capacity()
+	if ds.Type == "VOLUME" {
+		protocol = protocolISCSI
+		size = ds.VolSize.Size()
+	}
+
+	if prop, ok := ds.UserProperties[tns.VolumeIDProperty]; ok && prop.Value != "" {
+		nfsVol, err := getNfsVolFromID(prop.Value)
+		if err == nil && nfsVol.dsName == ds.Name {
+			nfsVol.size = size
+			return nfsVol
+		}
+		// A dataset replicated from another one may carry the id of the source: only its protocol is kept.
+		// A zvol is shared with iSCSI or NVMe-oF, the type of the dataset does not tell which
+		if err == nil && isBlockProtocol(nfsVol.protocol) == (ds.Type == "VOLUME") {
+			protocol = nfsVol.protocol
+		}
+		klog.Warningf("Ignoring volume id %q stored on dataset %s", prop.Value, ds.Name)
+	}
+
+	nfsVol, _ := newNFSVolume(tnsWsUrl, rootDataset, defaultOnDelete, DefaultDSArchivePrefix, pvNameRegexp.FindString(ds.Name), ds.Name, size, protocol)
+	return nfsVol
+}
+
 func newNFSSnapshot(name string, snapshotName string, srcVol *nfsVolume, params map[string]string) (*nfsSnapshot, error) {
 	tnsWsUrl := srcVol.tnsWsUrl
 	rootDataset := srcVol.rootDataset
@@ -615,6 +1420,9 @@ func getSnapshotIDFromNfsSnapshot(snapshot *nfsSnapshot) string {
 func getNfsSnapFromID(id string) (*nfsSnapshot, error) {
 	var tnsWsUrl, rootDataset, snapshotName, sourceDsName string
 	segments := strings.Split(id, separator)
+	if len(segments) != totalIDSnapElements {
+		return &nfsSnapshot{}, fmt.Errorf("failed to create nfsSnapshot from snapshot ID")
+	}
 	tnsWsUrl = segments[0]
 	rootDataset = segments[1]
 	snapshotName = segments[2]
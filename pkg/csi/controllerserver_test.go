@@ -0,0 +1,911 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	tns "github.com/titou10/csi-driver-truenas-scale/pkg/tns"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	testTnsWsUrl    = "wss://truenas.server/api/current"
+	testRootDataset = "POOL-ZFS02/CSI"
+	testPvName      = "pvc-73f86722-fcae-46e3-baa7-d9bd78f5984f"
+	testDsName      = testRootDataset + "/ns-pvc-" + testPvName
+)
+
+// newTestControllerServer returns a controller without backends config nor health cache
+func newTestControllerServer() *ControllerServer {
+	return &ControllerServer{Driver: &Driver{name: DefaultDriverName, backends: newBackendRegistry(), volumeLocks: NewVolumeLocks()}}
+}
+
+// newCreateVolumeRequest returns the request of the external-provisioner for a filesystem volume of the minimum size
+// on the test server (dataset testDsName), with the parameters of the storage class given added to tnsWsUrl and rootDataset
+func newCreateVolumeRequest(params map[string]string) *csi.CreateVolumeRequest {
+	parameters := map[string]string{
+		"tnsWsUrl":      testTnsWsUrl,
+		"rootDataset":   testRootDataset,
+		pvcNamespaceKey: "ns",
+		pvcNameKey:      "pvc",
+		pvNameKey:       testPvName,
+	}
+	for k, v := range params {
+		parameters[k] = v
+	}
+	return &csi.CreateVolumeRequest{
+		Name:          testPvName,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: MinimumDatasetSize},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+		Parameters: parameters,
+	}
+}
+
+// fakeTruenas is a minimal Truenas Scale JSON-RPC server, healthy, on which the NFS and SMB volumes are created.
+// The methods reply with their result in results, or with the result of the function called with the parameters
+// of the request. The other methods fail. The parameters of the calls are recorded
+type fakeTruenas struct {
+	server *httptest.Server
+
+	mu      sync.Mutex
+	results map[string]interface{}
+	calls   map[string][][]interface{} // method -> parameters of the calls
+}
+
+type fakeResult func(params []interface{}) (interface{}, error)
+
+// fakeAuthResult is a fakeResult that also receives the api key the connection is logged in with
+type fakeAuthResult func(apiKey string, params []interface{}) (interface{}, error)
+
+func newFakeTruenas(t *testing.T) *fakeTruenas {
+	f := &fakeTruenas{calls: make(map[string][][]interface{})}
+	created := func(params []interface{}) (interface{}, error) {
+		data := params[0].(map[string]interface{})
+		return map[string]interface{}{"id": data["name"], "name": data["name"], "mountpoint": "/mnt/" + data["name"].(string)}, nil
+	}
+	f.results = map[string]interface{}{
+		"auth.login_with_api_key": true,
+		"pool.dataset.get_instance": fakeResult(func(params []interface{}) (interface{}, error) {
+			if params[0] != testRootDataset {
+				return nil, errors.New("PoolDataset " + params[0].(string) + " does not exist")
+			}
+			return map[string]interface{}{"id": testRootDataset, "name": testRootDataset, "pool": "POOL-ZFS02", "mountpoint": "/mnt/" + testRootDataset}, nil
+		}),
+		"pool.query": []interface{}{map[string]interface{}{"id": 1, "name": "POOL-ZFS02", "status": "ONLINE", "healthy": true}},
+		"service.query": fakeResult(func(params []interface{}) (interface{}, error) {
+			service := params[0].([]interface{})[0].([]interface{})[2]
+			return []interface{}{map[string]interface{}{"id": 1, "service": service, "enable": true, "state": "RUNNING"}}, nil
+		}),
+		"pool.dataset.create": fakeResult(created),
+		"filesystem.setperm":  1,
+		"sharing.nfs.create": fakeResult(func(params []interface{}) (interface{}, error) {
+			return map[string]interface{}{"id": 1, "path": params[0].(map[string]interface{})["path"], "enabled": true}, nil
+		}),
+		"sharing.smb.query": []interface{}{},
+		"sharing.smb.create": fakeResult(func(params []interface{}) (interface{}, error) {
+			data := params[0].(map[string]interface{})
+			return map[string]interface{}{"id": 1, "name": data["name"], "path": data["path"], "enabled": true}, nil
+		}),
+		"sharing.smb.setacl": true,
+		"zfs.snapshot.create": fakeResult(func(params []interface{}) (interface{}, error) {
+			data := params[0].(map[string]interface{})
+			name := data["dataset"].(string) + "@" + data["name"].(string)
+			return map[string]interface{}{"id": name, "name": name, "dataset": data["dataset"], "snapshot_name": data["name"]}, nil
+		}),
+	}
+
+	upgrader := websocket.Upgrader{}
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade failed: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		var apiKey string
+		for {
+			var req tns.WSRequest
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+			params, _ := req.Params.([]interface{})
+			if req.Method == "auth.login_with_api_key" && len(params) > 0 {
+				apiKey, _ = params[0].(string)
+			}
+
+			f.mu.Lock()
+			f.calls[req.Method] = append(f.calls[req.Method], params)
+			result, ok := f.results[req.Method]
+			f.mu.Unlock()
+
+			err = errors.New("unknown method")
+			if ok {
+				err = nil
+				switch reply := result.(type) {
+				case fakeResult:
+					result, err = reply(params)
+				case fakeAuthResult:
+					result, err = reply(apiKey, params)
+				}
+			}
+			if err != nil {
+				_ = conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "error": map[string]interface{}{
+					"code": -32001, "message": "Method call error", "data": map[string]interface{}{"error": 22, "errname": "EINVAL", "reason": err.Error()},
+				}})
+				continue
+			}
+			_ = conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": result})
+		}
+	}))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeTruenas) url() string {
+	return strings.Replace(f.server.URL, "http://", "ws://", 1) + "/api/current"
+}
+
+// setResult replaces the result of a method
+func (f *fakeTruenas) setResult(method string, result interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.results[method] = result
+}
+
+// called returns the first parameter of each call of the method
+func (f *fakeTruenas) called(method string) []interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var params []interface{}
+	for _, p := range f.calls[method] {
+		params = append(params, p[0])
+	}
+	return params
+}
+
+// createVolume runs CreateVolume on the fake server, with an api key in the provisioner secret when there is no secret
+func (f *fakeTruenas) createVolume(cs *ControllerServer, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	req.Parameters["tnsWsUrl"] = f.url()
+	if req.Secrets == nil {
+		req.Secrets = map[string]string{apiKeySecretNameKey: "1-abc"}
+	}
+	return cs.CreateVolume(context.Background(), req)
+}
+
+// datasetCreated returns the dataset sent to pool.dataset.create
+func (f *fakeTruenas) datasetCreated(t *testing.T) map[string]interface{} {
+	created := f.called("pool.dataset.create")
+	if !assert.Len(t, created, 1) {
+		t.FailNow()
+	}
+	return created[0].(map[string]interface{})
+}
+
+func TestGetNfsVolFromID(t *testing.T) {
+	nfsVol, err := getNfsVolFromID(testTnsWsUrl + "#" + testRootDataset + "#" + testDsName + "#" + testPvName + "#ab#archive")
+	assert.NoError(t, err)
+	assert.Equal(t, testDsName, nfsVol.dsName)
+	assert.Equal(t, "ab", nfsVol.archivePrefix)
+	assert.Equal(t, "archive", nfsVol.onDelete)
+
+	_, err = getNfsVolFromID(testTnsWsUrl + "#" + testRootDataset + "#" + testDsName)
+	assert.Error(t, err)
+}
+
+func TestVolumeIDProtocol(t *testing.T) {
+	// The id of the nfs volumes is the same as with the previous versions
+	nfsVol, _ := newNFSVolume(testTnsWsUrl, testRootDataset, "delete", "ab", testPvName, testDsName, MinimumDatasetSize, protocolNFS)
+	assert.Equal(t, testTnsWsUrl+"#"+testRootDataset+"#"+testDsName+"#"+testPvName+"#ab#delete", nfsVol.id)
+	assert.Equal(t, protocolNFS, getVolumeProtocol(nfsVol.id))
+
+	iscsiVol, _ := newNFSVolume(testTnsWsUrl, testRootDataset, "delete", "ab", testPvName, testDsName, MinimumDatasetSize, protocolISCSI)
+	assert.Equal(t, nfsVol.id+"#iscsi", iscsiVol.id)
+	parsed, err := getNfsVolFromID(iscsiVol.id)
+	assert.NoError(t, err)
+	assert.Equal(t, protocolISCSI, parsed.protocol)
+	assert.Equal(t, testPvName, parsed.pvName)
+
+	nvmeofVol, _ := newNFSVolume(testTnsWsUrl, testRootDataset, "delete", "ab", testPvName, testDsName, MinimumDatasetSize, protocolNVMEOF)
+	assert.Equal(t, nfsVol.id+"#nvmeof", nvmeofVol.id)
+	assert.Equal(t, protocolNVMEOF, getVolumeProtocol(nvmeofVol.id))
+
+	smbVol, _ := newNFSVolume(testTnsWsUrl, testRootDataset, "delete", "ab", testPvName, testDsName, MinimumDatasetSize, protocolSMB)
+	assert.Equal(t, nfsVol.id+"#smb", smbVol.id)
+	assert.Equal(t, protocolSMB, getVolumeProtocol(smbVol.id))
+
+	assert.Equal(t, protocolNFS, getVolumeProtocol("invalid"))
+
+	// The protocol of a zvol is the one of the id stored at its creation, iSCSI without id
+	zvol := &tns.TNSDataset{Name: testDsName, Type: "VOLUME", VolSize: tns.ZFSProperty{Parsed: float64(2 * zvolSizeAlignment)}}
+	vol := getNfsVolFromDataset(testTnsWsUrl, testRootDataset, "delete", zvol)
+	assert.Equal(t, protocolISCSI, vol.protocol)
+	assert.Equal(t, 2*zvolSizeAlignment, vol.size)
+
+	zvol.UserProperties = map[string]tns.ZFSProperty{tns.VolumeIDProperty: {Value: nvmeofVol.id}}
+	vol = getNfsVolFromDataset(testTnsWsUrl, testRootDataset, "delete", zvol)
+	assert.Equal(t, protocolNVMEOF, vol.protocol)
+	assert.Equal(t, nvmeofVol.id, vol.id)
+	assert.Equal(t, 2*zvolSizeAlignment, vol.size)
+
+	// A zvol replicated from an NVMe-oF volume is an NVMe-oF volume
+	zvol.Name = testRootDataset + "/copy-" + testPvName
+	vol = getNfsVolFromDataset(testTnsWsUrl, testRootDataset, "delete", zvol)
+	assert.Equal(t, protocolNVMEOF, vol.protocol)
+	assert.Equal(t, zvol.Name, vol.dsName)
+
+	// An SMB dataset replicated from another one is an SMB volume
+	ds := &tns.TNSDataset{Name: testRootDataset + "/copy-" + testPvName, UserProperties: map[string]tns.ZFSProperty{tns.VolumeIDProperty: {Value: smbVol.id}}}
+	assert.Equal(t, protocolSMB, getNfsVolFromDataset(testTnsWsUrl, testRootDataset, "delete", ds).protocol)
+}
+
+func TestIsValidVolumeCapabilities(t *testing.T) {
+	volCap := func(block bool, mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		c := &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode}}
+		if block {
+			c.AccessType = &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}
+		} else {
+			c.AccessType = &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}
+		}
+		return c
+	}
+
+	tests := []struct {
+		desc     string
+		volCap   *csi.VolumeCapability
+		protocol string
+		hasErr   bool
+	}{
+		{desc: "nfs rwx", volCap: volCap(false, csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER), protocol: protocolNFS},
+		{desc: "nfs block", volCap: volCap(true, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER), protocol: protocolNFS, hasErr: true},
+		{desc: "iscsi rwo", volCap: volCap(false, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER), protocol: protocolISCSI},
+		{desc: "iscsi block", volCap: volCap(true, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER), protocol: protocolISCSI},
+		{desc: "iscsi rox", volCap: volCap(false, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY), protocol: protocolISCSI},
+		{desc: "iscsi rwx", volCap: volCap(true, csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER), protocol: protocolISCSI, hasErr: true},
+		{desc: "nvmeof block", volCap: volCap(true, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER), protocol: protocolNVMEOF},
+		{desc: "nvmeof rwx", volCap: volCap(false, csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER), protocol: protocolNVMEOF, hasErr: true},
+	}
+
+	for _, test := range tests {
+		err := isValidVolumeCapabilities([]*csi.VolumeCapability{test.volCap}, test.protocol)
+		assert.Equal(t, test.hasErr, err != nil, test.desc)
+	}
+
+	assert.Error(t, isValidVolumeCapabilities(nil, protocolNFS))
+}
+
+func TestGetNfsVolFromDataset(t *testing.T) {
+	storedID := testTnsWsUrl + "#" + testRootDataset + "#" + testDsName + "#" + testPvName + "#ab#retain"
+
+	tests := []struct {
+		desc       string
+		userProps  map[string]tns.ZFSProperty
+		expectedID string
+	}{
+		{
+			desc:       "Volume id stored on the dataset",
+			userProps:  map[string]tns.ZFSProperty{tns.VolumeIDProperty: {Value: storedID}},
+			expectedID: storedID,
+		},
+		{
+			desc:       "No volume id stored: rebuilt with the defaults",
+			expectedID: testTnsWsUrl + "#" + testRootDataset + "#" + testDsName + "#" + testPvName + "#" + DefaultDSArchivePrefix + "#delete",
+		},
+		{
+			desc:       "Volume id of another dataset: rebuilt with the defaults",
+			userProps:  map[string]tns.ZFSProperty{tns.VolumeIDProperty: {Value: testTnsWsUrl + "#" + testRootDataset + "#" + testRootDataset + "/other#" + testPvName + "#ab#retain"}},
+			expectedID: testTnsWsUrl + "#" + testRootDataset + "#" + testDsName + "#" + testPvName + "#" + DefaultDSArchivePrefix + "#delete",
+		},
+	}
+
+	for _, test := range tests {
+		ds := &tns.TNSDataset{
+			Name:           testDsName,
+			RefQuota:       tns.ZFSProperty{Parsed: float64(MinimumDatasetSize)},
+			UserProperties: test.userProps,
+		}
+		nfsVol := getNfsVolFromDataset(testTnsWsUrl, testRootDataset, "delete", ds)
+		assert.Equal(t, test.expectedID, nfsVol.id, test.desc)
+		assert.Equal(t, MinimumDatasetSize, nfsVol.size, test.desc)
+	}
+
+	// The size of a dataset created with quotaMode: quota is its quota
+	ds := &tns.TNSDataset{Name: testDsName, Quota: tns.ZFSProperty{Parsed: float64(2 * MinimumDatasetSize)}}
+	assert.Equal(t, 2*MinimumDatasetSize, getNfsVolFromDataset(testTnsWsUrl, testRootDataset, "delete", ds).size)
+}
+
+func TestBackendRegistry(t *testing.T) {
+	r := newBackendRegistry()
+
+	r.record("ws://b/api/current", "pool/b")
+	r.record("ws://a/api/current", "pool/z")
+	r.record("ws://a/api/current", "pool/a")
+	r.record("ws://a/api/current", "pool/z")
+	r.record("", "pool/x")
+	r.record("ws://a/api/current", "")
+
+	backends := r.list()
+	assert.Equal(t, []backend{
+		{tnsWsUrl: "ws://a/api/current", rootDataset: "pool/a"},
+		{tnsWsUrl: "ws://a/api/current", rootDataset: "pool/z"},
+		{tnsWsUrl: "ws://b/api/current", rootDataset: "pool/b"},
+	}, backends)
+	assert.Nil(t, r.credentials("ws://a/api/current", "pool/a"))
+}
+
+func TestLoadBackendsConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		return path
+	}
+
+	path := write("valid.yaml", `
+"wss://a/api/current":
+  apiKey: key-a
+  tlsInsecureSkipVerify: "true"
+  rootDatasets: pool/z, pool/a
+"ws://b/websocket":
+  apiKey: key-b
+"ws://shared/websocket":
+  - apiKey: key-team-a
+    rootDatasets: pool/team-a
+  - apiKey: key-team-b
+    rootDatasets: pool/team-b
+`)
+	configs, err := loadBackendsConfig(path)
+	assert.NoError(t, err)
+	assert.Len(t, configs, 4)
+
+	// The root datasets of the config are listed after a restart, without any call
+	r := newBackendRegistry()
+	r.seed(configs)
+	assert.True(t, r.credentials("wss://a/api/current", "pool/a").TLS.InsecureSkipVerify)
+	assert.Equal(t, "key-a", r.credentials("wss://a/api/current", "pool/z").ApiKey)
+	assert.Equal(t, "key-b", r.credentials("ws://b/websocket", "pool/b").ApiKey)
+	assert.Equal(t, "key-team-a", r.credentials("ws://shared/websocket", "pool/team-a").ApiKey)
+	assert.Equal(t, "key-team-b", r.credentials("ws://shared/websocket", "pool/team-b").ApiKey)
+
+	// The credentials of the root datasets are not used for the other root datasets of the server
+	assert.Nil(t, r.credentials("wss://a/api/current", "pool/other"))
+	assert.Nil(t, r.credentials("ws://shared/websocket", "pool/other"))
+
+	// The root datasets of the calls are added with the credentials of their server, if any
+	r.record("ws://b/websocket", "pool/b")
+	r.record("ws://c/websocket", "pool/c")
+	assert.Equal(t, []backend{
+		{tnsWsUrl: "ws://b/websocket", rootDataset: "pool/b", creds: r.credentials("ws://b/websocket", "pool/b")},
+		{tnsWsUrl: "ws://c/websocket", rootDataset: "pool/c"},
+		{tnsWsUrl: "ws://shared/websocket", rootDataset: "pool/team-a", creds: r.credentials("ws://shared/websocket", "pool/team-a")},
+		{tnsWsUrl: "ws://shared/websocket", rootDataset: "pool/team-b", creds: r.credentials("ws://shared/websocket", "pool/team-b")},
+		{tnsWsUrl: "wss://a/api/current", rootDataset: "pool/a", creds: r.credentials("wss://a/api/current", "pool/a")},
+		{tnsWsUrl: "wss://a/api/current", rootDataset: "pool/z", creds: r.credentials("wss://a/api/current", "pool/z")},
+	}, r.list())
+
+	_, err = loadBackendsConfig(write("nokey.yaml", `"wss://a/api/current": {tlsServerName: a}`))
+	assert.Error(t, err)
+
+	_, err = loadBackendsConfig(write("invalid.yaml", `- wss://a/api/current`))
+	assert.Error(t, err)
+
+	_, err = loadBackendsConfig(write("twice.yaml", `"wss://a/api/current": [{apiKey: a, rootDatasets: pool/a}, {apiKey: b, rootDatasets: pool/a}]`))
+	assert.Error(t, err)
+
+	_, err = loadBackendsConfig(write("noroot.yaml", `"wss://a/api/current": [{apiKey: a}, {apiKey: b}]`))
+	assert.Error(t, err)
+
+	_, err = loadBackendsConfig(filepath.Join(dir, "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestGetCapacity(t *testing.T) {
+	cs := &ControllerServer{Driver: &Driver{name: DefaultDriverName, backends: newBackendRegistry()}}
+
+	_, err := cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{
+		Parameters: map[string]string{"rootDataset": testRootDataset},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{
+		Parameters: map[string]string{"tnsWsUrl": testTnsWsUrl},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Server not declared in the backends config. The other parameters of the storage class are ignored
+	_, err = cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{
+		Parameters: map[string]string{"tnsWsUrl": testTnsWsUrl, "rootDataset": testRootDataset, "onDelete": "retain"},
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestListVolumes(t *testing.T) {
+	cs := &ControllerServer{Driver: &Driver{name: DefaultDriverName, backends: newBackendRegistry()}}
+
+	// No backend known yet
+	res, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	assert.Empty(t, res.GetEntries())
+	assert.Empty(t, res.GetNextToken())
+
+	_, err = cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{StartingToken: "invalid"})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+
+	_, err = cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{StartingToken: "1"})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+}
+
+func TestListVolumesCredentials(t *testing.T) {
+	f := newFakeTruenas(t)
+	cs := newTestControllerServer()
+
+	// Two root datasets of the server with their own api key, each one only lists its own root dataset
+	keys := map[string]string{"pool/team-a": "key-a", "pool/team-b": "key-b", "pool/broken": "key-broken"}
+	f.setResult("pool.dataset.query", fakeAuthResult(func(apiKey string, params []interface{}) (interface{}, error) {
+		rootDataset := strings.TrimSuffix(params[0].([]interface{})[0].([]interface{})[2].(string), "/")
+		if rootDataset == "pool/broken" || keys[rootDataset] != apiKey {
+			return nil, errors.New("[EACCES] permission denied")
+		}
+		name := rootDataset + "/" + testPvName
+		return []interface{}{map[string]interface{}{
+			"id": name, "name": name, "comments": map[string]interface{}{"value": DefaultDriverName},
+			"refquota": map[string]interface{}{"parsed": float64(MinimumDatasetSize)},
+		}}, nil
+	}))
+	cs.Driver.backends.seed([]*backendConfig{
+		{tnsWsUrl: f.url(), creds: &tns.Credentials{ApiKey: "key-a"}, rootDatasets: []string{"pool/team-a"}},
+		{tnsWsUrl: f.url(), creds: &tns.Credentials{ApiKey: "key-b"}, rootDatasets: []string{"pool/team-b"}},
+		{tnsWsUrl: f.url(), creds: &tns.Credentials{ApiKey: "key-broken"}, rootDatasets: []string{"pool/broken"}},
+	})
+
+	// The root dataset that fails is skipped
+	res, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	if assert.Len(t, res.GetEntries(), 2) {
+		assert.Contains(t, res.GetEntries()[0].GetVolume().GetVolumeId(), "#pool/team-a#pool/team-a/"+testPvName+"#")
+		assert.Contains(t, res.GetEntries()[1].GetVolume().GetVolumeId(), "#pool/team-b#pool/team-b/"+testPvName+"#")
+	}
+}
+
+func TestGetVolumeCondition(t *testing.T) {
+	ds := func(used float64) *tns.TNSDataset {
+		return &tns.TNSDataset{
+			Name:          testDsName,
+			MountPoint:    "/mnt/" + testDsName,
+			RefQuota:      tns.ZFSProperty{Parsed: float64(100)},
+			UsedByDataset: tns.ZFSProperty{Parsed: used},
+		}
+	}
+	enabled := &tns.TNSNFSShare{Enabled: true}
+
+	tests := []struct {
+		desc     string
+		ds       *tns.TNSDataset
+		share    *tns.TNSNFSShare
+		abnormal bool
+		message  string
+	}{
+		{desc: "Healthy volume", ds: ds(10), share: enabled, message: "volume is healthy"},
+		{desc: "Missing dataset", ds: nil, share: nil, abnormal: true, message: "dataset " + testDsName + " does not exist"},
+		{desc: "Missing share", ds: ds(10), share: nil, abnormal: true, message: "NFS share for /mnt/" + testDsName + " does not exist"},
+		{desc: "Disabled share", ds: ds(10), share: &tns.TNSNFSShare{}, abnormal: true, message: "NFS share for /mnt/" + testDsName + " is disabled"},
+		{desc: "Locked share", ds: ds(10), share: &tns.TNSNFSShare{Enabled: true, Locked: true}, abnormal: true, message: "NFS share for /mnt/" + testDsName + " is locked"},
+		{desc: "Usage above threshold", ds: ds(95), share: enabled, abnormal: true, message: "95% of the quota is used (threshold: 90%)"},
+	}
+
+	for _, test := range tests {
+		condition := getVolumeCondition(testDsName, test.ds, test.share, 90)
+		assert.Equal(t, test.abnormal, condition.GetAbnormal(), test.desc)
+		assert.Equal(t, test.message, condition.GetMessage(), test.desc)
+	}
+
+	// Threshold disabled
+	assert.False(t, getVolumeCondition(testDsName, ds(100), enabled, 0).GetAbnormal())
+
+	// With quotaMode: quota, the snapshots are counted
+	quotaDs := &tns.TNSDataset{
+		Name:          testDsName,
+		Quota:         tns.ZFSProperty{Parsed: float64(100)},
+		Used:          tns.ZFSProperty{Parsed: float64(95)},
+		UsedByDataset: tns.ZFSProperty{Parsed: float64(10)},
+	}
+	condition := getVolumeCondition(testDsName, quotaDs, enabled, 90)
+	assert.True(t, condition.GetAbnormal())
+	assert.Equal(t, "95% of the quota is used (threshold: 90%)", condition.GetMessage())
+}
+
+func TestGetSmbVolumeCondition(t *testing.T) {
+	ds := &tns.TNSDataset{
+		Name:          testDsName,
+		MountPoint:    "/mnt/" + testDsName,
+		RefQuota:      tns.ZFSProperty{Parsed: float64(100)},
+		UsedByDataset: tns.ZFSProperty{Parsed: float64(95)},
+	}
+
+	tests := []struct {
+		desc     string
+		ds       *tns.TNSDataset
+		share    *tns.TNSSMBShare
+		abnormal bool
+		message  string
+	}{
+		{desc: "Missing dataset", ds: nil, share: nil, abnormal: true, message: "dataset " + testDsName + " does not exist"},
+		{desc: "Missing share", ds: ds, share: nil, abnormal: true, message: "SMB share for /mnt/" + testDsName + " does not exist, 95% of the quota is used (threshold: 90%)"},
+		{desc: "Disabled share", ds: ds, share: &tns.TNSSMBShare{Name: testPvName}, abnormal: true, message: "SMB share " + testPvName + " is disabled, 95% of the quota is used (threshold: 90%)"},
+		{desc: "Locked share", ds: ds, share: &tns.TNSSMBShare{Name: testPvName, Enabled: true, Locked: true}, abnormal: true, message: "SMB share " + testPvName + " is locked, 95% of the quota is used (threshold: 90%)"},
+	}
+
+	for _, test := range tests {
+		condition := getSmbVolumeCondition(testDsName, test.ds, test.share, 90)
+		assert.Equal(t, test.abnormal, condition.GetAbnormal(), test.desc)
+		assert.Equal(t, test.message, condition.GetMessage(), test.desc)
+	}
+
+	assert.False(t, getSmbVolumeCondition(testDsName, ds, &tns.TNSSMBShare{Enabled: true}, 0).GetAbnormal())
+}
+
+func TestCreateVolumeShareProtocol(t *testing.T) {
+	cs := newTestControllerServer()
+
+	tests := []struct {
+		desc       string
+		parameters map[string]string
+	}{
+		{desc: "invalid share protocol", parameters: map[string]string{"shareProtocol": "afp"}},
+		{desc: "smb on a zvol", parameters: map[string]string{"shareProtocol": "smb", "protocol": "iscsi", "iscsiPortalID": "1"}},
+		{desc: "smb protocol", parameters: map[string]string{"protocol": "smb"}},
+		{desc: "invalid acl", parameters: map[string]string{"shareProtocol": "smb", "smbShareAcl": "user:1000:write"}},
+		{desc: "invalid browsable", parameters: map[string]string{"shareProtocol": "smb", "smbBrowsable": "maybe"}},
+		{desc: "invalid dataset property", parameters: map[string]string{"ds.compression": "brotli"}},
+	}
+	for _, test := range tests {
+		_, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest(test.parameters))
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), test.desc)
+	}
+
+	// The dataset is shared with SMB, the share is named after the pv
+	f := newFakeTruenas(t)
+	res, err := f.createVolume(cs, newCreateVolumeRequest(map[string]string{"shareProtocol": "SMB", "smbShareAcl": "S-1-1-0:read", "smbHostsAllow": "10.0.0.0/8"}))
+	assert.NoError(t, err)
+	assert.Equal(t, testPvName, res.GetVolume().GetVolumeContext()[paramSmbShareName])
+	assert.Equal(t, protocolSMB, getVolumeProtocol(res.GetVolume().GetVolumeId()))
+	if shares := f.called("sharing.smb.create"); assert.Len(t, shares, 1) {
+		assert.Equal(t, testPvName, shares[0].(map[string]interface{})["name"])
+		assert.Equal(t, []interface{}{"10.0.0.0/8"}, shares[0].(map[string]interface{})["hostsallow"])
+	}
+	assert.Len(t, f.called("sharing.smb.setacl"), 1)
+	assert.Empty(t, f.called("sharing.nfs.create"))
+
+	// The dataset properties are set at the creation of the dataset
+	f = newFakeTruenas(t)
+	_, err = f.createVolume(cs, newCreateVolumeRequest(map[string]string{"ds.compression": "lz4", "ds.acltype": "nfsv4", "ds.aclmode": "passthrough"}))
+	assert.NoError(t, err)
+	dataset := f.datasetCreated(t)
+	assert.Equal(t, "LZ4", dataset["compression"])
+	assert.Equal(t, "NFSV4", dataset["acltype"])
+	assert.Equal(t, "PASSTHROUGH", dataset["aclmode"])
+	assert.Len(t, f.called("sharing.nfs.create"), 1)
+}
+
+func TestCheckCloneSource(t *testing.T) {
+	dstVol := &nfsVolume{tnsWsUrl: "wss://truenas.local/api/current", dsName: "tank/csi/pvc-2"}
+
+	tests := []struct {
+		tnsWsUrl    string
+		srcName     string
+		expectedErr bool
+	}{
+		{tnsWsUrl: "wss://truenas.local/api/current", srcName: "tank/csi/pvc-1"},
+		{tnsWsUrl: "wss://truenas.local/api/current/", srcName: "tank/csi/pvc-1@snapshot-1"},
+		{tnsWsUrl: "wss://truenas.local/api/current", srcName: "tank/other/pvc-1"},
+		{tnsWsUrl: "wss://truenas.local/api/current", srcName: "ssd/csi/pvc-1@snapshot-1", expectedErr: true},
+		{tnsWsUrl: "wss://truenas2.local/api/current", srcName: "tank/csi/pvc-1", expectedErr: true},
+	}
+
+	for _, test := range tests {
+		err := checkCloneSource(test.tnsWsUrl, test.srcName, dstVol)
+		if (err != nil) != test.expectedErr {
+			t.Errorf("test[%s %s]: unexpected error: %v, expected error: %t", test.tnsWsUrl, test.srcName, err, test.expectedErr)
+		}
+	}
+}
+
+func TestCreateVolumeCloneMode(t *testing.T) {
+	cs := newTestControllerServer()
+
+	for _, cloneMode := range []string{"snapshot", ""} {
+		_, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest(map[string]string{"cloneMode": cloneMode}))
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), cloneMode)
+	}
+
+	srcDsName := testRootDataset + "/src"
+	tests := []struct {
+		cloneMode string
+		cloned    bool
+	}{
+		{cloneMode: "copy"},
+		{cloneMode: "Clone", cloned: true},
+		{cloneMode: "clone-promote", cloned: true},
+	}
+	for _, test := range tests {
+		f := newFakeTruenas(t)
+		req := newCreateVolumeRequest(map[string]string{"cloneMode": test.cloneMode})
+		srcVolumeID := f.url() + "#" + testRootDataset + "#" + srcDsName + "#src#ab#delete"
+		req.VolumeContentSource = &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: srcVolumeID}}}
+
+		// The fake server stops after the snapshot of the source: no replication nor ZFS clone
+		_, err := f.createVolume(cs, req)
+		assert.Error(t, err, test.cloneMode)
+		if snapshots := f.called("zfs.snapshot.create"); assert.Len(t, snapshots, 1, test.cloneMode) {
+			assert.Equal(t, srcDsName, snapshots[0].(map[string]interface{})["dataset"], test.cloneMode)
+		}
+		if test.cloned {
+			// A ZFS clone of the source, the dataset is not created
+			assert.Empty(t, f.called("pool.dataset.create"), test.cloneMode)
+			if clones := f.called("zfs.snapshot.clone"); assert.Len(t, clones, 1, test.cloneMode) {
+				assert.Equal(t, testDsName, clones[0].(map[string]interface{})["dataset_dst"], test.cloneMode)
+			}
+			assert.Empty(t, f.called("replication.run_onetime"), test.cloneMode)
+		} else {
+			// A new dataset, the data of the source is replicated to it
+			assert.Len(t, f.called("pool.dataset.create"), 1, test.cloneMode)
+			assert.Empty(t, f.called("zfs.snapshot.clone"), test.cloneMode)
+			assert.Len(t, f.called("replication.run_onetime"), 1, test.cloneMode)
+		}
+	}
+}
+
+func TestCreateVolumeEncryption(t *testing.T) {
+	cs := newTestControllerServer()
+	apiKey := map[string]string{apiKeySecretNameKey: "1-abc"}
+	srcVolumeID := testTnsWsUrl + "#" + testRootDataset + "#" + testDsName + "#" + testPvName + "#ab#delete"
+
+	tests := []struct {
+		name    string
+		params  map[string]string
+		secrets map[string]string
+		source  *csi.VolumeContentSource
+		code    codes.Code
+	}{
+		{name: "invalid encryption", params: map[string]string{"encryption": "yes"}, code: codes.InvalidArgument},
+		{name: "invalid key source", params: map[string]string{"encryption": "true", "encryptionKeySource": "vault"}, code: codes.InvalidArgument},
+		{name: "invalid algorithm", params: map[string]string{"encryption": "true", "encryptionAlgorithm": "AES-512-GCM"}, code: codes.InvalidArgument},
+		{name: "block volume", params: map[string]string{"encryption": "true", "protocol": "iscsi", "iscsiPortalId": "1"}, code: codes.InvalidArgument},
+		{
+			name:   "content source",
+			params: map[string]string{"encryption": "true"},
+			source: &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: srcVolumeID}}},
+			code:   codes.InvalidArgument,
+		},
+		{name: "no secret", params: map[string]string{"encryption": "true"}, code: codes.FailedPrecondition},
+		{name: "no passphrase", params: map[string]string{"encryption": "true", "encryptionKeySource": "passphrase"}, secrets: apiKey, code: codes.FailedPrecondition},
+		{
+			name:    "invalid key",
+			params:  map[string]string{"encryption": "true", "encryptionKeySource": "key"},
+			secrets: map[string]string{apiKeySecretNameKey: "1-abc", encryptionKeySecretKey: "not-hex"},
+			code:    codes.InvalidArgument,
+		},
+	}
+	for _, test := range tests {
+		req := newCreateVolumeRequest(test.params)
+		req.Secrets = test.secrets
+		req.VolumeContentSource = test.source
+		_, err := cs.CreateVolume(context.Background(), req)
+		assert.Equal(t, test.code, status.Code(err), test.name)
+	}
+
+	// The dataset is its own encryption root
+	f := newFakeTruenas(t)
+	_, err := f.createVolume(cs, newCreateVolumeRequest(map[string]string{"encryption": "true", "encryptionAlgorithm": "AES-128-GCM"}))
+	assert.NoError(t, err)
+	dataset := f.datasetCreated(t)
+	assert.Equal(t, true, dataset["encryption"])
+	assert.Equal(t, false, dataset["inherit_encryption"])
+	assert.Equal(t, map[string]interface{}{"generate_key": true, "algorithm": "AES-128-GCM"}, dataset["encryption_options"])
+
+	f = newFakeTruenas(t)
+	req := newCreateVolumeRequest(map[string]string{"encryption": "true", "encryptionKeySource": "passphrase"})
+	req.Secrets = map[string]string{apiKeySecretNameKey: "1-abc", encryptionPassphraseSecretKey: "a long passphrase"}
+	_, err = f.createVolume(cs, req)
+	assert.NoError(t, err)
+	options := f.datasetCreated(t)["encryption_options"].(map[string]interface{})
+	assert.Equal(t, false, options["generate_key"])
+	assert.Equal(t, "a long passphrase", options["passphrase"])
+	assert.NotContains(t, options, "key")
+
+	// Not encrypted
+	f = newFakeTruenas(t)
+	_, err = f.createVolume(cs, newCreateVolumeRequest(nil))
+	assert.NoError(t, err)
+	assert.NotContains(t, f.datasetCreated(t), "encryption_options")
+}
+
+func TestCreateVolumeSpaceOptions(t *testing.T) {
+	cs := newTestControllerServer()
+
+	for _, params := range []map[string]string{
+		{"quotaMode": "userquota"},
+		{"reservationMode": "thick"},
+		{"quotaMode": "quota", "protocol": "iscsi", "iscsiPortalId": "1"},
+		{"reservationMode": "refreservation", "protocol": "nvmeof", "nvmeofPortId": "1"},
+	} {
+		_, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest(params))
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), params)
+	}
+
+	size := float64(MinimumDatasetSize)
+	tests := []struct {
+		params   map[string]string
+		expected map[string]interface{} // size properties of the dataset
+	}{
+		{params: nil, expected: map[string]interface{}{"refquota": size}},
+		{params: map[string]string{"quotaMode": "Quota", "reservationMode": "reservation"}, expected: map[string]interface{}{"quota": size, "reservation": size}},
+		{params: map[string]string{"quotaMode": "refquota", "reservationMode": "none"}, expected: map[string]interface{}{"refquota": size}},
+		{params: map[string]string{"reservationMode": "refreservation", "shareProtocol": "smb"}, expected: map[string]interface{}{"refquota": size, "refreservation": size}},
+	}
+	for _, test := range tests {
+		f := newFakeTruenas(t)
+		_, err := f.createVolume(cs, newCreateVolumeRequest(test.params))
+		assert.NoError(t, err, test.params)
+		dataset := f.datasetCreated(t)
+		for _, name := range []string{"refquota", "quota", "refreservation", "reservation"} {
+			assert.Equal(t, test.expected[name], dataset[name], "%s %v", name, test.params)
+		}
+	}
+}
+
+func TestCreateVolumeNfsServer(t *testing.T) {
+	cs := newTestControllerServer()
+
+	for _, params := range []map[string]string{
+		{"nfsServer": "10.0.0.1:2049"},
+		{"nfsServer": "storage_vlan"},
+		{"nfsServer": " , "},
+		{"nfsServer": "10.0.0.1", "shareProtocol": "smb"},
+		{"nfsServer": "10.0.0.1", "protocol": "iscsi", "iscsiPortalId": "1"},
+		{"nfsServer": "10.0.0.1,10.0.0.2", "nfsServerSelection": "random"},
+		{"nfsServerSelection": "spread", "shareProtocol": "smb"},
+	} {
+		_, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest(params))
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), params)
+	}
+
+	// The addresses are given to the nodes in the volume context
+	for _, params := range []map[string]string{
+		{"nfsServer": "truenas-storage.local"},
+		{"NfsServer": "10.0.0.1, fd00::1, [fd00::2], nfs://truenas-storage.local"},
+		{"nfsServer": "10.0.0.1,10.0.0.2", "nfsServerSelection": "Spread"},
+	} {
+		f := newFakeTruenas(t)
+		res, err := f.createVolume(cs, newCreateVolumeRequest(params))
+		assert.NoError(t, err, params)
+		volumeContext := res.GetVolume().GetVolumeContext()
+		for k, v := range params {
+			assert.Equal(t, v, volumeContext[k], params)
+		}
+		assert.Equal(t, "/mnt/"+testDsName, volumeContext[paramNfsSharePath], params)
+	}
+}
+
+func TestControllerGetVolume(t *testing.T) {
+	cs := &ControllerServer{Driver: &Driver{name: DefaultDriverName, backends: newBackendRegistry()}}
+
+	_, err := cs.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = cs.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "invalid"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// No credentials configured for the root dataset, the ones of the calls are not used
+	volumeID := testTnsWsUrl + "#" + testRootDataset + "#" + testDsName + "#" + testPvName + "#ab#delete"
+	cs.Driver.backends.record(testTnsWsUrl, testRootDataset)
+	_, err = cs.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestGetCsiSnapshot(t *testing.T) {
+	srcVol, _ := newNFSVolume(testTnsWsUrl, testRootDataset, "delete", "ab", testPvName, testDsName, MinimumDatasetSize, protocolNFS)
+	tnsSnapshot := &tns.TNSSnapshot{
+		Name:    testDsName + "@snapshot-1",
+		Dataset: testDsName,
+		Properties: tns.TNSSnapshotProperties{
+			Creation:   tns.ZFSProperty{RawValue: "1735689600"},
+			Referenced: tns.ZFSProperty{Parsed: float64(4096)},
+		},
+	}
+
+	snapshot := getCsiSnapshot(srcVol, tnsSnapshot)
+	assert.Equal(t, testTnsWsUrl+"#"+testRootDataset+"#"+testDsName+"@snapshot-1#"+testDsName, snapshot.GetSnapshotId())
+	assert.Equal(t, srcVol.id, snapshot.GetSourceVolumeId())
+	assert.Equal(t, int64(4096), snapshot.GetSizeBytes())
+	assert.Equal(t, int64(1735689600), snapshot.GetCreationTime().GetSeconds())
+	assert.True(t, snapshot.GetReadyToUse())
+
+	// The id can be parsed back
+	nfsSnap, err := getNfsSnapFromID(snapshot.GetSnapshotId())
+	assert.NoError(t, err)
+	assert.Equal(t, tnsSnapshot.Name, nfsSnap.snapshotName)
+}
+
+func TestListSnapshots(t *testing.T) {
+	cs := &ControllerServer{Driver: &Driver{name: DefaultDriverName, backends: newBackendRegistry()}}
+
+	// Unknown snapshot: empty list
+	res, err := cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SnapshotId: "invalid"})
+	assert.NoError(t, err)
+	assert.Empty(t, res.GetEntries())
+
+	// No backend known yet
+	res, err = cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{})
+	assert.NoError(t, err)
+	assert.Empty(t, res.GetEntries())
+
+	// No credentials configured for the root dataset of the snapshot or of the source volume
+	snapshotID := testTnsWsUrl + "#" + testRootDataset + "#" + testDsName + "@snapshot-1#" + testDsName
+	_, err = cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SnapshotId: snapshotID})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	volumeID := testTnsWsUrl + "#" + testRootDataset + "#" + testDsName + "#" + testPvName + "#ab#delete"
+	_, err = cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SourceVolumeId: volumeID})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// The root datasets without credentials are skipped
+	cs.Driver.backends.record(testTnsWsUrl, testRootDataset)
+	res, err = cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{})
+	assert.NoError(t, err)
+	assert.Empty(t, res.GetEntries())
+
+	_, err = cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{StartingToken: "2"})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+}
+
+func TestControllerModifyVolume(t *testing.T) {
+	cs := &ControllerServer{Driver: &Driver{name: DefaultDriverName, backends: newBackendRegistry(), volumeLocks: NewVolumeLocks()}}
+	volumeID := testTnsWsUrl + "#" + testRootDataset + "#" + testDsName + "#" + testPvName + "#ab#delete"
+
+	_, err := cs.ControllerModifyVolume(context.Background(), &csi.ControllerModifyVolumeRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = cs.ControllerModifyVolume(context.Background(), &csi.ControllerModifyVolumeRequest{VolumeId: "invalid"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = cs.ControllerModifyVolume(context.Background(), &csi.ControllerModifyVolumeRequest{
+		VolumeId:          volumeID,
+		MutableParameters: map[string]string{"onDelete": "retain"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// No secret
+	_, err = cs.ControllerModifyVolume(context.Background(), &csi.ControllerModifyVolumeRequest{
+		VolumeId:          volumeID,
+		MutableParameters: map[string]string{"compression": "lz4"},
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
@@ -0,0 +1,132 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"encoding/hex"
+	"slices"
+	"strconv"
+	"strings"
+
+	tns "github.com/titou10/csi-driver-truenas-scale/pkg/tns"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The encrypted volumes are datasets with native ZFS encryption, each one being its own encryption root.
+// Their key is generated and kept by Truenas Scale, or is a passphrase or a hex key read from the secrets:
+// the dataset is then locked after a reboot of Truenas Scale and is unlocked by the node before it is mounted
+
+const (
+	defaultEncryptionAlgorithm = "AES-256-GCM"
+	encryptionPBKDF2Iters      = 350000 // Default of Truenas Scale
+	encryptionPassphraseMinLen = 8
+	encryptionKeyLen           = 64 // hex chars, 256 bits
+)
+
+var encryptionAlgorithms = []string{"AES-128-CCM", "AES-192-CCM", "AES-256-CCM", "AES-128-GCM", "AES-192-GCM", "AES-256-GCM"}
+
+// encryptionOptions are the storage class parameters of the encrypted volumes
+type encryptionOptions struct {
+	keySource string
+	algorithm string
+}
+
+// getEncryptionOptions returns the encryption options of the storage class parameters or of the volume context
+// (case-insensitive), nil when the volumes are not encrypted
+func getEncryptionOptions(parameters map[string]string) (*encryptionOptions, error) {
+	encrypted := false
+	opts := &encryptionOptions{keySource: encryptionKeySourceGenerated, algorithm: defaultEncryptionAlgorithm}
+	for k, v := range parameters {
+		switch strings.ToLower(k) {
+		case paramEncryption:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid value %q for parameter %q", v, k)
+			}
+			encrypted = b
+		case paramEncryptionKeySource:
+			opts.keySource = strings.ToLower(v)
+		case paramEncryptionAlgorithm:
+			opts.algorithm = strings.ToUpper(v)
+		}
+	}
+
+	switch opts.keySource {
+	case encryptionKeySourceGenerated, encryptionKeySourcePassphrase, encryptionKeySourceKey:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s %q: must be %s, %s or %s", paramEncryptionKeySource, opts.keySource, encryptionKeySourceGenerated, encryptionKeySourcePassphrase, encryptionKeySourceKey)
+	}
+	if !slices.Contains(encryptionAlgorithms, opts.algorithm) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s %q: must be one of %v", paramEncryptionAlgorithm, opts.algorithm, encryptionAlgorithms)
+	}
+
+	if !encrypted {
+		return nil, nil
+	}
+	return opts, nil
+}
+
+// getTnsEncryption returns the encryption of the dataset of a volume, with the passphrase or the key read from the secrets
+func getTnsEncryption(opts *encryptionOptions, secrets map[string]string) (*tns.EncryptionOptions, error) {
+	if opts == nil {
+		return nil, nil
+	}
+
+	encryption := &tns.EncryptionOptions{Algorithm: opts.algorithm}
+	switch opts.keySource {
+	case encryptionKeySourceGenerated:
+		encryption.GenerateKey = true
+	case encryptionKeySourcePassphrase:
+		passphrase, _, err := getEncryptionSecret(opts.keySource, secrets)
+		if err != nil {
+			return nil, err
+		}
+		encryption.Passphrase = &passphrase
+		encryption.PBKDF2Iters = encryptionPBKDF2Iters
+	case encryptionKeySourceKey:
+		_, key, err := getEncryptionSecret(opts.keySource, secrets)
+		if err != nil {
+			return nil, err
+		}
+		encryption.Key = &key
+	}
+	return encryption, nil
+}
+
+// getEncryptionSecret returns the passphrase or the hex key read from the secrets, depending on the key source
+func getEncryptionSecret(keySource string, secrets map[string]string) (string, string, error) {
+	switch keySource {
+	case encryptionKeySourcePassphrase:
+		passphrase, ok := secrets[encryptionPassphraseSecretKey]
+		if !ok || passphrase == "" {
+			return "", "", status.Errorf(codes.FailedPrecondition, "Secret with '%s' key not found", encryptionPassphraseSecretKey)
+		}
+		if len(passphrase) < encryptionPassphraseMinLen {
+			return "", "", status.Errorf(codes.InvalidArgument, "invalid '%s' key in secret: must be at least %d characters", encryptionPassphraseSecretKey, encryptionPassphraseMinLen)
+		}
+		return passphrase, "", nil
+	case encryptionKeySourceKey:
+		key, ok := secrets[encryptionKeySecretKey]
+		if !ok || key == "" {
+			return "", "", status.Errorf(codes.FailedPrecondition, "Secret with '%s' key not found", encryptionKeySecretKey)
+		}
+		if _, err := hex.DecodeString(key); err != nil || len(key) != encryptionKeyLen {
+			return "", "", status.Errorf(codes.InvalidArgument, "invalid '%s' key in secret: must be %d hex characters", encryptionKeySecretKey, encryptionKeyLen)
+		}
+		return "", key, nil
+	}
+	return "", "", status.Errorf(codes.InvalidArgument, "the key of %s encrypted volumes is not read from the secrets", keySource)
+}
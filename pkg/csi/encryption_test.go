@@ -0,0 +1,129 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var testEncryptionKey = strings.Repeat("0123456789abcdef", 4)
+
+func TestGetEncryptionOptions(t *testing.T) {
+	tests := []struct {
+		params   map[string]string
+		expected *encryptionOptions
+		code     codes.Code
+	}{
+		{params: map[string]string{}, expected: nil},
+		{params: map[string]string{"encryption": "false", "encryptionKeySource": "passphrase"}, expected: nil},
+		{params: map[string]string{"encryption": "true"}, expected: &encryptionOptions{keySource: "generated", algorithm: "AES-256-GCM"}},
+		{params: map[string]string{"Encryption": "true", "encryptionKeySource": "Passphrase", "encryptionAlgorithm": "aes-128-ccm"}, expected: &encryptionOptions{keySource: "passphrase", algorithm: "AES-128-CCM"}},
+		{params: map[string]string{"encryption": "1"}, expected: &encryptionOptions{keySource: "generated", algorithm: "AES-256-GCM"}},
+		{params: map[string]string{"encryption": "on"}, code: codes.InvalidArgument},
+		{params: map[string]string{"encryption": "true", "encryptionKeySource": "kms"}, code: codes.InvalidArgument},
+		{params: map[string]string{"encryption": "true", "encryptionAlgorithm": "AES-256-XTS"}, code: codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		opts, err := getEncryptionOptions(test.params)
+		assert.Equal(t, test.code, status.Code(err), test.params)
+		assert.Equal(t, test.expected, opts, test.params)
+	}
+}
+
+func TestGetTnsEncryption(t *testing.T) {
+	encryption, err := getTnsEncryption(nil, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, encryption)
+
+	encryption, err = getTnsEncryption(&encryptionOptions{keySource: "generated", algorithm: "AES-256-GCM"}, nil)
+	assert.NoError(t, err)
+	assert.True(t, encryption.GenerateKey)
+	assert.Nil(t, encryption.Passphrase)
+	assert.Nil(t, encryption.Key)
+
+	secrets := map[string]string{encryptionPassphraseSecretKey: "my passphrase", encryptionKeySecretKey: testEncryptionKey}
+	encryption, err = getTnsEncryption(&encryptionOptions{keySource: "passphrase", algorithm: "AES-128-GCM"}, secrets)
+	assert.NoError(t, err)
+	assert.False(t, encryption.GenerateKey)
+	assert.Equal(t, "my passphrase", *encryption.Passphrase)
+	assert.Equal(t, encryptionPBKDF2Iters, encryption.PBKDF2Iters)
+	assert.Equal(t, "AES-128-GCM", encryption.Algorithm)
+	assert.Nil(t, encryption.Key)
+
+	encryption, err = getTnsEncryption(&encryptionOptions{keySource: "key", algorithm: "AES-256-GCM"}, secrets)
+	assert.NoError(t, err)
+	assert.Equal(t, testEncryptionKey, *encryption.Key)
+	assert.Nil(t, encryption.Passphrase)
+
+	_, err = getTnsEncryption(&encryptionOptions{keySource: "key", algorithm: "AES-256-GCM"}, nil)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestGetEncryptionSecret(t *testing.T) {
+	tests := []struct {
+		keySource  string
+		secrets    map[string]string
+		passphrase string
+		key        string
+		code       codes.Code
+	}{
+		{keySource: "passphrase", secrets: map[string]string{encryptionPassphraseSecretKey: "12345678"}, passphrase: "12345678"},
+		{keySource: "passphrase", secrets: map[string]string{encryptionPassphraseSecretKey: "1234567"}, code: codes.InvalidArgument},
+		{keySource: "passphrase", secrets: map[string]string{encryptionKeySecretKey: testEncryptionKey}, code: codes.FailedPrecondition},
+		{keySource: "key", secrets: map[string]string{encryptionKeySecretKey: testEncryptionKey}, key: testEncryptionKey},
+		{keySource: "key", secrets: map[string]string{encryptionKeySecretKey: testEncryptionKey[1:]}, code: codes.InvalidArgument},
+		{keySource: "key", secrets: map[string]string{encryptionKeySecretKey: strings.Repeat("z", 64)}, code: codes.InvalidArgument},
+		{keySource: "key", secrets: map[string]string{}, code: codes.FailedPrecondition},
+		{keySource: "generated", secrets: map[string]string{}, code: codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		passphrase, key, err := getEncryptionSecret(test.keySource, test.secrets)
+		assert.Equal(t, test.code, status.Code(err), test.keySource, test.secrets)
+		assert.Equal(t, test.passphrase, passphrase)
+		assert.Equal(t, test.key, key)
+	}
+}
+
+func TestUnlockVolume(t *testing.T) {
+	ns := &NodeServer{Driver: &Driver{name: DefaultDriverName}}
+	volumeID := testTnsWsUrl + "#" + testRootDataset + "#" + testDsName + "#" + testPvName + "#ab#delete"
+
+	// Not encrypted, or the key is kept by Truenas Scale
+	assert.NoError(t, ns.unlockVolume(context.Background(), volumeID, map[string]string{}, nil))
+	assert.NoError(t, ns.unlockVolume(context.Background(), volumeID, map[string]string{"encryption": "true"}, nil))
+
+	// No node stage secret
+	volumeContext := map[string]string{"encryption": "true", "encryptionKeySource": "passphrase"}
+	err := ns.unlockVolume(context.Background(), volumeID, volumeContext, nil)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "node-stage-secret-name")
+
+	// No passphrase in the node stage secret
+	err = ns.unlockVolume(context.Background(), volumeID, volumeContext, map[string]string{apiKeySecretNameKey: "1-abc"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// Invalid volume id
+	secrets := map[string]string{apiKeySecretNameKey: "1-abc", encryptionPassphraseSecretKey: "my passphrase"}
+	err = ns.unlockVolume(context.Background(), "invalid", volumeContext, secrets)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
@@ -0,0 +1,85 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	tns "github.com/titou10/csi-driver-truenas-scale/pkg/tns"
+	"google.golang.org/grpc/codes"
+)
+
+// Before a volume is created, the driver checks that its root dataset, its pool and the service sharing it are usable,
+// to fail with an actionable error instead of a failure of Truenas Scale in the middle of the creation.
+// The results are cached for a short time per server, root dataset and service, not to query them for every volume
+
+const DefaultHealthCheckTTL = 30 * time.Second
+
+// healthServices are the services of Truenas Scale that share the volumes, per protocol
+var healthServices = map[string]string{
+	protocolNFS:    "nfs",
+	protocolSMB:    "cifs",
+	protocolISCSI:  "iscsitarget",
+	protocolNVMEOF: "nvmet",
+}
+
+type healthEntry struct {
+	checked time.Time
+	err     *tns.CsiError
+}
+
+type healthCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration // 0: no cache
+	entries map[string]healthEntry
+	now     func() time.Time
+}
+
+func newHealthCache(ttl time.Duration) *healthCache {
+	return &healthCache{
+		ttl:     ttl,
+		entries: make(map[string]healthEntry),
+		now:     time.Now,
+	}
+}
+
+// check returns the cached result of the health check of the backend, or runs it.
+// Only the results of the checks are cached, not the other errors (eg Truenas Scale not reachable)
+func (c *healthCache) check(tnsWsUrl string, rootDataset string, service string, startService bool, run func() *tns.CsiError) *tns.CsiError {
+	if c == nil || c.ttl <= 0 {
+		return run()
+	}
+
+	key := tnsWsUrl + "#" + rootDataset + "#" + service + "#" + strconv.FormatBool(startService)
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && c.now().Sub(entry.checked) < c.ttl {
+		return entry.err
+	}
+
+	csiErr := run()
+	if csiErr != nil && csiErr.Code != codes.FailedPrecondition {
+		return csiErr
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = healthEntry{checked: c.now(), err: csiErr}
+	return csiErr
+}
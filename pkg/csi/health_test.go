@@ -0,0 +1,104 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	tns "github.com/titou10/csi-driver-truenas-scale/pkg/tns"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestHealthCache(t *testing.T) {
+	now := time.Now()
+	c := newHealthCache(30 * time.Second)
+	c.now = func() time.Time { return now }
+
+	runs := 0
+	var result *tns.CsiError
+	run := func() *tns.CsiError {
+		runs++
+		return result
+	}
+
+	// Healthy, cached until the ttl expires
+	assert.Nil(t, c.check(testTnsWsUrl, testRootDataset, "nfs", false, run))
+	assert.Nil(t, c.check(testTnsWsUrl, testRootDataset, "nfs", false, run))
+	assert.Equal(t, 1, runs)
+	now = now.Add(31 * time.Second)
+	assert.Nil(t, c.check(testTnsWsUrl, testRootDataset, "nfs", false, run))
+	assert.Equal(t, 2, runs)
+
+	// Cached per root dataset, service and start of the service
+	result = tns.NewCsiError(codes.FailedPrecondition, errors.New("service cifs is not running"))
+	assert.Equal(t, result, c.check(testTnsWsUrl, testRootDataset, "cifs", false, run))
+	assert.Equal(t, result, c.check(testTnsWsUrl, testRootDataset, "cifs", false, run))
+	assert.Equal(t, 3, runs)
+	result = nil
+	assert.Nil(t, c.check(testTnsWsUrl, testRootDataset, "cifs", true, run))
+	assert.Nil(t, c.check(testTnsWsUrl, "tank/other", "cifs", false, run))
+	assert.Equal(t, 5, runs)
+
+	// The other errors are not cached
+	result = tns.NewCsiError(codes.Unavailable, errors.New("connection refused"))
+	assert.Equal(t, result, c.check(testTnsWsUrl, testRootDataset, "nvmet", false, run))
+	result = nil
+	assert.Nil(t, c.check(testTnsWsUrl, testRootDataset, "nvmet", false, run))
+	assert.Equal(t, 7, runs)
+
+	// No cache
+	for _, c := range []*healthCache{nil, newHealthCache(0)} {
+		runs = 0
+		assert.Nil(t, c.check(testTnsWsUrl, testRootDataset, "nfs", false, run))
+		assert.Nil(t, c.check(testTnsWsUrl, testRootDataset, "nfs", false, run))
+		assert.Equal(t, 2, runs)
+	}
+}
+
+func TestCreateVolumeAutoStartService(t *testing.T) {
+	cs := newTestControllerServer()
+
+	_, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest(map[string]string{"autoStartService": "yes"}))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// The NFS service is stopped, started only with autoStartService
+	for _, autoStartService := range []string{"false", "true"} {
+		f := newFakeTruenas(t)
+		state := "STOPPED"
+		f.setResult("service.query", fakeResult(func(_ []interface{}) (interface{}, error) {
+			return []interface{}{map[string]interface{}{"id": 1, "service": "nfs", "enable": true, "state": state}}, nil
+		}))
+		f.setResult("service.start", fakeResult(func(_ []interface{}) (interface{}, error) {
+			state = "RUNNING"
+			return true, nil
+		}))
+
+		_, err = f.createVolume(cs, newCreateVolumeRequest(map[string]string{"autoStartService": autoStartService}))
+		if autoStartService == "true" {
+			assert.NoError(t, err)
+			assert.Equal(t, []interface{}{"nfs"}, f.called("service.start"))
+			assert.Len(t, f.called("pool.dataset.create"), 1)
+		} else {
+			assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+			assert.Empty(t, f.called("service.start"))
+			assert.Empty(t, f.called("pool.dataset.create"))
+		}
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/klog/v2"
+	utilexec "k8s.io/utils/exec"
+)
+
+// The iSCSI sessions of the node are managed with iscsiadm (open-iscsi)
+// Each volume has its own target, so a session is opened when the volume is staged and closed when it is unstaged
+
+// iscsiadm exit codes
+const (
+	iscsiErrSessionExists = 15
+	iscsiErrNoObjsFound   = 21
+)
+
+var iscsiDiskByPathDir = "/dev/disk/by-path"
+
+// iscsiTarget is the target of a volume, from the volume context set by CreateVolume
+type iscsiTarget struct {
+	portal string // host:port
+	iqn    string
+	lun    int
+}
+
+// getIscsiTargetFromContext returns the iSCSI target from the volume context (case-insensitive)
+func getIscsiTargetFromContext(volumeContext map[string]string) (*iscsiTarget, error) {
+	var tnsWsUrl, portal, iqn, lun string
+	for k, v := range volumeContext {
+		switch strings.ToLower(k) {
+		case paramTnsWsUrl:
+			tnsWsUrl = v
+		case paramIscsiPortal:
+			portal = v
+		case paramIscsiIqn:
+			iqn = v
+		case paramIscsiLun:
+			lun = v
+		}
+	}
+
+	if iqn == "" {
+		return nil, fmt.Errorf("%v is a required parameter", paramIscsiIqn)
+	}
+	lunID, err := strconv.Atoi(lun)
+	if err != nil || lunID < 0 {
+		return nil, fmt.Errorf("invalid %v %q", paramIscsiLun, lun)
+	}
+	// The storage class may also set the portal, without the port
+	portal, err = getTargetAddress(tnsWsUrl, portal, defaultIscsiPort)
+	if err != nil {
+		return nil, err
+	}
+
+	return &iscsiTarget{portal: portal, iqn: iqn, lun: lunID}, nil
+}
+
+// iscsiInitiator runs iscsiadm on the node
+type iscsiInitiator struct {
+	exec utilexec.Interface
+}
+
+// run runs iscsiadm. The exit codes given are not errors
+func (i *iscsiInitiator) run(okExitCodes []int, args ...string) (string, error) {
+	klog.V(4).Infof("Running iscsiadm %v", args)
+	out, err := i.exec.Command("iscsiadm", args...).CombinedOutput()
+	if err != nil {
+		var exitErr utilexec.ExitError
+		if errors.As(err, &exitErr) && slices.Contains(okExitCodes, exitErr.ExitStatus()) {
+			return string(out), nil
+		}
+		return string(out), fmt.Errorf("iscsiadm %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// login opens a session with the target. It does nothing when the session already exists
+func (i *iscsiInitiator) login(target *iscsiTarget) error {
+	if _, err := i.run([]int{iscsiErrSessionExists}, "-m", "node", "-T", target.iqn, "-p", target.portal, "-o", "new"); err != nil {
+		return err
+	}
+	if _, err := i.run([]int{iscsiErrSessionExists}, "-m", "node", "-T", target.iqn, "-p", target.portal, "--login"); err != nil {
+		return err
+	}
+	klog.V(2).Infof("Logged in iSCSI target %s on %s", target.iqn, target.portal)
+	return nil
+}
+
+// logout closes the sessions with the target and forgets it
+func (i *iscsiInitiator) logout(iqn string) error {
+	if _, err := i.run([]int{iscsiErrNoObjsFound}, "-m", "node", "-T", iqn, "--logout"); err != nil {
+		return err
+	}
+	if _, err := i.run([]int{iscsiErrNoObjsFound}, "-m", "node", "-T", iqn, "-o", "delete"); err != nil {
+		return err
+	}
+	klog.V(2).Infof("Logged out of iSCSI target %s", iqn)
+	return nil
+}
+
+// rescan makes the kernel read the size of the LUNs of the target again, after an expansion
+func (i *iscsiInitiator) rescan(iqn string) error {
+	_, err := i.run(nil, "-m", "node", "-T", iqn, "-R")
+	return err
+}
+
+// sessionIqn returns the IQN of the session opened with the target named targetName, "" when there is none
+// Lines of "iscsiadm -m session": tcp: [1] 10.0.0.1:3260,1 iqn.2005-10.org.freenas.ctl:pvc-xxx (non-flash)
+func (i *iscsiInitiator) sessionIqn(targetName string) (string, error) {
+	out, err := i.run([]int{iscsiErrNoObjsFound}, "-m", "session")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && strings.HasSuffix(fields[3], ":"+targetName) {
+			return fields[3], nil
+		}
+	}
+	return "", nil
+}
+
+// findIscsiDevice returns the device of the LUN, "" when it is not there
+// The address in the name of the link may differ from the portal (eg portal given by host name)
+func findIscsiDevice(iqn string, lun int) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(iscsiDiskByPathDir, fmt.Sprintf("ip-*-iscsi-%s-lun-%d", iqn, lun)))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", nil
+	}
+	return filepath.EvalSymlinks(matches[0])
+}
+
+// waitForIscsiDevice waits for the device of the LUN to appear after the login
+func waitForIscsiDevice(ctx context.Context, target *iscsiTarget) (string, error) {
+	return waitForDevice(ctx, func() (string, error) {
+		return findIscsiDevice(target.iqn, target.lun)
+	}, fmt.Sprintf("LUN %d of iSCSI target %s", target.lun, target.iqn))
+}
+
+// getTargetAddress returns the host:port used by the nodes to connect to a block volume: the address given
+// in the storage class or the host of the Truenas Scale WS url, with the default port when none is given
+func getTargetAddress(tnsWsUrl string, address string, defaultPort string) (string, error) {
+	if address == "" {
+		host, err := getTnsHost(tnsWsUrl)
+		if err != nil {
+			return "", err
+		}
+		return net.JoinHostPort(host, defaultPort), nil
+	}
+
+	if host, port, err := net.SplitHostPort(address); err == nil {
+		if host == "" || port == "" {
+			return "", fmt.Errorf("invalid target address %q", address)
+		}
+		return address, nil
+	}
+	// No port. An IPv6 address may be given with brackets
+	return net.JoinHostPort(strings.Trim(address, "[]"), defaultPort), nil
+}
+
+var (
+	blockDeviceTimeout      = 30 * time.Second
+	blockDevicePollInterval = 1 * time.Second
+)
+
+// waitForDevice waits for the device of a block volume to appear once the node is connected to its target
+func waitForDevice(ctx context.Context, find func() (string, error), description string) (string, error) {
+	timeout := time.After(blockDeviceTimeout)
+	for {
+		device, err := find()
+		if err != nil {
+			return "", err
+		}
+		if device != "" {
+			return device, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-timeout:
+			return "", fmt.Errorf("device of %s not found after %s", description, blockDeviceTimeout)
+		case <-time.After(blockDevicePollInterval):
+		}
+	}
+}
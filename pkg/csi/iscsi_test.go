@@ -0,0 +1,204 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+)
+
+const testIqn = "iqn.2005-10.org.freenas.ctl:" + testPvName
+
+// fakeCommands returns an executor running the given command results, in order, and the arguments received
+func fakeCommands(results ...testingexec.FakeAction) (*testingexec.FakeExec, *[][]string) {
+	calls := [][]string{}
+	fake := &testingexec.FakeExec{}
+	for _, result := range results {
+		fake.CommandScript = append(fake.CommandScript, func(cmd string, args ...string) utilexec.Cmd {
+			calls = append(calls, append([]string{cmd}, args...))
+			return &testingexec.FakeCmd{CombinedOutputScript: []testingexec.FakeAction{result}}
+		})
+	}
+	return fake, &calls
+}
+
+func exitWith(output string, code int) testingexec.FakeAction {
+	return func() ([]byte, []byte, error) {
+		var err error
+		if code != 0 {
+			err = testingexec.FakeExitError{Status: code}
+		}
+		return []byte(output), nil, err
+	}
+}
+
+func TestIscsiSessionIqn(t *testing.T) {
+	sessions := "tcp: [1] 10.0.0.1:3260,1 iqn.2005-10.org.freenas.ctl:pvc-other (non-flash)\n" +
+		"tcp: [2] 10.0.0.1:3260,1 " + testIqn + " (non-flash)\n"
+
+	fake, calls := fakeCommands(exitWith(sessions, 0), exitWith("iscsiadm: No active sessions.", iscsiErrNoObjsFound), exitWith("", 1))
+	i := &iscsiInitiator{exec: fake}
+
+	iqn, err := i.sessionIqn(testPvName)
+	assert.NoError(t, err)
+	assert.Equal(t, testIqn, iqn)
+	assert.Equal(t, []string{"iscsiadm", "-m", "session"}, (*calls)[0])
+
+	iqn, err = i.sessionIqn(testPvName)
+	assert.NoError(t, err)
+	assert.Empty(t, iqn)
+
+	_, err = i.sessionIqn(testPvName)
+	assert.Error(t, err)
+}
+
+func TestIscsiLoginLogout(t *testing.T) {
+	target := &iscsiTarget{portal: "10.0.0.1:3260", iqn: testIqn}
+
+	// Session already opened
+	fake, calls := fakeCommands(exitWith("", 0), exitWith("", iscsiErrSessionExists))
+	i := &iscsiInitiator{exec: fake}
+	assert.NoError(t, i.login(target))
+	assert.Equal(t, []string{"iscsiadm", "-m", "node", "-T", testIqn, "-p", "10.0.0.1:3260", "--login"}, (*calls)[1])
+
+	fake, _ = fakeCommands(exitWith("", 0), exitWith("iscsiadm: connection login retries reached", 8))
+	i = &iscsiInitiator{exec: fake}
+	assert.Error(t, i.login(target))
+
+	// Target already forgotten
+	fake, calls = fakeCommands(exitWith("", iscsiErrNoObjsFound), exitWith("", iscsiErrNoObjsFound))
+	i = &iscsiInitiator{exec: fake}
+	assert.NoError(t, i.logout(testIqn))
+	assert.Equal(t, []string{"iscsiadm", "-m", "node", "-T", testIqn, "-o", "delete"}, (*calls)[1])
+}
+
+func TestGetIscsiTargetFromContext(t *testing.T) {
+	target, err := getIscsiTargetFromContext(map[string]string{
+		"tnsWsUrl":    testTnsWsUrl,
+		"iscsiiqn":    testIqn,
+		"iscsilun":    "0",
+		"iscsiPortal": "10.0.0.1",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &iscsiTarget{portal: "10.0.0.1:3260", iqn: testIqn, lun: 0}, target)
+
+	// Portal from the ws url
+	target, err = getIscsiTargetFromContext(map[string]string{"tnswsurl": testTnsWsUrl, "iscsiiqn": testIqn, "iscsilun": "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "truenas.server:3260", target.portal)
+	assert.Equal(t, 1, target.lun)
+
+	_, err = getIscsiTargetFromContext(map[string]string{"tnswsurl": testTnsWsUrl, "iscsilun": "0"})
+	assert.Error(t, err)
+
+	_, err = getIscsiTargetFromContext(map[string]string{"tnswsurl": testTnsWsUrl, "iscsiiqn": testIqn})
+	assert.Error(t, err)
+}
+
+func TestFindIscsiDevice(t *testing.T) {
+	dir := t.TempDir()
+	defer func(d string) { iscsiDiskByPathDir = d }(iscsiDiskByPathDir)
+	iscsiDiskByPathDir = dir
+
+	device, err := findIscsiDevice(testIqn, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, device)
+
+	// The name of the link has the address of the portal
+	disk := filepath.Join(dir, "sdb")
+	assert.NoError(t, os.WriteFile(disk, nil, 0600))
+	assert.NoError(t, os.Symlink(disk, filepath.Join(dir, "ip-10.0.0.1:3260-iscsi-"+testIqn+"-lun-0")))
+
+	device, err = findIscsiDevice(testIqn, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, disk, device)
+
+	device, err = findIscsiDevice(testIqn, 1)
+	assert.NoError(t, err)
+	assert.Empty(t, device)
+}
+
+func TestIscsiDeviceLookupError(t *testing.T) {
+	dir := t.TempDir()
+	defer func(d string) { iscsiDiskByPathDir = d }(iscsiDiskByPathDir)
+	iscsiDiskByPathDir = dir
+
+	// The link of the LUN points to a device that does not exist
+	assert.NoError(t, os.Symlink(filepath.Join(dir, "missing"), filepath.Join(dir, "ip-10.0.0.1:3260-iscsi-"+testIqn+"-lun-0")))
+
+	volumeID := testTnsWsUrl + "#" + testRootDataset + "#" + testDsName + "#" + testPvName + "#ab#delete#iscsi"
+	volumeContext := map[string]string{"tnsWsUrl": testTnsWsUrl, "iscsiIqn": testIqn, "iscsiLun": "0", "iscsiPortal": "10.0.0.1"}
+	volCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	fake, _ := fakeCommands(exitWith("", 0), exitWith("", 0))
+	ns := &NodeServer{Driver: &Driver{name: DefaultDriverName, volumeLocks: NewVolumeLocks()}, mounter: mount.NewFakeMounter(nil), iscsi: &iscsiInitiator{exec: fake}}
+
+	_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId: volumeID, StagingTargetPath: filepath.Join(dir, "globalmount"), VolumeCapability: volCap, VolumeContext: volumeContext,
+	})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	_, err = ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId: volumeID, StagingTargetPath: filepath.Join(dir, "globalmount"), TargetPath: filepath.Join(dir, "pod-1"), VolumeCapability: volCap, VolumeContext: volumeContext,
+	})
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.Empty(t, ns.mounter.(*mount.FakeMounter).MountPoints)
+}
+
+func TestGetTargetAddress(t *testing.T) {
+	tests := []struct {
+		desc     string
+		tnsWsUrl string
+		portal   string
+		result   string
+		hasErr   bool
+	}{
+		{desc: "host of the ws url", tnsWsUrl: "wss://truenas.local:8443/api/current", result: "truenas.local:3260"},
+		{desc: "ipv6 ws url", tnsWsUrl: "ws://[fd00::1]/websocket", result: "[fd00::1]:3260"},
+		{desc: "portal without port", tnsWsUrl: "wss://truenas.local/api/current", portal: "10.0.0.1", result: "10.0.0.1:3260"},
+		{desc: "portal with port", portal: "10.0.0.1:3261", result: "10.0.0.1:3261"},
+		{desc: "ipv6 portal without port", portal: "[fd00::2]", result: "[fd00::2]:3260"},
+		{desc: "ipv6 portal with port", portal: "[fd00::2]:3261", result: "[fd00::2]:3261"},
+		{desc: "portal without host", portal: ":3260", hasErr: true},
+		{desc: "invalid ws url", tnsWsUrl: "truenas", hasErr: true},
+	}
+
+	for _, test := range tests {
+		result, err := getTargetAddress(test.tnsWsUrl, test.portal, defaultIscsiPort)
+		if (err != nil) != test.hasErr {
+			t.Errorf("test[%s]: unexpected error: %v", test.desc, err)
+			continue
+		}
+		if result != test.result {
+			t.Errorf("test[%s]: unexpected result: %s, expected: %s", test.desc, result, test.result)
+		}
+	}
+
+	if result, _ := getTargetAddress("wss://truenas.local/api/current", "", defaultNvmeofPort); result != "truenas.local:4420" {
+		t.Errorf("unexpected NVMe-oF address: %s", result)
+	}
+}
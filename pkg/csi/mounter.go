@@ -0,0 +1,224 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// The NFS and SMB shares are mounted by a mount(8) process, killed when it does not complete in time (eg the server
+// does not answer), instead of a goroutine left blocked forever.
+// The mount options of the volumes are checked against the policy of the cluster admin and, when they do not set
+// the NFS version, the versions are tried from the most recent one until the server accepts one
+
+const DefaultMountTimeout = 90 * time.Second
+
+// nfsVersions are the NFS versions tried in order when the mount options do not set one
+var nfsVersions = []string{"4.2", "4.1", "3"}
+
+var nfsVersionOptionRegexp = regexp.MustCompile(`^(nfsvers|vers)=|^v[234](\.[0-2])?$`)
+
+// mountOptionsPolicy are the names of the mount options the volumes may use (all when empty) and may not use
+type mountOptionsPolicy struct {
+	allow []string
+	deny  []string
+}
+
+// newMountOptionsPolicy returns the policy of the comma separated lists of mount option names, nil when both are empty
+func newMountOptionsPolicy(allow string, deny string) (*mountOptionsPolicy, error) {
+	p := &mountOptionsPolicy{}
+	for _, list := range []struct {
+		value string
+		names *[]string
+	}{{allow, &p.allow}, {deny, &p.deny}} {
+		for _, name := range strings.Split(list.value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if strings.Contains(name, "=") {
+				return nil, fmt.Errorf("invalid mount option name %q: the value must not be given", name)
+			}
+			*list.names = append(*list.names, name)
+		}
+	}
+	if len(p.allow) == 0 && len(p.deny) == 0 {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// check returns an error for the first mount option that is denied or not allowed
+func (p *mountOptionsPolicy) check(mountOptions []string) error {
+	if p == nil {
+		return nil
+	}
+	for _, flags := range mountOptions {
+		for _, option := range strings.Split(flags, ",") {
+			name, _, _ := strings.Cut(strings.TrimSpace(option), "=")
+			if name == "" {
+				continue
+			}
+			if slices.Contains(p.deny, name) {
+				return fmt.Errorf("mount option %q is denied by the driver (--mount-options-deny)", name)
+			}
+			if len(p.allow) > 0 && !slices.Contains(p.allow, name) {
+				return fmt.Errorf("mount option %q is not allowed by the driver (--mount-options-allow)", name)
+			}
+		}
+	}
+	return nil
+}
+
+// hasNfsVersion returns true when the mount options set the NFS version
+func hasNfsVersion(mountOptions []string) bool {
+	for _, flags := range mountOptions {
+		for _, option := range strings.Split(flags, ",") {
+			if nfsVersionOptionRegexp.MatchString(strings.TrimSpace(option)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// makeMountArgs returns the arguments of mount(8), and the same arguments without the sensitive options to log them
+func makeMountArgs(source string, target string, fsType string, mountOptions []string, sensitiveOptions []string) ([]string, []string) {
+	var args, logArgs []string
+	if fsType != "" {
+		args = append(args, "-t", fsType)
+	}
+	logArgs = append(logArgs, args...)
+	if len(mountOptions) > 0 || len(sensitiveOptions) > 0 {
+		masked := slices.Clone(mountOptions)
+		for range sensitiveOptions {
+			masked = append(masked, "<masked>")
+		}
+		args = append(args, "-o", strings.Join(append(slices.Clone(mountOptions), sensitiveOptions...), ","))
+		logArgs = append(logArgs, "-o", strings.Join(masked, ","))
+	}
+	args = append(args, source, target)
+	logArgs = append(logArgs, source, target)
+	return args, logArgs
+}
+
+// mountErrors map the errors of the mount helpers (mount.nfs, mount.cifs), printed with strerror, to the gRPC codes
+var mountErrors = []struct {
+	errno   syscall.Errno
+	message string // Message of the mount helper, when it is not the one of the errno
+	code    codes.Code
+}{
+	{message: "access denied by server", code: codes.PermissionDenied},
+	{message: "requested NFS version or transport protocol is not supported", code: codes.FailedPrecondition},
+	{message: "bad option", code: codes.InvalidArgument},
+	{errno: syscall.EACCES, code: codes.PermissionDenied},
+	{errno: syscall.EPERM, code: codes.PermissionDenied},
+	{errno: syscall.ENOENT, code: codes.NotFound},
+	{errno: syscall.ECONNREFUSED, code: codes.Unavailable},
+	{errno: syscall.ETIMEDOUT, code: codes.Unavailable},
+	{errno: syscall.EHOSTUNREACH, code: codes.Unavailable},
+	{errno: syscall.EHOSTDOWN, code: codes.Unavailable},
+	{errno: syscall.ENETUNREACH, code: codes.Unavailable},
+	{errno: syscall.EPROTONOSUPPORT, code: codes.FailedPrecondition},
+	{errno: syscall.EINVAL, code: codes.InvalidArgument},
+}
+
+// getMountErrorCode returns the gRPC code of a failed mount
+func getMountErrorCode(ctx context.Context, err error) codes.Code {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	case errors.Is(ctx.Err(), context.Canceled):
+		return codes.Canceled
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, e := range mountErrors {
+		if e.errno != 0 && (errors.Is(err, e.errno) || strings.Contains(message, e.errno.Error())) {
+			return e.code
+		}
+		if e.message != "" && strings.Contains(message, strings.ToLower(e.message)) {
+			return e.code
+		}
+	}
+	return codes.Internal
+}
+
+// isNfsVersionRejected returns true when the server does not accept the NFS version
+func isNfsVersionRejected(ctx context.Context, err error) bool {
+	return ctx.Err() == nil && getMountErrorCode(ctx, err) == codes.FailedPrecondition
+}
+
+// mountWithTimeout mounts source on target, the mount is killed after the mount timeout of the driver.
+// The NFS versions are tried in order when the mount options do not set one
+func (ns *NodeServer) mountWithTimeout(ctx context.Context, source string, target string, fsType string, mountOptions []string, sensitiveOptions []string) error {
+	if ns.Driver.mountTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ns.Driver.mountTimeout)
+		defer cancel()
+	}
+
+	var err error
+	if fsType != "nfs" || hasNfsVersion(mountOptions) {
+		err = ns.mount(ctx, source, target, fsType, mountOptions, sensitiveOptions)
+	} else {
+		for _, version := range nfsVersions {
+			err = ns.mount(ctx, source, target, fsType, append(slices.Clone(mountOptions), "nfsvers="+version), sensitiveOptions)
+			if err == nil {
+				klog.V(2).Infof("%s mounted with NFS version %s", source, version)
+				break
+			}
+			if !isNfsVersionRejected(ctx, err) {
+				break
+			}
+			klog.Warningf("NFS version %s of %s not accepted: %v", version, source, err)
+		}
+	}
+	if err == nil {
+		return nil
+	}
+
+	code := getMountErrorCode(ctx, err)
+	if code == codes.DeadlineExceeded {
+		return status.Errorf(code, "mount of %s on %s did not complete in %v: %v", source, target, ns.Driver.mountTimeout, err)
+	}
+	return status.Error(code, err.Error())
+}
+
+// mount runs mount(8), killed when the context is done, or the mounter when there is no mount executor
+func (ns *NodeServer) mount(ctx context.Context, source string, target string, fsType string, mountOptions []string, sensitiveOptions []string) error {
+	if ns.mountExec == nil || fsType == "" {
+		return ns.mounter.MountSensitive(source, target, fsType, mountOptions, sensitiveOptions)
+	}
+
+	args, logArgs := makeMountArgs(source, target, fsType, mountOptions, sensitiveOptions)
+	klog.V(4).Infof("Running mount %v", logArgs)
+	out, err := ns.mountExec.CommandContext(ctx, "mount", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("mount %s failed: %v: %s", strings.Join(logArgs, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+	testingexec "k8s.io/utils/exec/testing"
+)
+
+func TestMountOptionsPolicy(t *testing.T) {
+	p, err := newMountOptionsPolicy(" ", "")
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+	assert.NoError(t, p.check([]string{"soft", "nolock"}))
+
+	_, err = newMountOptionsPolicy("nfsvers=4.1", "")
+	assert.Error(t, err)
+
+	p, err = newMountOptionsPolicy("nfsvers, hard,noatime,ro", "")
+	assert.NoError(t, err)
+	assert.NoError(t, p.check([]string{"nfsvers=4.1,hard", "noatime"}))
+	assert.ErrorContains(t, p.check([]string{"hard", "soft"}), `"soft" is not allowed`)
+
+	p, err = newMountOptionsPolicy("", "nolock,soft")
+	assert.NoError(t, err)
+	assert.NoError(t, p.check([]string{"hard", "nfsvers=3"}))
+	assert.ErrorContains(t, p.check([]string{"hard,nolock"}), `"nolock" is denied`)
+}
+
+func TestHasNfsVersion(t *testing.T) {
+	assert.False(t, hasNfsVersion(nil))
+	assert.False(t, hasNfsVersion([]string{"hard,noatime", "ro"}))
+	assert.True(t, hasNfsVersion([]string{"hard,nfsvers=4.1"}))
+	assert.True(t, hasNfsVersion([]string{"vers=3"}))
+	assert.True(t, hasNfsVersion([]string{"v4.2"}))
+}
+
+func TestMakeMountArgs(t *testing.T) {
+	args, logArgs := makeMountArgs("//truenas/share", "/mnt/target", "cifs", []string{"vers=3.0"}, []string{"username=user", "password=secret"})
+	assert.Equal(t, []string{"-t", "cifs", "-o", "vers=3.0,username=user,password=secret", "//truenas/share", "/mnt/target"}, args)
+	assert.Equal(t, []string{"-t", "cifs", "-o", "vers=3.0,<masked>,<masked>", "//truenas/share", "/mnt/target"}, logArgs)
+
+	args, _ = makeMountArgs("10.0.0.1:/mnt/tank/vol-1", "/mnt/target", "nfs", nil, nil)
+	assert.Equal(t, []string{"-t", "nfs", "10.0.0.1:/mnt/tank/vol-1", "/mnt/target"}, args)
+}
+
+func TestGetMountErrorCode(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected codes.Code
+	}{
+		{errors.New("mount.nfs: access denied by server while mounting 10.0.0.1:/mnt/tank/vol-1"), codes.PermissionDenied},
+		{errors.New("mount error(13): Permission denied"), codes.PermissionDenied},
+		{errors.New("mount.nfs: mounting 10.0.0.1:/mnt/tank/vol-1 failed, reason given by server: No such file or directory"), codes.NotFound},
+		{errors.New("mount.nfs: Connection refused"), codes.Unavailable},
+		{errors.New("mount.nfs: No route to host"), codes.Unavailable},
+		{errors.New("mount.nfs: requested NFS version or transport protocol is not supported"), codes.FailedPrecondition},
+		{errors.New("mount.nfs: Protocol not supported"), codes.FailedPrecondition},
+		{errors.New("mount: wrong fs type, bad option, bad superblock on 10.0.0.1:/mnt/tank/vol-1"), codes.InvalidArgument},
+		{&os.PathError{Op: "mount", Path: "/mnt/target", Err: syscall.EACCES}, codes.PermissionDenied},
+		{fmt.Errorf("mount failed: %w", syscall.EHOSTUNREACH), codes.Unavailable},
+		{errors.New("mount failed: exit status 32"), codes.Internal},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, getMountErrorCode(context.Background(), test.err), test.err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, codes.Canceled, getMountErrorCode(ctx, errors.New("signal: killed")))
+}
+
+func TestMountWithTimeout(t *testing.T) {
+	source := "10.0.0.1:/mnt/tank/vol-1"
+	target := "/mnt/target"
+	newNodeServer := func(results ...testingexec.FakeAction) (*NodeServer, *[][]string) {
+		fake, calls := fakeCommands(results...)
+		return &NodeServer{Driver: &Driver{name: DefaultDriverName, mountTimeout: time.Second}, mounter: mount.NewFakeMounter(nil), mountExec: fake}, calls
+	}
+
+	// The server does not accept NFS 4.2
+	ns, calls := newNodeServer(exitWith("mount.nfs: requested NFS version or transport protocol is not supported", 32), exitWith("", 0))
+	assert.NoError(t, ns.mountWithTimeout(context.Background(), source, target, "nfs", []string{"hard"}, nil))
+	assert.Equal(t, [][]string{
+		{"mount", "-t", "nfs", "-o", "hard,nfsvers=4.2", source, target},
+		{"mount", "-t", "nfs", "-o", "hard,nfsvers=4.1", source, target},
+	}, *calls)
+
+	// No version accepted
+	ns, calls = newNodeServer(exitWith("mount.nfs: Protocol not supported", 32), exitWith("mount.nfs: Protocol not supported", 32), exitWith("mount.nfs: Protocol not supported", 32))
+	err := ns.mountWithTimeout(context.Background(), source, target, "nfs", nil, nil)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Len(t, *calls, 3)
+
+	// The version of the mount options is the only one tried, the other errors are not retried
+	ns, calls = newNodeServer(exitWith("mount.nfs: access denied by server while mounting "+source, 32))
+	err = ns.mountWithTimeout(context.Background(), source, target, "nfs", []string{"nfsvers=3"}, nil)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Equal(t, [][]string{{"mount", "-t", "nfs", "-o", "nfsvers=3", source, target}}, *calls)
+
+	ns, calls = newNodeServer(exitWith("mount.nfs: Connection refused", 32))
+	err = ns.mountWithTimeout(context.Background(), source, target, "nfs", nil, nil)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Len(t, *calls, 1)
+
+	// The mount process is killed after the mount timeout
+	ns, _ = newNodeServer(func() ([]byte, []byte, error) {
+		time.Sleep(50 * time.Millisecond)
+		return nil, nil, errors.New("signal: killed")
+	})
+	ns.Driver.mountTimeout = 10 * time.Millisecond
+	err = ns.mountWithTimeout(context.Background(), source, target, "nfs", []string{"nfsvers=4.1"}, nil)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	// The bind mounts are made by the mounter
+	ns, calls = newNodeServer()
+	assert.NoError(t, ns.mountWithTimeout(context.Background(), "/staging", target, "", []string{"bind"}, nil))
+	assert.Empty(t, *calls)
+	assert.Len(t, ns.mounter.(*mount.FakeMounter).MountPoints, 1)
+}
+
+func TestNodePublishVolumeMountOptionsPolicy(t *testing.T) {
+	policy, err := newMountOptionsPolicy("", "nolock")
+	assert.NoError(t, err)
+	ns := &NodeServer{Driver: &Driver{name: DefaultDriverName, volumeLocks: NewVolumeLocks(), mountOptionsPolicy: policy}, mounter: mount.NewFakeMounter(nil)}
+	volCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"hard,nolock"}}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+	volumeID := testTnsWsUrl + "#" + testRootDataset + "#" + testDsName + "#" + testPvName + "#ab#delete"
+	dir := t.TempDir()
+
+	_, err = ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{VolumeId: volumeID, StagingTargetPath: filepath.Join(dir, "globalmount"), VolumeCapability: volCap})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{VolumeId: volumeID, TargetPath: filepath.Join(dir, "pod-1"), VolumeCapability: volCap})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Empty(t, ns.mounter.(*mount.FakeMounter).MountPoints)
+}
@@ -0,0 +1,277 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+// The NFS share of a volume is mounted once per node on the staging path by NodeStageVolume, and bind mounted
+// on the target path of each pod by NodePublishVolume.
+// The NFS shares may be reachable at several addresses (several data interfaces, the VIP and the controllers of a
+// HA pair...). When the storage class gives several, the node probes the NFS port of each one in turn and mounts
+// the first reachable one. The address mounted on each path is recorded for the other node calls
+
+const (
+	defaultNfsPort = "2049"
+
+	// Order in which the NFS servers are tried
+	nfsServerSelectionOrdered = "ordered" // The order of the storage class: failover
+	nfsServerSelectionSpread  = "spread"  // Starting at an address chosen by a hash of the volume id: load spreading
+)
+
+var nfsProbeTimeout = 2 * time.Second
+
+// nfsShare is the NFS share of a volume, from the volume context set by CreateVolume
+type nfsShare struct {
+	servers []string // In the order they are tried
+	path    string
+}
+
+// getNfsShareFromContext returns the NFS share of the volume from the volume context (case-insensitive)
+func getNfsShareFromContext(volumeID string, volumeContext map[string]string) (*nfsShare, error) {
+	var tnsWsUrl, nfsServer, selection, path string
+	for k, v := range volumeContext {
+		switch strings.ToLower(k) {
+		case paramTnsWsUrl:
+			tnsWsUrl = v
+		case paramNfsServer:
+			nfsServer = v
+		case paramNfsServerSelection:
+			selection = strings.ToLower(v)
+		case paramNfsSharePath:
+			path = v
+		}
+	}
+
+	if path == "" {
+		return nil, fmt.Errorf("%v is a required parameter", paramNfsSharePath)
+	}
+	// The data path may use another network than the management one
+	servers, err := getNfsServers(nfsServer, tnsWsUrl)
+	if err != nil {
+		return nil, err
+	}
+	return &nfsShare{servers: orderNfsServers(servers, selection, volumeID), path: path}, nil
+}
+
+// parseNfsServers parses the NFS servers given in the storage class: a comma-separated list of hostnames or IP addresses,
+// IPv6 addresses with or without brackets, or urls (eg nfs://truenas-storage.local). Returns the hosts, without brackets
+func parseNfsServers(value string) ([]string, error) {
+	servers := []string{}
+	for _, entry := range splitList(value) {
+		host := entry
+		if strings.Contains(entry, "://") {
+			u, err := url.Parse(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid NFS server %q: %v", entry, err)
+			}
+			if u.Port() != "" {
+				return nil, fmt.Errorf("invalid NFS server %q: the port is a mount option", entry)
+			}
+			host = u.Hostname()
+		} else if _, _, err := net.SplitHostPort(entry); err == nil {
+			return nil, fmt.Errorf("invalid NFS server %q: the port is a mount option", entry)
+		}
+		host = strings.Trim(host, "[]")
+
+		if net.ParseIP(host) == nil && len(validation.IsDNS1123Subdomain(strings.ToLower(host))) > 0 {
+			return nil, fmt.Errorf("invalid NFS server %q: must be a hostname or an IP address", entry)
+		}
+		servers = append(servers, host)
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no NFS server in %q", value)
+	}
+	return servers, nil
+}
+
+// getNfsServers returns the hosts of the NFS server of a volume: the nfsServer of its storage class or, for the volumes
+// created without it, the host of the Truenas Scale WS url
+func getNfsServers(nfsServer string, tnsWsUrl string) ([]string, error) {
+	if nfsServer != "" {
+		return parseNfsServers(nfsServer)
+	}
+	host, err := getTnsHost(tnsWsUrl)
+	if err != nil {
+		return nil, err
+	}
+	return []string{host}, nil
+}
+
+// source returns the mount source of the share on the server
+func (s *nfsShare) source(server string) string {
+	return fmt.Sprintf("%s:%s", getServerFromSource(server), s.path)
+}
+
+// isReadOnlyAccessMode returns true for the access modes of the volumes that are never written
+func isReadOnlyAccessMode(volCap *csi.VolumeCapability) bool {
+	switch volCap.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	}
+	return false
+}
+
+// isStagingPath returns true for the staging paths of the volumes of the driver created by kubelet:
+// <kubelet dir>/plugins/kubernetes.io/csi/<driver name>/<hash of the volume id>/globalmount
+func isStagingPath(path string, driverName string) bool {
+	return strings.Contains(path, "/plugins/kubernetes.io/csi/"+driverName+"/") && strings.HasSuffix(path, "/globalmount")
+}
+
+// nfsProbe checks that a host:port accepts TCP connections
+type nfsProbe func(ctx context.Context, address string) error
+
+func probeTCP(ctx context.Context, address string) error {
+	ctx, cancel := context.WithTimeout(ctx, nfsProbeTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// orderNfsServers returns the servers in the order they are tried
+func orderNfsServers(servers []string, selection string, volumeID string) []string {
+	if selection != nfsServerSelectionSpread || len(servers) < 2 {
+		return servers
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(volumeID))
+	start := int(h.Sum32() % uint32(len(servers)))
+	return append(append([]string{}, servers[start:]...), servers[:start]...)
+}
+
+// selectNfsServer returns the first server whose NFS port is reachable. A single server is not probed:
+// the mount reports why it is not reachable
+func selectNfsServer(ctx context.Context, servers []string, port string, probe nfsProbe) (string, error) {
+	if len(servers) == 1 {
+		return servers[0], nil
+	}
+	if probe == nil {
+		probe = probeTCP
+	}
+
+	var errs []error
+	for _, server := range servers {
+		address := net.JoinHostPort(server, port)
+		err := probe(ctx, address)
+		if err == nil {
+			return server, nil
+		}
+		klog.Warningf("NFS server %s not reachable: %v", address, err)
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return "", fmt.Errorf("no NFS server reachable among %v: %w", servers, errors.Join(errs...))
+}
+
+// getNfsPort returns the port of the NFS server, given by the port mount option or the default one
+func getNfsPort(mountOptions []string) string {
+	port := defaultNfsPort
+	for _, flags := range mountOptions {
+		for _, option := range strings.Split(flags, ",") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(option), "port="); ok && v != "" && v != "0" {
+				port = v
+			}
+		}
+	}
+	return port
+}
+
+// nfsMountRecord records the NFS server address mounted on each target path. After a restart of the node plugin,
+// the address is read from the mount table
+type nfsMountRecord struct {
+	mu      sync.Mutex
+	servers map[string]string // target path -> server
+}
+
+func newNfsMountRecord() *nfsMountRecord {
+	return &nfsMountRecord{
+		servers: make(map[string]string),
+	}
+}
+
+func (r *nfsMountRecord) record(targetPath string, server string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.servers[targetPath] = server
+}
+
+func (r *nfsMountRecord) forget(targetPath string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.servers, targetPath)
+}
+
+// server returns the NFS server mounted on the target path, "" when it is not a NFS mount of the driver
+func (r *nfsMountRecord) server(targetPath string, mounter mount.Interface) string {
+	if r != nil {
+		r.mu.Lock()
+		server, ok := r.servers[targetPath]
+		r.mu.Unlock()
+		if ok {
+			return server
+		}
+	}
+	if mounter == nil {
+		return ""
+	}
+
+	mountPoints, err := mounter.List()
+	if err != nil {
+		klog.Warningf("failed to list the mount points: %v", err)
+		return ""
+	}
+	for _, mp := range mountPoints {
+		if mp.Path != targetPath || !strings.HasPrefix(mp.Type, "nfs") {
+			continue
+		}
+		// The source is <host>:<path>, the IPv6 hosts are in brackets
+		i := strings.Index(mp.Device, ":/")
+		if i <= 0 {
+			return ""
+		}
+		server := strings.Trim(mp.Device[:i], "[]")
+		r.record(targetPath, server)
+		return server
+	}
+	return ""
+}
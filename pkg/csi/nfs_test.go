@@ -0,0 +1,403 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+)
+
+func TestOrderNfsServers(t *testing.T) {
+	servers := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+
+	assert.Equal(t, servers, orderNfsServers(servers, "", "vol-1"))
+	assert.Equal(t, servers, orderNfsServers(servers, nfsServerSelectionOrdered, "vol-1"))
+	assert.Equal(t, []string{"10.0.0.1"}, orderNfsServers([]string{"10.0.0.1"}, nfsServerSelectionSpread, "vol-1"))
+
+	// Spread: a rotation of the servers, the same for a volume, different between volumes
+	starts := map[string]bool{}
+	for _, volumeID := range []string{"vol-1", "vol-2", "vol-3", "vol-4", "vol-5", "vol-6"} {
+		ordered := orderNfsServers(servers, nfsServerSelectionSpread, volumeID)
+		start := slices.Index(servers, ordered[0])
+		assert.Equal(t, append(slices.Clone(servers[start:]), servers[:start]...), ordered)
+		assert.Equal(t, ordered, orderNfsServers(servers, nfsServerSelectionSpread, volumeID))
+		starts[ordered[0]] = true
+	}
+	assert.Greater(t, len(starts), 1)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, servers, "servers must not be modified")
+}
+
+func TestSelectNfsServer(t *testing.T) {
+	probed := []string{}
+	probe := func(_ context.Context, address string) error {
+		probed = append(probed, address)
+		if address == "[fd00::2]:2049" {
+			return nil
+		}
+		return errors.New("connection refused")
+	}
+
+	server, err := selectNfsServer(context.Background(), []string{"10.0.0.1", "fd00::2", "10.0.0.3"}, "2049", probe)
+	assert.NoError(t, err)
+	assert.Equal(t, "fd00::2", server)
+	assert.Equal(t, []string{"10.0.0.1:2049", "[fd00::2]:2049"}, probed)
+
+	_, err = selectNfsServer(context.Background(), []string{"10.0.0.1", "10.0.0.3"}, "2049", probe)
+	assert.ErrorContains(t, err, "no NFS server reachable")
+
+	// A single server is not probed
+	probed = []string{}
+	server, err = selectNfsServer(context.Background(), []string{"10.0.0.1"}, "2049", probe)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", server)
+	assert.Empty(t, probed)
+}
+
+func TestProbeTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	address := listener.Addr().String()
+	assert.NoError(t, probeTCP(context.Background(), address))
+
+	listener.Close()
+	assert.Error(t, probeTCP(context.Background(), address))
+}
+
+func TestGetNfsPort(t *testing.T) {
+	assert.Equal(t, "2049", getNfsPort(nil))
+	assert.Equal(t, "2049", getNfsPort([]string{"nfsvers=4.1", "port=0"}))
+	assert.Equal(t, "20490", getNfsPort([]string{"hard", "nfsvers=3,port=20490"}))
+}
+
+func TestNfsMountRecord(t *testing.T) {
+	mounter := mount.NewFakeMounter([]mount.MountPoint{
+		{Device: "10.0.0.2:/mnt/tank/k8s/vol-1", Path: "/pods/1/mount", Type: "nfs4"},
+		{Device: "[fd00::2]:/mnt/tank/k8s/vol-2", Path: "/pods/2/mount", Type: "nfs"},
+		{Device: "/dev/sdb", Path: "/pods/3/mount", Type: "ext4"},
+	})
+
+	r := newNfsMountRecord()
+	r.record("/pods/1/mount", "10.0.0.1")
+	assert.Equal(t, "10.0.0.1", r.server("/pods/1/mount", mounter))
+
+	// Read from the mount table
+	r.forget("/pods/1/mount")
+	assert.Equal(t, "10.0.0.2", r.server("/pods/1/mount", mounter))
+	assert.Equal(t, "fd00::2", r.server("/pods/2/mount", mounter))
+	assert.Equal(t, "", r.server("/pods/3/mount", mounter))
+	assert.Equal(t, "", r.server("/pods/4/mount", mounter))
+
+	// No record
+	var none *nfsMountRecord
+	none.record("/pods/1/mount", "10.0.0.1")
+	none.forget("/pods/1/mount")
+	assert.Equal(t, "fd00::2", none.server("/pods/2/mount", mounter))
+}
+
+func TestGetNfsShareFromContext(t *testing.T) {
+	share, err := getNfsShareFromContext("vol-1", map[string]string{"tnsWsUrl": "wss://truenas.mgmt.local/api/current", "nfsSharePath": "/mnt/tank/k8s/vol-1"})
+	assert.NoError(t, err)
+	assert.Equal(t, &nfsShare{servers: []string{"truenas.mgmt.local"}, path: "/mnt/tank/k8s/vol-1"}, share)
+
+	share, err = getNfsShareFromContext("vol-1", map[string]string{"nfssharepath": "/mnt/tank/k8s/vol-1", "nfsServer": "fd00::1,10.0.0.2"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"fd00::1", "10.0.0.2"}, share.servers)
+	assert.Equal(t, "[fd00::1]:/mnt/tank/k8s/vol-1", share.source(share.servers[0]))
+
+	_, err = getNfsShareFromContext("vol-1", map[string]string{"tnsWsUrl": testTnsWsUrl})
+	assert.ErrorContains(t, err, paramNfsSharePath)
+	_, err = getNfsShareFromContext("vol-1", map[string]string{"nfsSharePath": "/mnt/tank/k8s/vol-1"})
+	assert.Error(t, err)
+}
+
+func TestParseNfsServers(t *testing.T) {
+	tests := []struct {
+		desc   string
+		value  string
+		result []string
+		hasErr bool
+	}{
+		{desc: "hostname", value: "truenas-storage.local", result: []string{"truenas-storage.local"}},
+		{desc: "list", value: "10.0.0.1, Truenas-B.local", result: []string{"10.0.0.1", "Truenas-B.local"}},
+		{desc: "ipv6", value: "fd00::1,[fd00::2]", result: []string{"fd00::1", "fd00::2"}},
+		{desc: "urls", value: "nfs://truenas.local/mnt,nfs://[fd00::3]", result: []string{"truenas.local", "fd00::3"}},
+		{desc: "port", value: "10.0.0.1:2049", hasErr: true},
+		{desc: "ipv6 with port", value: "[fd00::1]:2049", hasErr: true},
+		{desc: "url with port", value: "nfs://truenas.local:2049", hasErr: true},
+		{desc: "url without host", value: "nfs:///mnt", hasErr: true},
+		{desc: "invalid hostname", value: "truenas_storage", hasErr: true},
+		{desc: "empty", value: " , ", hasErr: true},
+	}
+
+	for _, test := range tests {
+		result, err := parseNfsServers(test.value)
+		if (err != nil) != test.hasErr {
+			t.Errorf("test[%s]: unexpected error: %v", test.desc, err)
+			continue
+		}
+		if !test.hasErr && !reflect.DeepEqual(result, test.result) {
+			t.Errorf("test[%s]: unexpected result: %v, expected: %v", test.desc, result, test.result)
+		}
+	}
+}
+
+func TestGetNfsServers(t *testing.T) {
+	tests := []struct {
+		desc      string
+		nfsServer string
+		tnsWsUrl  string
+		result    []string
+		hasErr    bool
+	}{
+		{desc: "nfs server", nfsServer: "10.10.0.1", tnsWsUrl: "wss://truenas.mgmt.local/api/current", result: []string{"10.10.0.1"}},
+		{desc: "host of the ws url", tnsWsUrl: "wss://truenas.mgmt.local:8443/api/current", result: []string{"truenas.mgmt.local"}},
+		{desc: "ipv6 ws url", tnsWsUrl: "ws://[fd00::1]/websocket", result: []string{"fd00::1"}},
+		{desc: "invalid ws url", tnsWsUrl: "truenas", hasErr: true},
+	}
+
+	for _, test := range tests {
+		result, err := getNfsServers(test.nfsServer, test.tnsWsUrl)
+		if (err != nil) != test.hasErr {
+			t.Errorf("test[%s]: unexpected error: %v", test.desc, err)
+			continue
+		}
+		if !test.hasErr && !reflect.DeepEqual(result, test.result) {
+			t.Errorf("test[%s]: unexpected result: %v, expected: %v", test.desc, result, test.result)
+		}
+	}
+}
+
+func TestIsStagingPath(t *testing.T) {
+	assert.True(t, isStagingPath("/var/lib/kubelet/plugins/kubernetes.io/csi/tns.csi.titou10.org/0a1b2c/globalmount", DefaultDriverName))
+	assert.False(t, isStagingPath("/var/lib/kubelet/plugins/kubernetes.io/csi/nfs.csi.k8s.io/0a1b2c/globalmount", DefaultDriverName))
+	assert.False(t, isStagingPath("/var/lib/kubelet/pods/1234/volumes/kubernetes.io~csi/pvc-1/mount", DefaultDriverName))
+}
+
+func TestStageNfsVolume(t *testing.T) {
+	dir := t.TempDir()
+	stagingPath := filepath.Join(dir, "globalmount")
+	targetPaths := []string{filepath.Join(dir, "pod-1"), filepath.Join(dir, "pod-2")}
+	volumeID := testTnsWsUrl + "#" + testRootDataset + "#" + testDsName + "#" + testPvName + "#ab#delete"
+	volumeContext := map[string]string{"tnsWsUrl": "wss://truenas.mgmt.local/api/current", "nfsServer": "10.0.0.1", "nfsSharePath": "/mnt/tank/k8s/vol-1"}
+	volCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"nfsvers=4.1"}}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+
+	mounter := mount.NewFakeMounter(nil)
+	ns := &NodeServer{Driver: &Driver{name: DefaultDriverName, volumeLocks: NewVolumeLocks()}, mounter: mounter, nfsMounts: newNfsMountRecord()}
+	stageRequest := &csi.NodeStageVolumeRequest{VolumeId: volumeID, StagingTargetPath: stagingPath, VolumeCapability: volCap, VolumeContext: volumeContext}
+
+	// A single NFS mount, on the staging path
+	for i := 0; i < 2; i++ {
+		_, err := ns.NodeStageVolume(context.Background(), stageRequest)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []mount.MountPoint{{Device: "10.0.0.1:/mnt/tank/k8s/vol-1", Path: stagingPath, Type: "nfs", Opts: []string{"nfsvers=4.1"}}}, mounter.MountPoints)
+
+	// Bind mounts of the staging path, read-only for the second pod
+	for i, targetPath := range targetPaths {
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId: volumeID, StagingTargetPath: stagingPath, TargetPath: targetPath, VolumeCapability: volCap, VolumeContext: volumeContext, Readonly: i == 1,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "10.0.0.1", ns.nfsMounts.server(targetPath, mounter))
+	}
+	assert.Len(t, mounter.MountPoints, 3)
+	assert.Equal(t, mount.MountPoint{Device: "10.0.0.1:/mnt/tank/k8s/vol-1", Path: targetPaths[1], Type: "", Opts: []string{"bind", "ro"}}, mounter.MountPoints[2])
+
+	// Not unstaged while it is published
+	_, err := ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: volumeID, StagingTargetPath: stagingPath})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	for _, targetPath := range targetPaths {
+		_, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID, TargetPath: targetPath})
+		assert.NoError(t, err)
+	}
+	_, err = ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: volumeID, StagingTargetPath: stagingPath})
+	assert.NoError(t, err)
+	assert.Empty(t, mounter.MountPoints)
+	assert.NoDirExists(t, stagingPath)
+
+	// Not staged: the share is mounted for the pod
+	_, err = ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId: volumeID, StagingTargetPath: stagingPath, TargetPath: targetPaths[0], VolumeCapability: volCap, VolumeContext: volumeContext,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []mount.MountPoint{{Device: "10.0.0.1:/mnt/tank/k8s/vol-1", Path: targetPaths[0], Type: "nfs", Opts: []string{"nfsvers=4.1"}}}, mounter.MountPoints)
+}
+
+func TestStageNfsVolumeStale(t *testing.T) {
+	dir := t.TempDir()
+	stagingPath := filepath.Join(dir, "plugins/kubernetes.io/csi", DefaultDriverName, "0a1b2c/globalmount")
+	assert.NoError(t, os.MkdirAll(stagingPath, 0750))
+	volumeID := testTnsWsUrl + "#" + testRootDataset + "#" + testDsName + "#" + testPvName + "#ab#delete"
+
+	mounter := mount.NewFakeMounter([]mount.MountPoint{{Device: "10.0.0.9:/mnt/tank/k8s/vol-1", Path: stagingPath, Type: "nfs"}})
+	mounter.MountCheckErrors = map[string]error{stagingPath: syscall.ESTALE}
+	ns := &NodeServer{Driver: &Driver{name: DefaultDriverName, volumeLocks: NewVolumeLocks()}, mounter: mounter, nfsMounts: newNfsMountRecord()}
+
+	_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: stagingPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+		},
+		VolumeContext: map[string]string{"nfsServer": "10.0.0.1", "nfsSharePath": "/mnt/tank/k8s/vol-1"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []mount.MountPoint{{Device: "10.0.0.1:/mnt/tank/k8s/vol-1", Path: stagingPath, Type: "nfs", Opts: []string{"ro", "nfsvers=4.2"}}}, mounter.MountPoints)
+}
+
+func TestPublishNfsVolumeStale(t *testing.T) {
+	dir := t.TempDir()
+	stagingPath := filepath.Join(dir, "globalmount")
+	targetPath := filepath.Join(dir, "pod-1")
+	volumeID := testTnsWsUrl + "#" + testRootDataset + "#" + testDsName + "#" + testPvName + "#ab#delete"
+
+	// The staging mount and the bind mount of the pod are stale after a failover of the server
+	mounter := mount.NewFakeMounter([]mount.MountPoint{
+		{Device: "10.0.0.9:/mnt/tank/k8s/vol-1", Path: stagingPath, Type: "nfs"},
+		{Device: "10.0.0.9:/mnt/tank/k8s/vol-1", Path: targetPath, Type: "nfs"},
+	})
+	mounter.MountCheckErrors = map[string]error{stagingPath: syscall.ESTALE, targetPath: syscall.ESTALE}
+	ns := &NodeServer{Driver: &Driver{name: DefaultDriverName, volumeLocks: NewVolumeLocks()}, mounter: mounter, nfsMounts: newNfsMountRecord()}
+
+	_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+		VolumeContext: map[string]string{"tnsWsUrl": testTnsWsUrl, "nfsServer": "10.0.0.1", "nfsSharePath": "/mnt/tank/k8s/vol-1"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []mount.MountPoint{
+		{Device: "10.0.0.1:/mnt/tank/k8s/vol-1", Path: stagingPath, Type: "nfs"},
+		{Device: "10.0.0.1:/mnt/tank/k8s/vol-1", Path: targetPath, Type: "", Opts: []string{"bind"}},
+	}, mounter.MountPoints)
+	assert.Equal(t, "10.0.0.1", ns.nfsMounts.server(targetPath, mounter))
+}
+
+// hungMounter is a FakeMounter whose mount point checks of the hung paths block until release is closed
+type hungMounter struct {
+	*mount.FakeMounter
+	hung    map[string]bool
+	release chan struct{}
+}
+
+func (m *hungMounter) IsLikelyNotMountPoint(file string) (bool, error) {
+	if m.hung[file] {
+		<-m.release
+	}
+	return m.FakeMounter.IsLikelyNotMountPoint(file)
+}
+
+func TestPublishNfsVolumeHung(t *testing.T) {
+	timeout := volumeStatsTimeout
+	volumeStatsTimeout = 50 * time.Millisecond
+	defer func() { volumeStatsTimeout = timeout }()
+
+	dir := t.TempDir()
+	stagingPath := filepath.Join(dir, "globalmount")
+	targetPath := filepath.Join(dir, "pod-1")
+	volumeID := testTnsWsUrl + "#" + testRootDataset + "#" + testDsName + "#" + testPvName + "#ab#delete"
+
+	// The server of the staging mount and of the bind mount of the pod does not answer anymore
+	mounter := &hungMounter{
+		FakeMounter: mount.NewFakeMounter([]mount.MountPoint{
+			{Device: "10.0.0.9:/mnt/tank/k8s/vol-1", Path: stagingPath, Type: "nfs"},
+			{Device: "10.0.0.9:/mnt/tank/k8s/vol-1", Path: targetPath, Type: "nfs"},
+		}),
+		hung:    map[string]bool{stagingPath: true, targetPath: true},
+		release: make(chan struct{}),
+	}
+	defer close(mounter.release)
+	ns := &NodeServer{Driver: &Driver{name: DefaultDriverName, volumeLocks: NewVolumeLocks()}, mounter: mounter, nfsMounts: newNfsMountRecord(), stats: newVolumeStats()}
+
+	// The checks time out: the mounts are handled as stale, unmounted and mounted again from the other server
+	_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+		VolumeContext: map[string]string{"tnsWsUrl": testTnsWsUrl, "nfsServer": "10.0.0.1", "nfsSharePath": "/mnt/tank/k8s/vol-1"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []mount.MountPoint{
+		{Device: "10.0.0.1:/mnt/tank/k8s/vol-1", Path: stagingPath, Type: "nfs"},
+		{Device: "10.0.0.1:/mnt/tank/k8s/vol-1", Path: targetPath, Type: "", Opts: []string{"bind"}},
+	}, mounter.MountPoints)
+}
+
+func TestCleanupStaleStagingMounts(t *testing.T) {
+	timeout := volumeStatsTimeout
+	volumeStatsTimeout = 50 * time.Millisecond
+	defer func() { volumeStatsTimeout = timeout }()
+
+	dir := t.TempDir()
+	stagingPath := func(name string) string {
+		return filepath.Join(dir, "plugins/kubernetes.io/csi", DefaultDriverName, name, "globalmount")
+	}
+	mounter := mount.NewFakeMounter([]mount.MountPoint{
+		{Device: "10.0.0.1:/mnt/tank/k8s/vol-1", Path: stagingPath("stale"), Type: "nfs4"},
+		{Device: "10.0.0.2:/mnt/tank/k8s/vol-2", Path: stagingPath("hung"), Type: "nfs"},
+		{Device: "10.0.0.1:/mnt/tank/k8s/vol-3", Path: stagingPath("healthy"), Type: "nfs"},
+		{Device: "10.0.0.1:/mnt/tank/k8s/vol-4", Path: filepath.Join(dir, "pods/1234/volumes/kubernetes.io~csi/pvc-4/mount"), Type: "nfs"},
+	})
+	ns := &NodeServer{Driver: &Driver{name: DefaultDriverName}, mounter: mounter, stats: newVolumeStats()}
+
+	release := make(chan struct{})
+	defer close(release)
+	ns.stats.get = func(path string) (*volumeMetrics, error) {
+		switch path {
+		case stagingPath("stale"):
+			return nil, &os.PathError{Op: "stat", Path: path, Err: syscall.ESTALE}
+		case stagingPath("hung"):
+			<-release
+		}
+		return &volumeMetrics{}, nil
+	}
+
+	// Only the stale staging mount is unmounted, the hung one does not block the cleanup
+	ns.cleanupStaleStagingMounts()
+	paths := []string{}
+	for _, mp := range mounter.MountPoints {
+		paths = append(paths, mp.Path)
+	}
+	assert.Equal(t, []string{stagingPath("hung"), stagingPath("healthy"), filepath.Join(dir, "pods/1234/volumes/kubernetes.io~csi/pvc-4/mount")}, paths)
+}
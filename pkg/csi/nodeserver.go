@@ -15,30 +15,40 @@
 package csi
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	tns "github.com/titou10/csi-driver-truenas-scale/pkg/tns"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
-	"k8s.io/kubernetes/pkg/volume"
 	mount "k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
 )
 
 // NodeServer driver
 type NodeServer struct {
-	Driver  *Driver
-	mounter mount.Interface
+	Driver    *Driver
+	mounter   mount.Interface
+	exec      utilexec.Interface
+	iscsi     *iscsiInitiator
+	nvmeof    *nvmeofInitiator
+	nfsMounts *nfsMountRecord
+	nfsProbe  nfsProbe
+	stats     *volumeStats
+	mountExec utilexec.Interface // Runs mount(8) for the NFS and SMB shares, nil: mounted by the mounter
 	csi.UnimplementedNodeServer
 }
 
 // NodePublishVolume mount the volume
-func (ns *NodeServer) NodePublishVolume(_ context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	volCap := req.GetVolumeCapability()
 	if volCap == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
@@ -59,11 +69,19 @@ func (ns *NodeServer) NodePublishVolume(_ context.Context, req *csi.NodePublishV
 	defer ns.Driver.volumeLocks.Release(lockKey)
 
 	mountOptions := volCap.GetMount().GetMountFlags()
+	if err := ns.Driver.mountOptionsPolicy.check(mountOptions); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 	if req.GetReadonly() {
 		mountOptions = append(mountOptions, "ro")
 	}
 
-	var tnsWsUrl, nfsSharePath string
+	protocol := getVolumeProtocol(volumeID)
+	if isBlockProtocol(protocol) {
+		return ns.publishBlockVolume(ctx, req, mountOptions)
+	}
+
+	var tnsWsUrl, smbShareName string
 
 	mountPermissions := ns.Driver.mountPermissions
 	for k, v := range req.GetVolumeContext() {
@@ -71,8 +89,8 @@ func (ns *NodeServer) NodePublishVolume(_ context.Context, req *csi.NodePublishV
 
 		case paramTnsWsUrl:
 			tnsWsUrl = v
-		case paramNfsSharePath:
-			nfsSharePath = v
+		case paramSmbShareName:
+			smbShareName = v
 
 		// case mountOptionsField:
 		// 	if v != "" {
@@ -91,19 +109,63 @@ func (ns *NodeServer) NodePublishVolume(_ context.Context, req *csi.NodePublishV
 	if tnsWsUrl == "" {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%v is a required parameter", paramTnsWsUrl))
 	}
-	if nfsSharePath == "" {
-		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%v is a required parameter", paramNfsSharePath))
-	}
 
-	server := getServerFromSource(tnsWsUrl)
+	stagingPath := req.GetStagingTargetPath()
+	var source, fsType, server string
+	var sensitiveOptions []string
+	if protocol == protocolSMB {
+		if smbShareName == "" {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%v is a required parameter", paramSmbShareName))
+		}
+		host, err := getTnsHost(tnsWsUrl)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		source = fmt.Sprintf("//%s/%s", getServerFromSource(host), smbShareName)
+		fsType = "cifs"
+		// The credentials are not logged
+		sensitiveOptions = getSmbCredentialsOptions(req.GetSecrets())
+	} else if stale := ns.isStale(stagingPath); stale || ns.isStaged(stagingPath) {
+		if stale {
+			// The server does not know the share mounted anymore, eg after a failover of Truenas Scale
+			if err := ns.restageNfsVolume(ctx, volumeID, stagingPath, volCap, req.GetVolumeContext()); err != nil {
+				return nil, err
+			}
+		}
+		// The share is mounted once on the node by NodeStageVolume
+		source = stagingPath
+		server = ns.nfsMounts.server(stagingPath, ns.mounter)
+		mountOptions = []string{"bind"}
+		if req.GetReadonly() {
+			mountOptions = append(mountOptions, "ro")
+		}
+	} else {
+		// Not staged, eg a volume staged by a previous version of the driver: the share is mounted for the pod
+		share, err := getNfsShareFromContext(volumeID, req.GetVolumeContext())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if server, err = selectNfsServer(ctx, share.servers, getNfsPort(mountOptions), ns.nfsProbe); err != nil {
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+		source = share.source(server)
+		fsType = "nfs"
+	}
 
-	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
+	notMnt, err := ns.isLikelyNotMountPoint(targetPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			if err := os.MkdirAll(targetPath, os.FileMode(mountPermissions)); err != nil {
 				return nil, status.Error(codes.Internal, err.Error())
 			}
 			notMnt = true
+		} else if isStaleMount(err) {
+			klog.Warningf("NodePublishVolume: stale mount of volume %s on %s, mounting it again: %v", volumeID, targetPath, err)
+			if err := ns.unmountStale(targetPath); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to unmount target %q: %v", targetPath, err)
+			}
+			ns.nfsMounts.forget(targetPath)
+			notMnt = true
 		} else {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
@@ -112,8 +174,6 @@ func (ns *NodeServer) NodePublishVolume(_ context.Context, req *csi.NodePublishV
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
-	source := fmt.Sprintf("%s:%s", server, nfsSharePath)
-
 	// ******************************
 	// klog.V(3).Infof(">>>> PUB >>>>>>>>>>>>> %s %s %s", targetPath, mountOptions, volumeID)
 	// klog.V(3).Infof(">>>> server      : %s", server)
@@ -125,18 +185,8 @@ func (ns *NodeServer) NodePublishVolume(_ context.Context, req *csi.NodePublishV
 	// ******************************
 
 	klog.V(2).Infof("NodePublishVolume: volumeID(%v) source(%s) targetPath(%s) mountflags(%v)", volumeID, source, targetPath, mountOptions)
-	execFunc := func() error {
-		return ns.mounter.Mount(source, targetPath, "nfs", mountOptions)
-	}
-	timeoutFunc := func() error { return fmt.Errorf("time out") }
-	if err := WaitUntilTimeout(90*time.Second, execFunc, timeoutFunc); err != nil {
-		if os.IsPermission(err) {
-			return nil, status.Error(codes.PermissionDenied, err.Error())
-		}
-		if strings.Contains(err.Error(), "invalid argument") {
-			return nil, status.Error(codes.InvalidArgument, err.Error())
-		}
-		return nil, status.Error(codes.Internal, err.Error())
+	if err := ns.mountWithTimeout(ctx, source, targetPath, fsType, mountOptions, sensitiveOptions); err != nil {
+		return nil, err
 	}
 
 	if mountPermissions > 0 {
@@ -147,6 +197,9 @@ func (ns *NodeServer) NodePublishVolume(_ context.Context, req *csi.NodePublishV
 		klog.V(2).Infof("skip chmod on targetPath(%s) since mountPermissions is set as 0", targetPath)
 	}
 
+	if server != "" {
+		ns.nfsMounts.record(targetPath, server)
+	}
 	klog.V(2).Infof("volume(%s) mount %s on %s succeeded", volumeID, source, targetPath)
 	return &csi.NodePublishVolumeResponse{}, nil
 }
@@ -168,19 +221,15 @@ func (ns *NodeServer) NodeUnpublishVolume(_ context.Context, req *csi.NodeUnpubl
 	}
 	defer ns.Driver.volumeLocks.Release(lockKey)
 
-	klog.V(2).Infof("NodeUnpublishVolume: unmounting volume %s on %s", volumeID, targetPath)
-	var err error
-	extensiveMountPointCheck := true
-	forceUnmounter, ok := ns.mounter.(mount.MounterForceUnmounter)
-	if ok {
-		klog.V(2).Infof("force unmount %s on %s", volumeID, targetPath)
-		err = mount.CleanupMountWithForce(targetPath, forceUnmounter, extensiveMountPointCheck, 30*time.Second)
+	if server := ns.nfsMounts.server(targetPath, ns.mounter); server != "" {
+		klog.V(2).Infof("NodeUnpublishVolume: unmounting volume %s from NFS server %s on %s", volumeID, server, targetPath)
 	} else {
-		err = mount.CleanupMountPoint(targetPath, ns.mounter, extensiveMountPointCheck)
+		klog.V(2).Infof("NodeUnpublishVolume: unmounting volume %s on %s", volumeID, targetPath)
 	}
-	if err != nil {
+	if err := ns.cleanupMountPoint(targetPath); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to unmount target %q: %v", targetPath, err)
 	}
+	ns.nfsMounts.forget(targetPath)
 	klog.V(2).Infof("NodeUnpublishVolume: unmount volume %s on %s successfully", volumeID, targetPath)
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
@@ -215,17 +264,46 @@ func (ns *NodeServer) NodeGetVolumeStats(_ context.Context, req *csi.NodeGetVolu
 		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats volume path was empty")
 	}
 
-	if _, err := os.Lstat(req.VolumePath); err != nil {
+	result, err := ns.stats.stat(req.VolumePath, volumeStatsTimeout)
+	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, status.Errorf(codes.NotFound, "path %s does not exist", req.VolumePath)
 		}
-		return nil, status.Errorf(codes.Internal, "failed to stat file %s: %v", req.VolumePath, err)
-	}
-
-	volumeMetrics, err := volume.NewMetricsStatFS(req.VolumePath).GetMetrics()
-	if err != nil {
+		// A hung or stale mount is reported to kubelet instead of failing or blocking the call
+		if errors.Is(err, errVolumeStatsTimeout) || mount.IsCorruptedMnt(err) {
+			message := fmt.Sprintf("volume %s mounted on %s does not answer: %v", req.VolumeId, req.VolumePath, err)
+			if server := ns.nfsMounts.server(req.VolumePath, ns.mounter); server != "" {
+				message = fmt.Sprintf("%s (NFS server %s)", message, server)
+			}
+			klog.Warning(message)
+			return &csi.NodeGetVolumeStatsResponse{
+				VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: message},
+			}, nil
+		}
+		if server := ns.nfsMounts.server(req.VolumePath, ns.mounter); server != "" {
+			return nil, status.Errorf(codes.Internal, "failed to get metrics from NFS server %s: %v", server, err)
+		}
 		return nil, status.Errorf(codes.Internal, "failed to get metrics: %v", err)
 	}
+	volumeMetrics := result.metrics
+	condition := &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}
+
+	if result.block {
+		// Raw block volume: only the size is known
+		capacity, ok := volumeMetrics.Capacity.AsInt64()
+		if !ok {
+			return nil, status.Errorf(codes.Internal, "failed to transform volume capacity size(%v)", volumeMetrics.Capacity)
+		}
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: []*csi.VolumeUsage{
+				{
+					Unit:  csi.VolumeUsage_BYTES,
+					Total: capacity,
+				},
+			},
+			VolumeCondition: condition,
+		}, nil
+	}
 
 	available, ok := volumeMetrics.Available.AsInt64()
 	if !ok {
@@ -268,22 +346,560 @@ func (ns *NodeServer) NodeGetVolumeStats(_ context.Context, req *csi.NodeGetVolu
 				Used:      inodesUsed,
 			},
 		},
+		VolumeCondition: condition,
 	}
 
-	return &resp, err
+	return &resp, nil
 }
 
-// NodeUnstageVolume unstage volume
-func (ns *NodeServer) NodeUnstageVolume(_ context.Context, _ *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+// NodeStageVolume stage volume
+// The NFS share of the volume is mounted on the staging path, SMB volumes are mounted by NodePublishVolume.
+// The node connects to the target of the block (iSCSI, NVMe-oF) volumes which, unless they are raw block volumes,
+// are formatted if needed and mounted on the staging path
+func (ns *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	stagingPath := req.GetStagingTargetPath()
+	if len(stagingPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path not provided")
+	}
+	volCap := req.GetVolumeCapability()
+	if volCap == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+	if err := ns.Driver.mountOptionsPolicy.check(volCap.GetMount().GetMountFlags()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// Truenas Scale locks the encrypted datasets after a reboot, when their key is not kept by Truenas Scale
+	if err := ns.unlockVolume(ctx, volumeID, req.GetVolumeContext(), req.GetSecrets()); err != nil {
+		return nil, err
+	}
+
+	protocol := getVolumeProtocol(volumeID)
+	if protocol == protocolNFS {
+		return ns.stageNfsVolume(ctx, req)
+	}
+	if !isBlockProtocol(protocol) {
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	if acquired := ns.Driver.volumeLocks.TryAcquire(volumeID); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer ns.Driver.volumeLocks.Release(volumeID)
+
+	device, err := ns.attachBlockVolume(ctx, protocol, req.GetVolumeContext())
+	if err != nil {
+		return nil, err
+	}
+
+	if volCap.GetBlock() != nil {
+		// The device is bind mounted by NodePublishVolume
+		klog.V(2).Infof("NodeStageVolume: volume %s attached on %s", volumeID, device)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	notMnt, err := ns.isLikelyNotMountPoint(stagingPath)
+	switch {
+	case err == nil:
+	case isStaleMount(err):
+		klog.Warningf("NodeStageVolume: stale mount of volume %s on %s, mounting it again: %v", volumeID, stagingPath, err)
+		if err := ns.unmountStale(stagingPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to unmount staging target %q: %v", stagingPath, err)
+		}
+		notMnt = true
+	case os.IsNotExist(err):
+		if err := os.MkdirAll(stagingPath, 0750); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		notMnt = true
+	default:
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !notMnt {
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	fsType := volCap.GetMount().GetFsType()
+	if fsType == "" {
+		fsType = defaultFsType
+	}
+	mountOptions := volCap.GetMount().GetMountFlags()
+
+	klog.V(2).Infof("NodeStageVolume: volumeID(%v) device(%s) stagingPath(%s) fsType(%s) mountflags(%v)", volumeID, device, stagingPath, fsType, mountOptions)
+	formatter := &mount.SafeFormatAndMount{Interface: ns.mounter, Exec: ns.exec}
+	if err := formatter.FormatAndMount(device, stagingPath, fsType, mountOptions); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to format and mount %s on %s: %v", device, stagingPath, err)
+	}
+
+	klog.V(2).Infof("volume(%s) mount %s on %s succeeded", volumeID, device, stagingPath)
+	return &csi.NodeStageVolumeResponse{}, nil
 }
 
-// NodeStageVolume stage volume
-func (ns *NodeServer) NodeStageVolume(_ context.Context, _ *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+// NodeUnstageVolume unstage volume
+func (ns *NodeServer) NodeUnstageVolume(_ context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	stagingPath := req.GetStagingTargetPath()
+	if len(stagingPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+
+	nfsVol, err := getNfsVolFromID(volumeID)
+	if err != nil || !isBlockProtocol(nfsVol.protocol) {
+		// The SMB volumes are not staged: there is nothing to unmount
+		return ns.unstageNfsVolume(volumeID, stagingPath)
+	}
+
+	if acquired := ns.Driver.volumeLocks.TryAcquire(volumeID); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer ns.Driver.volumeLocks.Release(volumeID)
+
+	klog.V(2).Infof("NodeUnstageVolume: unmounting volume %s on %s", volumeID, stagingPath)
+	if err := mount.CleanupMountPoint(stagingPath, ns.mounter, true); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unmount staging target %q: %v", stagingPath, err)
+	}
+
+	if err := ns.detachBlockVolume(nfsVol.protocol, nfsVol.pvName); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	klog.V(2).Infof("NodeUnstageVolume: volume %s detached successfully", volumeID)
+	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
 // NodeExpandVolume node expand volume
-func (ns *NodeServer) NodeExpandVolume(_ context.Context, _ *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+// The zvol of a block volume has been expanded by the controller: the device is rescanned and the filesystem resized
+func (ns *NodeServer) NodeExpandVolume(_ context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	volumePath := req.GetVolumePath()
+	if len(volumePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
+	}
+
+	nfsVol, err := getNfsVolFromID(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "failed to get volume for id %v: %v", volumeID, err)
+	}
+	if !isBlockProtocol(nfsVol.protocol) {
+		// Nothing to do on the node, the quota of the dataset has been updated
+		return &csi.NodeExpandVolumeResponse{}, nil
+	}
+
+	if acquired := ns.Driver.volumeLocks.TryAcquire(volumeID); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer ns.Driver.volumeLocks.Release(volumeID)
+
+	if err := ns.rescanBlockVolume(nfsVol.protocol, nfsVol.pvName); err != nil {
+		return nil, err
+	}
+
+	if req.GetVolumeCapability().GetBlock() != nil {
+		return &csi.NodeExpandVolumeResponse{CapacityBytes: req.GetCapacityRange().GetRequiredBytes()}, nil
+	}
+
+	mountPath := req.GetStagingTargetPath()
+	if mountPath == "" {
+		mountPath = volumePath
+	}
+	device, _, err := mount.GetDeviceNameFromMount(ns.mounter, mountPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get device of %s: %v", mountPath, err)
+	}
+	if device == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s is not mounted", mountPath)
+	}
+
+	if _, err := mount.NewResizeFs(ns.exec).Resize(device, mountPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to resize the filesystem of %s: %v", device, err)
+	}
+
+	klog.V(2).Infof("NodeExpandVolume(%s) successfully, device: %s", volumeID, device)
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: req.GetCapacityRange().GetRequiredBytes()}, nil
+}
+
+// unlockVolume unlocks the dataset of a volume encrypted with a passphrase or a key. The api key and the passphrase
+// or the key are read from the node stage secret. It does nothing for the other volumes
+func (ns *NodeServer) unlockVolume(ctx context.Context, volumeID string, volumeContext map[string]string, secrets map[string]string) error {
+	opts, err := getEncryptionOptions(volumeContext)
+	if err != nil {
+		return err
+	}
+	if opts == nil || opts.keySource == encryptionKeySourceGenerated {
+		return nil
+	}
+
+	if len(secrets) == 0 {
+		return status.Errorf(codes.FailedPrecondition, "volume %s is encrypted with a %s: csi.storage.k8s.io/node-stage-secret-name must be set in the storage class", volumeID, opts.keySource)
+	}
+	creds, err := getTnsCredentials(secrets)
+	if err != nil {
+		return err
+	}
+	passphrase, key, err := getEncryptionSecret(opts.keySource, secrets)
+	if err != nil {
+		return err
+	}
+	vol, err := getNfsVolFromID(volumeID)
+	if err != nil {
+		return status.Error(codes.NotFound, err.Error())
+	}
+
+	if csiErr := tns.CsiDatasetUnlock(ctx, vol.tnsWsUrl, creds, vol.dsName, passphrase, key); csiErr != nil {
+		klog.Errorf("CsiDatasetUnlock error: %v", csiErr)
+		return status.Error(csiErr.Code, csiErr.Err.Error())
+	}
+	return nil
+}
+
+// publishBlockVolume bind mounts the device (raw block volume) or the staging path of a block volume on the target path
+func (ns *NodeServer) publishBlockVolume(_ context.Context, req *csi.NodePublishVolumeRequest, mountOptions []string) (*csi.NodePublishVolumeResponse, error) {
+	targetPath := req.GetTargetPath()
+	source := req.GetStagingTargetPath()
+
+	if req.GetVolumeCapability().GetBlock() != nil {
+		var err error
+		source, err = findBlockDevice(getVolumeProtocol(req.GetVolumeId()), req.GetVolumeContext())
+		if err != nil {
+			return nil, err
+		}
+
+		// The target of a block volume is a file
+		if err := os.MkdirAll(filepath.Dir(targetPath), 0750); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		file, err := os.OpenFile(targetPath, os.O_CREATE, 0660)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		file.Close()
+	} else {
+		if len(source) == 0 {
+			return nil, status.Error(codes.FailedPrecondition, "Staging target path not provided")
+		}
+		if err := os.MkdirAll(targetPath, 0750); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	notMnt, err := ns.isLikelyNotMountPoint(targetPath)
+	if isStaleMount(err) {
+		klog.Warningf("NodePublishVolume: stale mount of volume %s on %s, mounting it again: %v", req.GetVolumeId(), targetPath, err)
+		if err := ns.unmountStale(targetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to unmount target %q: %v", targetPath, err)
+		}
+		notMnt, err = true, nil
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !notMnt {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	mountOptions = append(mountOptions, "bind")
+	klog.V(2).Infof("NodePublishVolume: volumeID(%v) source(%s) targetPath(%s) mountflags(%v)", req.GetVolumeId(), source, targetPath, mountOptions)
+	if err := ns.mounter.Mount(source, targetPath, "", mountOptions); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to bind mount %s on %s: %v", source, targetPath, err)
+	}
+
+	klog.V(2).Infof("volume(%s) mount %s on %s succeeded", req.GetVolumeId(), source, targetPath)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// stageNfsVolume mounts the NFS share of the volume on the staging path, once per node
+func (ns *NodeServer) stageNfsVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+
+	if acquired := ns.Driver.volumeLocks.TryAcquire(volumeID); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer ns.Driver.volumeLocks.Release(volumeID)
+
+	if err := ns.mountNfsStagingPath(ctx, volumeID, req.GetStagingTargetPath(), req.GetVolumeCapability(), req.GetVolumeContext()); err != nil {
+		return nil, err
+	}
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// restageNfsVolume mounts again the NFS share of a volume whose staging mount is stale
+func (ns *NodeServer) restageNfsVolume(ctx context.Context, volumeID string, stagingPath string, volCap *csi.VolumeCapability, volumeContext map[string]string) error {
+	if acquired := ns.Driver.volumeLocks.TryAcquire(volumeID); !acquired {
+		return status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer ns.Driver.volumeLocks.Release(volumeID)
+
+	return ns.mountNfsStagingPath(ctx, volumeID, stagingPath, volCap, volumeContext)
+}
+
+// mountNfsStagingPath mounts the NFS share of the volume on the staging path. A stale mount, eg after a restart
+// or a failover of the server, is unmounted and mounted again
+func (ns *NodeServer) mountNfsStagingPath(ctx context.Context, volumeID string, stagingPath string, volCap *csi.VolumeCapability, volumeContext map[string]string) error {
+	notMnt, err := ns.isLikelyNotMountPoint(stagingPath)
+	switch {
+	case err == nil && !notMnt:
+		return nil
+	case err == nil:
+	case os.IsNotExist(err):
+	case isStaleMount(err):
+		klog.Warningf("NodeStageVolume: stale mount of volume %s on %s, mounting it again: %v", volumeID, stagingPath, err)
+		if err := ns.unmountStale(stagingPath); err != nil {
+			return status.Errorf(codes.Internal, "failed to unmount staging target %q: %v", stagingPath, err)
+		}
+		ns.nfsMounts.forget(stagingPath)
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := os.MkdirAll(stagingPath, 0750); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	share, err := getNfsShareFromContext(volumeID, volumeContext)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	// The pods get read-only bind mounts when needed, the staging mount is read-only only for read-only volumes
+	mountOptions := volCap.GetMount().GetMountFlags()
+	if isReadOnlyAccessMode(volCap) {
+		mountOptions = append(mountOptions, "ro")
+	}
+	server, err := selectNfsServer(ctx, share.servers, getNfsPort(mountOptions), ns.nfsProbe)
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	source := share.source(server)
+
+	klog.V(2).Infof("NodeStageVolume: volumeID(%v) source(%s) stagingPath(%s) mountflags(%v)", volumeID, source, stagingPath, mountOptions)
+	if err := ns.mountWithTimeout(ctx, source, stagingPath, "nfs", mountOptions, nil); err != nil {
+		return err
+	}
+
+	ns.nfsMounts.record(stagingPath, server)
+	klog.V(2).Infof("volume(%s) mount %s on %s succeeded", volumeID, source, stagingPath)
+	return nil
+}
+
+// unstageNfsVolume unmounts the NFS share of the volume from the staging path, once it is not bind mounted anymore
+func (ns *NodeServer) unstageNfsVolume(volumeID string, stagingPath string) (*csi.NodeUnstageVolumeResponse, error) {
+	if acquired := ns.Driver.volumeLocks.TryAcquire(volumeID); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer ns.Driver.volumeLocks.Release(volumeID)
+
+	// The references of a stale mount cannot be read: kubelet only unstages the volumes that are not published
+	if notMnt, err := ns.isLikelyNotMountPoint(stagingPath); err == nil && !notMnt {
+		refs, err := ns.mounter.GetMountRefs(stagingPath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get the mount references of %q: %v", stagingPath, err)
+		}
+		if len(refs) > 0 {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s is still mounted on %v", volumeID, refs)
+		}
+	}
+
+	klog.V(2).Infof("NodeUnstageVolume: unmounting volume %s on %s", volumeID, stagingPath)
+	if err := ns.cleanupMountPoint(stagingPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unmount staging target %q: %v", stagingPath, err)
+	}
+	ns.nfsMounts.forget(stagingPath)
+
+	klog.V(2).Infof("NodeUnstageVolume: unmount volume %s on %s successfully", volumeID, stagingPath)
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// isStaged returns true when the staging path is a mount point that is not stale
+func (ns *NodeServer) isStaged(stagingPath string) bool {
+	if stagingPath == "" {
+		return false
+	}
+	notMnt, err := ns.isLikelyNotMountPoint(stagingPath)
+	return err == nil && !notMnt
+}
+
+// isStale returns true when the path is a mount point whose server does not know the share mounted anymore
+// or does not answer
+func (ns *NodeServer) isStale(path string) bool {
+	if path == "" {
+		return false
+	}
+	_, err := ns.isLikelyNotMountPoint(path)
+	if isStaleMount(err) {
+		klog.Warningf("stale mount on %s: %v", path, err)
+		return true
+	}
+	return false
+}
+
+// isLikelyNotMountPoint checks the mount point with a timeout: the stat of a hard NFS mount whose server
+// does not answer blocks until it is back
+func (ns *NodeServer) isLikelyNotMountPoint(path string) (bool, error) {
+	return ns.stats.isLikelyNotMountPoint(ns.mounter, path, volumeStatsTimeout)
+}
+
+// cleanupStaleStagingMounts unmounts the stale NFS staging mounts of the driver left by a previous run of the
+// node plugin, eg when the server has been replaced in the meantime: they are mounted again by NodeStageVolume
+// or NodePublishVolume. The mounts whose server does not answer are left as they are, they may come back
+func (ns *NodeServer) cleanupStaleStagingMounts() {
+	mountPoints, err := ns.mounter.List()
+	if err != nil {
+		klog.Warningf("failed to list the mount points: %v", err)
+		return
+	}
+	for _, mp := range mountPoints {
+		if !strings.HasPrefix(mp.Type, "nfs") || !isStagingPath(mp.Path, ns.Driver.name) {
+			continue
+		}
+		_, err := ns.stats.stat(mp.Path, volumeStatsTimeout)
+		if errors.Is(err, errVolumeStatsTimeout) {
+			klog.Warningf("staging mount %s of %s does not answer: %v", mp.Path, mp.Device, err)
+			continue
+		}
+		if err == nil || !mount.IsCorruptedMnt(err) {
+			continue
+		}
+		klog.Warningf("unmounting stale staging mount %s of %s: %v", mp.Path, mp.Device, err)
+		if err := ns.unmountStale(mp.Path); err != nil {
+			klog.Errorf("failed to unmount stale staging mount %s: %v", mp.Path, err)
+		}
+	}
+}
+
+// cleanupMountPoint unmounts the path, forcing the unmount of the unreachable NFS servers when possible,
+// and removes it
+func (ns *NodeServer) cleanupMountPoint(path string) error {
+	extensiveMountPointCheck := true
+	if forceUnmounter, ok := ns.mounter.(mount.MounterForceUnmounter); ok {
+		klog.V(2).Infof("force unmount %s", path)
+		return mount.CleanupMountWithForce(path, forceUnmounter, extensiveMountPointCheck, 30*time.Second)
+	}
+	return mount.CleanupMountPoint(path, ns.mounter, extensiveMountPointCheck)
+}
+
+// unmountStale unmounts a stale mount, whose server does not answer anymore
+func (ns *NodeServer) unmountStale(path string) error {
+	if forceUnmounter, ok := ns.mounter.(mount.MounterForceUnmounter); ok {
+		return forceUnmounter.UnmountWithForce(path, 30*time.Second)
+	}
+	return ns.mounter.Unmount(path)
+}
+
+// attachBlockVolume connects the node to the target of the block volume and returns its device
+func (ns *NodeServer) attachBlockVolume(ctx context.Context, protocol string, volumeContext map[string]string) (string, error) {
+	var device string
+	var err error
+
+	switch protocol {
+	case protocolISCSI:
+		var target *iscsiTarget
+		if target, err = getIscsiTargetFromContext(volumeContext); err != nil {
+			return "", status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err = ns.iscsi.login(target); err != nil {
+			return "", status.Error(codes.Internal, err.Error())
+		}
+		device, err = waitForIscsiDevice(ctx, target)
+	case protocolNVMEOF:
+		var target *nvmeofTarget
+		if target, err = getNvmeofTargetFromContext(volumeContext); err != nil {
+			return "", status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err = ns.nvmeof.connect(target); err != nil {
+			return "", status.Error(codes.Internal, err.Error())
+		}
+		device, err = waitForNvmeofDevice(ctx, target)
+	default:
+		return "", status.Errorf(codes.InvalidArgument, "%s is not a block protocol", protocol)
+	}
+
+	if err != nil {
+		return "", status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return device, nil
+}
+
+// findBlockDevice returns the device of a staged block volume
+func findBlockDevice(protocol string, volumeContext map[string]string) (string, error) {
+	var device, target string
+	var err error
+
+	switch protocol {
+	case protocolISCSI:
+		var t *iscsiTarget
+		if t, err = getIscsiTargetFromContext(volumeContext); err != nil {
+			return "", status.Error(codes.InvalidArgument, err.Error())
+		}
+		target = "iSCSI target " + t.iqn
+		device, err = findIscsiDevice(t.iqn, t.lun)
+	case protocolNVMEOF:
+		var t *nvmeofTarget
+		if t, err = getNvmeofTargetFromContext(volumeContext); err != nil {
+			return "", status.Error(codes.InvalidArgument, err.Error())
+		}
+		target = "NVMe subsystem " + t.nqn
+		device, err = findNvmeofDevice(t.nqn, t.nsid)
+	default:
+		return "", status.Errorf(codes.InvalidArgument, "%s is not a block protocol", protocol)
+	}
+
+	if err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	if device == "" {
+		return "", status.Errorf(codes.FailedPrecondition, "device of %s not found: volume not staged", target)
+	}
+	return device, nil
+}
+
+// detachBlockVolume disconnects the node from the target of the block volume, named after the pv
+func (ns *NodeServer) detachBlockVolume(protocol string, pvName string) error {
+	switch protocol {
+	case protocolISCSI:
+		iqn, err := ns.iscsi.sessionIqn(pvName)
+		if err != nil || iqn == "" {
+			return err
+		}
+		return ns.iscsi.logout(iqn)
+	case protocolNVMEOF:
+		nqn, err := subsystemNqn(pvName)
+		if err != nil || nqn == "" {
+			return err
+		}
+		return ns.nvmeof.disconnect(nqn)
+	}
+	return nil
+}
+
+// rescanBlockVolume makes the kernel read the size of the device of the block volume again
+func (ns *NodeServer) rescanBlockVolume(protocol string, pvName string) error {
+	var name string
+	var err error
+
+	switch protocol {
+	case protocolISCSI:
+		if name, err = ns.iscsi.sessionIqn(pvName); err == nil && name != "" {
+			err = ns.iscsi.rescan(name)
+		}
+	case protocolNVMEOF:
+		if name, err = subsystemNqn(pvName); err == nil && name != "" {
+			err = ns.nvmeof.rescan(name)
+		}
+	}
+
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if name == "" {
+		return status.Errorf(codes.FailedPrecondition, "volume %s is not attached to this node", pvName)
+	}
+	return nil
 }
@@ -0,0 +1,232 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	"k8s.io/klog/v2"
+	utilexec "k8s.io/utils/exec"
+)
+
+// The NVMe-oF connections of the node are managed with nvme-cli, over TCP
+// Each volume has its own subsystem, so the node connects when the volume is staged and disconnects when it is unstaged
+// The subsystems and their devices are found in sysfs:
+//   /sys/class/nvme-subsystem/nvme-subsys0/subsysnqn
+//   /sys/class/nvme-subsystem/nvme-subsys0/nvme0            controller
+//   /sys/class/nvme-subsystem/nvme-subsys0/nvme0n1/nsid     namespace, with native multipath
+//   /sys/class/nvme-subsystem/nvme-subsys0/nvme0/nvme0n1    namespace, without native multipath
+
+var (
+	nvmeSubsystemDir = "/sys/class/nvme-subsystem"
+	nvmeDevDir       = "/dev"
+)
+
+var (
+	nvmeControllerRegexp = regexp.MustCompile(`^nvme[0-9]+$`)
+	nvmeNamespaceRegexp  = regexp.MustCompile(`^nvme[0-9]+n[0-9]+$`)
+)
+
+// nvmeofTarget is the subsystem of a volume, from the volume context set by CreateVolume
+type nvmeofTarget struct {
+	address string // host:port
+	nqn     string
+	nsid    int
+}
+
+// getNvmeofTargetFromContext returns the NVMe-oF subsystem from the volume context (case-insensitive)
+func getNvmeofTargetFromContext(volumeContext map[string]string) (*nvmeofTarget, error) {
+	var tnsWsUrl, address, nqn, nsid string
+	for k, v := range volumeContext {
+		switch strings.ToLower(k) {
+		case paramTnsWsUrl:
+			tnsWsUrl = v
+		case paramNvmeofAddress:
+			address = v
+		case paramNvmeofNqn:
+			nqn = v
+		case paramNvmeofNsid:
+			nsid = v
+		}
+	}
+
+	if nqn == "" {
+		return nil, fmt.Errorf("%v is a required parameter", paramNvmeofNqn)
+	}
+	nsID, err := strconv.Atoi(nsid)
+	if err != nil || nsID <= 0 {
+		return nil, fmt.Errorf("invalid %v %q", paramNvmeofNsid, nsid)
+	}
+	// The storage class may also set the address, without the port
+	address, err = getTargetAddress(tnsWsUrl, address, defaultNvmeofPort)
+	if err != nil {
+		return nil, err
+	}
+
+	return &nvmeofTarget{address: address, nqn: nqn, nsid: nsID}, nil
+}
+
+// nvmeofInitiator runs nvme-cli on the node
+type nvmeofInitiator struct {
+	exec utilexec.Interface
+}
+
+func (n *nvmeofInitiator) run(args ...string) error {
+	klog.V(4).Infof("Running nvme %v", args)
+	out, err := n.exec.Command("nvme", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nvme %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// connect connects to the subsystem. It does nothing when the node is already connected
+func (n *nvmeofInitiator) connect(target *nvmeofTarget) error {
+	subsysDir, err := findNvmeofSubsystem(func(nqn string) bool { return nqn == target.nqn })
+	if err != nil {
+		return err
+	}
+	if subsysDir != "" {
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(target.address)
+	if err != nil {
+		return err
+	}
+	if err := n.run("connect", "--transport=tcp", "--traddr="+host, "--trsvcid="+port, "--nqn="+target.nqn); err != nil {
+		return err
+	}
+	klog.V(2).Infof("Connected to NVMe subsystem %s on %s", target.nqn, target.address)
+	return nil
+}
+
+// disconnect disconnects all the controllers of the subsystem
+func (n *nvmeofInitiator) disconnect(nqn string) error {
+	if err := n.run("disconnect", "--nqn="+nqn); err != nil {
+		return err
+	}
+	klog.V(2).Infof("Disconnected from NVMe subsystem %s", nqn)
+	return nil
+}
+
+// rescan makes the kernel read the size of the namespaces of the subsystem again, after an expansion
+func (n *nvmeofInitiator) rescan(nqn string) error {
+	subsysDir, err := findNvmeofSubsystem(func(subsysnqn string) bool { return subsysnqn == nqn })
+	if err != nil {
+		return err
+	}
+	if subsysDir == "" {
+		return fmt.Errorf("not connected to NVMe subsystem %s", nqn)
+	}
+
+	entries, err := os.ReadDir(subsysDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if nvmeControllerRegexp.MatchString(entry.Name()) {
+			if err := n.run("ns-rescan", filepath.Join(nvmeDevDir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// subsystemNqn returns the NQN of the subsystem named subsysName the node is connected to, "" when there is none
+func subsystemNqn(subsysName string) (string, error) {
+	subsysDir, err := findNvmeofSubsystem(func(nqn string) bool { return strings.HasSuffix(nqn, ":"+subsysName) })
+	if err != nil || subsysDir == "" {
+		return "", err
+	}
+	return readSysfsValue(filepath.Join(subsysDir, "subsysnqn"))
+}
+
+// findNvmeofSubsystem returns the sysfs directory of the first subsystem whose NQN matches, "" when there is none
+func findNvmeofSubsystem(match func(nqn string) bool) (string, error) {
+	entries, err := os.ReadDir(nvmeSubsystemDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// nvme modules not loaded
+			return "", nil
+		}
+		return "", err
+	}
+	for _, entry := range entries {
+		subsysDir := filepath.Join(nvmeSubsystemDir, entry.Name())
+		nqn, err := readSysfsValue(filepath.Join(subsysDir, "subsysnqn"))
+		if err != nil {
+			continue
+		}
+		if match(nqn) {
+			return subsysDir, nil
+		}
+	}
+	return "", nil
+}
+
+// findNvmeofDevice returns the device of the namespace, "" when it is not there
+func findNvmeofDevice(nqn string, nsid int) (string, error) {
+	subsysDir, err := findNvmeofSubsystem(func(subsysnqn string) bool { return subsysnqn == nqn })
+	if err != nil || subsysDir == "" {
+		return "", err
+	}
+
+	// With native multipath, the namespaces are in the subsystem. Otherwise, in the controllers
+	for _, pattern := range []string{"nvme*n*", "nvme*/nvme*n*"} {
+		matches, err := filepath.Glob(filepath.Join(subsysDir, pattern))
+		if err != nil {
+			return "", err
+		}
+		for _, match := range matches {
+			name := filepath.Base(match)
+			if !nvmeNamespaceRegexp.MatchString(name) {
+				// eg nvme0c0n1, the path of a multipath device
+				continue
+			}
+			value, err := readSysfsValue(filepath.Join(match, "nsid"))
+			if err != nil {
+				continue
+			}
+			if value == strconv.Itoa(nsid) {
+				return filepath.Join(nvmeDevDir, name), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// waitForNvmeofDevice waits for the device of the namespace to appear after the connection
+func waitForNvmeofDevice(ctx context.Context, target *nvmeofTarget) (string, error) {
+	return waitForDevice(ctx, func() (string, error) {
+		return findNvmeofDevice(target.nqn, target.nsid)
+	}, fmt.Sprintf("namespace %d of NVMe subsystem %s", target.nsid, target.nqn))
+}
+
+func readSysfsValue(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
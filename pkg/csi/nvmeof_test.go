@@ -0,0 +1,135 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testNqn = "nqn.2011-06.com.truenas:uuid:1234:" + testPvName
+
+// fakeNvmeSysfs creates the sysfs and dev directories with a subsystem connected to the given nqn
+func fakeNvmeSysfs(t *testing.T, nqn string, multipath bool) string {
+	sysDir := t.TempDir()
+	devDir := t.TempDir()
+
+	oldSubsystemDir, oldDevDir := nvmeSubsystemDir, nvmeDevDir
+	t.Cleanup(func() { nvmeSubsystemDir, nvmeDevDir = oldSubsystemDir, oldDevDir })
+	nvmeSubsystemDir, nvmeDevDir = sysDir, devDir
+
+	subsysDir := filepath.Join(sysDir, "nvme-subsys0")
+	nsDir := filepath.Join(subsysDir, "nvme0", "nvme0n1")
+	if multipath {
+		nsDir = filepath.Join(subsysDir, "nvme0n1")
+		// Path of the multipath device, not a namespace
+		assert.NoError(t, os.MkdirAll(filepath.Join(subsysDir, "nvme0", "nvme0c0n1"), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(subsysDir, "nvme0", "nvme0c0n1", "nsid"), []byte("1\n"), 0600))
+	}
+	assert.NoError(t, os.MkdirAll(nsDir, 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(subsysDir, "nvme0"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(subsysDir, "subsysnqn"), []byte(nqn+"\n"), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(nsDir, "nsid"), []byte("1\n"), 0600))
+	return devDir
+}
+
+func TestGetNvmeofTargetFromContext(t *testing.T) {
+	target, err := getNvmeofTargetFromContext(map[string]string{
+		"tnsWsUrl":      testTnsWsUrl,
+		"nvmeofnqn":     testNqn,
+		"nvmeofnsid":    "1",
+		"nvmeofAddress": "10.0.0.1",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &nvmeofTarget{address: "10.0.0.1:4420", nqn: testNqn, nsid: 1}, target)
+
+	// Address from the ws url
+	target, err = getNvmeofTargetFromContext(map[string]string{"tnswsurl": testTnsWsUrl, "nvmeofnqn": testNqn, "nvmeofnsid": "2"})
+	assert.NoError(t, err)
+	assert.Equal(t, "truenas.server:4420", target.address)
+	assert.Equal(t, 2, target.nsid)
+
+	_, err = getNvmeofTargetFromContext(map[string]string{"tnswsurl": testTnsWsUrl, "nvmeofnsid": "1"})
+	assert.Error(t, err)
+
+	// Namespace ids start at 1
+	_, err = getNvmeofTargetFromContext(map[string]string{"tnswsurl": testTnsWsUrl, "nvmeofnqn": testNqn, "nvmeofnsid": "0"})
+	assert.Error(t, err)
+}
+
+func TestNvmeofConnectDisconnect(t *testing.T) {
+	fakeNvmeSysfs(t, "nqn.2011-06.com.truenas:uuid:1234:pvc-other", false)
+	target := &nvmeofTarget{address: "10.0.0.1:4420", nqn: testNqn, nsid: 1}
+
+	fake, calls := fakeCommands(exitWith("", 0), exitWith("", 0), exitWith("no subsystem", 1))
+	n := &nvmeofInitiator{exec: fake}
+
+	assert.NoError(t, n.connect(target))
+	assert.Equal(t, []string{"nvme", "connect", "--transport=tcp", "--traddr=10.0.0.1", "--trsvcid=4420", "--nqn=" + testNqn}, (*calls)[0])
+
+	assert.NoError(t, n.disconnect(testNqn))
+	assert.Equal(t, []string{"nvme", "disconnect", "--nqn=" + testNqn}, (*calls)[1])
+
+	assert.Error(t, n.disconnect(testNqn))
+}
+
+func TestNvmeofConnectAlreadyConnected(t *testing.T) {
+	devDir := fakeNvmeSysfs(t, testNqn, false)
+
+	fake, calls := fakeCommands(exitWith("", 0))
+	n := &nvmeofInitiator{exec: fake}
+
+	assert.NoError(t, n.connect(&nvmeofTarget{address: "10.0.0.1:4420", nqn: testNqn, nsid: 1}))
+	assert.Empty(t, *calls)
+
+	nqn, err := subsystemNqn(testPvName)
+	assert.NoError(t, err)
+	assert.Equal(t, testNqn, nqn)
+
+	nqn, err = subsystemNqn("pvc-other")
+	assert.NoError(t, err)
+	assert.Empty(t, nqn)
+
+	// The controllers of the subsystem are rescanned
+	assert.NoError(t, n.rescan(testNqn))
+	assert.Equal(t, []string{"nvme", "ns-rescan", filepath.Join(devDir, "nvme0")}, (*calls)[0])
+}
+
+func TestFindNvmeofDevice(t *testing.T) {
+	for _, multipath := range []bool{false, true} {
+		devDir := fakeNvmeSysfs(t, testNqn, multipath)
+
+		device, err := findNvmeofDevice(testNqn, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join(devDir, "nvme0n1"), device)
+
+		device, err = findNvmeofDevice(testNqn, 2)
+		assert.NoError(t, err)
+		assert.Empty(t, device)
+
+		device, err = findNvmeofDevice("nqn.2011-06.com.truenas:uuid:1234:pvc-other", 1)
+		assert.NoError(t, err)
+		assert.Empty(t, device)
+	}
+
+	// nvme modules not loaded
+	nvmeSubsystemDir = filepath.Join(t.TempDir(), "missing")
+	device, err := findNvmeofDevice(testNqn, 1)
+	assert.NoError(t, err)
+	assert.Empty(t, device)
+}
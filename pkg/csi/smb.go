@@ -0,0 +1,79 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	tns "github.com/titou10/csi-driver-truenas-scale/pkg/tns"
+)
+
+// The SMB share of a volume is created by CreateVolume with the ACL of the storage class, and mounted with cifs
+// on the target path of each pod by NodePublishVolume, with the credentials of the node publish secret
+
+// parseSmbShareAcl parses the ACL of the SMB shares given in the storage class: a comma-separated list of
+// <USER|GROUP>:<id>:<FULL|CHANGE|READ>[:<ALLOWED|DENIED>] or <SID>:<FULL|CHANGE|READ>[:<ALLOWED|DENIED>]
+func parseSmbShareAcl(value string) ([]tns.TNSSMBShareAce, error) {
+	acl := []tns.TNSSMBShareAce{}
+	for _, entry := range splitList(value) {
+		fields := strings.Split(strings.ToUpper(entry), ":")
+
+		var ace tns.TNSSMBShareAce
+		switch {
+		case len(fields) >= 3 && (fields[0] == "USER" || fields[0] == "GROUP"):
+			id, err := strconv.Atoi(fields[1])
+			if err != nil || id < 0 {
+				return nil, fmt.Errorf("invalid id in SMB share ACL entry %q", entry)
+			}
+			ace.WhoID = &tns.TNSSMBShareAceWho{IDType: fields[0], ID: id}
+			fields = fields[2:]
+		case len(fields) >= 2 && strings.HasPrefix(fields[0], "S-"):
+			ace.WhoSid = fields[0]
+			fields = fields[1:]
+		default:
+			return nil, fmt.Errorf("invalid SMB share ACL entry %q: <USER|GROUP>:<id>:<permission> or <SID>:<permission>", entry)
+		}
+
+		switch fields[0] {
+		case "FULL", "CHANGE", "READ":
+			ace.Perm = fields[0]
+		default:
+			return nil, fmt.Errorf("invalid permission in SMB share ACL entry %q: FULL, CHANGE or READ", entry)
+		}
+		ace.Type = "ALLOWED"
+		switch {
+		case len(fields) == 2 && (fields[1] == "ALLOWED" || fields[1] == "DENIED"):
+			ace.Type = fields[1]
+		case len(fields) > 1:
+			return nil, fmt.Errorf("invalid type in SMB share ACL entry %q: ALLOWED or DENIED", entry)
+		}
+		acl = append(acl, ace)
+	}
+	return acl, nil
+}
+
+// getSmbCredentialsOptions returns the cifs mount options with the credentials of the node publish secret
+// Without username, the share is mounted as guest unless the mount options of the storage class say otherwise
+func getSmbCredentialsOptions(secrets map[string]string) []string {
+	options := []string{}
+	for _, key := range []string{smbUsernameSecretKey, smbPasswordSecretKey, smbDomainSecretKey} {
+		if value := secrets[key]; value != "" {
+			options = append(options, fmt.Sprintf("%s=%s", key, value))
+		}
+	}
+	return options
+}
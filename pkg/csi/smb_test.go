@@ -0,0 +1,62 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"reflect"
+	"testing"
+
+	tns "github.com/titou10/csi-driver-truenas-scale/pkg/tns"
+)
+
+func TestParseSmbShareAcl(t *testing.T) {
+	tests := []struct {
+		desc   string
+		value  string
+		result []tns.TNSSMBShareAce
+		hasErr bool
+	}{
+		{desc: "empty", value: "", result: []tns.TNSSMBShareAce{}},
+		{
+			desc:  "user and group",
+			value: "user:1000:full, GROUP:6000:Read:denied",
+			result: []tns.TNSSMBShareAce{
+				{WhoID: &tns.TNSSMBShareAceWho{IDType: "USER", ID: 1000}, Perm: "FULL", Type: "ALLOWED"},
+				{WhoID: &tns.TNSSMBShareAceWho{IDType: "GROUP", ID: 6000}, Perm: "READ", Type: "DENIED"},
+			},
+		},
+		{
+			desc:   "sid",
+			value:  "S-1-1-0:change",
+			result: []tns.TNSSMBShareAce{{WhoSid: "S-1-1-0", Perm: "CHANGE", Type: "ALLOWED"}},
+		},
+		{desc: "invalid id", value: "user:bob:full", hasErr: true},
+		{desc: "missing permission", value: "user:1000", hasErr: true},
+		{desc: "invalid permission", value: "group:6000:write", hasErr: true},
+		{desc: "invalid type", value: "S-1-1-0:read:maybe", hasErr: true},
+		{desc: "unknown trustee", value: "everyone:full", hasErr: true},
+	}
+
+	for _, test := range tests {
+		result, err := parseSmbShareAcl(test.value)
+		if (err != nil) != test.hasErr {
+			t.Errorf("test[%s]: unexpected error: %v", test.desc, err)
+			continue
+		}
+		if !test.hasErr && !reflect.DeepEqual(result, test.result) {
+			t.Errorf("test[%s]: unexpected result: %v, expected: %v", test.desc, result, test.result)
+		}
+	}
+}
@@ -23,6 +23,7 @@ import (
 	tns "github.com/titou10/csi-driver-truenas-scale/pkg/tns"
 	"k8s.io/klog/v2"
 	mount "k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
 )
 
 // DriverOptions defines driver parameters specified in driver deployment
@@ -32,6 +33,15 @@ type DriverOptions struct {
 	Endpoint              string
 	MountPermissions      uint64
 	DefaultOnDeletePolicy string
+	AbortJobsOnCancel     bool
+	JobTimeout            time.Duration
+	VolumeUsageThreshold  int
+	BackendsConfig        string
+	HealthCheckTTL        time.Duration
+	MountTimeout          time.Duration
+	MountOptionsAllow     string
+	MountOptionsDeny      string
+	NodePlugin            bool
 }
 
 type Driver struct {
@@ -41,27 +51,54 @@ type Driver struct {
 	endpoint              string
 	mountPermissions      uint64
 	defaultOnDeletePolicy string
+	volumeUsageThreshold  int // % of the refquota above which a volume is reported abnormal. 0: disabled
+	mountTimeout          time.Duration
+	mountOptionsPolicy    *mountOptionsPolicy
+	nodePlugin            bool // Run by the DaemonSet of the nodes
 
 	//ids *identityServer
 	ns          *NodeServer
 	cscap       []*csi.ControllerServiceCapability
 	nscap       []*csi.NodeServiceCapability
 	volumeLocks *VolumeLocks
+	backends    *backendRegistry
+	health      *healthCache
 }
 
 const (
-	DefaultDriverName            = "tns.csi.titou10.org"
-	DefaultDsNameTemplate        = "${pvc.metadata.namespace}-${pvc.metadata.name}-${pv.metadata.name}"
-	DefaultDSArchivePrefix       = "zz"
-	TruenassDsMaxLength          = 200
-	MinimumDatasetSize     int64 = 1073741824 // 1 GB
+	DefaultDriverName                 = "tns.csi.titou10.org"
+	DefaultDsNameTemplate             = "${pvc.metadata.namespace}-${pvc.metadata.name}-${pv.metadata.name}"
+	DefaultDSArchivePrefix            = "zz"
+	TruenassDsMaxLength               = 200
+	MinimumDatasetSize          int64 = 1073741824 // 1 GB
+	DefaultVolumeUsageThreshold       = 90         // % of the refquota
 
 	// Secret key for Truenas Scale api key
 	apiKeySecretNameKey = "apiKey"
 
+	// Secret keys for the TLS verification of wss:// urls
+	tlsCaCertSecretNameKey             = "tlsCaCert"
+	tlsCertSha256SecretNameKey         = "tlsCertSha256"
+	tlsServerNameSecretNameKey         = "tlsServerName"
+	tlsInsecureSkipVerifySecretNameKey = "tlsInsecureSkipVerify"
+
+	// Node publish secret keys for the credentials of the SMB shares
+	smbUsernameSecretKey = "username"
+	smbPasswordSecretKey = "password"
+	smbDomainSecretKey   = "domain"
+
+	// Provisioner and node stage secret keys of the encrypted volumes
+	encryptionPassphraseSecretKey = "encryptionPassphrase"
+	encryptionKeySecretKey        = "encryptionKey"
+
 	// Params set on PV
 	paramDsName       = "dsname"
 	paramNfsSharePath = "nfssharepath"
+	paramSmbShareName = "smbsharename"
+	paramIscsiIqn     = "iscsiiqn"
+	paramIscsiLun     = "iscsilun"
+	paramNvmeofNqn    = "nvmeofnqn"
+	paramNvmeofNsid   = "nvmeofnsid"
 
 	// Storage class parameters
 	paramTnsWsUrl        = "tnswsurl"
@@ -69,6 +106,48 @@ const (
 	paramOnDelete        = "ondelete"
 	paramDsNameTemplate  = "dsnametemplate"
 	paramDsArchivePrefix = "dsarchiveprefix"
+	paramProtocol        = "protocol"
+	paramShareProtocol   = "shareprotocol"
+	paramCloneMode       = "clonemode"
+	paramQuotaMode       = "quotamode"
+	paramReservationMode = "reservationmode"
+
+	// Storage class parameters of the addresses of the NFS server, also read from the volume context by the nodes
+	paramNfsServer          = "nfsserver"
+	paramNfsServerSelection = "nfsserverselection"
+
+	// Storage class parameter of the health check of the server before the creation of the volumes
+	paramAutoStartService = "autostartservice"
+
+	// Storage class parameters of the capacity policy
+	paramCapacityRoundUp     = "capacityroundup"
+	paramCapacityGranularity = "capacitygranularity"
+	paramMaxVolumeSize       = "maxvolumesize"
+	paramOvercommitRatio     = "overcommitratio"
+
+	// Storage class parameters of the dataset properties: ds.compression, ds.recordsize...
+	paramDsPropertyPrefix = "ds."
+
+	// Storage class parameters of the encrypted volumes
+	paramEncryption          = "encryption"
+	paramEncryptionKeySource = "encryptionkeysource"
+	paramEncryptionAlgorithm = "encryptionalgorithm"
+
+	// Storage class parameters of the SMB shares
+	paramSmbShareAcl   = "smbshareacl"
+	paramSmbHostsAllow = "smbhostsallow"
+	paramSmbHostsDeny  = "smbhostsdeny"
+	paramSmbBrowsable  = "smbbrowsable"
+
+	// Storage class parameters of the iSCSI (block) volumes
+	paramIscsiPortalID         = "iscsiportalid"
+	paramIscsiInitiatorGroupID = "iscsiinitiatorgroupid"
+	paramIscsiPortal           = "iscsiportal" // Also set on PV, with the port
+	paramZvolSparse            = "zvolsparse"  // Also used by the NVMe-oF volumes
+
+	// Storage class parameters of the NVMe-oF (block) volumes
+	paramNvmeofPortID  = "nvmeofportid"
+	paramNvmeofAddress = "nvmeofaddress" // Also set on PV, with the port
 
 	// linux mount directory permission
 	mountPermissionsField = "mountpermissions"
@@ -86,6 +165,33 @@ const (
 	paramShareAllowedHosts    = "shareallowedhosts"
 	paramShareAllowedNetworks = "shareallowednetworks"
 
+	// VolumeAttributesClass parameters (mutable), with paramShareAllowedHosts and paramShareAllowedNetworks
+	paramCompression = "compression"
+	paramRecordSize  = "recordsize"
+	paramSync        = "sync"
+	paramAtime       = "atime"
+
+	// Volume protocols
+	protocolNFS    = "nfs"
+	protocolSMB    = "smb"
+	protocolISCSI  = "iscsi"
+	protocolNVMEOF = "nvmeof"
+
+	// Clone modes of the volumes created from a snapshot or a volume
+	cloneModeCopy         = "copy"          // Replication of the data
+	cloneModeClone        = "clone"         // ZFS clone, that depends on its origin
+	cloneModeClonePromote = "clone-promote" // ZFS clone then promoted: the origin depends on the clone
+
+	// Sources of the keys of the encrypted volumes
+	encryptionKeySourceGenerated  = "generated"  // Generated and kept by Truenas Scale, loaded at boot
+	encryptionKeySourcePassphrase = "passphrase" // From the secrets, the volume is locked after a reboot
+	encryptionKeySourceKey        = "key"        // From the secrets (hex), the volume is locked after a reboot
+
+	defaultIscsiPort        = "3260"
+	defaultNvmeofPort       = "4420"
+	defaultFsType           = "ext4"
+	zvolSizeAlignment int64 = 1048576 // 1 MiB, a multiple of all the volblocksize values
+
 	pvcNameKey           = "csi.storage.k8s.io/pvc/name"
 	pvcNamespaceKey      = "csi.storage.k8s.io/pvc/namespace"
 	pvNameKey            = "csi.storage.k8s.io/pv/name"
@@ -104,37 +210,79 @@ func NewDriver(options *DriverOptions) *Driver {
 		endpoint:              options.Endpoint,
 		mountPermissions:      options.MountPermissions,
 		defaultOnDeletePolicy: options.DefaultOnDeletePolicy,
+		volumeUsageThreshold:  options.VolumeUsageThreshold,
+		mountTimeout:          options.MountTimeout,
+		nodePlugin:            options.NodePlugin,
 	}
 
-	n.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+	tns.SetAbortJobsOnCancel(options.AbortJobsOnCancel)
+	tns.SetJobTimeout(options.JobTimeout)
+
+	controllerCapabilities := []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
 		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
 		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
 
-		//csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
-		//csi.ControllerServiceCapability_RPC_GET_VOLUME,
-		//csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
-		// Capacity
-		// csi.ControllerServiceCapability_RPC_GET_CAPACITY,
-	})
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
+	}
+	if options.BackendsConfig != "" {
+		// GetCapacity receives no secret: the credentials of the servers must be configured
+		controllerCapabilities = append(controllerCapabilities, csi.ControllerServiceCapability_RPC_GET_CAPACITY)
+	}
+	n.AddControllerServiceCapabilities(controllerCapabilities)
 
 	n.AddNodeServiceCapabilities([]csi.NodeServiceCapability_RPC_Type{
 		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
 		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
 		csi.NodeServiceCapability_RPC_UNKNOWN,
 	})
 	n.volumeLocks = NewVolumeLocks()
+	n.backends = newBackendRegistry()
+	n.health = newHealthCache(options.HealthCheckTTL)
+
+	policy, err := newMountOptionsPolicy(options.MountOptionsAllow, options.MountOptionsDeny)
+	if err != nil {
+		klog.Fatalf("%v", err)
+	}
+	n.mountOptionsPolicy = policy
+
+	if options.BackendsConfig != "" {
+		configs, err := loadBackendsConfig(options.BackendsConfig)
+		if err != nil {
+			klog.Fatalf("%v", err)
+		}
+		n.backends.seed(configs)
+		klog.V(2).Infof("%d backend(s) loaded from %s", len(configs), options.BackendsConfig)
+	}
 
 	return n
 }
 
 func NewNodeServer(n *Driver, mounter mount.Interface) *NodeServer {
-	return &NodeServer{
-		Driver:  n,
-		mounter: mounter,
+	executor := utilexec.New()
+	ns := &NodeServer{
+		Driver:    n,
+		mounter:   mounter,
+		exec:      executor,
+		iscsi:     &iscsiInitiator{exec: executor},
+		nvmeof:    &nvmeofInitiator{exec: executor},
+		nfsMounts: newNfsMountRecord(),
+		nfsProbe:  probeTCP,
+		stats:     newVolumeStats(),
 	}
+	if runtime.GOOS == "linux" {
+		ns.mountExec = executor
+	}
+	return ns
 }
 
 func (n *Driver) Run(testMode bool) {
@@ -150,6 +298,10 @@ func (n *Driver) Run(testMode bool) {
 		mounter = mounter.(mount.MounterForceUnmounter)
 	}
 	n.ns = NewNodeServer(n, mounter)
+	if n.nodePlugin {
+		// The stat of the mounts of a server that does not answer blocks: the gRPC server starts in the meantime
+		go n.ns.cleanupStaleStagingMounts()
+	}
 	s := NewNonBlockingGRPCServer()
 
 	s.Start(n.endpoint,
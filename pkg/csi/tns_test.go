@@ -151,6 +151,26 @@ func TestNewControllerServiceCapability(t *testing.T) {
 	}
 }
 
+func TestNewDriverGetCapacity(t *testing.T) {
+	hasGetCapacity := func(d *Driver) bool {
+		for _, c := range d.cscap {
+			if c.GetRpc().GetType() == csi.ControllerServiceCapability_RPC_GET_CAPACITY {
+				return true
+			}
+		}
+		return false
+	}
+
+	// GetCapacity receives no secret, only advertised when the credentials of the servers are configured
+	assert.False(t, hasGetCapacity(NewDriver(&DriverOptions{DriverName: DefaultDriverName})))
+
+	path := filepath.Join(t.TempDir(), "backends.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(`"wss://a/api/current": {apiKey: key-a, rootDatasets: pool/a}`), 0600))
+	d := NewDriver(&DriverOptions{DriverName: DefaultDriverName, BackendsConfig: path})
+	assert.True(t, hasGetCapacity(d))
+	assert.Equal(t, "key-a", d.backends.credentials("wss://a/api/current", "pool/a").ApiKey)
+}
+
 func TestNewNodeServiceCapability(t *testing.T) {
 	tests := []struct {
 		cap csi.NodeServiceCapability_RPC_Type
@@ -18,16 +18,22 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"math/big"
+	"net/url"
 	"os"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	tns "github.com/titou10/csi-driver-truenas-scale/pkg/tns"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/apimachinery/pkg/util/sets"
 
 	"k8s.io/klog/v2"
@@ -37,13 +43,13 @@ import (
 //nolint:revive
 const (
 	separator                       = "#"
-	delete                          = "delete"
+	onDeleteDelete                  = "delete"
 	retain                          = "retain"
 	archive                         = "archive"
 	volumeOperationAlreadyExistsFmt = "An operation with the given Volume ID %s already exists"
 )
 
-var supportedOnDeleteValues = []string{"", delete, retain, archive}
+var supportedOnDeleteValues = []string{"", onDeleteDelete, retain, archive}
 
 func validateOnDeleteValue(onDelete string) error {
 	for _, v := range supportedOnDeleteValues {
@@ -55,6 +61,38 @@ func validateOnDeleteValue(onDelete string) error {
 	return fmt.Errorf("invalid value %s for OnDelete, supported values are %v", onDelete, supportedOnDeleteValues)
 }
 
+// getTnsCredentials returns the api key and TLS options read from the secret
+func getTnsCredentials(secrets map[string]string) (*tns.Credentials, error) {
+	apiKey, exists := secrets[apiKeySecretNameKey]
+	if !exists || apiKey == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "Secret with 'apiKey' key not found")
+	}
+
+	creds := &tns.Credentials{
+		ApiKey: apiKey,
+		TLS: tns.TLSOptions{
+			CACert:     secrets[tlsCaCertSecretNameKey],
+			CertSHA256: secrets[tlsCertSha256SecretNameKey],
+			ServerName: secrets[tlsServerNameSecretNameKey],
+		},
+	}
+
+	if creds.TLS.CertSHA256 != "" {
+		if _, err := tns.ParseCertFingerprint(creds.TLS.CertSHA256); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid '%s' key in secret: %v", tlsCertSha256SecretNameKey, err)
+		}
+	}
+	if v, ok := secrets[tlsInsecureSkipVerifySecretNameKey]; ok && v != "" {
+		insecureSkipVerify, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid '%s' key in secret: %v", tlsInsecureSkipVerifySecretNameKey, err)
+		}
+		creds.TLS.InsecureSkipVerify = insecureSkipVerify
+	}
+
+	return creds, nil
+}
+
 func NewDefaultIdentityServer(d *Driver) *IdentityServer {
 	return &IdentityServer{
 		Driver: d,
@@ -236,3 +274,202 @@ func isArchivePrefixValid(s string) bool {
 	re := regexp.MustCompile(`^[A-Za-z0-9_]+[^_]$`)
 	return re.MatchString(s)
 }
+
+// paginate returns the range of the entries to return and the token of the next page
+// The token is the index of the first entry of the page
+func paginate(total int, startingToken string, maxEntries int32) (int, int, string, error) {
+	start := 0
+	if startingToken != "" {
+		i, err := strconv.Atoi(startingToken)
+		if err != nil || i < 0 || i > total {
+			return 0, 0, "", status.Errorf(codes.Aborted, "invalid starting token %q", startingToken)
+		}
+		start = i
+	}
+
+	end := total
+	if maxEntries > 0 && start+int(maxEntries) < total {
+		end = start + int(maxEntries)
+	}
+
+	nextToken := ""
+	if end < total {
+		nextToken = strconv.Itoa(end)
+	}
+	return start, end, nextToken, nil
+}
+
+var (
+	compressionRegexp = regexp.MustCompile(`^(ON|OFF|INHERIT|LZ4|LZJB|ZLE|GZIP(-[1-9])?|ZSTD(-[0-9]+)?|ZSTD-FAST(-[0-9]+)?)$`)
+	recordSizeRegexp  = regexp.MustCompile(`^(INHERIT|512|[0-9]+[KM])$`)
+)
+
+// datasetPropertyValues are the values of the dataset properties that can be set by the storage classes
+// (ds.<property>), besides compression, recordsize and copies
+var datasetPropertyValues = map[string][]string{
+	"aclmode":       {"PASSTHROUGH", "RESTRICTED", "DISCARD", "INHERIT"},
+	"acltype":       {"OFF", "NFSV4", "POSIX", "INHERIT"},
+	"atime":         {"ON", "OFF", "INHERIT"},
+	"deduplication": {"ON", "OFF", "VERIFY", "INHERIT"},
+	"exec":          {"ON", "OFF", "INHERIT"},
+	"readonly":      {"ON", "OFF", "INHERIT"},
+	"snapdir":       {"VISIBLE", "HIDDEN", "INHERIT"},
+	"sync":          {"STANDARD", "ALWAYS", "DISABLED", "INHERIT"},
+	"xattr":         {"ON", "SA", "INHERIT"},
+}
+
+// filesystemProperties are the dataset properties that do not apply to the zvols
+var filesystemProperties = []string{"aclmode", "acltype", "atime", "exec", "recordsize", "snapdir", "xattr"}
+
+// parseDatasetProperty validates the value of a dataset property (case-insensitive).
+// Returns the name and the value of the property for the Truenas Scale api
+func parseDatasetProperty(name string, v string) (string, interface{}, error) {
+	value := strings.ToUpper(strings.TrimSpace(v))
+
+	switch name {
+	case "compression":
+		if !compressionRegexp.MatchString(value) {
+			return "", nil, fmt.Errorf("invalid compression")
+		}
+		return name, value, nil
+	case "recordsize":
+		if !recordSizeRegexp.MatchString(value) {
+			return "", nil, fmt.Errorf("invalid record size")
+		}
+		return name, normalizeRecordSize(value), nil
+	case "copies":
+		copies, err := strconv.Atoi(value)
+		if err != nil || copies < 1 || copies > 3 {
+			return "", nil, fmt.Errorf("1, 2 or 3")
+		}
+		return name, copies, nil
+	case "dedup":
+		// zfs name of the property
+		name = "deduplication"
+	}
+
+	values, ok := datasetPropertyValues[name]
+	if !ok {
+		return "", nil, fmt.Errorf("unsupported dataset property %q", name)
+	}
+	if !slices.Contains(values, value) {
+		return "", nil, fmt.Errorf("%s", strings.ToLower(strings.Join(values, ", ")))
+	}
+	return name, value, nil
+}
+
+// normalizeRecordSize writes the record size the way Truenas Scale returns it (eg 1024K -> 1M)
+func normalizeRecordSize(value string) string {
+	size, err := strconv.ParseInt(strings.TrimRight(value, "KM"), 10, 64)
+	if err != nil {
+		return value
+	}
+	switch {
+	case strings.HasSuffix(value, "M"):
+		size *= 1024 * 1024
+	case strings.HasSuffix(value, "K"):
+		size *= 1024
+	}
+	switch {
+	case size%(1024*1024) == 0:
+		return fmt.Sprintf("%dM", size/(1024*1024))
+	case size%1024 == 0:
+		return fmt.Sprintf("%dK", size/1024)
+	}
+	return value
+}
+
+// getDatasetProperties validates the dataset properties of the storage class (ds.<property>, case-insensitive)
+func getDatasetProperties(parameters map[string]string) (map[string]interface{}, error) {
+	properties := make(map[string]interface{})
+	for k, v := range parameters {
+		property, ok := strings.CutPrefix(strings.ToLower(k), paramDsPropertyPrefix)
+		if !ok {
+			continue
+		}
+		name, value, err := parseDatasetProperty(property, v)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid value %q for parameter %q: %v", v, k, err)
+		}
+		properties[name] = value
+	}
+	return properties, nil
+}
+
+// getVolumeModifications validates the mutable parameters (VolumeAttributesClass, case-insensitive)
+// and returns the properties to update on the dataset and on the NFS share
+func getVolumeModifications(parameters map[string]string) (map[string]interface{}, map[string]interface{}, error) {
+	dsProperties := make(map[string]interface{})
+	shareProperties := make(map[string]interface{})
+
+	for k, v := range parameters {
+		switch strings.ToLower(k) {
+		case paramCompression, paramRecordSize, paramSync, paramAtime:
+			name, value, err := parseDatasetProperty(strings.ToLower(k), v)
+			if err != nil {
+				return nil, nil, status.Errorf(codes.InvalidArgument, "invalid value %q for parameter %q: %v", v, k, err)
+			}
+			dsProperties[name] = value
+
+		case paramShareAllowedNetworks:
+			shareProperties["networks"] = splitList(v)
+		case paramShareAllowedHosts:
+			shareProperties["hosts"] = splitList(v)
+
+		default:
+			return nil, nil, status.Errorf(codes.InvalidArgument, "invalid mutable parameter %q", k)
+		}
+	}
+
+	return dsProperties, shareProperties, nil
+}
+
+// splitList splits a comma separated list. An empty value gives an empty list, not nil
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// isBlockProtocol returns true for the protocols of the volumes backed by a zvol
+func isBlockProtocol(protocol string) bool {
+	return protocol == protocolISCSI || protocol == protocolNVMEOF
+}
+
+// checkVolumeModifications rejects the mutable parameters that do not apply to the volumes of the protocol:
+// the NFS share parameters for the volumes without NFS share, the filesystem properties for the zvols
+func checkVolumeModifications(protocol string, dsProperties map[string]interface{}, shareProperties map[string]interface{}) error {
+	if protocol != protocolNFS && len(shareProperties) > 0 {
+		return status.Errorf(codes.InvalidArgument, "NFS share parameters are not supported by %s volumes", protocol)
+	}
+	if !isBlockProtocol(protocol) {
+		return nil
+	}
+	for _, property := range filesystemProperties {
+		if _, ok := dsProperties[property]; ok {
+			return status.Errorf(codes.InvalidArgument, "parameter %q is not supported by %s volumes", property, protocol)
+		}
+	}
+	return nil
+}
+
+// roundUpSize rounds the size up to a multiple of the alignment
+func roundUpSize(size int64, alignment int64) int64 {
+	if remainder := size % alignment; remainder != 0 {
+		return size + alignment - remainder
+	}
+	return size
+}
+
+// getTnsHost returns the host of the Truenas Scale WS url
+func getTnsHost(tnsWsUrl string) (string, error) {
+	u, err := url.Parse(tnsWsUrl)
+	if err != nil || u.Hostname() == "" {
+		return "", fmt.Errorf("failed to get the host from %s %q: %v", paramTnsWsUrl, tnsWsUrl, err)
+	}
+	return u.Hostname(), nil
+}
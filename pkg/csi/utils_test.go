@@ -19,6 +19,10 @@ import (
 	"reflect"
 	"testing"
 	"time"
+
+	tns "github.com/titou10/csi-driver-truenas-scale/pkg/tns"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var (
@@ -264,3 +268,253 @@ func TestWaitUntilTimeout(t *testing.T) {
 		}
 	}
 }
+
+func TestGetTnsCredentials(t *testing.T) {
+	pin := "AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67:89"
+	tests := []struct {
+		desc        string
+		secrets     map[string]string
+		expectedErr codes.Code
+		expected    *tns.Credentials
+	}{
+		{
+			desc:        "no apiKey",
+			secrets:     map[string]string{},
+			expectedErr: codes.FailedPrecondition,
+		},
+		{
+			desc:        "apiKey only: verification enabled",
+			secrets:     map[string]string{apiKeySecretNameKey: "1-abc"},
+			expectedErr: codes.OK,
+			expected:    &tns.Credentials{ApiKey: "1-abc"},
+		},
+		{
+			desc: "all tls keys",
+			secrets: map[string]string{
+				apiKeySecretNameKey:                "1-abc",
+				tlsCaCertSecretNameKey:             "-----BEGIN CERTIFICATE-----",
+				tlsCertSha256SecretNameKey:         pin,
+				tlsServerNameSecretNameKey:         "truenas.local",
+				tlsInsecureSkipVerifySecretNameKey: "false",
+			},
+			expectedErr: codes.OK,
+			expected: &tns.Credentials{
+				ApiKey: "1-abc",
+				TLS: tns.TLSOptions{
+					CACert:     "-----BEGIN CERTIFICATE-----",
+					CertSHA256: pin,
+					ServerName: "truenas.local",
+				},
+			},
+		},
+		{
+			desc:        "insecure",
+			secrets:     map[string]string{apiKeySecretNameKey: "1-abc", tlsInsecureSkipVerifySecretNameKey: "true"},
+			expectedErr: codes.OK,
+			expected:    &tns.Credentials{ApiKey: "1-abc", TLS: tns.TLSOptions{InsecureSkipVerify: true}},
+		},
+		{
+			desc:        "invalid insecure value",
+			secrets:     map[string]string{apiKeySecretNameKey: "1-abc", tlsInsecureSkipVerifySecretNameKey: "maybe"},
+			expectedErr: codes.InvalidArgument,
+		},
+		{
+			desc:        "invalid pin",
+			secrets:     map[string]string{apiKeySecretNameKey: "1-abc", tlsCertSha256SecretNameKey: "abcd"},
+			expectedErr: codes.InvalidArgument,
+		},
+	}
+
+	for _, test := range tests {
+		creds, err := getTnsCredentials(test.secrets)
+		if status.Code(err) != test.expectedErr {
+			t.Errorf("test[%s]: unexpected error: %v, expected code: %v", test.desc, err, test.expectedErr)
+			continue
+		}
+		if !reflect.DeepEqual(creds, test.expected) {
+			t.Errorf("test[%s]: unexpected output: %v, expected result: %v", test.desc, creds, test.expected)
+		}
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	tests := []struct {
+		desc          string
+		total         int
+		startingToken string
+		maxEntries    int32
+		start         int
+		end           int
+		nextToken     string
+		expectedErr   codes.Code
+	}{
+		{desc: "all entries", total: 5, start: 0, end: 5},
+		{desc: "first page", total: 5, maxEntries: 2, start: 0, end: 2, nextToken: "2"},
+		{desc: "middle page", total: 5, startingToken: "2", maxEntries: 2, start: 2, end: 4, nextToken: "4"},
+		{desc: "last page", total: 5, startingToken: "4", maxEntries: 2, start: 4, end: 5},
+		{desc: "no entries", total: 0, start: 0, end: 0},
+		{desc: "token at the end", total: 5, startingToken: "5", start: 5, end: 5},
+		{desc: "token too big", total: 5, startingToken: "6", expectedErr: codes.Aborted},
+		{desc: "invalid token", total: 5, startingToken: "abc", expectedErr: codes.Aborted},
+	}
+
+	for _, test := range tests {
+		start, end, nextToken, err := paginate(test.total, test.startingToken, test.maxEntries)
+		if status.Code(err) != test.expectedErr {
+			t.Errorf("test[%s]: unexpected error: %v, expected code: %v", test.desc, err, test.expectedErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if start != test.start || end != test.end || nextToken != test.nextToken {
+			t.Errorf("test[%s]: unexpected output: %d %d %q, expected: %d %d %q", test.desc, start, end, nextToken, test.start, test.end, test.nextToken)
+		}
+	}
+}
+
+func TestGetVolumeModifications(t *testing.T) {
+	tests := []struct {
+		desc            string
+		parameters      map[string]string
+		dsProperties    map[string]interface{}
+		shareProperties map[string]interface{}
+		expectedErr     codes.Code
+	}{
+		{
+			desc:            "no parameters",
+			dsProperties:    map[string]interface{}{},
+			shareProperties: map[string]interface{}{},
+		},
+		{
+			desc:            "dataset properties",
+			parameters:      map[string]string{"compression": "zstd-3", "recordSize": "1m", "sync": "Disabled", "atime": "off"},
+			dsProperties:    map[string]interface{}{"compression": "ZSTD-3", "recordsize": "1M", "sync": "DISABLED", "atime": "OFF"},
+			shareProperties: map[string]interface{}{},
+		},
+		{
+			desc:            "share properties",
+			parameters:      map[string]string{"shareAllowedNetworks": "192.168.5.0/24 , 192.168.6.0/24", "shareAllowedHosts": ""},
+			dsProperties:    map[string]interface{}{},
+			shareProperties: map[string]interface{}{"networks": []string{"192.168.5.0/24", "192.168.6.0/24"}, "hosts": []string{}},
+		},
+		{desc: "invalid compression", parameters: map[string]string{"compression": "brotli"}, expectedErr: codes.InvalidArgument},
+		{desc: "invalid recordsize", parameters: map[string]string{"recordsize": "128"}, expectedErr: codes.InvalidArgument},
+		{desc: "invalid sync", parameters: map[string]string{"sync": "sometimes"}, expectedErr: codes.InvalidArgument},
+		{desc: "invalid atime", parameters: map[string]string{"atime": "true"}, expectedErr: codes.InvalidArgument},
+		{desc: "immutable parameter", parameters: map[string]string{"rootDataset": "pool/other"}, expectedErr: codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		dsProperties, shareProperties, err := getVolumeModifications(test.parameters)
+		if status.Code(err) != test.expectedErr {
+			t.Errorf("test[%s]: unexpected error: %v, expected code: %v", test.desc, err, test.expectedErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(dsProperties, test.dsProperties) || !reflect.DeepEqual(shareProperties, test.shareProperties) {
+			t.Errorf("test[%s]: unexpected output: %v %v, expected: %v %v", test.desc, dsProperties, shareProperties, test.dsProperties, test.shareProperties)
+		}
+	}
+}
+
+func TestRoundUpSize(t *testing.T) {
+	tests := []struct {
+		size   int64
+		result int64
+	}{
+		{size: 0, result: 0},
+		{size: 1, result: zvolSizeAlignment},
+		{size: zvolSizeAlignment, result: zvolSizeAlignment},
+		{size: zvolSizeAlignment + 1, result: 2 * zvolSizeAlignment},
+	}
+
+	for _, test := range tests {
+		if result := roundUpSize(test.size, zvolSizeAlignment); result != test.result {
+			t.Errorf("roundUpSize(%d): %d, expected: %d", test.size, result, test.result)
+		}
+	}
+}
+
+func TestCheckVolumeModifications(t *testing.T) {
+	share := map[string]interface{}{"hosts": []string{"host1"}}
+	recordSize := map[string]interface{}{"recordsize": "1M"}
+
+	tests := []struct {
+		protocol        string
+		dsProperties    map[string]interface{}
+		shareProperties map[string]interface{}
+		expectedErr     codes.Code
+	}{
+		{protocol: protocolNFS, dsProperties: recordSize, shareProperties: share},
+		{protocol: protocolSMB, dsProperties: recordSize},
+		{protocol: protocolSMB, shareProperties: share, expectedErr: codes.InvalidArgument},
+		{protocol: protocolISCSI, shareProperties: share, expectedErr: codes.InvalidArgument},
+		{protocol: protocolNVMEOF, dsProperties: recordSize, expectedErr: codes.InvalidArgument},
+		{protocol: protocolISCSI, dsProperties: map[string]interface{}{"compression": "LZ4", "copies": 2}},
+		{protocol: protocolISCSI, dsProperties: map[string]interface{}{"snapdir": "HIDDEN"}, expectedErr: codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		err := checkVolumeModifications(test.protocol, test.dsProperties, test.shareProperties)
+		if status.Code(err) != test.expectedErr {
+			t.Errorf("test[%s %v %v]: unexpected error: %v, expected code: %v", test.protocol, test.dsProperties, test.shareProperties, err, test.expectedErr)
+		}
+	}
+}
+
+func TestGetDatasetProperties(t *testing.T) {
+	tests := []struct {
+		desc        string
+		parameters  map[string]string
+		properties  map[string]interface{}
+		expectedErr codes.Code
+	}{
+		{
+			desc:       "no dataset property",
+			parameters: map[string]string{"rootDataset": "tank/csi", "dsPermissionsMode": "0770"},
+			properties: map[string]interface{}{},
+		},
+		{
+			desc:       "dataset properties",
+			parameters: map[string]string{"ds.compression": "zstd", "DS.recordSize": "1024k", "ds.dedup": "off", "ds.copies": "2", "ds.aclType": "posix", "ds.snapdir": "hidden", "ds.xattr": "sa", "ds.sync": "inherit"},
+			properties: map[string]interface{}{"compression": "ZSTD", "recordsize": "1M", "deduplication": "OFF", "copies": 2, "acltype": "POSIX", "snapdir": "HIDDEN", "xattr": "SA", "sync": "INHERIT"},
+		},
+		{desc: "unsupported property", parameters: map[string]string{"ds.quota": "10G"}, expectedErr: codes.InvalidArgument},
+		{desc: "invalid copies", parameters: map[string]string{"ds.copies": "4"}, expectedErr: codes.InvalidArgument},
+		{desc: "invalid acltype", parameters: map[string]string{"ds.acltype": "smb"}, expectedErr: codes.InvalidArgument},
+		{desc: "invalid recordsize", parameters: map[string]string{"ds.recordsize": "1G"}, expectedErr: codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		properties, err := getDatasetProperties(test.parameters)
+		if status.Code(err) != test.expectedErr {
+			t.Errorf("test[%s]: unexpected error: %v, expected code: %v", test.desc, err, test.expectedErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(properties, test.properties) {
+			t.Errorf("test[%s]: unexpected output: %v, expected: %v", test.desc, properties, test.properties)
+		}
+	}
+}
+
+func TestNormalizeRecordSize(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{value: "512", expected: "512"},
+		{value: "128K", expected: "128K"},
+		{value: "1024K", expected: "1M"},
+		{value: "16M", expected: "16M"},
+		{value: "INHERIT", expected: "INHERIT"},
+	}
+
+	for _, test := range tests {
+		if result := normalizeRecordSize(test.value); result != test.expected {
+			t.Errorf("normalizeRecordSize(%s) = %s, expected: %s", test.value, result, test.expected)
+		}
+	}
+}
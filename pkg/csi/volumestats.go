@@ -0,0 +1,151 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/kubernetes/pkg/volume"
+	mount "k8s.io/mount-utils"
+)
+
+// The stat of a volume whose NFS server does not answer anymore (hard mount) blocks until the server is back.
+// NodeGetVolumeStats gives up after a timeout and reports the volume as abnormal instead of blocking kubelet.
+// The blocked stat keeps running: the volume is reported as abnormal without a new stat until it returns.
+// The mount point checks of the node are bounded the same way: a mount that does not answer is handled as stale
+
+var volumeStatsTimeout = 10 * time.Second
+
+var errVolumeStatsTimeout = errors.New("stat timed out")
+
+// volumeMetrics are the metrics of a volume, a raw block volume only has its capacity
+type volumeMetrics struct {
+	block   bool
+	metrics *volume.Metrics
+}
+
+// getVolumeMetrics returns the metrics of the filesystem or the device of the volume path
+func getVolumeMetrics(path string) (*volumeMetrics, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Mode()&os.ModeDevice != 0 {
+		metrics, err := volume.NewMetricsBlock(path).GetMetrics()
+		if err != nil {
+			return nil, err
+		}
+		return &volumeMetrics{block: true, metrics: metrics}, nil
+	}
+	metrics, err := volume.NewMetricsStatFS(path).GetMetrics()
+	if err != nil {
+		return nil, err
+	}
+	return &volumeMetrics{metrics: metrics}, nil
+}
+
+type volumeStatsResult struct {
+	metrics *volumeMetrics
+	err     error
+}
+
+// volumeStats runs the stats of the volumes with a timeout, at most one at a time per volume path
+type volumeStats struct {
+	mu      sync.Mutex
+	running map[string]bool // volume path -> stat running
+	get     func(path string) (*volumeMetrics, error)
+}
+
+func newVolumeStats() *volumeStats {
+	return &volumeStats{
+		running: make(map[string]bool),
+		get:     getVolumeMetrics,
+	}
+}
+
+// stat returns the metrics of the volume path, or errVolumeStatsTimeout when the stat does not return in time
+// or when a previous stat of the path is still blocked
+func (s *volumeStats) stat(path string, timeout time.Duration) (*volumeMetrics, error) {
+	if s == nil {
+		return getVolumeMetrics(path)
+	}
+
+	var metrics *volumeMetrics
+	err := s.run(path, timeout, func() error {
+		var err error
+		metrics, err = s.get(path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// isLikelyNotMountPoint is mounter.IsLikelyNotMountPoint with the timeout of stat, which it shares the running stats with
+func (s *volumeStats) isLikelyNotMountPoint(mounter mount.Interface, path string, timeout time.Duration) (bool, error) {
+	var notMnt bool
+	err := s.run(path, timeout, func() error {
+		var err error
+		notMnt, err = mounter.IsLikelyNotMountPoint(path)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return notMnt, nil
+}
+
+// run calls check on the path, or returns errVolumeStatsTimeout when it does not return in time
+// or when a previous one on the path is still blocked
+func (s *volumeStats) run(path string, timeout time.Duration, check func() error) error {
+	if s == nil {
+		return check()
+	}
+
+	s.mu.Lock()
+	if s.running[path] {
+		s.mu.Unlock()
+		return errVolumeStatsTimeout
+	}
+	s.running[path] = true
+	s.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		err := check()
+		s.mu.Lock()
+		delete(s.running, path)
+		s.mu.Unlock()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return errVolumeStatsTimeout
+	}
+}
+
+// isStaleMount returns true when the error of the stat of a mount point tells that its server does not know
+// the share mounted anymore or does not answer
+func isStaleMount(err error) bool {
+	return err != nil && (mount.IsCorruptedMnt(err) || errors.Is(err, errVolumeStatsTimeout))
+}
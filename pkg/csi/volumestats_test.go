@@ -0,0 +1,87 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csi
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+)
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	dir := t.TempDir()
+	ns := &NodeServer{Driver: &Driver{name: DefaultDriverName}, mounter: mount.NewFakeMounter(nil), nfsMounts: newNfsMountRecord(), stats: newVolumeStats()}
+
+	resp, err := ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "vol-1", VolumePath: dir})
+	assert.NoError(t, err)
+	assert.False(t, resp.GetVolumeCondition().GetAbnormal())
+	assert.Len(t, resp.GetUsage(), 2)
+
+	_, err = ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "vol-1", VolumePath: filepath.Join(dir, "missing")})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestNodeGetVolumeStatsHung(t *testing.T) {
+	timeout := volumeStatsTimeout
+	volumeStatsTimeout = 50 * time.Millisecond
+	defer func() { volumeStatsTimeout = timeout }()
+
+	dir := t.TempDir()
+	mounter := mount.NewFakeMounter([]mount.MountPoint{{Device: "10.0.0.1:/mnt/tank/k8s/vol-1", Path: dir, Type: "nfs"}})
+	ns := &NodeServer{Driver: &Driver{name: DefaultDriverName}, mounter: mounter, nfsMounts: newNfsMountRecord(), stats: newVolumeStats()}
+
+	// The NFS server does not answer: the stat blocks
+	release := make(chan struct{})
+	var stats atomic.Int32
+	ns.stats.get = func(path string) (*volumeMetrics, error) {
+		stats.Add(1)
+		<-release
+		return getVolumeMetrics(path)
+	}
+
+	for i := 0; i < 2; i++ {
+		resp, err := ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "vol-1", VolumePath: dir})
+		assert.NoError(t, err)
+		assert.True(t, resp.GetVolumeCondition().GetAbnormal())
+		assert.Contains(t, resp.GetVolumeCondition().GetMessage(), "NFS server 10.0.0.1")
+		assert.Empty(t, resp.GetUsage())
+	}
+
+	// No new stat while the first one is blocked, the volume is healthy once it returns
+	close(release)
+	assert.Eventually(t, func() bool {
+		resp, err := ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "vol-1", VolumePath: dir})
+		return err == nil && !resp.GetVolumeCondition().GetAbnormal()
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), stats.Load())
+
+	// Stale mount
+	ns.stats.get = func(_ string) (*volumeMetrics, error) {
+		return nil, &os.PathError{Op: "stat", Path: dir, Err: syscall.ESTALE}
+	}
+	resp, err := ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "vol-1", VolumePath: dir})
+	assert.NoError(t, err)
+	assert.True(t, resp.GetVolumeCondition().GetAbnormal())
+}
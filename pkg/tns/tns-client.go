@@ -15,11 +15,21 @@
 package tns
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"google.golang.org/grpc/codes"
 	"k8s.io/klog/v2"
@@ -29,70 +39,258 @@ const legacyPath = "/websocket"
 const modernPath = "/api/current"
 const timeout = 10
 
+// An idle WebSocket is pinged every pingInterval and closed when the pong is not received within pongTimeout
+const pingInterval = 30 * time.Second
+const pongTimeout = 5 * time.Second
+
+// Number of concurrent calls sharing one connection before a new one is opened
+const maxCallsPerClient = 32
+
+// Client is a multiplexed connection to Truenas Scale
+// A single reader goroutine reads all the messages received on the WebSocket:
+// - responses are routed by request id to the callers waiting for them
+// - notifications (eg collection updates) are routed to the subscribers of the collection
+// Any number of goroutines can call Truenas Scale concurrently with the same Client
+// When the WebSocket is lost, idempotent calls reconnect the Client to the same url with the same credentials
 type Client struct {
 	legacyTns  bool // true for Truenas Scale v24.10-: endpoint="/websocket". false for Truenas Scale v25.04+: endpoint="/api/current" + jsonrcp
-	conn       *websocket.Conn
-	mu         sync.Mutex
+	tnsWsUrl   string
+	creds      Credentials
+	mu         sync.Mutex // protects lastActive, refs and apiKey
+	writeMu    sync.Mutex // one writer at a time on the WebSocket
 	lastActive time.Time
-	inUse      bool
+	refs       int    // number of callers currently holding the client
+	poolKey    string // url + hash of the credentials used to login
+	apiKey     string // kept to login again when the session is no more authenticated
+
+	pendingMu   sync.Mutex                        // protects conn, done, readErr, pending and subscribers
+	conn        *websocket.Conn                   // current WebSocket, replaced on reconnect
+	pending     map[string]chan []byte            // request id -> caller waiting for the response
+	subscribers map[string][]chan *WSNotification // collection -> subscribers
+
+	subscribeMu sync.Mutex      // one subscription on the Truenas Scale side at a time
+	remoteSubs  map[string]bool // collections subscribed on the Truenas Scale side
+
+	reconnectMu sync.Mutex
+	done        chan struct{} // closed when the reader goroutine of the current WebSocket exits
+	readErr     error         // why the reader goroutine exited
+	lastRead    atomic.Int64  // unix nano of the last message or pong received
+}
+
+// Credentials holds what is needed to connect and login to a Truenas Scale server
+type Credentials struct {
+	ApiKey string
+	TLS    TLSOptions
+}
+
+// TLSOptions defines how the certificate presented by a wss:// server is verified
+type TLSOptions struct {
+	CACert             string // PEM encoded CA bundle. Empty: use the system roots
+	CertSHA256         string // Optional SHA-256 fingerprint of the server certificate (hex, ':' allowed)
+	ServerName         string // Optional server name used for verification instead of the url host
+	InsecureSkipVerify bool   // Disable any verification. Not recommended
+}
+
+// Hash of everything used to open and authenticate a connection
+// Two requests share a pooled connection only if they use the same url and the same credentials
+func (creds *Credentials) hash() string {
+	h := sha256.New()
+	for _, s := range []string{creds.ApiKey, creds.TLS.CACert, creds.TLS.CertSHA256, creds.TLS.ServerName, fmt.Sprintf("%t", creds.TLS.InsecureSkipVerify)} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
 }
 
+// ConnectionPool holds the WebSocket connections, keyed by url + credentials hash
+// The connections are opened without holding mu: a slow or unreachable server does not block the other ones
 type ConnectionPool struct {
-	mu    sync.Mutex
-	conns map[string][]*Client
+	mu      sync.Mutex
+	conns   map[string][]*Client
+	dialing map[string]*dialCall // key -> connection being opened, the other callers of the key wait for it
+}
+
+// dialCall is a connection being opened. done is closed once it is in the pool or has failed with err
+type dialCall struct {
+	done chan struct{}
+	err  *CsiError
 }
 
 var pool = &ConnectionPool{
-	conns: make(map[string][]*Client),
+	conns:   make(map[string][]*Client),
+	dialing: make(map[string]*dialCall),
 }
 
-func GetClient(tnsWsUrl, apiKey string, insecureSkipVerify bool) (*Client, *CsiError) {
-	klog.V(3).Infof("GetClient tnsWsUrl: %s insecureSkipVerify? %t", tnsWsUrl, insecureSkipVerify)
+func poolKey(tnsWsUrl string, creds *Credentials) string {
+	return tnsWsUrl + "#" + creds.hash()
+}
 
-	pool.mu.Lock()
-	defer pool.mu.Unlock()
+func GetClient(ctx context.Context, tnsWsUrl string, creds *Credentials) (*Client, *CsiError) {
+	klog.V(3).Infof("GetClient tnsWsUrl: %s insecureSkipVerify? %t", tnsWsUrl, creds.TLS.InsecureSkipVerify)
 
-	if clients, exists := pool.conns[tnsWsUrl]; exists {
-		for _, client := range clients {
-			client.mu.Lock()
-			if !client.inUse && client.isAlive() { // Check if the connection is still alive
-				client.inUse = true
-				client.mu.Unlock()
-				klog.V(2).Infof("Reusing WebSocket connection for %s", tnsWsUrl)
-				return client, nil
-			}
-			client.mu.Unlock()
+	key := poolKey(tnsWsUrl, creds)
+
+	for {
+		pool.mu.Lock()
+		if client := reuseClientLocked(key); client != nil {
+			pool.mu.Unlock()
+			klog.V(2).Infof("Reusing WebSocket connection for %s", tnsWsUrl)
+			return client, nil
+		}
+
+		call, dialing := pool.dialing[key]
+		if !dialing {
+			break // pool.mu is released once the dial is registered
+		}
+		pool.mu.Unlock()
+
+		// Another caller is opening a connection with the same credentials: reuse it
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, NewCsiError(codes.Unavailable, ctx.Err())
+		}
+		if call.err != nil && call.err.Code != codes.Canceled && call.err.Code != codes.DeadlineExceeded {
+			return nil, call.err
 		}
 	}
 
+	call := &dialCall{done: make(chan struct{})}
+	pool.dialing[key] = call
+	pool.mu.Unlock()
+
 	klog.V(2).Infof("Creating new WebSocket connection for %s", tnsWsUrl)
-	client, err := newClient(tnsWsUrl, apiKey, insecureSkipVerify)
+	client, err := newClient(ctx, tnsWsUrl, creds)
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	delete(pool.dialing, key)
+	call.err = err
+	close(call.done)
+
 	if err != nil {
+		if err.Code == codes.Unauthenticated {
+			// The api key has been revoked or rotated: the sessions opened with it must not be reused
+			evictClientsLocked(key)
+		}
 		return nil, err
 	}
 
-	client.inUse = true
-	pool.conns[tnsWsUrl] = append(pool.conns[tnsWsUrl], client)
+	client.poolKey = key
+	pool.conns[key] = append(pool.conns[key], client)
 	return client, nil
 }
 
+// reuseClientLocked returns a live client of the key with room for one more call, nil if there is none
+// The dead clients no more used are removed from the pool. Must be called with pool.mu held
+func reuseClientLocked(key string) *Client {
+	var dead []*Client
+	defer func() {
+		for _, client := range dead {
+			removeClientLocked(client)
+		}
+	}()
+
+	for _, client := range pool.conns[key] {
+		client.mu.Lock()
+		alive := client.isAlive() // Check if the connection is still alive
+		if client.refs < maxCallsPerClient && alive {
+			client.refs++
+			client.mu.Unlock()
+			return client
+		}
+		if !alive && client.refs == 0 {
+			// Do not keep dead connections in the pool (eg Truenas Scale rebooted)
+			client.closeConn()
+			dead = append(dead, client)
+		}
+		client.mu.Unlock()
+	}
+	return nil
+}
+
 func ReleaseClient(client *Client) {
 	client.mu.Lock()
-	defer client.mu.Unlock()
 
-	client.inUse = false
+	client.refs--
+	client.lastActive = time.Now()
 
 	if client.isAlive() {
+		client.mu.Unlock()
 		klog.V(3).Infof("Released WebSocket connection back to the pool")
-	} else {
-		// If the connection is dead, close it
-		client.conn.Close()
-		klog.V(2).Infof("Closed dead WebSocket connection")
+		return
+	}
+
+	// If the connection is dead, close it and remove it from the pool
+	client.closeConn()
+	client.mu.Unlock()
+	klog.V(2).Infof("Closed dead WebSocket connection")
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	removeClientLocked(client)
+}
+
+// evictClientsLocked must be called with pool.mu held
+func evictClientsLocked(key string) {
+	clients := pool.conns[key]
+	if len(clients) == 0 {
+		return
+	}
+	klog.V(2).Infof("Evicting %d WebSocket connection(s) for %s", len(clients), strings.Split(key, "#")[0])
+
+	for _, client := range clients {
+		client.mu.Lock()
+		client.apiKey = "" // A connection in use must not login again with this api key
+		client.closeConn()
+		client.mu.Unlock()
+	}
+	delete(pool.conns, key)
+}
+
+// removeClientLocked must be called with pool.mu held
+func removeClientLocked(client *Client) {
+	clients := pool.conns[client.poolKey]
+	for i, c := range clients {
+		if c == client {
+			pool.conns[client.poolKey] = append(clients[:i], clients[i+1:]...)
+			break
+		}
+	}
+	if len(pool.conns[client.poolKey]) == 0 {
+		delete(pool.conns, client.poolKey)
 	}
 }
 
-func newClient(tnsWsUrl string, apiKey string, insecureSkipVerify bool) (*Client, *CsiError) {
-	klog.V(3).Infof("newClient tnsWsUrl: %s insecureSkipVerify? %t", tnsWsUrl, insecureSkipVerify)
+func newClient(ctx context.Context, tnsWsUrl string, creds *Credentials) (*Client, *CsiError) {
+	klog.V(3).Infof("newClient tnsWsUrl: %s insecureSkipVerify? %t", tnsWsUrl, creds.TLS.InsecureSkipVerify)
+
+	legacyTns, csiErr := parseTnsWsUrl(tnsWsUrl)
+	if csiErr != nil {
+		return nil, csiErr
+	}
+
+	client := &Client{
+		legacyTns:   legacyTns,
+		tnsWsUrl:    tnsWsUrl,
+		creds:       *creds,
+		lastActive:  time.Now(),
+		refs:        1,
+		apiKey:      creds.ApiKey,
+		pending:     make(map[string]chan []byte),
+		subscribers: make(map[string][]chan *WSNotification),
+		remoteSubs:  make(map[string]bool),
+	}
+
+	if csiErr := client.connect(ctx); csiErr != nil {
+		return nil, csiErr
+	}
+	return client, nil
+}
+
+// parseTnsWsUrl validates the url and returns true for a legacy Truenas Scale
+func parseTnsWsUrl(tnsWsUrl string) (bool, *CsiError) {
 
 	// Truenas Scale < v25.0
 	// ws://<truenas.server>/websocket
@@ -105,28 +303,86 @@ func newClient(tnsWsUrl string, apiKey string, insecureSkipVerify bool) (*Client
 	if err != nil {
 		csiErr := NewCsiError(codes.InvalidArgument, err)
 		klog.Errorf("invalid truenas scale url: %s", csiErr)
-		return nil, csiErr
+		return false, csiErr
 	}
 	scheme := parsedURL.Scheme
 	if scheme != "ws" && scheme != "wss" {
 		csiErr := NewCsiError(codes.InvalidArgument, err)
 		klog.Errorf("invalid truenas scale url scheme. must be either 'ws' or 'wss': %s", csiErr)
-		return nil, csiErr
+		return false, csiErr
 	}
 	path := parsedURL.Path
 	if path != legacyPath && path != modernPath {
 		csiErr := NewCsiError(codes.InvalidArgument, err)
 		klog.Errorf("invalid truenas scale url path. must be either '/websocket (v24.10-)' or '/api/current (v25.04+)': %s", csiErr)
-		return nil, csiErr
+		return false, csiErr
+	}
+
+	return path == legacyPath, nil
+}
+
+// connect opens a new WebSocket, starts its reader goroutine and login
+// The outcome is recorded by the circuit breaker of the url
+func (client *Client) connect(ctx context.Context) *CsiError {
+	breaker := breakerFor(client.tnsWsUrl)
+	if csiErr := breaker.allow(); csiErr != nil {
+		return csiErr
+	}
+
+	conn, csiErr := client.dial(ctx)
+	if csiErr != nil {
+		breaker.record(csiErr)
+		return csiErr
+	}
+
+	done := make(chan struct{})
+	client.pendingMu.Lock()
+	client.conn = conn
+	client.done = done
+	client.readErr = nil
+	client.pendingMu.Unlock()
+	client.lastRead.Store(time.Now().UnixNano())
+
+	client.subscribeMu.Lock()
+	client.remoteSubs = make(map[string]bool) // Subscriptions do not survive the WebSocket
+	client.subscribeMu.Unlock()
+
+	conn.SetPongHandler(func(string) error {
+		client.lastRead.Store(time.Now().UnixNano())
+		return nil
+	})
+	go client.readLoop(conn, done)
+	go client.keepAlive(conn, done)
+
+	// Login
+	client.mu.Lock()
+	apiKey := client.apiKey
+	client.mu.Unlock()
+	csiErr = TNSLogin(ctx, client, apiKey)
+	if csiErr != nil {
+		conn.Close()
+		breaker.record(csiErr)
+		return csiErr
 	}
 
+	breaker.record(nil)
+	return nil
+}
+
+func (client *Client) dial(ctx context.Context) (*websocket.Conn, *CsiError) {
+	tnsWsUrl := client.tnsWsUrl
+	legacyTns := client.legacyTns
+
 	// TLS or not
 	var dialer websocket.Dialer
-	if scheme == "wss" {
+	if strings.HasPrefix(tnsWsUrl, "wss:") {
+		tlsConfig, csiErr := buildTLSConfig(&client.creds.TLS)
+		if csiErr != nil {
+			klog.Errorf("invalid TLS configuration for %s: %s", tnsWsUrl, csiErr)
+			return nil, csiErr
+		}
 		dialer = websocket.Dialer{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: insecureSkipVerify,
-			},
+			TLSClientConfig:  tlsConfig,
 			HandshakeTimeout: timeout * time.Second,
 		}
 	} else {
@@ -134,34 +390,46 @@ func newClient(tnsWsUrl string, apiKey string, insecureSkipVerify bool) (*Client
 			HandshakeTimeout: timeout * time.Second,
 		}
 	}
-	legacyTns := true
-	if path == modernPath {
-		legacyTns = false
-	}
 
 	klog.V(3).Infof("tnsWsUrl: %s", tnsWsUrl)
 
 	// Perform a WebSocket connection
-	conn, _, err := dialer.Dial(tnsWsUrl, nil)
+	conn, _, err := dialer.DialContext(ctx, tnsWsUrl, nil)
 	if err != nil {
-		csiErr := NewCsiError(codes.Internal, err)
+		if ctx.Err() != nil {
+			// The caller gave up, not a failure of the server
+			csiErr := NewCsiError(codes.DeadlineExceeded, ctx.Err())
+			klog.Errorf("WebSocket connection abandoned: %s", csiErr)
+			return nil, csiErr
+		}
+		if isTLSVerificationError(err) {
+			csiErr := NewCsiError(codes.FailedPrecondition, fmt.Errorf("TLS certificate verification failed for %s. Check the 'tlsCaCert', 'tlsCertSha256' and 'tlsServerName' keys of the secret: %w", tnsWsUrl, err))
+			klog.Errorf("WebSocket connection failed: %s", csiErr)
+			return nil, csiErr
+		}
+		csiErr := NewCsiError(codes.Unavailable, &connectionError{err: err})
 		klog.Errorf("WebSocket connection failed: %s", csiErr)
 		return nil, csiErr
 	}
 	klog.V(3).Infof("WebSocket connection established with %s", tnsWsUrl)
 
+	// The handshake must complete before the deadline of the caller
+	handshakeDeadline := deadlineFromContext(ctx)
+	_ = conn.SetWriteDeadline(handshakeDeadline)
+	_ = conn.SetReadDeadline(handshakeDeadline)
+
 	// Send WebSocket "connect" message
 	if legacyTns {
 		jsonMessage := []byte(`{"msg": "connect", "version": "1", "support": ["1" ]}`)
 		if err := conn.WriteMessage(websocket.TextMessage, jsonMessage); err != nil {
-			csiErr := NewCsiError(codes.Internal, err)
+			csiErr := NewCsiError(codes.Unavailable, &connectionError{err: err})
 			klog.Errorf("Failed to send connect message: %s", csiErr)
 			conn.Close()
 			return nil, csiErr
 		}
 		_, response, err := conn.ReadMessage()
 		if err != nil {
-			csiErr := NewCsiError(codes.Internal, err)
+			csiErr := NewCsiError(codes.Unavailable, &connectionError{err: err})
 			klog.Errorf("Failed to read connect response: %s", csiErr)
 			conn.Close()
 			return nil, csiErr
@@ -169,36 +437,439 @@ func newClient(tnsWsUrl string, apiKey string, insecureSkipVerify bool) (*Client
 		klog.V(3).Infof("Truenas Connect OK: %s", string(response))
 	}
 
-	// Login
-	csiErr := TNSLogin(legacyTns, conn, apiKey)
-	if csiErr != nil {
+	// From now on, the write deadline is set per message and the reader goroutine waits forever
+	_ = conn.SetWriteDeadline(time.Time{})
+	_ = conn.SetReadDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// reconnect replaces a lost WebSocket. Concurrent callers share the same new WebSocket
+func (client *Client) reconnect(ctx context.Context, lost chan struct{}) *CsiError {
+	client.reconnectMu.Lock()
+	defer client.reconnectMu.Unlock()
+
+	client.pendingMu.Lock()
+	current := client.done
+	client.pendingMu.Unlock()
+	if current != lost {
+		// Already done by another caller
+		return nil
+	}
+
+	klog.Warningf("Reconnecting to %s", client.tnsWsUrl)
+	return client.connect(ctx)
+}
+
+// closeConn closes the current WebSocket. The reader goroutine then wakes up all the callers
+func (client *Client) closeConn() {
+	client.pendingMu.Lock()
+	conn := client.conn
+	client.pendingMu.Unlock()
+	if conn != nil {
 		conn.Close()
-		return nil, csiErr
+	}
+}
+
+// readLoop is the only goroutine reading the WebSocket
+func (client *Client) readLoop(conn *websocket.Conn, done chan struct{}) {
+	var err error
+	defer func() {
+		client.pendingMu.Lock()
+		if client.done == done {
+			client.readErr = err
+			for collection, subs := range client.subscribers {
+				for _, ch := range subs {
+					close(ch)
+				}
+				delete(client.subscribers, collection)
+			}
+		}
+		close(done) // Wake up all the callers waiting for a response on this WebSocket
+		client.pendingMu.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		var message []byte
+		_, message, err = conn.ReadMessage()
+		if err != nil {
+			klog.V(3).Infof("WebSocket reader stopped: %v", err)
+			return
+		}
+		client.lastRead.Store(time.Now().UnixNano())
+		client.dispatch(message)
+	}
+}
+
+// keepAlive pings an idle WebSocket and closes it when the pong does not come back in time
+// (eg Truenas Scale rebooting: the TCP connection may stay open for a long time)
+func (client *Client) keepAlive(conn *websocket.Conn, done chan struct{}) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		if time.Since(client.lastReadTime()) < pingInterval {
+			// Messages received recently, the connection is alive
+			continue
+		}
+
+		pingAt := time.Now()
+		// WriteControl can be called concurrently with the other methods
+		if err := conn.WriteControl(websocket.PingMessage, nil, pingAt.Add(pongTimeout)); err != nil {
+			klog.Warningf("Ping failed for %s: %v. Closing connection", client.tnsWsUrl, err)
+			conn.Close()
+			return
+		}
+
+		select {
+		case <-done:
+			return
+		case <-time.After(pongTimeout):
+		}
+		if client.lastReadTime().Before(pingAt) {
+			klog.Warningf("No pong received from %s within %s. Closing connection", client.tnsWsUrl, pongTimeout)
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (client *Client) lastReadTime() time.Time {
+	return time.Unix(0, client.lastRead.Load())
+}
+
+// wsEnvelope holds the fields needed to route a message received from Truenas Scale
+type wsEnvelope struct {
+	ID     json.RawMessage `json:"id"`     // request id for a response. Object id for a legacy collection update
+	Msg    string          `json:"msg"`    // Truenas Scale < 25.x: "result", "added", "changed", "removed", "ping"...
+	Method string          `json:"method"` // Truenas Scale >= 25.x: set for notifications, eg "collection_update"
+	Params json.RawMessage `json:"params"`
+}
+
+func (client *Client) dispatch(message []byte) {
+	var envelope wsEnvelope
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		klog.Errorf("Failed to decode message received from truenas: %v", err)
+		return
+	}
+
+	if client.legacyTns {
+		switch envelope.Msg {
+		case "result":
+			client.deliverResponse(envelope.ID, message)
+		case "added", "changed", "removed":
+			var notification WSNotification
+			if err := json.Unmarshal(message, &notification); err != nil {
+				klog.Errorf("Failed to decode notification: %v", err)
+				return
+			}
+			client.deliverNotification(&notification)
+		case "ping":
+			client.write([]byte(`{"msg": "pong"}`))
+		default:
+			klog.V(4).Infof("Ignoring message: %s", string(message))
+		}
+		return
+	}
+
+	// JSON-RPC notifications have a method and no id
+	if envelope.Method != "" {
+		if envelope.Method != "collection_update" {
+			klog.V(4).Infof("Ignoring notification: %s", string(message))
+			return
+		}
+		var notification WSNotification
+		if err := json.Unmarshal(envelope.Params, &notification); err != nil {
+			klog.Errorf("Failed to decode notification: %v", err)
+			return
+		}
+		client.deliverNotification(&notification)
+		return
+	}
+	client.deliverResponse(envelope.ID, message)
+}
+
+func (client *Client) deliverResponse(rawID json.RawMessage, message []byte) {
+	var id string
+	if err := json.Unmarshal(rawID, &id); err != nil {
+		klog.Warningf("Ignoring response with an unexpected id: %s", string(message))
+		return
+	}
+
+	client.pendingMu.Lock()
+	ch, ok := client.pending[id]
+	delete(client.pending, id)
+	client.pendingMu.Unlock()
+
+	if !ok {
+		klog.Warningf("Ignoring response for unknown request id %s", id)
+		return
+	}
+	ch <- message // buffered, never blocks
+}
+
+func (client *Client) deliverNotification(notification *WSNotification) {
+	klog.V(4).Infof("Notification %s for %s", notification.Msg, notification.Collection)
+
+	client.pendingMu.Lock()
+	defer client.pendingMu.Unlock()
+
+	for _, ch := range client.subscribers[notification.Collection] {
+		select {
+		case ch <- notification:
+		default:
+			klog.Warningf("Subscriber for %s is too slow, notification dropped", notification.Collection)
+		}
+	}
+}
+
+// Subscribe registers a local subscriber for the notifications of a collection (eg "core.get_jobs")
+// The subscription on the Truenas Scale side must be done separately
+// The channel is closed when the connection is closed or when the returned function is called
+func (client *Client) Subscribe(collection string) (<-chan *WSNotification, func()) {
+	ch := make(chan *WSNotification, 64)
+
+	client.pendingMu.Lock()
+	select {
+	case <-client.done:
+		close(ch)
+		client.pendingMu.Unlock()
+		return ch, func() {}
+	default:
+	}
+	client.subscribers[collection] = append(client.subscribers[collection], ch)
+	client.pendingMu.Unlock()
+
+	unsubscribe := func() {
+		client.pendingMu.Lock()
+		defer client.pendingMu.Unlock()
+		subs := client.subscribers[collection]
+		for i, sub := range subs {
+			if sub == ch {
+				client.subscribers[collection] = append(subs[:i], subs[i+1:]...)
+				close(ch)
+				break
+			}
+		}
+	}
+	return ch, unsubscribe
+}
+
+// SubscribeRemote asks Truenas Scale to send the notifications of a collection on this connection
+// This is done once per connection, the subscription lasts as long as the connection
+func (client *Client) SubscribeRemote(ctx context.Context, collection string) *CsiError {
+	client.subscribeMu.Lock()
+	defer client.subscribeMu.Unlock()
+
+	if client.remoteSubs[collection] {
+		return nil
+	}
+
+	if client.legacyTns {
+		// Legacy subscriptions are not acknowledged
+		message, _ := json.Marshal(map[string]string{"msg": "sub", "id": uuid.New().String(), "name": collection})
+		if err := client.writeWithDeadline(deadlineFromContext(ctx), message); err != nil {
+			return NewCsiError(codes.Unavailable, err)
+		}
+	} else {
+		if csiErr := TNSCoreSubscribe(ctx, client, collection); csiErr != nil {
+			return csiErr
+		}
+	}
+
+	client.remoteSubs[collection] = true
+	return nil
+}
+
+// roundTrip sends a request and waits for the response with the same id, until the context is done
+func (client *Client) roundTrip(ctx context.Context, id string, request []byte) ([]byte, error) {
+	ch := make(chan []byte, 1)
+
+	client.pendingMu.Lock()
+	done := client.done
+	select {
+	case <-done:
+		client.pendingMu.Unlock()
+		return nil, client.closedError()
+	default:
+	}
+	client.pending[id] = ch
+	client.pendingMu.Unlock()
+
+	forget := func() {
+		client.pendingMu.Lock()
+		delete(client.pending, id)
+		client.pendingMu.Unlock()
+	}
+
+	if err := client.writeWithDeadline(deadlineFromContext(ctx), request); err != nil {
+		forget()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, &connectionError{err: err}
+	}
+
+	select {
+	case response := <-ch:
+		return response, nil
+	case <-done:
+		forget()
+		return nil, client.closedError()
+	case <-ctx.Done():
+		// The response, if any, will be ignored by the reader goroutine
+		forget()
+		klog.Warningf("Request %s abandoned: %v", id, ctx.Err())
+		return nil, ctx.Err()
+	}
+}
+
+func (client *Client) write(message []byte) error {
+	return client.writeWithDeadline(time.Now().Add(timeout*time.Second), message)
+}
+
+func (client *Client) writeWithDeadline(deadline time.Time, message []byte) error {
+	client.pendingMu.Lock()
+	conn := client.conn
+	client.pendingMu.Unlock()
+
+	client.writeMu.Lock()
+	defer client.writeMu.Unlock()
+	_ = conn.SetWriteDeadline(deadline)
+	return conn.WriteMessage(websocket.TextMessage, message)
+}
+
+// deadlineFromContext returns the deadline of the context, or the default timeout if there is none
+// or if it is longer than the default timeout (writes must not wait on a stalled connection)
+func deadlineFromContext(ctx context.Context) time.Time {
+	deadline := time.Now().Add(timeout * time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		return d
+	}
+	return deadline
+}
+
+func (client *Client) closedError() error {
+	client.pendingMu.Lock()
+	defer client.pendingMu.Unlock()
+	if client.readErr != nil {
+		return &connectionError{err: fmt.Errorf("connection closed: %w", client.readErr)}
+	}
+	return &connectionError{err: errors.New("connection closed")}
+}
+
+// buildTLSConfig builds the tls.Config used to dial a wss:// url
+// - with a CA bundle, the server certificate must be signed by one of the CAs
+// - with a pin only, the server certificate must match the fingerprint. The chain is not verified (eg self-signed certificates)
+// - with a CA bundle and a pin, both checks are done
+func buildTLSConfig(opts *TLSOptions) (*tls.Config, *CsiError) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: opts.ServerName,
 	}
 
-	return &Client{
-		legacyTns: legacyTns,
-		conn:      conn,
-		inUse:     true,
-	}, nil
+	if opts.InsecureSkipVerify {
+		klog.Warning("TLS certificate verification is disabled")
+		tlsConfig.InsecureSkipVerify = true
+		return tlsConfig, nil
+	}
+
+	if opts.CACert != "" {
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM([]byte(opts.CACert)) {
+			return nil, NewCsiError(codes.InvalidArgument, errors.New("no valid PEM certificate found in the CA bundle"))
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if opts.CertSHA256 != "" {
+		pin, err := ParseCertFingerprint(opts.CertSHA256)
+		if err != nil {
+			return nil, NewCsiError(codes.InvalidArgument, err)
+		}
+		if opts.CACert == "" {
+			// Pin only: the pinned certificate is the trust anchor
+			tlsConfig.InsecureSkipVerify = true
+		}
+		// VerifyConnection is called even when InsecureSkipVerify is set
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return &pinError{msg: "no certificate presented by the server"}
+			}
+			fingerprint := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			if !strings.EqualFold(hex.EncodeToString(fingerprint[:]), pin) {
+				return &pinError{msg: fmt.Sprintf("server certificate fingerprint %x does not match the pinned fingerprint %s", fingerprint, pin)}
+			}
+			return nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// ParseCertFingerprint validates a SHA-256 fingerprint and returns it as lowercase hex without separators
+// Accepts "ab12..." or "AB:12:..." (openssl x509 -fingerprint -sha256 output)
+func ParseCertFingerprint(fingerprint string) (string, error) {
+	s := strings.ToLower(strings.TrimSpace(fingerprint))
+	s = strings.TrimPrefix(s, "sha256 fingerprint=")
+	s = strings.ReplaceAll(s, ":", "")
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("invalid SHA-256 certificate fingerprint '%s'", fingerprint)
+	}
+	return s, nil
+}
+
+type pinError struct {
+	msg string
+}
+
+func (e *pinError) Error() string {
+	return e.msg
+}
+
+func isTLSVerificationError(err error) bool {
+	var verificationErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certificateInvalidErr x509.CertificateInvalidError
+	var pinErr *pinError
+	return errors.As(err, &verificationErr) ||
+		errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &certificateInvalidErr) ||
+		errors.As(err, &pinErr)
 }
 
+// isAlive is cheap: the keepAlive goroutine closes the WebSocket when the pong is missing
+// It does not change lastActive, set when the client is released, that tells how long it has been idle
 func (client *Client) isAlive() bool {
 	klog.V(4).Infof("isAlive?")
 
-	if client.conn == nil {
+	client.pendingMu.Lock()
+	done := client.done
+	client.pendingMu.Unlock()
+
+	select {
+	case <-done:
+		klog.V(3).Infof("Connection closed. isAlive: No")
 		return false
+	default:
 	}
 
-	client.lastActive = time.Now()
-
-	err := client.conn.WriteMessage(websocket.PingMessage, nil)
-	if err != nil {
-		klog.Errorf("Ping failed for connection: %s. isAlive: No", err)
-		return false // Connection is dead or unreachable
+	if time.Since(client.lastReadTime()) > pingInterval+pongTimeout {
+		// The keepAlive goroutine should have closed it already
+		klog.V(3).Infof("Nothing received for %s. isAlive: No", time.Since(client.lastReadTime()))
+		return false
 	}
 
-	// set a timeout for a Pong response using ReadMessage or a dedicated goroutine?
 	klog.V(3).Infof("isAlive: Yes")
 	return true
 }
@@ -222,20 +893,25 @@ func cleanupInactiveConnections(maxIdleTime time.Duration) {
 	pool.mu.Lock()
 	defer pool.mu.Unlock()
 
-	for host, clients := range pool.conns {
+	// Connections opened with an api key no more used (eg rotated secret) are closed here too
+	for key, clients := range pool.conns {
 		activeClients := []*Client{}
 		for _, client := range clients {
 			client.mu.Lock()
 
-			if time.Since(client.lastActive) > maxIdleTime {
-				klog.V(3).Infof("Closing inactive WebSocket connection for %s", host)
-				client.conn.Close()
+			if client.refs == 0 && time.Since(client.lastActive) > maxIdleTime {
+				klog.V(3).Infof("Closing inactive WebSocket connection for %s", strings.Split(key, "#")[0])
+				client.closeConn()
 			} else {
 				activeClients = append(activeClients, client) // Keep active clients
 			}
 
 			client.mu.Unlock()
 		}
-		pool.conns[host] = activeClients
+		if len(activeClients) == 0 {
+			delete(pool.conns, key)
+		} else {
+			pool.conns[key] = activeClients
+		}
 	}
 }
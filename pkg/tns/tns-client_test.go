@@ -0,0 +1,353 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+)
+
+// fakeTruenas is a minimal Truenas Scale v25.04+ JSON-RPC server
+// "test.echo" replies with its first parameter, after the delay (ms) given as second parameter
+// "test.notify" sends a collection_update notification before replying
+// "test.query" replies "ok", "test.drop" closes the connection without replying
+// "core.subscribe" to "core.get_jobs" plays jobScript for job 7, "core.get_jobs" returns its current state
+// "auth.login_with_api_key" accepts "good-key", closes the connection for "drop-key", replies after 200ms
+// for "slow-key" and "slow-good-key" (accepted) and replies a string for "junk-key"
+// The other methods reply with their result in results, "service.start" sets the state of the service to RUNNING
+type fakeTruenas struct {
+	server *httptest.Server
+
+	mu        sync.Mutex
+	jobState  map[string]interface{}
+	jobScript []map[string]interface{}
+	aborted   bool
+	results   map[string]interface{}
+}
+
+func newFakeTruenas(t *testing.T) *fakeTruenas {
+	upgrader := websocket.Upgrader{}
+	f := &fakeTruenas{}
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade failed: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		var writeMu sync.Mutex
+		send := func(v interface{}) {
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			_ = conn.WriteJSON(v)
+		}
+
+		for {
+			var req WSRequest
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+			params, _ := req.Params.([]interface{})
+			switch req.Method {
+			case "auth.login_with_api_key":
+				switch params[0] {
+				case "drop-key":
+					return
+				case "slow-key", "slow-good-key":
+					time.Sleep(200 * time.Millisecond)
+				case "junk-key":
+					send(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": "yes"})
+					continue
+				}
+				send(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": params[0] == "good-key" || params[0] == "slow-good-key"})
+			case "test.echo":
+				go func(id string, params []interface{}) {
+					time.Sleep(time.Duration(params[1].(float64)) * time.Millisecond)
+					send(map[string]interface{}{"jsonrpc": "2.0", "id": id, "result": params[0]})
+				}(req.ID, params)
+			case "test.notify":
+				send(map[string]interface{}{"jsonrpc": "2.0", "method": "collection_update", "params": map[string]interface{}{
+					"msg": "changed", "collection": "core.get_jobs", "id": 42, "fields": map[string]interface{}{"state": "RUNNING"},
+				}})
+				send(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": true})
+			case "test.query":
+				send(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": "ok"})
+			case "test.drop":
+				return
+			case "core.subscribe":
+				send(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": "sub-1"})
+				go func() {
+					f.mu.Lock()
+					script := f.jobScript
+					f.mu.Unlock()
+					for _, state := range script {
+						time.Sleep(20 * time.Millisecond)
+						f.mu.Lock()
+						f.jobState = state
+						f.mu.Unlock()
+						send(map[string]interface{}{"jsonrpc": "2.0", "method": "collection_update", "params": map[string]interface{}{
+							"msg": "changed", "collection": "core.get_jobs", "id": 7, "fields": state,
+						}})
+					}
+				}()
+			case "core.get_jobs":
+				f.mu.Lock()
+				state := f.jobState
+				f.mu.Unlock()
+				send(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": []interface{}{state}})
+			case "core.job_abort":
+				f.mu.Lock()
+				f.aborted = true
+				f.mu.Unlock()
+				send(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": nil})
+			case "service.start":
+				f.mu.Lock()
+				if services, ok := f.results["service.query"].([]interface{}); ok && len(services) > 0 {
+					services[0].(map[string]interface{})["state"] = "RUNNING"
+				}
+				f.mu.Unlock()
+				send(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": true})
+			default:
+				f.mu.Lock()
+				result, ok := f.results[req.Method]
+				f.mu.Unlock()
+				if ok {
+					send(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": result})
+					continue
+				}
+				send(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "error": map[string]interface{}{
+					"code": -32001, "message": "Method call error", "data": map[string]interface{}{"error": 22, "errname": "EINVAL", "reason": "unknown method"},
+				}})
+			}
+		}
+	}))
+	return f
+}
+
+func (f *fakeTruenas) url() string {
+	return strings.Replace(f.server.URL, "http://", "ws://", 1) + modernPath
+}
+
+func TestClientConcurrentCalls(t *testing.T) {
+	f := newFakeTruenas(t)
+	defer f.server.Close()
+
+	client, csiErr := GetClient(context.Background(), f.url(), &Credentials{ApiKey: "good-key"})
+	if csiErr != nil {
+		t.Fatalf("GetClient failed: %v", csiErr)
+	}
+	defer ReleaseClient(client)
+
+	// Responses arrive in reverse order: each caller must get its own response
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := callTS[string](context.Background(), client, "test.echo", []interface{}{fmt.Sprintf("call-%d", i), (10 - i) * 20})
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("call-%d", i), res)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestClientNotifications(t *testing.T) {
+	f := newFakeTruenas(t)
+	defer f.server.Close()
+
+	client, csiErr := GetClient(context.Background(), f.url(), &Credentials{ApiKey: "good-key"})
+	if csiErr != nil {
+		t.Fatalf("GetClient failed: %v", csiErr)
+	}
+	defer ReleaseClient(client)
+
+	notifications, unsubscribe := client.Subscribe("core.get_jobs")
+	defer unsubscribe()
+
+	res, err := callTS[bool](context.Background(), client, "test.notify", []interface{}{})
+	assert.NoError(t, err)
+	assert.True(t, res)
+
+	select {
+	case n := <-notifications:
+		assert.Equal(t, "changed", n.Msg)
+		assert.Equal(t, json.RawMessage("42"), n.ID)
+	case <-time.After(2 * time.Second):
+		t.Fatal("notification not received")
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	f := newFakeTruenas(t)
+	defer f.server.Close()
+
+	_, csiErr := GetClient(context.Background(), f.url(), &Credentials{ApiKey: "bad-key"})
+	assert.NotNil(t, csiErr)
+
+	client, csiErr := GetClient(context.Background(), f.url(), &Credentials{ApiKey: "good-key"})
+	if csiErr != nil {
+		t.Fatalf("GetClient failed: %v", csiErr)
+	}
+	defer ReleaseClient(client)
+
+	_, err := callTS[bool](context.Background(), client, "test.unknown", []interface{}{})
+	customErr, ok := err.(CustomError)
+	assert.True(t, ok)
+	assert.Equal(t, "unknown method", customErr.Reason)
+}
+
+func TestClientLoginErrors(t *testing.T) {
+	f := newFakeTruenas(t)
+	defer f.server.Close()
+
+	// Only a refusal of the api key is Unauthenticated, which evicts the pooled connections opened with it
+	for _, test := range []struct {
+		apiKey   string
+		timeout  time.Duration
+		expected codes.Code
+	}{
+		{apiKey: "drop-key", expected: codes.Unavailable},
+		{apiKey: "slow-key", timeout: 50 * time.Millisecond, expected: codes.DeadlineExceeded},
+		{apiKey: "junk-key", expected: codes.Internal},
+		{apiKey: "bad-key", expected: codes.Unauthenticated},
+	} {
+		ctx := context.Background()
+		if test.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, test.timeout)
+			defer cancel()
+		}
+		_, csiErr := newClient(ctx, f.url(), &Credentials{ApiKey: test.apiKey})
+		if assert.NotNil(t, csiErr, test.apiKey) {
+			assert.Equal(t, test.expected, csiErr.Code, test.apiKey)
+		}
+	}
+}
+
+func TestClientSharedPerCredentials(t *testing.T) {
+	f := newFakeTruenas(t)
+	defer f.server.Close()
+
+	creds := &Credentials{ApiKey: "good-key"}
+	client1, csiErr := GetClient(context.Background(), f.url(), creds)
+	assert.Nil(t, csiErr)
+	client2, csiErr := GetClient(context.Background(), f.url(), creds)
+	assert.Nil(t, csiErr)
+	assert.Same(t, client1, client2)
+
+	client3, csiErr := GetClient(context.Background(), f.url(), &Credentials{ApiKey: "good-key", TLS: TLSOptions{ServerName: "other"}})
+	assert.Nil(t, csiErr)
+	assert.NotSame(t, client1, client3)
+
+	ReleaseClient(client1)
+	ReleaseClient(client2)
+	ReleaseClient(client3)
+}
+
+func TestClientDialOutsidePoolLock(t *testing.T) {
+	f := newFakeTruenas(t)
+	defer f.server.Close()
+
+	client, csiErr := GetClient(context.Background(), f.url(), &Credentials{ApiKey: "good-key"})
+	assert.Nil(t, csiErr)
+	ReleaseClient(client)
+
+	// While a connection with other credentials logs in, the pooled ones are still given
+	// and the callers with the same credentials wait for it instead of opening their own
+	slow := make(chan *Client, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			client, csiErr := GetClient(context.Background(), f.url(), &Credentials{ApiKey: "slow-good-key"})
+			assert.Nil(t, csiErr)
+			slow <- client
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	client, csiErr = GetClient(context.Background(), f.url(), &Credentials{ApiKey: "good-key"})
+	assert.Nil(t, csiErr)
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+	ReleaseClient(client)
+
+	client1, client2 := <-slow, <-slow
+	assert.Same(t, client1, client2)
+	ReleaseClient(client1)
+	ReleaseClient(client2)
+}
+
+func TestClientIdleCleanup(t *testing.T) {
+	f := newFakeTruenas(t)
+	defer f.server.Close()
+
+	creds := &Credentials{ApiKey: "good-key", TLS: TLSOptions{ServerName: "idle"}}
+	client, csiErr := GetClient(context.Background(), f.url(), creds)
+	assert.Nil(t, csiErr)
+	ReleaseClient(client)
+
+	// Checking the connection does not make it active again
+	client.mu.Lock()
+	client.lastActive = time.Now().Add(-time.Hour)
+	assert.True(t, client.isAlive())
+	client.mu.Unlock()
+
+	cleanupInactiveConnections(time.Minute)
+	pool.mu.Lock()
+	_, pooled := pool.conns[poolKey(f.url(), creds)]
+	pool.mu.Unlock()
+	assert.False(t, pooled)
+}
+
+func TestClientContextDeadline(t *testing.T) {
+	f := newFakeTruenas(t)
+	defer f.server.Close()
+
+	client, csiErr := GetClient(context.Background(), f.url(), &Credentials{ApiKey: "good-key"})
+	if csiErr != nil {
+		t.Fatalf("GetClient failed: %v", csiErr)
+	}
+	defer ReleaseClient(client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := callTS[string](ctx, client, "test.echo", []interface{}{"late", 500})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, codes.DeadlineExceeded, NewCsiError(codes.Internal, err).Code)
+
+	// The connection is still usable after an abandoned call
+	res, err := callTS[string](context.Background(), client, "test.echo", []interface{}{"ok", 0})
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", res)
+}
+
+func TestIsSensitiveRequest(t *testing.T) {
+	assert.True(t, isSensitiveRequest("auth.login_with_api_key", []byte(`{"params":["1-abc"]}`)))
+	assert.True(t, isSensitiveRequest("pool.dataset.unlock", []byte(`{"params":["pool/ds",{}]}`)))
+	assert.True(t, isSensitiveRequest("pool.dataset.create", []byte(`{"params":[{"name":"pool/ds","encryption_options":{"passphrase":"secret"}}]}`)))
+	assert.False(t, isSensitiveRequest("pool.dataset.create", []byte(`{"params":[{"name":"pool/ds"}]}`)))
+}
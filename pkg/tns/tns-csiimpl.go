@@ -15,7 +15,9 @@
 package tns
 
 import (
+	"context"
 	"fmt"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -25,24 +27,29 @@ import (
 	"k8s.io/klog/v2"
 )
 
-func CsiVolumeCreate(tnsWsUrl string, apiKey string, driverName string, dsName string, reqCapacity int64, parameters map[string]string) (*string, *string, *CsiError) {
-	klog.V(2).Infof("*** CsiVolumeCreate tnsWsUrl: %s dsName: %s reqCapacity: %d", tnsWsUrl, dsName, reqCapacity)
+func CsiVolumeCreate(ctx context.Context, tnsWsUrl string, creds *Credentials, driverName string, dsName string, volumeID string, reqCapacity int64, space SpaceOptions, properties map[string]interface{}, encryption *EncryptionOptions, parameters map[string]string) (*string, *string, *CsiError) {
+	klog.V(2).Infof("*** CsiVolumeCreate tnsWsUrl: %s dsName: %s volumeID: %s reqCapacity: %d encrypted: %t", tnsWsUrl, dsName, volumeID, reqCapacity, encryption != nil)
 	defer klog.V(2).Info("*** CsiVolumeCreate")
 
-	client, csiErr := GetClient(tnsWsUrl, apiKey, true)
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
 	if csiErr != nil {
 		return nil, nil, csiErr
 	}
 	defer ReleaseClient(client)
 
-	ds, csiErr := TNSDatasetCreate(client, driverName, dsName, reqCapacity, parameters)
+	ds, csiErr := TNSDatasetCreate(ctx, client, driverName, dsName, volumeID, reqCapacity, space, properties, encryption, parameters)
 	if csiErr != nil {
 		if csiErr.Code == codes.AlreadyExists {
-			// If ds exists with same capacity and params, use the existing one
-			different, nfsSharePath, csiErr2 := isDifferentVolume(client, dsName, reqCapacity, parameters)
+			// If ds exists with same capacity and params, use the existing one. Its share may be missing after a
+			// failure, or because the dataset has been cloned by CsiVolumeClone
+			different, ds, csiErr2 := isDifferentVolume(ctx, client, dsName, reqCapacity, space, properties, encryption != nil, parameters)
 			if (csiErr2 != nil) || different {
 				return nil, nil, logAndReturnError("Failed to create dataset", csiErr2)
 			}
+			nfsSharePath, csiErr := ensureNfsShare(ctx, client, ds.MountPoint, parameters)
+			if csiErr != nil {
+				return nil, nil, logAndReturnError("Failed to create NFS share", csiErr)
+			}
 			klog.V(2).Info("Dataset with same specs already exists. Use it")
 			return &dsName, nfsSharePath, nil
 		} else {
@@ -50,14 +57,14 @@ func CsiVolumeCreate(tnsWsUrl string, apiKey string, driverName string, dsName s
 		}
 	}
 
-	if csiErr := TNSDatasetSetPermissions(client, ds.MountPoint, parameters); csiErr != nil {
-		cleanupDataset(client, ds.Name)
+	if csiErr := TNSDatasetSetPermissions(ctx, client, ds.MountPoint, parameters); csiErr != nil {
+		cleanupDataset(ctx, client, ds.Name)
 		return nil, nil, logAndReturnError("Failed to set permissions", csiErr)
 	}
 
-	nfsSharePath, csiErr := TNSShareNfsCreate(client, ds.MountPoint, parameters)
+	nfsSharePath, csiErr := TNSShareNfsCreate(ctx, client, ds.MountPoint, parameters)
 	if csiErr != nil {
-		cleanupDataset(client, ds.Name)
+		cleanupDataset(ctx, client, ds.Name)
 		return nil, nil, logAndReturnError("Failed to create NFS share", csiErr)
 	}
 
@@ -65,18 +72,25 @@ func CsiVolumeCreate(tnsWsUrl string, apiKey string, driverName string, dsName s
 	return &dsName, nfsSharePath, nil
 }
 
-func CsiVolumeDelete(tnsWsUrl string, apiKey string, dsName string) *CsiError {
+func CsiVolumeDelete(ctx context.Context, tnsWsUrl string, creds *Credentials, dsName string) *CsiError {
 	klog.V(2).Infof("*** CsiVolumeDelete tnsWsUrl: %s dsName: %s", tnsWsUrl, dsName)
 	defer klog.V(2).Info("*** CsiVolumeDelete")
 
-	client, csiErr := GetClient(tnsWsUrl, apiKey, true)
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
 	if csiErr != nil {
 		return csiErr
 	}
 	defer ReleaseClient(client)
 
+	// The clones of its snapshots must not depend on it anymore
+	csiErr = promoteDependentClones(ctx, client, dsName)
+	if csiErr != nil {
+		klog.Errorf("Volume delete failed:: %s", csiErr)
+		return csiErr
+	}
+
 	// delete ds + share + snapshots
-	csiErr = TNSDatasetDelete(client, dsName)
+	csiErr = TNSDatasetDelete(ctx, client, dsName)
 	if csiErr != nil {
 		klog.Errorf("Volume delete failed:: %s", csiErr)
 		return csiErr
@@ -86,11 +100,11 @@ func CsiVolumeDelete(tnsWsUrl string, apiKey string, dsName string) *CsiError {
 	return nil
 }
 
-func CsiVolumeArchive(tnsWsUrl string, apiKey string, rootDataset string, dsName string, archivePrefix string) *CsiError {
+func CsiVolumeArchive(ctx context.Context, tnsWsUrl string, creds *Credentials, rootDataset string, dsName string, archivePrefix string) *CsiError {
 	klog.V(2).Infof("*** CsiVolumeArchive tnsWsUrl: %s rootDataset: %s dsName: %s archivePrefix: %s", tnsWsUrl, rootDataset, dsName, archivePrefix)
 	defer klog.V(2).Info("*** CsiVolumeArchive")
 
-	client, csiErr := GetClient(tnsWsUrl, apiKey, true)
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
 	if csiErr != nil {
 		return csiErr
 	}
@@ -101,17 +115,17 @@ func CsiVolumeArchive(tnsWsUrl string, apiKey string, rootDataset string, dsName
 	archiveDsName := rootDataset + "/" + archivePrefix + "_" + baseDsName
 
 	// Take snapshot
-	snapshot, csiErr := TNSSnapshotCreate(client, dsName, tempSnapshotName)
+	snapshot, csiErr := TNSSnapshotCreate(ctx, client, dsName, tempSnapshotName)
 	if csiErr != nil {
 		klog.Errorf("Volume archive failed during snapshot creation: %s", csiErr)
 		return csiErr
 	}
 
 	// Restore snapshot into new archive ds
-	csiErr = TNSSnapshotClone(client, snapshot.Name, archiveDsName)
+	csiErr = TNSSnapshotClone(ctx, client, snapshot.Name, archiveDsName)
 	if csiErr != nil {
 		klog.Errorf("Volume archive failed during snapshot cloning: %s", csiErr)
-		_, csiErr2 := TNSSnapshotDelete(client, snapshot.Name)
+		_, csiErr2 := TNSSnapshotDelete(ctx, client, snapshot.Name, false)
 		if csiErr2 != nil {
 			klog.Errorf("Snapshot cleanup failed. Ignoring: %s", csiErr2)
 		}
@@ -119,14 +133,14 @@ func CsiVolumeArchive(tnsWsUrl string, apiKey string, rootDataset string, dsName
 	}
 
 	// Promote archive ds
-	csiErr = TNSDatasetPromote(client, archiveDsName)
+	csiErr = TNSDatasetPromote(ctx, client, archiveDsName)
 	if csiErr != nil {
 		klog.Errorf("Volume archive failed during dataset promotion: %s", csiErr)
-		_, csiErr2 := TNSSnapshotDelete(client, snapshot.Name)
+		_, csiErr2 := TNSSnapshotDelete(ctx, client, snapshot.Name, false)
 		if csiErr2 != nil {
 			klog.Errorf("Snapshot cleanup failed. Ignoring: %s", csiErr2)
 		}
-		csiErr2 = TNSDatasetDelete(client, archiveDsName)
+		csiErr2 = TNSDatasetDelete(ctx, client, archiveDsName)
 		if csiErr2 != nil {
 			klog.Errorf("Archive Dataset cleanup failed. Ignoring: %s", csiErr2)
 		}
@@ -134,14 +148,14 @@ func CsiVolumeArchive(tnsWsUrl string, apiKey string, rootDataset string, dsName
 	}
 
 	// Delete base ds + snapshots + share
-	csiErr = TNSDatasetDelete(client, dsName)
+	csiErr = TNSDatasetDelete(ctx, client, dsName)
 	if csiErr != nil {
 		klog.Errorf("Volume archive failed during dataset deletion: %s", csiErr)
-		_, csiErr2 := TNSSnapshotDelete(client, snapshot.Name)
+		_, csiErr2 := TNSSnapshotDelete(ctx, client, snapshot.Name, false)
 		if csiErr2 != nil {
 			klog.Errorf("Snapshot cleanup failed. Ignoring: %s", csiErr2)
 		}
-		csiErr2 = TNSDatasetDelete(client, archiveDsName)
+		csiErr2 = TNSDatasetDelete(ctx, client, archiveDsName)
 		if csiErr2 != nil {
 			klog.Errorf("Archive Dataset cleanup failed. Ignoring: %s", csiErr2)
 		}
@@ -149,7 +163,7 @@ func CsiVolumeArchive(tnsWsUrl string, apiKey string, rootDataset string, dsName
 	}
 
 	// Delete Snapshot on archive
-	_, csiErr = TNSDatasetDestroySnapshotsJob(client, archiveDsName)
+	_, csiErr = TNSDatasetDestroySnapshotsJob(ctx, client, archiveDsName)
 	if csiErr != nil {
 		klog.Warningf("Delete Snapshot on archive dataset failed. Continue: %v", csiErr)
 	}
@@ -158,27 +172,29 @@ func CsiVolumeArchive(tnsWsUrl string, apiKey string, rootDataset string, dsName
 	return nil
 }
 
-func CsiDatasetClone(tnsWsUrl string, apiKey string, rootDataset string, srcDsName, destDsName string) *CsiError {
+func CsiDatasetClone(ctx context.Context, tnsWsUrl string, creds *Credentials, rootDataset string, srcDsName, destDsName string) *CsiError {
 	klog.V(2).Infof("*** CsiDatasetClone tnsWsUrl: %s rootDataset: %s srcDsName: %s destDsName: %s", tnsWsUrl, rootDataset, srcDsName, destDsName)
 	defer klog.V(2).Info("*** CsiDatasetClone")
 
-	client, csiErr := GetClient(tnsWsUrl, apiKey, true)
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
 	if csiErr != nil {
 		return csiErr
 	}
 	defer ReleaseClient(client)
 
 	snapshotName := uuid.New().String()
-	tempSnapshot, csiErr := TNSSnapshotCreate(client, srcDsName, snapshotName)
+	tempSnapshot, csiErr := TNSSnapshotCreate(ctx, client, srcDsName, snapshotName)
 	if csiErr != nil {
 		return csiErr
 	}
 
 	// Start Replication Job
-	jobID, csiErr := TNSOneTimeReplicationJob(client, srcDsName, snapshotName, destDsName)
+	jobID, csiErr := TNSOneTimeReplicationJob(ctx, client, srcDsName, snapshotName, destDsName)
 	if csiErr != nil {
-		// Try to cleanup the freshly created dataset
-		csiErr2 := TNSDatasetDelete(client, destDsName)
+		// Try to cleanup the freshly created dataset, even if the request has been cancelled
+		cleanupCtx, cancel := cleanupContext(ctx)
+		csiErr2 := TNSDatasetDelete(cleanupCtx, client, destDsName)
+		cancel()
 		if csiErr2 != nil {
 			klog.Warningf("Dataset delete/cleanup failed. Continue: %v", csiErr2)
 		}
@@ -186,9 +202,11 @@ func CsiDatasetClone(tnsWsUrl string, apiKey string, rootDataset string, srcDsNa
 	}
 
 	// Wait for Completion
-	if csiErr := waitForJobCompletion(client, jobID); csiErr != nil {
-		// Try to cleanup the freshly created dataset
-		csiErr2 := TNSDatasetDelete(client, destDsName)
+	if csiErr := waitForJobCompletion(ctx, client, jobID); csiErr != nil {
+		// Try to cleanup the freshly created dataset, even if the request has been cancelled
+		cleanupCtx, cancel := cleanupContext(ctx)
+		csiErr2 := TNSDatasetDelete(cleanupCtx, client, destDsName)
+		cancel()
 		if csiErr2 != nil {
 			klog.Warningf("Dataset delete/cleanup failed. Continue: %v", csiErr2)
 		}
@@ -196,13 +214,13 @@ func CsiDatasetClone(tnsWsUrl string, apiKey string, rootDataset string, srcDsNa
 	}
 
 	// Delete Source Snapshot
-	_, csiErr = TNSSnapshotDelete(client, tempSnapshot.Name)
+	_, csiErr = TNSSnapshotDelete(ctx, client, tempSnapshot.Name, false)
 	if csiErr != nil {
 		klog.Warningf("Delete Snapshot created for replication failed. Continue: %v", csiErr)
 	}
 
 	// Delete target Snapshot
-	_, csiErr = TNSDatasetDestroySnapshotsJob(client, destDsName)
+	_, csiErr = TNSDatasetDestroySnapshotsJob(ctx, client, destDsName)
 	if csiErr != nil {
 		klog.Warningf("Delete Snapshot created for replication failed. Continue: %v", csiErr)
 	}
@@ -211,18 +229,148 @@ func CsiDatasetClone(tnsWsUrl string, apiKey string, rootDataset string, srcDsNa
 	return nil
 }
 
-func CsiGetCapacity(tnsWsUrl string, apiKey string, dsName string) (*int64, *CsiError) {
+// CsiVolumeGet returns the dataset and its NFS share. They are nil when they do not exist
+func CsiVolumeGet(ctx context.Context, tnsWsUrl string, creds *Credentials, dsName string) (*TNSDataset, *TNSNFSShare, *CsiError) {
+	klog.V(2).Infof("*** CsiVolumeGet tnsWsUrl: %s dsName: %s", tnsWsUrl, dsName)
+	defer klog.V(2).Info("*** CsiVolumeGet")
+
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
+	if csiErr != nil {
+		return nil, nil, csiErr
+	}
+	defer ReleaseClient(client)
+
+	ds, csiErr := TNSDatasetGet(ctx, client, dsName)
+	if csiErr != nil {
+		if csiErr.Code == codes.NotFound {
+			return nil, nil, nil
+		}
+		return nil, nil, csiErr
+	}
+
+	share, csiErr := TNSShareNfsGet(ctx, client, ds.MountPoint)
+	if csiErr != nil {
+		return nil, nil, csiErr
+	}
+
+	klog.V(2).Info("++ Volume get successful")
+	return ds, share, nil
+}
+
+// CsiDatasetUnlock unlocks an encrypted dataset with its passphrase or its hex key, eg after a reboot of Truenas Scale.
+// It does nothing when the dataset is not locked
+func CsiDatasetUnlock(ctx context.Context, tnsWsUrl string, creds *Credentials, dsName string, passphrase string, key string) *CsiError {
+	klog.V(2).Infof("*** CsiDatasetUnlock tnsWsUrl: %s dsName: %s", tnsWsUrl, dsName)
+	defer klog.V(2).Info("*** CsiDatasetUnlock")
+
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
+	if csiErr != nil {
+		return csiErr
+	}
+	defer ReleaseClient(client)
+
+	ds, csiErr := TNSDatasetGet(ctx, client, dsName)
+	if csiErr != nil {
+		return csiErr
+	}
+	if !ds.Locked {
+		return nil
+	}
+
+	jobID, csiErr := TNSDatasetUnlockJob(ctx, client, dsName, passphrase, key)
+	if csiErr != nil {
+		return logAndReturnError("Failed to unlock dataset", csiErr)
+	}
+	if csiErr := waitForJobCompletion(ctx, client, jobID); csiErr != nil {
+		return logAndReturnError("Failed to unlock dataset", csiErr)
+	}
+
+	// The job succeeds when the key is wrong: the dataset is then reported as failed to unlock and stays locked
+	ds, csiErr = TNSDatasetGet(ctx, client, dsName)
+	if csiErr != nil {
+		return csiErr
+	}
+	if ds.Locked {
+		return logAndReturnError("Failed to unlock dataset", NewCsiError(codes.FailedPrecondition, fmt.Errorf("dataset %s is still locked: invalid passphrase or key", dsName)))
+	}
+
+	klog.V(2).Info("++ Dataset unlock successful")
+	return nil
+}
+
+// CsiVolumeList returns the datasets created by the driver under rootDataset
+func CsiVolumeList(ctx context.Context, tnsWsUrl string, creds *Credentials, driverName string, rootDataset string) ([]TNSDataset, *CsiError) {
+	klog.V(2).Infof("*** CsiVolumeList tnsWsUrl: %s rootDataset: %s", tnsWsUrl, rootDataset)
+	defer klog.V(2).Info("*** CsiVolumeList")
+
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
+	if csiErr != nil {
+		return nil, csiErr
+	}
+	defer ReleaseClient(client)
+
+	datasets, csiErr := TNSDatasetQueryChildren(ctx, client, driverName, rootDataset)
+	if csiErr != nil {
+		klog.Errorf("Volume list failed: %s", csiErr)
+		return nil, csiErr
+	}
+
+	klog.V(2).Infof("++ Volume list successful: %d dataset(s)", len(datasets))
+	return datasets, nil
+}
+
+// CsiGetProvisionedCapacity returns the capacity of the volumes created by the driver under rootDataset, except dsName,
+// and the space of rootDataset (used + available)
+func CsiGetProvisionedCapacity(ctx context.Context, tnsWsUrl string, creds *Credentials, driverName string, rootDataset string, dsName string) (int64, int64, *CsiError) {
+	klog.V(2).Infof("*** CsiGetProvisionedCapacity tnsWsUrl: %s rootDataset: %s dsName: %s", tnsWsUrl, rootDataset, dsName)
+	defer klog.V(2).Info("*** CsiGetProvisionedCapacity")
+
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
+	if csiErr != nil {
+		return 0, 0, csiErr
+	}
+	defer ReleaseClient(client)
+
+	root, csiErr := TNSDatasetGet(ctx, client, rootDataset)
+	if csiErr != nil {
+		klog.Errorf("Get Capacity get failed:: %s", csiErr)
+		return 0, 0, csiErr
+	}
+	space := root.Used.Size() + root.Available.Size()
+
+	datasets, csiErr := TNSDatasetQueryChildren(ctx, client, driverName, rootDataset)
+	if csiErr != nil {
+		klog.Errorf("Volume list failed: %s", csiErr)
+		return 0, 0, csiErr
+	}
+	var provisioned int64
+	for _, ds := range datasets {
+		switch {
+		case ds.Name == dsName:
+			// The volume being created, when a previous attempt has created it
+		case ds.Type == "VOLUME":
+			provisioned += ds.VolSize.Size()
+		default:
+			provisioned += ds.Capacity()
+		}
+	}
+
+	klog.V(2).Infof("++ Provisioned capacity get successful: %d/%d", provisioned, space)
+	return provisioned, space, nil
+}
+
+func CsiGetCapacity(ctx context.Context, tnsWsUrl string, creds *Credentials, dsName string) (*int64, *CsiError) {
 	klog.V(2).Infof("*** CsiGetCapacity tnsWsUrl: %s dsName: %s", tnsWsUrl, dsName)
 	defer klog.V(2).Info("*** CsiGetCapacity")
 
-	client, csiErr := GetClient(tnsWsUrl, apiKey, true)
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
 	if csiErr != nil {
 		return nil, csiErr
 	}
 	defer ReleaseClient(client)
 
 	// delete ds + share + snapshots
-	ds, csiErr := TNSDatasetGet(client, dsName)
+	ds, csiErr := TNSDatasetGet(ctx, client, dsName)
 	if csiErr != nil {
 		klog.Errorf("Get Capacity get failed:: %s", csiErr)
 		return nil, csiErr
@@ -241,25 +389,107 @@ func CsiGetCapacity(tnsWsUrl string, apiKey string, dsName string) (*int64, *Csi
 	return &availableCapacity, nil
 }
 
-func CsiSnapshotClone(tnsWsUrl string, apiKey string, rootDataset string, srcSnapshotName string, destDsName string) *CsiError {
+// CsiCheckBackendHealth checks that the volumes can be provisioned under rootDataset: the root dataset exists, is mounted
+// and unlocked, its pool is healthy and the service sharing the volumes is running. The service is started when
+// startService is true. The errors are FailedPrecondition, with the action to take on Truenas Scale
+func CsiCheckBackendHealth(ctx context.Context, tnsWsUrl string, creds *Credentials, rootDataset string, service string, startService bool) *CsiError {
+	klog.V(2).Infof("*** CsiCheckBackendHealth tnsWsUrl: %s rootDataset: %s service: %s startService: %t", tnsWsUrl, rootDataset, service, startService)
+	defer klog.V(2).Info("*** CsiCheckBackendHealth")
+
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
+	if csiErr != nil {
+		return csiErr
+	}
+	defer ReleaseClient(client)
+
+	root, csiErr := TNSDatasetGet(ctx, client, rootDataset)
+	if csiErr != nil {
+		if csiErr.Code == codes.NotFound {
+			return logAndReturnError("Backend health check failed", NewCsiError(codes.FailedPrecondition, fmt.Errorf("root dataset %s does not exist: create it on Truenas Scale or fix the rootDataset parameter", rootDataset)))
+		}
+		return csiErr
+	}
+	if root.Locked {
+		return logAndReturnError("Backend health check failed", NewCsiError(codes.FailedPrecondition, fmt.Errorf("root dataset %s is locked: unlock it on Truenas Scale", rootDataset)))
+	}
+	if root.MountPoint == "" {
+		return logAndReturnError("Backend health check failed", NewCsiError(codes.FailedPrecondition, fmt.Errorf("root dataset %s is not mounted: check its mountpoint on Truenas Scale", rootDataset)))
+	}
+
+	poolName := root.Pool
+	if poolName == "" {
+		poolName, _, _ = strings.Cut(rootDataset, "/")
+	}
+	pool, csiErr := TNSPoolGet(ctx, client, poolName)
+	if csiErr != nil {
+		return csiErr
+	}
+	if pool == nil {
+		return logAndReturnError("Backend health check failed", NewCsiError(codes.FailedPrecondition, fmt.Errorf("pool %s of root dataset %s does not exist: import it on Truenas Scale", poolName, rootDataset)))
+	}
+	if pool.Status != "ONLINE" || !pool.Healthy {
+		return logAndReturnError("Backend health check failed", NewCsiError(codes.FailedPrecondition, fmt.Errorf("pool %s is not healthy (status: %s): check its disks on Truenas Scale", poolName, pool.Status)))
+	}
+
+	svc, csiErr := TNSServiceGet(ctx, client, service)
+	if csiErr != nil {
+		return csiErr
+	}
+	if svc == nil {
+		return logAndReturnError("Backend health check failed", NewCsiError(codes.FailedPrecondition, fmt.Errorf("service %s does not exist on this version of Truenas Scale", service)))
+	}
+	if svc.State != "RUNNING" {
+		if !startService {
+			return logAndReturnError("Backend health check failed", NewCsiError(codes.FailedPrecondition, fmt.Errorf("service %s is not running (state: %s): start it on Truenas Scale, or set autoStartService to true in the storage class", service, svc.State)))
+		}
+		jobID, csiErr := TNSServiceStart(ctx, client, service)
+		if csiErr != nil {
+			return logAndReturnError("Failed to start service", csiErr)
+		}
+		if jobID != nil {
+			if csiErr := waitForJobCompletion(ctx, client, jobID); csiErr != nil {
+				return logAndReturnError("Failed to start service", csiErr)
+			}
+		}
+		svc, csiErr = TNSServiceGet(ctx, client, service)
+		if csiErr != nil {
+			return csiErr
+		}
+		if svc == nil || svc.State != "RUNNING" {
+			return logAndReturnError("Backend health check failed", NewCsiError(codes.FailedPrecondition, fmt.Errorf("service %s failed to start: check its configuration on Truenas Scale", service)))
+		}
+		klog.Infof("Service %s started", service)
+	}
+
+	klog.V(2).Info("++ Backend health check successful")
+	return nil
+}
+
+func CsiSnapshotClone(ctx context.Context, tnsWsUrl string, creds *Credentials, rootDataset string, srcSnapshotName string, destDsName string) *CsiError {
 	klog.V(2).Infof("*** CsiSnapshotClone tnsWsUrl: %s rootDataset: %s srcSnapshotName: %s destDsName: %s", tnsWsUrl, rootDataset, srcSnapshotName, destDsName)
 	defer klog.V(2).Info("*** CsiSnapshotClone")
 
-	client, csiErr := GetClient(tnsWsUrl, apiKey, true)
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
 	if csiErr != nil {
 		return csiErr
 	}
 	defer ReleaseClient(client)
 
-	snapshotParts := strings.Split(srcSnapshotName, "@")
-	dsName := snapshotParts[0]
-	snapshotName := snapshotParts[1]
+	snapshot, csiErr := findSnapshot(ctx, client, rootDataset, srcSnapshotName)
+	if csiErr != nil {
+		return csiErr
+	}
+	if snapshot == nil {
+		return NewCsiError(codes.NotFound, fmt.Errorf("snapshot %s does not exist", srcSnapshotName))
+	}
 
 	// Start Replication Job
-	jobID, csiErr := TNSOneTimeReplicationJob(client, dsName, snapshotName, destDsName)
+	jobID, csiErr := TNSOneTimeReplicationJob(ctx, client, snapshot.Dataset, snapshot.SnapshotName, destDsName)
 	if csiErr != nil {
-		// Try to cleanup the freshly created dataset
-		csiErr2 := TNSDatasetDelete(client, destDsName)
+		// Try to cleanup the freshly created dataset, even if the request has been cancelled
+		cleanupCtx, cancel := cleanupContext(ctx)
+		csiErr2 := TNSDatasetDelete(cleanupCtx, client, destDsName)
+		cancel()
 		if csiErr2 != nil {
 			klog.Warningf("Dataset delete/cleanup failed. Continue: %v", csiErr2)
 		}
@@ -267,9 +497,11 @@ func CsiSnapshotClone(tnsWsUrl string, apiKey string, rootDataset string, srcSna
 	}
 
 	// Wait for Completion
-	if csiErr := waitForJobCompletion(client, jobID); csiErr != nil {
-		// Try to cleanup the freshly created dataset
-		csiErr2 := TNSDatasetDelete(client, destDsName)
+	if csiErr := waitForJobCompletion(ctx, client, jobID); csiErr != nil {
+		// Try to cleanup the freshly created dataset, even if the request has been cancelled
+		cleanupCtx, cancel := cleanupContext(ctx)
+		csiErr2 := TNSDatasetDelete(cleanupCtx, client, destDsName)
+		cancel()
 		if csiErr2 != nil {
 			klog.Warningf("Dataset delete/cleanup failed. Continue: %v", csiErr2)
 		}
@@ -277,7 +509,7 @@ func CsiSnapshotClone(tnsWsUrl string, apiKey string, rootDataset string, srcSna
 	}
 
 	// Delete target snapshots
-	_, csiErr = TNSDatasetDestroySnapshotsJob(client, destDsName)
+	_, csiErr = TNSDatasetDestroySnapshotsJob(ctx, client, destDsName)
 	if csiErr != nil {
 		klog.Warningf("Delete Snapshot created for replication failed. Continue: %v", csiErr)
 	}
@@ -286,21 +518,93 @@ func CsiSnapshotClone(tnsWsUrl string, apiKey string, rootDataset string, srcSna
 	return nil
 }
 
-func CsiSnapshotCreate(tnsWsUrl string, apiKey string, rootDataset string, dsName string, snapshotName string) (*string, *int64, *CsiError) {
+// CsiVolumeClone creates the dataset dsName as a ZFS clone of srcName, a snapshot (dataset@snapshot) or a dataset.
+// A dataset is first snapshotted, under the name of the clone: this snapshot is destroyed with the clone.
+// A promoted clone does not depend on its origin anymore, the origin depends on it.
+// The dataset is then shared by CsiVolumeCreate or CsiSmbVolumeCreate, that use the existing dataset
+func CsiVolumeClone(ctx context.Context, tnsWsUrl string, creds *Credentials, driverName string, rootDataset string, srcName string, dsName string, volumeID string, reqCapacity int64, space SpaceOptions, properties map[string]interface{}, parameters map[string]string, promote bool) *CsiError {
+	klog.V(2).Infof("*** CsiVolumeClone tnsWsUrl: %s rootDataset: %s srcName: %s dsName: %s volumeID: %s reqCapacity: %d promote: %t", tnsWsUrl, rootDataset, srcName, dsName, volumeID, reqCapacity, promote)
+	defer klog.V(2).Info("*** CsiVolumeClone")
+
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
+	if csiErr != nil {
+		return csiErr
+	}
+	defer ReleaseClient(client)
+
+	// The clone exists when a previous call failed after the cloning
+	created := false
+	ds, csiErr := TNSDatasetGet(ctx, client, dsName)
+	if csiErr != nil {
+		if csiErr.Code != codes.NotFound {
+			return logAndReturnError("Failed to get dataset", csiErr)
+		}
+		if csiErr := cloneSnapshot(ctx, client, rootDataset, srcName, dsName); csiErr != nil {
+			return logAndReturnError("Failed to clone snapshot", csiErr)
+		}
+		created = true
+		if ds, csiErr = TNSDatasetGet(ctx, client, dsName); csiErr != nil {
+			cleanupDataset(ctx, client, dsName)
+			return logAndReturnError("Failed to get dataset", csiErr)
+		}
+	}
+
+	// The clone inherits the properties of its parent, not the ones of its origin
+	update := map[string]interface{}{
+		"comments": driverName,
+		"user_properties_update": []map[string]string{
+			{"key": VolumeIDProperty, "value": volumeID},
+		},
+	}
+	for name, value := range space.sizeProperties(reqCapacity) {
+		update[name] = value
+	}
+	for name, value := range properties {
+		update[name] = value
+	}
+	if _, csiErr := TNSDatasetUpdate(ctx, client, dsName, update); csiErr != nil {
+		if created {
+			cleanupDataset(ctx, client, dsName)
+		}
+		return logAndReturnError("Failed to update dataset", csiErr)
+	}
+
+	if csiErr := TNSDatasetSetPermissions(ctx, client, ds.MountPoint, parameters); csiErr != nil {
+		if created {
+			cleanupDataset(ctx, client, dsName)
+		}
+		return logAndReturnError("Failed to set permissions", csiErr)
+	}
+
+	// Last, a promoted clone can not be deleted while its origin exists
+	if promote && isClone(ds) {
+		if csiErr := TNSDatasetPromote(ctx, client, dsName); csiErr != nil {
+			if created {
+				cleanupDataset(ctx, client, dsName)
+			}
+			return logAndReturnError("Failed to promote dataset", csiErr)
+		}
+	}
+
+	klog.V(2).Info("++ Dataset cloned successfully")
+	return nil
+}
+
+func CsiSnapshotCreate(ctx context.Context, tnsWsUrl string, creds *Credentials, rootDataset string, dsName string, snapshotName string) (*string, *int64, *CsiError) {
 	klog.V(2).Infof("*** CsiSnapshotCreate tnsWsUrl: %s rootDataset: %s dsName: %s snapshotName: %s", tnsWsUrl, rootDataset, dsName, snapshotName)
 	defer klog.V(2).Info("*** CsiSnapshotCreate")
 
-	client, csiErr := GetClient(tnsWsUrl, apiKey, true)
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
 	if csiErr != nil {
 		return nil, nil, csiErr
 	}
 	defer ReleaseClient(client)
 
-	snapshot, csiErr := TNSSnapshotCreate(client, dsName, snapshotName)
+	snapshot, csiErr := TNSSnapshotCreate(ctx, client, dsName, snapshotName)
 	if csiErr != nil {
 		if csiErr.Code == codes.AlreadyExists {
 			// Snapshot already exist, use it
-			snapshot, csiErr = TNSSnapshotGet(client, dsName+"@"+snapshotName)
+			snapshot, csiErr = TNSSnapshotGet(ctx, client, dsName+"@"+snapshotName)
 			if csiErr != nil {
 				return nil, nil, csiErr
 			}
@@ -320,17 +624,80 @@ func CsiSnapshotCreate(tnsWsUrl string, apiKey string, rootDataset string, dsNam
 	return &snapshot.Name, &restoreSize, nil
 }
 
-func CsiSnapshotDelete(tnsWsUrl string, apiKey string, snapshotName string) *CsiError {
-	klog.V(2).Infof("*** CsiSnapshotDelete tnsWsUrl: %s snapshotName: %s", tnsWsUrl, snapshotName)
+// CsiSnapshotList returns the snapshots of the datasets created by the driver under rootDataset, and these datasets
+// The snapshots can be restricted to the ones of a dataset (dsName) or to a single snapshot (snapshotName: dataset@snapshot)
+func CsiSnapshotList(ctx context.Context, tnsWsUrl string, creds *Credentials, driverName string, rootDataset string, dsName string, snapshotName string) ([]TNSSnapshot, map[string]TNSDataset, *CsiError) {
+	klog.V(2).Infof("*** CsiSnapshotList tnsWsUrl: %s rootDataset: %s dsName: %s snapshotName: %s", tnsWsUrl, rootDataset, dsName, snapshotName)
+	defer klog.V(2).Info("*** CsiSnapshotList")
+
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
+	if csiErr != nil {
+		return nil, nil, csiErr
+	}
+	defer ReleaseClient(client)
+
+	datasets, csiErr := TNSDatasetQueryChildren(ctx, client, driverName, rootDataset)
+	if csiErr != nil {
+		klog.Errorf("Snapshot list failed: %s", csiErr)
+		return nil, nil, csiErr
+	}
+	dsByName := make(map[string]TNSDataset, len(datasets))
+	for _, ds := range datasets {
+		dsByName[ds.Name] = ds
+	}
+
+	var filters [][]interface{}
+	switch {
+	case snapshotName != "":
+		filters = [][]interface{}{{"id", "=", snapshotName}}
+	case dsName != "":
+		filters = [][]interface{}{{"dataset", "=", dsName}}
+	default:
+		filters = [][]interface{}{{"dataset", "^", rootDataset + "/"}}
+	}
+	snapshots, csiErr := TNSSnapshotQuery(ctx, client, filters)
+	if csiErr != nil {
+		klog.Errorf("Snapshot list failed: %s", csiErr)
+		return nil, nil, csiErr
+	}
+
+	// Only the snapshots of the volumes. The deleted snapshots still used by clones are hidden
+	result := []TNSSnapshot{}
+	for _, snapshot := range snapshots {
+		if snapshot.Properties.DeferDestroy.Value == "on" {
+			continue
+		}
+		if _, ok := dsByName[snapshot.Dataset]; ok {
+			result = append(result, snapshot)
+		}
+	}
+
+	klog.V(2).Infof("++ Snapshot list successful: %d snapshot(s)", len(result))
+	return result, dsByName, nil
+}
+
+// CsiSnapshotDelete deletes a snapshot (dataset@snapshot). A snapshot used by clones is destroyed with its last clone
+func CsiSnapshotDelete(ctx context.Context, tnsWsUrl string, creds *Credentials, rootDataset string, snapshotName string) *CsiError {
+	klog.V(2).Infof("*** CsiSnapshotDelete tnsWsUrl: %s rootDataset: %s snapshotName: %s", tnsWsUrl, rootDataset, snapshotName)
 	defer klog.V(2).Info("*** CsiSnapshotDelete")
 
-	client, csiErr := GetClient(tnsWsUrl, apiKey, true)
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
 	if csiErr != nil {
 		return csiErr
 	}
 	defer ReleaseClient(client)
 
-	res, csiErr := TNSSnapshotDelete(client, snapshotName)
+	snapshot, csiErr := findSnapshot(ctx, client, rootDataset, snapshotName)
+	if csiErr != nil {
+		klog.Errorf("Snapshot delete failed: %s", csiErr)
+		return csiErr
+	}
+	if snapshot == nil {
+		klog.Warningf("++ Snapshot %s does not exist, continue", snapshotName)
+		return nil
+	}
+
+	res, csiErr := TNSSnapshotDelete(ctx, client, snapshot.Name, true)
 	if csiErr != nil {
 		klog.Errorf("Snapshot delete failed: %s", csiErr)
 		return csiErr
@@ -340,28 +707,342 @@ func CsiSnapshotDelete(tnsWsUrl string, apiKey string, snapshotName string) *Csi
 	return nil
 }
 
-func CsiVolumeExpand(tnsWsUrl string, apiKey string, rootDataset string, dsName string, newSize int64) (*int64, *CsiError) {
+func CsiVolumeExpand(ctx context.Context, tnsWsUrl string, creds *Credentials, rootDataset string, dsName string, newSize int64) (*int64, *CsiError) {
 	klog.V(2).Infof("*** CsiVolumeExpand tnsWsUrl: %s rootDataset: %s dsName: %s newSize: %d", tnsWsUrl, rootDataset, dsName, newSize)
 	defer klog.V(2).Info("*** CsiVolumeExpand")
 
-	client, csiErr := GetClient(tnsWsUrl, apiKey, true)
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
 	if csiErr != nil {
 		return nil, csiErr
 	}
 	defer ReleaseClient(client)
 
-	res, csiErr := TNSDatasetSetSize(client, dsName, newSize)
+	// The quota and the reservation of the dataset are kept in sync
+	ds, csiErr := TNSDatasetGet(ctx, client, dsName)
+	if csiErr != nil {
+		klog.Errorf("Dataset expand failed: %s", csiErr)
+		return nil, csiErr
+	}
+	res, csiErr := TNSDatasetSetSize(ctx, client, dsName, ds.SpaceOptions(), newSize)
 	if csiErr != nil {
 		klog.Errorf("Dataset expand failed: %s", csiErr)
 		return nil, csiErr
 	}
 
+	size := res.Capacity()
+
+	klog.V(2).Infof("++ Dataset expanded successfully. New size: %d", size)
+	return &size, nil
+}
+
+// CsiVolumeModify applies the properties of a VolumeAttributesClass to the dataset and to its NFS share
+func CsiVolumeModify(ctx context.Context, tnsWsUrl string, creds *Credentials, dsName string, dsProperties map[string]interface{}, shareProperties map[string]interface{}) *CsiError {
+	klog.V(2).Infof("*** CsiVolumeModify tnsWsUrl: %s dsName: %s dsProperties: %v shareProperties: %v", tnsWsUrl, dsName, dsProperties, shareProperties)
+	defer klog.V(2).Info("*** CsiVolumeModify")
+
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
+	if csiErr != nil {
+		return csiErr
+	}
+	defer ReleaseClient(client)
+
+	ds, csiErr := TNSDatasetGet(ctx, client, dsName)
+	if csiErr != nil {
+		return logAndReturnError("Failed to get dataset", csiErr)
+	}
+
+	if len(dsProperties) > 0 {
+		if _, csiErr := TNSDatasetUpdate(ctx, client, dsName, dsProperties); csiErr != nil {
+			return logAndReturnError("Failed to update dataset", csiErr)
+		}
+	}
+
+	if len(shareProperties) > 0 {
+		share, csiErr := TNSShareNfsGet(ctx, client, ds.MountPoint)
+		if csiErr != nil {
+			return logAndReturnError("Failed to get NFS share", csiErr)
+		}
+		if share == nil {
+			return logAndReturnError("Failed to update NFS share", NewCsiError(codes.NotFound, fmt.Errorf("NFS share for %s does not exist", ds.MountPoint)))
+		}
+		if csiErr := TNSShareNfsUpdate(ctx, client, share.ID, shareProperties); csiErr != nil {
+			return logAndReturnError("Failed to update NFS share", csiErr)
+		}
+	}
+
+	klog.V(2).Info("++ Dataset and NFS share modified successfully")
+	return nil
+}
+
+// -----------------------
+// SMB volumes
+// -----------------------
+
+// CsiSmbVolumeCreate creates a dataset and shares it with SMB under the name shareName. Returns the name of the dataset
+func CsiSmbVolumeCreate(ctx context.Context, tnsWsUrl string, creds *Credentials, driverName string, dsName string, volumeID string, shareName string, reqCapacity int64, space SpaceOptions, properties map[string]interface{}, encryption *EncryptionOptions, parameters map[string]string, opts *SMBShareOptions) (*string, *CsiError) {
+	klog.V(2).Infof("*** CsiSmbVolumeCreate tnsWsUrl: %s dsName: %s volumeID: %s shareName: %s reqCapacity: %d encrypted: %t", tnsWsUrl, dsName, volumeID, shareName, reqCapacity, encryption != nil)
+	defer klog.V(2).Info("*** CsiSmbVolumeCreate")
+
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
+	if csiErr != nil {
+		return nil, csiErr
+	}
+	defer ReleaseClient(client)
+
+	ds, csiErr := TNSDatasetCreate(ctx, client, driverName, dsName, volumeID, reqCapacity, space, properties, encryption, parameters)
+	if csiErr != nil {
+		if csiErr.Code != codes.AlreadyExists {
+			return nil, logAndReturnError("Failed to create dataset", csiErr)
+		}
+		// If ds exists with same capacity and params, use the existing one. Its share may be missing after a failure
+		different, ds, csiErr2 := isDifferentVolume(ctx, client, dsName, reqCapacity, space, properties, encryption != nil, parameters)
+		if (csiErr2 != nil) || different {
+			return nil, logAndReturnError("Failed to create dataset", csiErr2)
+		}
+		if _, csiErr := ensureSmbShare(ctx, client, ds.MountPoint, shareName, opts); csiErr != nil {
+			return nil, logAndReturnError("Failed to create SMB share", csiErr)
+		}
+		klog.V(2).Info("Dataset with same specs already exists. Use it")
+		return &dsName, nil
+	}
+
+	if csiErr := TNSDatasetSetPermissions(ctx, client, ds.MountPoint, parameters); csiErr != nil {
+		cleanupDataset(ctx, client, ds.Name)
+		return nil, logAndReturnError("Failed to set permissions", csiErr)
+	}
+
+	if _, csiErr := ensureSmbShare(ctx, client, ds.MountPoint, shareName, opts); csiErr != nil {
+		// The share is deleted with the dataset
+		cleanupDataset(ctx, client, ds.Name)
+		return nil, logAndReturnError("Failed to create SMB share", csiErr)
+	}
+
+	klog.V(2).Info("++ Dataset and SMB share created successfully")
+	return &dsName, nil
+}
+
+// CsiSmbVolumeGet returns the dataset and its SMB share. They are nil when they do not exist
+func CsiSmbVolumeGet(ctx context.Context, tnsWsUrl string, creds *Credentials, dsName string) (*TNSDataset, *TNSSMBShare, *CsiError) {
+	klog.V(2).Infof("*** CsiSmbVolumeGet tnsWsUrl: %s dsName: %s", tnsWsUrl, dsName)
+	defer klog.V(2).Info("*** CsiSmbVolumeGet")
+
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
+	if csiErr != nil {
+		return nil, nil, csiErr
+	}
+	defer ReleaseClient(client)
+
+	ds, csiErr := TNSDatasetGet(ctx, client, dsName)
+	if csiErr != nil {
+		if csiErr.Code == codes.NotFound {
+			return nil, nil, nil
+		}
+		return nil, nil, csiErr
+	}
+
+	share, csiErr := TNSShareSmbGet(ctx, client, ds.MountPoint)
+	if csiErr != nil {
+		return nil, nil, csiErr
+	}
+
+	klog.V(2).Info("++ Volume get successful")
+	return ds, share, nil
+}
+
+// -----------------------
+// iSCSI (block) volumes
+// -----------------------
+
+// IscsiLunID is the LUN of the zvol in its target: each volume has its own target
+const IscsiLunID = 0
+
+// CsiIscsiVolumeCreate creates a zvol and exposes it through an iSCSI target named targetName. Returns the IQN of the target
+func CsiIscsiVolumeCreate(ctx context.Context, tnsWsUrl string, creds *Credentials, driverName string, dsName string, volumeID string, targetName string, size int64, sparse bool, portalID int, initiatorID int) (*string, *CsiError) {
+	klog.V(2).Infof("*** CsiIscsiVolumeCreate tnsWsUrl: %s dsName: %s volumeID: %s targetName: %s size: %d", tnsWsUrl, dsName, volumeID, targetName, size)
+	defer klog.V(2).Info("*** CsiIscsiVolumeCreate")
+
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
+	if csiErr != nil {
+		return nil, csiErr
+	}
+	defer ReleaseClient(client)
+
+	created, csiErr := ensureZvol(ctx, client, driverName, dsName, volumeID, size, sparse)
+	if csiErr != nil {
+		return nil, logAndReturnError("Failed to create zvol", csiErr)
+	}
+
+	iqn, csiErr := ensureIscsiTarget(ctx, client, dsName, targetName, portalID, initiatorID)
+	if csiErr != nil {
+		if created {
+			cleanupCtx, cancel := cleanupContext(ctx)
+			if csiErr2 := deleteIscsiTarget(cleanupCtx, client, targetName); csiErr2 != nil {
+				klog.Warningf("iSCSI target cleanup failed: %v", csiErr2)
+			}
+			cancel()
+			cleanupDataset(ctx, client, dsName)
+		}
+		return nil, logAndReturnError("Failed to create iSCSI target", csiErr)
+	}
+
+	klog.V(2).Infof("++ Zvol and iSCSI target %s created successfully", *iqn)
+	return iqn, nil
+}
+
+// CsiIscsiTargetDelete deletes the iSCSI target and extent of a block volume, not its zvol
+func CsiIscsiTargetDelete(ctx context.Context, tnsWsUrl string, creds *Credentials, targetName string) *CsiError {
+	klog.V(2).Infof("*** CsiIscsiTargetDelete tnsWsUrl: %s targetName: %s", tnsWsUrl, targetName)
+	defer klog.V(2).Info("*** CsiIscsiTargetDelete")
+
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
+	if csiErr != nil {
+		return csiErr
+	}
+	defer ReleaseClient(client)
+
+	if csiErr := deleteIscsiTarget(ctx, client, targetName); csiErr != nil {
+		return logAndReturnError("Failed to delete iSCSI target", csiErr)
+	}
+
+	klog.V(2).Info("++ iSCSI target delete successful")
+	return nil
+}
+
+// CsiIscsiVolumeGet returns the zvol and its iSCSI target. They are nil when they do not exist
+func CsiIscsiVolumeGet(ctx context.Context, tnsWsUrl string, creds *Credentials, dsName string, targetName string) (*TNSDataset, *TNSIscsiTarget, *CsiError) {
+	klog.V(2).Infof("*** CsiIscsiVolumeGet tnsWsUrl: %s dsName: %s targetName: %s", tnsWsUrl, dsName, targetName)
+	defer klog.V(2).Info("*** CsiIscsiVolumeGet")
+
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
+	if csiErr != nil {
+		return nil, nil, csiErr
+	}
+	defer ReleaseClient(client)
+
+	ds, csiErr := TNSDatasetGet(ctx, client, dsName)
+	if csiErr != nil {
+		if csiErr.Code == codes.NotFound {
+			return nil, nil, nil
+		}
+		return nil, nil, csiErr
+	}
+
+	target, csiErr := TNSIscsiTargetGet(ctx, client, targetName)
+	if csiErr != nil {
+		return nil, nil, csiErr
+	}
+
+	klog.V(2).Info("++ iSCSI volume get successful")
+	return ds, target, nil
+}
+
+// ----------------------
+// NVMe-oF (block) volumes
+// ----------------------
+
+// CsiNvmeofVolumeCreate creates a zvol and exposes it as a namespace of an NVMe subsystem named subsysName,
+// exported on the port portID. Returns the NQN of the subsystem and the id of the namespace
+func CsiNvmeofVolumeCreate(ctx context.Context, tnsWsUrl string, creds *Credentials, driverName string, dsName string, volumeID string, subsysName string, size int64, sparse bool, portID int) (*string, *int, *CsiError) {
+	klog.V(2).Infof("*** CsiNvmeofVolumeCreate tnsWsUrl: %s dsName: %s volumeID: %s subsysName: %s size: %d", tnsWsUrl, dsName, volumeID, subsysName, size)
+	defer klog.V(2).Info("*** CsiNvmeofVolumeCreate")
+
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
+	if csiErr != nil {
+		return nil, nil, csiErr
+	}
+	defer ReleaseClient(client)
+
+	created, csiErr := ensureZvol(ctx, client, driverName, dsName, volumeID, size, sparse)
+	if csiErr != nil {
+		return nil, nil, logAndReturnError("Failed to create zvol", csiErr)
+	}
+
+	nqn, nsid, csiErr := ensureNvmeofSubsys(ctx, client, dsName, subsysName, portID)
+	if csiErr != nil {
+		if created {
+			cleanupCtx, cancel := cleanupContext(ctx)
+			if csiErr2 := deleteNvmeofSubsys(cleanupCtx, client, subsysName); csiErr2 != nil {
+				klog.Warningf("NVMe subsystem cleanup failed: %v", csiErr2)
+			}
+			cancel()
+			cleanupDataset(ctx, client, dsName)
+		}
+		return nil, nil, logAndReturnError("Failed to create NVMe subsystem", csiErr)
+	}
+
+	klog.V(2).Infof("++ Zvol and NVMe subsystem %s created successfully", *nqn)
+	return nqn, nsid, nil
+}
+
+// CsiNvmeofSubsysDelete deletes the NVMe subsystem of a block volume, not its zvol
+func CsiNvmeofSubsysDelete(ctx context.Context, tnsWsUrl string, creds *Credentials, subsysName string) *CsiError {
+	klog.V(2).Infof("*** CsiNvmeofSubsysDelete tnsWsUrl: %s subsysName: %s", tnsWsUrl, subsysName)
+	defer klog.V(2).Info("*** CsiNvmeofSubsysDelete")
+
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
+	if csiErr != nil {
+		return csiErr
+	}
+	defer ReleaseClient(client)
+
+	if csiErr := deleteNvmeofSubsys(ctx, client, subsysName); csiErr != nil {
+		return logAndReturnError("Failed to delete NVMe subsystem", csiErr)
+	}
+
+	klog.V(2).Info("++ NVMe subsystem delete successful")
+	return nil
+}
+
+// CsiNvmeofVolumeGet returns the zvol and its NVMe subsystem. They are nil when they do not exist
+func CsiNvmeofVolumeGet(ctx context.Context, tnsWsUrl string, creds *Credentials, dsName string, subsysName string) (*TNSDataset, *TNSNvmetSubsys, *CsiError) {
+	klog.V(2).Infof("*** CsiNvmeofVolumeGet tnsWsUrl: %s dsName: %s subsysName: %s", tnsWsUrl, dsName, subsysName)
+	defer klog.V(2).Info("*** CsiNvmeofVolumeGet")
+
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
+	if csiErr != nil {
+		return nil, nil, csiErr
+	}
+	defer ReleaseClient(client)
+
+	ds, csiErr := TNSDatasetGet(ctx, client, dsName)
+	if csiErr != nil {
+		if csiErr.Code == codes.NotFound {
+			return nil, nil, nil
+		}
+		return nil, nil, csiErr
+	}
+
+	subsys, csiErr := TNSNvmetSubsysGet(ctx, client, subsysName)
+	if csiErr != nil {
+		return nil, nil, csiErr
+	}
+
+	klog.V(2).Info("++ NVMe-oF volume get successful")
+	return ds, subsys, nil
+}
+
+func CsiZvolExpand(ctx context.Context, tnsWsUrl string, creds *Credentials, dsName string, newSize int64) (*int64, *CsiError) {
+	klog.V(2).Infof("*** CsiZvolExpand tnsWsUrl: %s dsName: %s newSize: %d", tnsWsUrl, dsName, newSize)
+	defer klog.V(2).Info("*** CsiZvolExpand")
+
+	client, csiErr := GetClient(ctx, tnsWsUrl, creds)
+	if csiErr != nil {
+		return nil, csiErr
+	}
+	defer ReleaseClient(client)
+
+	res, csiErr := TNSZvolSetSize(ctx, client, dsName, newSize)
+	if csiErr != nil {
+		klog.Errorf("Zvol expand failed: %s", csiErr)
+		return nil, csiErr
+	}
+
 	var size int64 = 0
-	if parsed, ok := res.RefQuota.Parsed.(float64); ok {
+	if parsed, ok := res.VolSize.Parsed.(float64); ok {
 		size = int64(parsed)
 	}
 
-	klog.V(2).Infof("++ Dataset expanded successfully. New size: %d", size)
+	klog.V(2).Infof("++ Zvol expanded successfully. New size: %d", size)
 	return &size, nil
 }
 
@@ -369,27 +1050,51 @@ func CsiVolumeExpand(tnsWsUrl string, apiKey string, rootDataset string, dsName
 // Helpers
 // -------
 
-func isDifferentVolume(client *Client, dsName string, reqCapacity int64, parameters map[string]string) (bool, *string, *CsiError) {
+// isDifferentVolume checks the capacity, the reservation, the properties, the encryption and the permissions of an existing dataset
+func isDifferentVolume(ctx context.Context, client *Client, dsName string, reqCapacity int64, space SpaceOptions, properties map[string]interface{}, encrypted bool, parameters map[string]string) (bool, *TNSDataset, *CsiError) {
 	defer klog.V(3).Info("Requested dataset already exist. Check attributes")
 
 	// Check DS attributes
-	ds, csiErr := TNSDatasetGet(client, dsName)
+	ds, csiErr := TNSDatasetGet(ctx, client, dsName)
 	if csiErr != nil {
 		return true, nil, csiErr
 	}
-	refQuota, ok := ds.RefQuota.Parsed.(float64)
-	if !ok {
-		csiErr := NewCsiError(codes.Internal, fmt.Errorf("Error parsing RefQuota value. Could not assert that '%v' is int64", ds.Available.Parsed))
-		klog.Errorf("Get Capacity get failed:: %s", csiErr)
+	if ds.Capacity() != reqCapacity {
+		csiErr := NewCsiError(codes.Internal, fmt.Errorf("dataset already exist with different capacity: %d, requested: %d", ds.Capacity(), reqCapacity))
+		return true, nil, csiErr
+	}
+
+	// Check DS quota and reservation modes
+	requested := space.withDefaults()
+	if current := ds.SpaceOptions(); current != requested {
+		csiErr := NewCsiError(codes.AlreadyExists, fmt.Errorf("dataset already exist with different quota/reservation: %+v, requested: %+v", current, requested))
+		return true, nil, csiErr
+	}
+	if reserved := ds.reservationSize(); requested.ReservationMode != ReservationModeNone && reserved != reqCapacity {
+		csiErr := NewCsiError(codes.AlreadyExists, fmt.Errorf("dataset already exist with different %s: %d, requested: %d", requested.ReservationMode, reserved, reqCapacity))
 		return true, nil, csiErr
 	}
-	if int64(refQuota) != reqCapacity {
-		csiErr := NewCsiError(codes.Internal, fmt.Errorf("dataset already exist with different capacity: %v, requested: %d", ds.RefQuota.Parsed, reqCapacity))
+
+	// Check DS properties. An inherited property may have any value
+	for name, value := range properties {
+		requested := strings.ToUpper(fmt.Sprint(value))
+		if requested == "INHERIT" {
+			continue
+		}
+		if property := datasetProperty(ds, name); property != nil && !strings.EqualFold(property.Value, requested) {
+			csiErr := NewCsiError(codes.AlreadyExists, fmt.Errorf("dataset already exist with different %s: %s, requested: %s", name, property.Value, requested))
+			return true, nil, csiErr
+		}
+	}
+
+	// An encrypted volume has its own key. A volume that is not, may still inherit the encryption of its parent
+	if encrypted && ds.EncryptionRoot != ds.Name {
+		csiErr := NewCsiError(codes.AlreadyExists, fmt.Errorf("dataset already exist without its own encryption, encryption root: %q", ds.EncryptionRoot))
 		return true, nil, csiErr
 	}
 
 	// Check DS permissions
-	dsStats, csiErr := TNSDatasetGetPermissions(client, ds.MountPoint)
+	dsStats, csiErr := TNSDatasetGetPermissions(ctx, client, ds.MountPoint)
 	if csiErr != nil {
 		return true, nil, csiErr
 	}
@@ -419,48 +1124,310 @@ func isDifferentVolume(client *Client, dsName string, reqCapacity int64, paramet
 		}
 	}
 
-	// Check NFS Sharing
-	share, csiErr := TNSShareNfsGet(client, ds.MountPoint)
-	if csiErr != nil || share == nil {
-		return true, nil, csiErr
+	return false, ds, nil
+}
+
+func cleanupDataset(ctx context.Context, client *Client, dsName string) {
+	cleanupCtx, cancel := cleanupContext(ctx)
+	defer cancel()
+	if err := TNSDatasetDelete(cleanupCtx, client, dsName); err != nil {
+		klog.Warningf("Dataset cleanup failed: %v", err)
 	}
+}
 
-	return false, &share.Path, nil
+// datasetProperty returns the property of the dataset that can be set by the storage classes, nil for the others
+func datasetProperty(ds *TNSDataset, name string) *ZFSProperty {
+	switch name {
+	case "aclmode":
+		return &ds.ACLMode
+	case "acltype":
+		return &ds.ACLType
+	case "atime":
+		return &ds.ATime
+	case "compression":
+		return &ds.Compression
+	case "copies":
+		return &ds.Copies
+	case "deduplication":
+		return &ds.Deduplication
+	case "exec":
+		return &ds.Exec
+	case "readonly":
+		return &ds.ReadOnly
+	case "recordsize":
+		return &ds.RecordSize
+	case "snapdir":
+		return &ds.SnapDir
+	case "sync":
+		return &ds.Sync
+	case "xattr":
+		return &ds.XAttr
+	}
+	return nil
+}
 
+// isClone returns true when the dataset is a clone that has not been promoted
+func isClone(ds *TNSDataset) bool {
+	return ds.Origin.Value != "" && ds.Origin.Value != "-"
 }
 
-func cleanupDataset(client *Client, dsName string) {
-	if err := TNSDatasetDelete(client, dsName); err != nil {
-		klog.Warningf("Dataset cleanup failed: %v", err)
+// cloneSnapshot clones srcName into dsName. srcName is a snapshot (dataset@snapshot) or a dataset,
+// snapshotted under the name of the clone. This snapshot is destroyed with the clone
+func cloneSnapshot(ctx context.Context, client *Client, rootDataset string, srcName string, dsName string) *CsiError {
+	if strings.Contains(srcName, "@") {
+		snapshot, csiErr := findSnapshot(ctx, client, rootDataset, srcName)
+		if csiErr != nil {
+			return csiErr
+		}
+		if snapshot == nil {
+			return NewCsiError(codes.NotFound, fmt.Errorf("snapshot %s does not exist", srcName))
+		}
+		return TNSSnapshotClone(ctx, client, snapshot.Name, dsName)
 	}
+
+	snapshotName := path.Base(dsName)
+	if _, csiErr := TNSSnapshotCreate(ctx, client, srcName, snapshotName); csiErr != nil && csiErr.Code != codes.AlreadyExists {
+		return csiErr
+	}
+	fullSnapshotName := srcName + "@" + snapshotName
+	if csiErr := TNSSnapshotClone(ctx, client, fullSnapshotName, dsName); csiErr != nil {
+		if _, csiErr2 := TNSSnapshotDelete(ctx, client, fullSnapshotName, false); csiErr2 != nil {
+			klog.Warningf("Snapshot cleanup failed. Ignoring: %s", csiErr2)
+		}
+		return csiErr
+	}
+	if _, csiErr := TNSSnapshotDelete(ctx, client, fullSnapshotName, true); csiErr != nil {
+		klog.Warningf("Deferred delete of snapshot %s failed. Continue: %v", fullSnapshotName, csiErr)
+	}
+	return nil
 }
-func logAndReturnError(msg string, err *CsiError) *CsiError {
-	klog.Errorf("%s: %s", msg, err)
-	return err
+
+// findSnapshot returns the snapshot dataset@snapshot, nil when it does not exist. The promotion of a clone
+// moves the snapshots of its origin to the clone: the snapshot is then searched by its short name under rootDataset
+func findSnapshot(ctx context.Context, client *Client, rootDataset string, snapshotName string) (*TNSSnapshot, *CsiError) {
+	snapshots, csiErr := TNSSnapshotQuery(ctx, client, [][]interface{}{{"id", "=", snapshotName}})
+	if csiErr != nil {
+		return nil, csiErr
+	}
+	if len(snapshots) == 0 {
+		shortName := snapshotName[strings.Index(snapshotName, "@")+1:]
+		filters := [][]interface{}{{"snapshot_name", "=", shortName}, {"dataset", "^", rootDataset + "/"}}
+		if snapshots, csiErr = TNSSnapshotQuery(ctx, client, filters); csiErr != nil {
+			return nil, csiErr
+		}
+		if len(snapshots) == 0 {
+			return nil, nil
+		}
+		klog.V(2).Infof("Snapshot %s has moved to %s", snapshotName, snapshots[0].Name)
+	}
+	return &snapshots[0], nil
 }
 
-func waitForJobCompletion(client *Client, jobID *int) *CsiError {
-	sleepTime := 2 * time.Second
+// promoteDependentClones promotes the clones of the snapshots of the dataset, so that it can be deleted.
+// The snapshots of the dataset, up to the origin of a clone, move to this clone
+func promoteDependentClones(ctx context.Context, client *Client, dsName string) *CsiError {
+	snapshots, csiErr := TNSSnapshotQuery(ctx, client, [][]interface{}{{"dataset", "=", dsName}})
+	if csiErr != nil {
+		return csiErr
+	}
 
-	for {
-		time.Sleep(sleepTime)
+	// Each promotion moves at least one snapshot: there are at most as many promotions as snapshots
+	for range snapshots {
+		clone := ""
+		for _, snapshot := range snapshots {
+			if clones := snapshot.Properties.Clones.Value; clones != "" && clones != "-" {
+				clone = strings.Split(clones, ",")[0]
+				break
+			}
+		}
+		if clone == "" {
+			return nil
+		}
 
-		jobStatus, csiErr := TNSGetJobStatus(client, *jobID)
-		if csiErr != nil {
+		klog.V(2).Infof("Promote %s before deleting its origin %s", clone, dsName)
+		if csiErr := TNSDatasetPromote(ctx, client, clone); csiErr != nil {
+			return csiErr
+		}
+		if snapshots, csiErr = TNSSnapshotQuery(ctx, client, [][]interface{}{{"dataset", "=", dsName}}); csiErr != nil {
 			return csiErr
 		}
+	}
+	return nil
+}
 
-		switch jobStatus.State {
-		case "RUNNING":
-			continue
-		case "SUCCESS":
-			return nil
-		case "FAILED", "ABORTED":
-			klog.Errorf("Job failed or aborted: %v", *jobStatus)
-			return NewCsiError(codes.Internal, fmt.Errorf("%s", jobStatus.Err))
-		default:
-			klog.Errorf("default: %s", csiErr)
-			return NewCsiError(codes.Internal, fmt.Errorf("Unexpected job state: %s", jobStatus.State))
+// ensureZvol creates the zvol of a block volume. An existing zvol with the same size is used:
+// the objects exposing it may be missing after a failure. Returns true when the zvol has been created
+func ensureZvol(ctx context.Context, client *Client, driverName string, dsName string, volumeID string, size int64, sparse bool) (bool, *CsiError) {
+	_, csiErr := TNSZvolCreate(ctx, client, driverName, dsName, volumeID, size, sparse)
+	if csiErr == nil {
+		return true, nil
+	}
+	if csiErr.Code != codes.AlreadyExists {
+		return false, csiErr
+	}
+
+	ds, csiErr := TNSDatasetGet(ctx, client, dsName)
+	if csiErr != nil {
+		return false, csiErr
+	}
+	volSize, _ := ds.VolSize.Parsed.(float64)
+	if ds.Type != "VOLUME" || int64(volSize) != size {
+		return false, NewCsiError(codes.AlreadyExists, fmt.Errorf("dataset %s already exists with a different type (%s) or size (%v), requested: %d", dsName, ds.Type, ds.VolSize.Parsed, size))
+	}
+	klog.V(2).Info("Zvol with same specs already exists. Use it")
+	return false, nil
+}
+
+// ensureNfsShare creates the NFS share of the dataset when it does not exist. Returns the path of the share
+func ensureNfsShare(ctx context.Context, client *Client, dsMountPoint string, parameters map[string]string) (*string, *CsiError) {
+	share, csiErr := TNSShareNfsGet(ctx, client, dsMountPoint)
+	if csiErr != nil {
+		return nil, csiErr
+	}
+	if share != nil {
+		return &share.Path, nil
+	}
+	return TNSShareNfsCreate(ctx, client, dsMountPoint, parameters)
+}
+
+// ensureSmbShare creates the SMB share of the dataset and sets its ACL when it does not exist
+func ensureSmbShare(ctx context.Context, client *Client, dsMountPoint string, shareName string, opts *SMBShareOptions) (*TNSSMBShare, *CsiError) {
+	share, csiErr := TNSShareSmbGet(ctx, client, dsMountPoint)
+	if csiErr != nil || share != nil {
+		return share, csiErr
+	}
+
+	if share, csiErr = TNSShareSmbCreate(ctx, client, shareName, dsMountPoint, opts); csiErr != nil {
+		return nil, csiErr
+	}
+	if len(opts.Acl) > 0 {
+		if csiErr := TNSShareSmbSetAcl(ctx, client, share.Name, opts.Acl); csiErr != nil {
+			return nil, csiErr
+		}
+	}
+	return share, nil
+}
+
+// ensureIscsiTarget creates the target, the extent and their association when they do not exist. Returns the IQN of the target
+func ensureIscsiTarget(ctx context.Context, client *Client, dsName string, targetName string, portalID int, initiatorID int) (*string, *CsiError) {
+	global, csiErr := TNSIscsiGlobalConfigGet(ctx, client)
+	if csiErr != nil {
+		return nil, csiErr
+	}
+
+	target, csiErr := TNSIscsiTargetGet(ctx, client, targetName)
+	if csiErr != nil {
+		return nil, csiErr
+	}
+	if target == nil {
+		if target, csiErr = TNSIscsiTargetCreate(ctx, client, targetName, portalID, initiatorID); csiErr != nil {
+			return nil, csiErr
+		}
+	}
+
+	extent, csiErr := TNSIscsiExtentGet(ctx, client, targetName)
+	if csiErr != nil {
+		return nil, csiErr
+	}
+	if extent == nil {
+		if extent, csiErr = TNSIscsiExtentCreate(ctx, client, targetName, dsName); csiErr != nil {
+			return nil, csiErr
+		}
+	}
+
+	targetExtent, csiErr := TNSIscsiTargetExtentGet(ctx, client, target.ID, extent.ID)
+	if csiErr != nil {
+		return nil, csiErr
+	}
+	if targetExtent == nil {
+		if _, csiErr = TNSIscsiTargetExtentCreate(ctx, client, target.ID, extent.ID, IscsiLunID); csiErr != nil {
+			return nil, csiErr
+		}
+	}
+
+	iqn := global.Basename + ":" + targetName
+	return &iqn, nil
+}
+
+// deleteIscsiTarget deletes the target and the extent named targetName, if they exist
+func deleteIscsiTarget(ctx context.Context, client *Client, targetName string) *CsiError {
+	target, csiErr := TNSIscsiTargetGet(ctx, client, targetName)
+	if csiErr != nil {
+		return csiErr
+	}
+	if target != nil {
+		if csiErr := TNSIscsiTargetDelete(ctx, client, target.ID); csiErr != nil {
+			return csiErr
+		}
+	}
+
+	extent, csiErr := TNSIscsiExtentGet(ctx, client, targetName)
+	if csiErr != nil {
+		return csiErr
+	}
+	if extent != nil {
+		if csiErr := TNSIscsiExtentDelete(ctx, client, extent.ID); csiErr != nil {
+			return csiErr
+		}
+	}
+	return nil
+}
+
+// ensureNvmeofSubsys creates the subsystem, the namespace of the zvol and the association with the port
+// when they do not exist. Returns the NQN of the subsystem and the id of the namespace
+func ensureNvmeofSubsys(ctx context.Context, client *Client, dsName string, subsysName string, portID int) (*string, *int, *CsiError) {
+	subsys, csiErr := TNSNvmetSubsysGet(ctx, client, subsysName)
+	if csiErr != nil {
+		return nil, nil, csiErr
+	}
+	if subsys == nil {
+		if subsys, csiErr = TNSNvmetSubsysCreate(ctx, client, subsysName); csiErr != nil {
+			return nil, nil, csiErr
+		}
+	}
+
+	namespace, csiErr := TNSNvmetNamespaceGet(ctx, client, subsys.ID, dsName)
+	if csiErr != nil {
+		return nil, nil, csiErr
+	}
+	if namespace == nil {
+		if namespace, csiErr = TNSNvmetNamespaceCreate(ctx, client, subsys.ID, dsName); csiErr != nil {
+			return nil, nil, csiErr
+		}
+	}
+
+	portSubsys, csiErr := TNSNvmetPortSubsysGet(ctx, client, portID, subsys.ID)
+	if csiErr != nil {
+		return nil, nil, csiErr
+	}
+	if portSubsys == nil {
+		if _, csiErr = TNSNvmetPortSubsysCreate(ctx, client, portID, subsys.ID); csiErr != nil {
+			return nil, nil, csiErr
 		}
 	}
+
+	return &subsys.Subnqn, &namespace.Nsid, nil
+}
+
+// deleteNvmeofSubsys deletes the subsystem named subsysName, if it exists
+func deleteNvmeofSubsys(ctx context.Context, client *Client, subsysName string) *CsiError {
+	subsys, csiErr := TNSNvmetSubsysGet(ctx, client, subsysName)
+	if csiErr != nil {
+		return csiErr
+	}
+	if subsys != nil {
+		return TNSNvmetSubsysDelete(ctx, client, subsys.ID)
+	}
+	return nil
+}
+
+func logAndReturnError(msg string, err *CsiError) *CsiError {
+	klog.Errorf("%s: %s", msg, err)
+	return err
+}
+
+// cleanupContext returns a context that survives the cancellation of the request,
+// to undo a partially done operation
+func cleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), timeout*time.Second)
 }
@@ -0,0 +1,107 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tns
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+)
+
+func TestCsiCheckBackendHealth(t *testing.T) {
+	rootDataset := map[string]interface{}{"id": "tank/k8s", "name": "tank/k8s", "pool": "tank", "mountpoint": "/mnt/tank/k8s"}
+	pool := map[string]interface{}{"id": 1, "name": "tank", "status": "ONLINE", "healthy": true}
+	service := func(state string) []interface{} {
+		return []interface{}{map[string]interface{}{"id": 5, "service": "nfs", "enable": true, "state": state}}
+	}
+	with := func(m map[string]interface{}, k string, v interface{}) map[string]interface{} {
+		c := map[string]interface{}{}
+		for mk, mv := range m {
+			c[mk] = mv
+		}
+		c[k] = v
+		return c
+	}
+
+	tests := []struct {
+		desc         string
+		results      map[string]interface{}
+		startService bool
+		expected     codes.Code
+		contains     string
+	}{
+		{
+			desc:     "Healthy",
+			results:  map[string]interface{}{"pool.dataset.get_instance": rootDataset, "pool.query": []interface{}{pool}, "service.query": service("RUNNING")},
+			expected: codes.OK,
+		},
+		{
+			desc:     "Root dataset locked",
+			results:  map[string]interface{}{"pool.dataset.get_instance": with(rootDataset, "locked", true)},
+			expected: codes.FailedPrecondition,
+			contains: "locked",
+		},
+		{
+			desc:     "Root dataset not mounted",
+			results:  map[string]interface{}{"pool.dataset.get_instance": with(rootDataset, "mountpoint", "")},
+			expected: codes.FailedPrecondition,
+			contains: "not mounted",
+		},
+		{
+			desc:     "Pool does not exist",
+			results:  map[string]interface{}{"pool.dataset.get_instance": rootDataset, "pool.query": []interface{}{}},
+			expected: codes.FailedPrecondition,
+			contains: "import it",
+		},
+		{
+			desc:     "Pool degraded",
+			results:  map[string]interface{}{"pool.dataset.get_instance": rootDataset, "pool.query": []interface{}{with(pool, "status", "DEGRADED")}},
+			expected: codes.FailedPrecondition,
+			contains: "DEGRADED",
+		},
+		{
+			desc:     "Service stopped",
+			results:  map[string]interface{}{"pool.dataset.get_instance": rootDataset, "pool.query": []interface{}{pool}, "service.query": service("STOPPED")},
+			expected: codes.FailedPrecondition,
+			contains: "autoStartService",
+		},
+		{
+			desc:         "Service stopped then started",
+			results:      map[string]interface{}{"pool.dataset.get_instance": rootDataset, "pool.query": []interface{}{pool}, "service.query": service("STOPPED")},
+			startService: true,
+			expected:     codes.OK,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			f := newFakeTruenas(t)
+			defer f.server.Close()
+			f.results = test.results
+
+			csiErr := CsiCheckBackendHealth(context.Background(), f.url(), &Credentials{ApiKey: "good-key"}, "tank/k8s", "nfs", test.startService)
+			if test.expected == codes.OK {
+				assert.Nil(t, csiErr)
+				return
+			}
+			if assert.NotNil(t, csiErr) {
+				assert.Equal(t, test.expected, csiErr.Code)
+				assert.Contains(t, csiErr.Error(), test.contains)
+			}
+		})
+	}
+}
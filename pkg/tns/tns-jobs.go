@@ -0,0 +1,214 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"k8s.io/klog/v2"
+)
+
+// Truenas Scale jobs (eg replications) are tracked with the notifications of the "core.get_jobs" collection
+// The job is still polled, often when notifications are not available, seldom otherwise in case one is missed
+
+const jobsCollection = "core.get_jobs"
+
+const (
+	jobStateWaiting = "WAITING"
+	jobStateRunning = "RUNNING"
+	jobStateSuccess = "SUCCESS"
+	jobStateFailed  = "FAILED"
+	jobStateAborted = "ABORTED"
+)
+
+const DefaultJobTimeout = 1 * time.Hour
+
+var (
+	jobTimeout            = DefaultJobTimeout
+	jobPollInterval       = 2 * time.Second  // when notifications are not available
+	jobSafetyPollInterval = 30 * time.Second // when notifications are available
+)
+
+// Abort the Truenas job (eg replication) when the request waiting for it is cancelled or times out
+var abortJobsOnCancel = false
+
+// SetAbortJobsOnCancel sets whether Truenas jobs are aborted when the request waiting for them is cancelled
+func SetAbortJobsOnCancel(abort bool) {
+	abortJobsOnCancel = abort
+}
+
+// SetJobTimeout sets how long to wait for a Truenas job to complete. 0 means no limit
+func SetJobTimeout(t time.Duration) {
+	jobTimeout = t
+}
+
+func waitForJobCompletion(ctx context.Context, client *Client, jobID *int) *CsiError {
+	klog.V(2).Infof("Waiting for job %d (timeout: %s)", *jobID, jobTimeout)
+
+	jobCtx := ctx
+	if jobTimeout > 0 {
+		var cancel context.CancelFunc
+		jobCtx, cancel = context.WithTimeout(ctx, jobTimeout)
+		defer cancel()
+	}
+
+	// Subscribe before the first query so that no update is lost
+	notifications, unsubscribe := client.Subscribe(jobsCollection)
+	defer unsubscribe()
+	pollInterval := jobSafetyPollInterval
+	if csiErr := client.SubscribeRemote(jobCtx, jobsCollection); csiErr != nil {
+		klog.Warningf("Subscription to job updates failed, polling job %d instead: %v", *jobID, csiErr)
+		notifications = nil
+		pollInterval = jobPollInterval
+	}
+
+	tracker := jobTracker{jobID: *jobID}
+
+	poll := time.NewTimer(0)
+	defer poll.Stop()
+
+	for {
+		var jobStatus *TNSJobStatus
+
+		select {
+		case <-jobCtx.Done():
+			return tracker.stop(ctx, client, jobCtx.Err())
+
+		case notification, ok := <-notifications:
+			if !ok {
+				// Connection closed: the polling will report the error
+				klog.Warningf("Job updates not available anymore, polling job %d", *jobID)
+				notifications = nil
+				pollInterval = jobPollInterval
+				continue
+			}
+			jobStatus = jobStatusFromNotification(notification)
+			if jobStatus == nil || jobStatus.ID != *jobID {
+				continue
+			}
+
+		case <-poll.C:
+			var csiErr *CsiError
+			jobStatus, csiErr = TNSGetJobStatus(jobCtx, client, *jobID)
+			if csiErr != nil {
+				if jobCtx.Err() != nil {
+					// Handled at the top of the loop
+					continue
+				}
+				return csiErr
+			}
+			poll.Reset(pollInterval)
+		}
+
+		if done, csiErr := tracker.update(jobStatus); done {
+			return csiErr
+		}
+	}
+}
+
+// jobTracker follows the state of a job and logs its progress
+type jobTracker struct {
+	jobID       int
+	lastState   string
+	lastPercent float64
+}
+
+// update returns true when the job is finished, with an error if it did not succeed
+func (t *jobTracker) update(jobStatus *TNSJobStatus) (bool, *CsiError) {
+	switch jobStatus.State {
+	case jobStateWaiting, jobStateRunning:
+		t.logProgress(jobStatus)
+		return false, nil
+	case jobStateSuccess:
+		klog.V(2).Infof("Job %d completed successfully", t.jobID)
+		return true, nil
+	case jobStateFailed, jobStateAborted:
+		klog.Errorf("Job failed or aborted: %v", *jobStatus)
+		return true, NewCsiError(codes.Internal, fmt.Errorf("Job %d %s: %v", t.jobID, jobStatus.State, jobStatus.Err))
+	default:
+		// Maybe a state introduced by a newer Truenas Scale. The timeout protects from waiting forever
+		klog.Warningf("Unexpected state for job %d: %s. Continue waiting", t.jobID, jobStatus.State)
+		return false, nil
+	}
+}
+
+func (t *jobTracker) logProgress(jobStatus *TNSJobStatus) {
+	percent := t.lastPercent
+	if jobStatus.Progress.Percent != nil {
+		percent = *jobStatus.Progress.Percent
+	}
+	if jobStatus.State == t.lastState && percent == t.lastPercent {
+		return
+	}
+	t.lastState = jobStatus.State
+	t.lastPercent = percent
+
+	klog.V(2).Infof("Job %d %s: %.0f%% %s", t.jobID, jobStatus.State, percent, jobStatus.Progress.Description)
+}
+
+// stop is called when the caller gives up waiting for the job, the job is aborted if requested
+func (t *jobTracker) stop(ctx context.Context, client *Client, err error) *CsiError {
+	klog.Warningf("Stop waiting for job %d: %v", t.jobID, err)
+
+	if abortJobsOnCancel {
+		abortCtx, cancel := cleanupContext(ctx)
+		if csiErr := TNSJobAbort(abortCtx, client, t.jobID); csiErr != nil {
+			klog.Warningf("Job abort failed. Continue: %v", csiErr)
+		}
+		cancel()
+	}
+
+	if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+		// Only the job timeout expired
+		return NewCsiError(codes.DeadlineExceeded, fmt.Errorf("Job %d did not complete within %s", t.jobID, jobTimeout))
+	}
+	if errors.Is(ctx.Err(), context.Canceled) {
+		// The caller cancelled the request
+		return NewCsiError(codes.Canceled, fmt.Errorf("Stopped waiting for job %d: %w", t.jobID, ctx.Err()))
+	}
+	return NewCsiError(codes.DeadlineExceeded, err)
+}
+
+// jobStatusFromNotification decodes the job carried by a "core.get_jobs" notification
+func jobStatusFromNotification(notification *WSNotification) *TNSJobStatus {
+	if len(notification.Fields) == 0 {
+		return nil
+	}
+
+	var jobStatus TNSJobStatus
+	if err := json.Unmarshal(notification.Fields, &jobStatus); err != nil {
+		klog.Warningf("Failed to decode job notification: %v", err)
+		return nil
+	}
+	if jobStatus.State == "" {
+		// Nothing to track in this update
+		return nil
+	}
+	if jobStatus.ID == 0 {
+		// The fields of a "changed" notification may not include the id
+		id, err := strconv.Atoi(string(notification.ID))
+		if err != nil {
+			return nil
+		}
+		jobStatus.ID = id
+	}
+	return &jobStatus
+}
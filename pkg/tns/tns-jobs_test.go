@@ -0,0 +1,105 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+)
+
+func jobState(state string, percent float64) map[string]interface{} {
+	return map[string]interface{}{"id": 7, "state": state, "progress": map[string]interface{}{"percent": percent, "description": "replicating"}}
+}
+
+func TestWaitForJobCompletion(t *testing.T) {
+	tests := []struct {
+		desc       string
+		script     []map[string]interface{}
+		jobTimeout time.Duration
+		cancel     time.Duration // Cancel the request after this delay
+		expected   codes.Code
+		aborted    bool
+	}{
+		{
+			desc:     "Job succeeds after waiting and running",
+			script:   []map[string]interface{}{jobState("RUNNING", 10), jobState("RUNNING", 60), jobState("SUCCESS", 100)},
+			expected: codes.OK,
+		},
+		{
+			desc:     "Job fails",
+			script:   []map[string]interface{}{jobState("RUNNING", 10), {"id": 7, "state": "FAILED", "error": "boom"}},
+			expected: codes.Internal,
+		},
+		{
+			desc:       "Job stays waiting until the timeout and is aborted",
+			jobTimeout: 200 * time.Millisecond,
+			expected:   codes.DeadlineExceeded,
+			aborted:    true,
+		},
+		{
+			desc:     "Request cancelled while the job is waiting, the job is aborted",
+			cancel:   200 * time.Millisecond,
+			expected: codes.Canceled,
+			aborted:  true,
+		},
+	}
+
+	defer SetJobTimeout(DefaultJobTimeout)
+	defer SetAbortJobsOnCancel(false)
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			f := newFakeTruenas(t)
+			defer f.server.Close()
+			f.jobState = jobState("WAITING", 0)
+			f.jobScript = test.script
+
+			SetJobTimeout(test.jobTimeout)
+			SetAbortJobsOnCancel(test.aborted)
+
+			client, csiErr := GetClient(context.Background(), f.url(), &Credentials{ApiKey: "good-key"})
+			if csiErr != nil {
+				t.Fatalf("GetClient failed: %v", csiErr)
+			}
+			defer ReleaseClient(client)
+
+			// Notifications must be used: the safety polling is much longer than the test
+			ctx := context.Background()
+			if test.cancel > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithCancel(ctx)
+				time.AfterFunc(test.cancel, cancel)
+			}
+			start := time.Now()
+			jobID := 7
+			csiErr = waitForJobCompletion(ctx, client, &jobID)
+			assert.Less(t, time.Since(start), 5*time.Second)
+
+			if test.expected == codes.OK {
+				assert.Nil(t, csiErr)
+			} else if assert.NotNil(t, csiErr) {
+				assert.Equal(t, test.expected, csiErr.Code)
+			}
+
+			f.mu.Lock()
+			assert.Equal(t, test.aborted, f.aborted)
+			f.mu.Unlock()
+		})
+	}
+}
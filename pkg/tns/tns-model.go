@@ -15,7 +15,9 @@
 package tns
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"google.golang.org/grpc/codes"
@@ -26,10 +28,17 @@ import (
 // -------------------------
 
 type TNSJobStatus struct {
-	ID     int         `json:"id"`
-	State  string      `json:"state"`
-	Result interface{} `json:"result,omitempty"`
-	Err    interface{} `json:"error,omitempty"`
+	ID       int            `json:"id"`
+	Method   string         `json:"method,omitempty"`
+	State    string         `json:"state"` // WAITING, RUNNING, SUCCESS, FAILED, ABORTED
+	Progress TNSJobProgress `json:"progress,omitempty"`
+	Result   interface{}    `json:"result,omitempty"`
+	Err      interface{}    `json:"error,omitempty"`
+}
+
+type TNSJobProgress struct {
+	Percent     *float64 `json:"percent,omitempty"`
+	Description string   `json:"description,omitempty"`
 }
 
 type TNSSnapshot struct {
@@ -43,10 +52,11 @@ type TNSSnapshot struct {
 }
 
 type TNSSnapshotProperties struct {
+	Clones ZFSProperty `json:"clones,omitempty"` // Datasets cloned from the snapshot, comma separated
 	// Compressratio     ZFSProperty `json:"compressratio,omitempty"`
 	// Createtxg         ZFSProperty `json:"createtxg,omitempty"`
-	// Creation          ZFSProperty `json:"creation,omitempty"`
-	// DeferDestroy      ZFSProperty `json:"defer_destroy,omitempty"`
+	Creation     ZFSProperty `json:"creation,omitempty"`
+	DeferDestroy ZFSProperty `json:"defer_destroy,omitempty"` // "on" when destroyed with its last clone
 	// Encryptionroot    ZFSProperty `json:"encryptionroot,omitempty"`
 	// GUID              ZFSProperty `json:"guid,omitempty"`
 	// Inconsistent      ZFSProperty `json:"inconsistent,omitempty"`
@@ -97,42 +107,55 @@ type TNSDataset struct {
 	Available  ZFSProperty `json:"available,omitempty"`
 	Comments   ZFSProperty `json:"comments,omitempty"`
 	MountPoint string      `json:"mountpoint,omitempty"`
+	Origin     ZFSProperty `json:"origin,omitempty"` // Snapshot the dataset is cloned from
 	RefQuota   ZFSProperty `json:"refquota,omitempty"`
+	Used       ZFSProperty `json:"used,omitempty"`
+
+	Quota          ZFSProperty `json:"quota,omitempty"`          // Size of the volume with quotaMode: quota (snapshots included)
+	Reservation    ZFSProperty `json:"reservation,omitempty"`    // Thick provisioning, snapshots included
+	RefReservation ZFSProperty `json:"refreservation,omitempty"` // Thick provisioning
+
+	UsedByDataset ZFSProperty `json:"usedbydataset,omitempty"` // What refquota applies to (snapshots excluded)
+
+	UserProperties map[string]ZFSProperty `json:"user_properties,omitempty"`
+
+	Type    string      `json:"type,omitempty"`    // FILESYSTEM or VOLUME (zvol)
+	VolSize ZFSProperty `json:"volsize,omitempty"` // zvol only
+
+	// Properties that can be set by the storage classes (ds.<property>)
+	ACLMode       ZFSProperty `json:"aclmode,omitempty"`
+	ACLType       ZFSProperty `json:"acltype,omitempty"`
+	ATime         ZFSProperty `json:"atime,omitempty"`
+	Compression   ZFSProperty `json:"compression,omitempty"`
+	Copies        ZFSProperty `json:"copies,omitempty"`
+	Deduplication ZFSProperty `json:"deduplication,omitempty"`
+	Exec          ZFSProperty `json:"exec,omitempty"`
+	ReadOnly      ZFSProperty `json:"readonly,omitempty"`
+	RecordSize    ZFSProperty `json:"recordsize,omitempty"`
+	SnapDir       ZFSProperty `json:"snapdir,omitempty"`
+	Sync          ZFSProperty `json:"sync,omitempty"`
+	XAttr         ZFSProperty `json:"xattr,omitempty"`
+
+	Encrypted      bool   `json:"encrypted,omitempty"`
+	EncryptionRoot string `json:"encryption_root,omitempty"`
+	KeyLoaded      bool   `json:"key_loaded,omitempty"`
+	Locked         bool   `json:"locked,omitempty"` // Encrypted and its key is not loaded, eg after a reboot
 
-	// Type           string      `json:"type,omitempty"`
-	// Encrypted      bool        `json:"encrypted,omitempty"`
-	// EncryptionRoot string      `json:"encryption_root,omitempty"`
-	// KeyLoaded      bool        `json:"key_loaded,omitempty"`
 	// Children       []any  `json:"children"`
 	// ManagedBy      ZFSProperty `json:"managedby,omitempty"`
-	// Deduplication  ZFSProperty `json:"deduplication,omitempty"`
-	// ACLMode        ZFSProperty `json:"aclmode"`
-	// ACLType        ZFSProperty `json:"acltype"`
 
-	// ATime                 ZFSProperty `json:"atime"`
 	// CaseSensitivity       ZFSProperty `json:"casesensitivity"`
 	// Checksum              ZFSProperty `json:"checksum"`
-	// Compression           ZFSProperty `json:"compression"`
 	// CompressRatio         ZFSProperty `json:"compressratio"`
-	// Copies                ZFSProperty `json:"copies"`
-	// VolSize               ZFSProperty `json:"volsize,omitempty"`
 	// VolBlockSize          ZFSProperty `json:"volblocksize,omitempty"`
 	// Sparse                ZFSProperty `json:"sparse,omitempty"`
 	// ForceSize             ZFSProperty `json:"force_size,omitempty"`
-	// Sync                  ZFSProperty `json:"sync,omitempty"`
 	// SnapDev               ZFSProperty `json:"snapdev,omitempty"`
-	// Exec                  ZFSProperty `json:"exec,omitempty"`
-	// Quota                 ZFSProperty `json:"quota,omitempty"`
 	// QuotaWarning          ZFSProperty `json:"quota_warning,omitempty"`
 	// QuotaCritical         ZFSProperty `json:"quota_critical,omitempty"`
 	// RefQuotaWarning       ZFSProperty `json:"refquota_warning,omitempty"`
 	// RefQuotaCritical      ZFSProperty `json:"refquota_critical,omitempty"`
-	// Reservation           ZFSProperty `json:"reservation,omitempty"`
-	// RefReservation        ZFSProperty `json:"refreservation,omitempty"`
 	// SpecialSmallBlockSize ZFSProperty `json:"special_small_block_size,omitempty"`
-	// SnapDir               ZFSProperty `json:"snapdir,omitempty"`
-	// ReadOnly              ZFSProperty `json:"readonly,omitempty"`
-	// RecordSize            ZFSProperty `json:"recordsize,omitempty"`
 	// EncryptionOptions     ZFSProperty `json:"encryption_options"`
 	// Encryption            ZFSProperty `json:"encryption"`
 	// InheritEncryption     ZFSProperty `json:"inherit_encryption"`
@@ -155,6 +178,102 @@ type TNSNFSShare struct {
 	Locked       bool     `json:"locked,omitempty"`        // Optional
 }
 
+type TNSSMBShare struct {
+	Name       string   `json:"name"`                 // Required
+	Path       string   `json:"path"`                 // Required
+	Comment    string   `json:"comment,omitempty"`    // Default: ""
+	Browsable  bool     `json:"browsable,omitempty"`  // Default: true
+	HostsAllow []string `json:"hostsallow,omitempty"` // Default: []
+	HostsDeny  []string `json:"hostsdeny,omitempty"`  // Default: []
+	Enabled    bool     `json:"enabled,omitempty"`    // Default: true
+	ID         uint     `json:"id,omitempty"`         // Optional
+	Locked     bool     `json:"locked,omitempty"`     // Optional
+}
+
+// TNSSMBShareAce is an entry of the ACL of an SMB share, for either a SID or a user/group id
+type TNSSMBShareAce struct {
+	WhoSid string             `json:"ae_who_sid,omitempty"`
+	WhoID  *TNSSMBShareAceWho `json:"ae_who_id,omitempty"`
+	Perm   string             `json:"ae_perm"` // FULL, CHANGE or READ
+	Type   string             `json:"ae_type"` // ALLOWED or DENIED
+}
+
+type TNSSMBShareAceWho struct {
+	IDType string `json:"id_type"` // USER or GROUP
+	ID     int    `json:"id"`
+}
+
+// SMBShareOptions are the settings of the SMB shares given in the storage class
+type SMBShareOptions struct {
+	Browsable  *bool // Default of Truenas Scale when nil
+	HostsAllow []string
+	HostsDeny  []string
+	Acl        []TNSSMBShareAce // Default ACL of Truenas Scale when empty
+}
+
+// TNSPool is a ZFS pool, with its health
+type TNSPool struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Status  string `json:"status"` // ONLINE, DEGRADED, FAULTED, OFFLINE...
+	Healthy bool   `json:"healthy"`
+}
+
+// TNSService is a service of Truenas Scale (nfs, cifs, iscsitarget, nvmet...)
+type TNSService struct {
+	ID      int    `json:"id"`
+	Service string `json:"service"`
+	Enable  bool   `json:"enable"` // Started at boot
+	State   string `json:"state"`  // RUNNING, STOPPED...
+}
+
+type TNSIscsiGlobalConfig struct {
+	Basename string `json:"basename"` // eg iqn.2005-10.org.freenas.ctl
+}
+
+type TNSIscsiTarget struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Alias string `json:"alias,omitempty"`
+	Mode  string `json:"mode,omitempty"`
+}
+
+type TNSIscsiExtent struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Type    string `json:"type,omitempty"`
+	Disk    string `json:"disk,omitempty"` // zvol/<dataset>
+	Enabled bool   `json:"enabled,omitempty"`
+	Locked  bool   `json:"locked,omitempty"`
+}
+
+type TNSIscsiTargetExtent struct {
+	ID     int `json:"id"`
+	Target int `json:"target"`
+	Extent int `json:"extent"`
+	LunID  int `json:"lunid"`
+}
+
+type TNSNvmetSubsys struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	Subnqn       string `json:"subnqn"` // <basenqn>:<name> by default
+	AllowAnyHost bool   `json:"allow_any_host,omitempty"`
+}
+
+type TNSNvmetNamespace struct {
+	ID         int    `json:"id"`
+	Nsid       int    `json:"nsid"`
+	DeviceType string `json:"device_type,omitempty"` // ZVOL or FILE
+	DevicePath string `json:"device_path,omitempty"` // zvol/<dataset>
+	Enabled    bool   `json:"enabled,omitempty"`
+	Locked     bool   `json:"locked,omitempty"`
+}
+
+type TNSNvmetPortSubsys struct {
+	ID int `json:"id"`
+}
+
 type TNSDatasetStats struct {
 	//Realpath        string   `json:"realpath"`
 	//Size            int      `json:"size"`
@@ -178,10 +297,11 @@ type TNSDatasetStats struct {
 	//Acl             bool     `json:"acl"`
 }
 
+// EncryptionOptions of an encrypted dataset: a key generated and kept by Truenas Scale, a passphrase or a hex key
 type EncryptionOptions struct {
 	GenerateKey bool    `json:"generate_key"`
-	PBKDF2Iters int     `json:"pbkdf2iters"`
-	Algorithm   string  `json:"algorithm"`
+	PBKDF2Iters int     `json:"pbkdf2iters,omitempty"`
+	Algorithm   string  `json:"algorithm,omitempty"`
 	Passphrase  *string `json:"passphrase,omitempty"`
 	Key         *string `json:"key,omitempty"`
 }
@@ -194,6 +314,89 @@ type ZFSProperty struct {
 	Value      string  `json:"value"`
 }
 
+// Size returns the value of a size property (eg refquota), 0 when it is not set
+func (p ZFSProperty) Size() int64 {
+	if parsed, ok := p.Parsed.(float64); ok {
+		return int64(parsed)
+	}
+	return 0
+}
+
+// Quota modes of the datasets: the property limiting the size of the volumes
+const (
+	QuotaModeRefQuota = "refquota" // The snapshots are not counted
+	QuotaModeQuota    = "quota"    // The snapshots are counted
+)
+
+// Reservation modes of the datasets: the property reserving the size of the volumes in the pool (thick provisioning)
+const (
+	ReservationModeNone           = "none"
+	ReservationModeRefReservation = "refreservation" // The snapshots are not counted
+	ReservationModeReservation    = "reservation"    // The snapshots are counted
+)
+
+// SpaceOptions are the quota and reservation modes of the dataset of a volume. The zero value is a refquota without reservation
+type SpaceOptions struct {
+	QuotaMode       string
+	ReservationMode string
+}
+
+// withDefaults returns the options with the default modes when they are not set
+func (o SpaceOptions) withDefaults() SpaceOptions {
+	if o.QuotaMode == "" {
+		o.QuotaMode = QuotaModeRefQuota
+	}
+	if o.ReservationMode == "" {
+		o.ReservationMode = ReservationModeNone
+	}
+	return o
+}
+
+// sizeProperties returns the quota and the reservation of a dataset of the given size
+func (o SpaceOptions) sizeProperties(size int64) map[string]interface{} {
+	properties := map[string]interface{}{}
+	if o.QuotaMode == QuotaModeQuota {
+		properties[QuotaModeQuota] = size
+	} else {
+		properties[QuotaModeRefQuota] = size
+	}
+	switch o.ReservationMode {
+	case ReservationModeRefReservation, ReservationModeReservation:
+		properties[o.ReservationMode] = size
+	}
+	return properties
+}
+
+// SpaceOptions returns the quota and reservation modes of an existing dataset
+func (ds *TNSDataset) SpaceOptions() SpaceOptions {
+	o := SpaceOptions{QuotaMode: QuotaModeRefQuota, ReservationMode: ReservationModeNone}
+	if ds.Quota.Size() > 0 {
+		o.QuotaMode = QuotaModeQuota
+	}
+	if ds.RefReservation.Size() > 0 {
+		o.ReservationMode = ReservationModeRefReservation
+	} else if ds.Reservation.Size() > 0 {
+		o.ReservationMode = ReservationModeReservation
+	}
+	return o
+}
+
+// reservationSize returns the space reserved for the dataset, 0 without thick provisioning
+func (ds *TNSDataset) reservationSize() int64 {
+	if ds.SpaceOptions().ReservationMode == ReservationModeReservation {
+		return ds.Reservation.Size()
+	}
+	return ds.RefReservation.Size()
+}
+
+// Capacity returns the size of the volume of a filesystem dataset: its quota or its refquota
+func (ds *TNSDataset) Capacity() int64 {
+	if ds.SpaceOptions().QuotaMode == QuotaModeQuota {
+		return ds.Quota.Size()
+	}
+	return ds.RefQuota.Size()
+}
+
 // -------------------------
 // truenas WS request
 // -------------------------
@@ -206,6 +409,17 @@ type WSRequest struct {
 	Params  interface{} `json:"params"`
 }
 
+// -------------------------
+// truenas WS notification
+// -------------------------
+
+type WSNotification struct {
+	Msg        string          `json:"msg"`        // "added", "changed" or "removed"
+	Collection string          `json:"collection"` // eg "core.get_jobs"
+	ID         json.RawMessage `json:"id"`         // id of the object in the collection
+	Fields     json.RawMessage `json:"fields,omitempty"`
+}
+
 // -------------------------
 // truenas WS result message
 // -------------------------
@@ -224,20 +438,33 @@ type Error struct {
 	Type    string `json:"type,omitempty"`    // Truenas Scale < 25.x
 	Reason  string `json:"reason,omitempty"`  // Truenas Scale < 25.x
 	// Trace   Trace  `json:"trace,omitempty"` // Truenas Scale < 25.x
-	Message string `json:"message,omitempty"` // Truenas Scale >= 25.x
-	Data    string `json:"data,omitempty"`    // Truenas Scale >= 25.x
+	JsonRPCCode int             `json:"code,omitempty"`    // Truenas Scale >= 25.x
+	Message     string          `json:"message,omitempty"` // Truenas Scale >= 25.x
+	Data        json.RawMessage `json:"data,omitempty"`    // Truenas Scale >= 25.x. Usually the legacy error object
 }
 
 func (e Error) IsErrorPresent() bool {
 	//	return !(e.Code == 0 && e.Errname == "" && e.Type == "" && e.Reason == "" && len(e.Trace.Frames) == 0)
-	return !(e.Code == 0 && e.Errname == "" && e.Type == "" && e.Reason == "")
+	return !(e.Code == 0 && e.Errname == "" && e.Type == "" && e.Reason == "" && e.JsonRPCCode == 0 && e.Message == "")
 }
 func (e Error) ToError() error {
+	var data Error
+	if len(e.Data) > 0 && json.Unmarshal(e.Data, &data) == nil && data.IsErrorPresent() {
+		return data.ToError()
+	}
+	reason := e.Reason
+	if reason == "" {
+		reason = e.Message
+	}
+	code := e.Code
+	if code == 0 {
+		code = e.JsonRPCCode
+	}
 	return CustomError{
-		Code:    e.Code,
+		Code:    code,
 		Type:    e.Type,
 		Errname: e.Errname,
-		Reason:  e.Reason,
+		Reason:  reason,
 	}
 }
 
@@ -251,6 +478,16 @@ type CsiError struct {
 }
 
 func NewCsiError(code codes.Code, err error) *CsiError {
+	// When the request has been cancelled or has timed out, report it as such whatever the caller code
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case isConnectionError(err):
+		// Truenas Scale unreachable: the caller should retry later
+		code = codes.Unavailable
+	}
 	return &CsiError{
 		Code: code,
 		Err:  err,
@@ -0,0 +1,59 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpaceOptionsSizeProperties(t *testing.T) {
+	tests := []struct {
+		space    SpaceOptions
+		expected map[string]interface{}
+	}{
+		{space: SpaceOptions{}, expected: map[string]interface{}{"refquota": int64(10)}},
+		{space: SpaceOptions{QuotaMode: QuotaModeQuota, ReservationMode: ReservationModeNone}, expected: map[string]interface{}{"quota": int64(10)}},
+		{space: SpaceOptions{ReservationMode: ReservationModeRefReservation}, expected: map[string]interface{}{"refquota": int64(10), "refreservation": int64(10)}},
+		{space: SpaceOptions{QuotaMode: QuotaModeQuota, ReservationMode: ReservationModeReservation}, expected: map[string]interface{}{"quota": int64(10), "reservation": int64(10)}},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.space.sizeProperties(10), test.space)
+	}
+}
+
+func TestDatasetSpaceOptions(t *testing.T) {
+	size := func(v float64) ZFSProperty { return ZFSProperty{Parsed: v} }
+
+	ds := &TNSDataset{RefQuota: size(100)}
+	assert.Equal(t, SpaceOptions{QuotaMode: QuotaModeRefQuota, ReservationMode: ReservationModeNone}, ds.SpaceOptions())
+	assert.Equal(t, int64(100), ds.Capacity())
+	assert.Equal(t, int64(0), ds.reservationSize())
+
+	ds = &TNSDataset{Quota: size(200), RefReservation: size(200)}
+	assert.Equal(t, SpaceOptions{QuotaMode: QuotaModeQuota, ReservationMode: ReservationModeRefReservation}, ds.SpaceOptions())
+	assert.Equal(t, int64(200), ds.Capacity())
+	assert.Equal(t, int64(200), ds.reservationSize())
+
+	ds = &TNSDataset{RefQuota: size(100), Reservation: size(100)}
+	assert.Equal(t, SpaceOptions{QuotaMode: QuotaModeRefQuota, ReservationMode: ReservationModeReservation}, ds.SpaceOptions())
+	assert.Equal(t, int64(100), ds.reservationSize())
+
+	// Unset properties
+	ds = &TNSDataset{RefQuota: ZFSProperty{Value: "none"}}
+	assert.Equal(t, int64(0), ds.Capacity())
+}
@@ -0,0 +1,178 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"k8s.io/klog/v2"
+)
+
+// Resilience to Truenas Scale being unreachable (eg reboot or upgrade):
+// - idempotent calls that lost their WebSocket are retried on a new one, after a jittered exponential backoff
+// - each url has a circuit breaker: after breakerThreshold consecutive connection failures, calls fail fast
+//   with codes.Unavailable until a probe connection succeeds
+
+const (
+	maxCallRetries   = 3
+	retryBaseDelay   = 250 * time.Millisecond
+	retryMaxDelay    = 4 * time.Second
+	breakerThreshold = 3
+	breakerBaseDelay = 5 * time.Second
+	breakerMaxDelay  = 2 * time.Minute
+)
+
+// connectionError is an error of the WebSocket itself, not an error returned by Truenas Scale
+type connectionError struct {
+	err error
+}
+
+func (e *connectionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *connectionError) Unwrap() error {
+	return e.err
+}
+
+func isConnectionError(err error) bool {
+	var connErr *connectionError
+	return errors.As(err, &connErr)
+}
+
+// isIdempotentMethod returns true for the methods that can safely be sent again
+// when the response has been lost with the WebSocket
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case "core.get_jobs", "filesystem.stat":
+		return true
+	}
+	return strings.HasSuffix(method, ".query") || strings.HasSuffix(method, ".get_instance")
+}
+
+// retryDelay returns the delay before the given retry (1..n): exponential with "equal jitter"
+func retryDelay(retry int) time.Duration {
+	delay := retryBaseDelay << (retry - 1)
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// sleepContext waits for the delay, or less if the context is done
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// -------------------
+// Circuit breaker
+// -------------------
+
+type circuitBreaker struct {
+	tnsWsUrl  string
+	mu        sync.Mutex
+	failures  int       // consecutive connection failures
+	opens     int       // consecutive openings, to compute the delay
+	openUntil time.Time // zero when closed
+	probing   bool      // half-open: one connection attempt in progress
+}
+
+var breakers = struct {
+	mu sync.Mutex
+	m  map[string]*circuitBreaker
+}{m: make(map[string]*circuitBreaker)}
+
+func breakerFor(tnsWsUrl string) *circuitBreaker {
+	breakers.mu.Lock()
+	defer breakers.mu.Unlock()
+
+	breaker, ok := breakers.m[tnsWsUrl]
+	if !ok {
+		breaker = &circuitBreaker{tnsWsUrl: tnsWsUrl}
+		breakers.m[tnsWsUrl] = breaker
+	}
+	return breaker
+}
+
+// allow returns an error when the breaker is open. Once the delay has expired, one caller is let through as a probe
+func (b *circuitBreaker) allow() *CsiError {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openUntil.IsZero() {
+		return nil
+	}
+	if remaining := time.Until(b.openUntil); remaining > 0 || b.probing {
+		if remaining < 0 {
+			remaining = 0
+		}
+		return NewCsiError(codes.Unavailable, fmt.Errorf("Truenas Scale %s is unavailable, next connection attempt in %s", b.tnsWsUrl, remaining.Round(time.Second)))
+	}
+
+	klog.V(2).Infof("Circuit breaker for %s half-open: trying to connect", b.tnsWsUrl)
+	b.probing = true
+	return nil
+}
+
+// record updates the breaker with the outcome of a connection attempt
+// Only codes.Unavailable counts as a failure: any other error means the server answered
+func (b *circuitBreaker) record(csiErr *CsiError) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+
+	if csiErr != nil && (csiErr.Code == codes.DeadlineExceeded || csiErr.Code == codes.Canceled) {
+		// The caller gave up, nothing learnt about the server
+		return
+	}
+
+	if csiErr == nil || csiErr.Code != codes.Unavailable {
+		if !b.openUntil.IsZero() {
+			klog.Infof("Circuit breaker for %s closed: connection restored", b.tnsWsUrl)
+		}
+		b.failures = 0
+		b.opens = 0
+		b.openUntil = time.Time{}
+		return
+	}
+
+	b.failures++
+	if b.failures < breakerThreshold && b.openUntil.IsZero() {
+		return
+	}
+
+	delay := breakerBaseDelay << b.opens
+	if delay > breakerMaxDelay || delay <= 0 {
+		delay = breakerMaxDelay
+	}
+	b.opens++
+	b.openUntil = time.Now().Add(delay)
+	klog.Warningf("Circuit breaker for %s open for %s after %d connection failure(s): %v", b.tnsWsUrl, delay, b.failures, csiErr)
+}
@@ -0,0 +1,139 @@
+// Copyright (C) 2025 Denis Forveille titou10.titou10@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tns
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+)
+
+func TestIsIdempotentMethod(t *testing.T) {
+	tests := []struct {
+		method   string
+		expected bool
+	}{
+		{method: "sharing.nfs.query", expected: true},
+		{method: "pool.dataset.get_instance", expected: true},
+		{method: "core.get_jobs", expected: true},
+		{method: "core.job_abort", expected: false},
+		{method: "pool.dataset.create", expected: false},
+		{method: "zfs.snapshot.delete", expected: false},
+		{method: "replication.run_onetime", expected: false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, isIdempotentMethod(test.method), test.method)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for retry := 1; retry <= 10; retry++ {
+		delay := retryDelay(retry)
+		assert.GreaterOrEqual(t, delay, retryBaseDelay/2)
+		assert.LessOrEqual(t, delay, retryMaxDelay)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &circuitBreaker{tnsWsUrl: "ws://truenas/api/current"}
+	unavailable := NewCsiError(codes.Unavailable, &connectionError{err: errors.New("connection refused")})
+
+	// Closed until the threshold is reached
+	for i := 0; i < breakerThreshold-1; i++ {
+		b.record(unavailable)
+		assert.Nil(t, b.allow())
+	}
+	b.record(unavailable)
+	csiErr := b.allow()
+	if assert.NotNil(t, csiErr) {
+		assert.Equal(t, codes.Unavailable, csiErr.Code)
+	}
+
+	// Errors from a server that answered do not open the breaker
+	other := &circuitBreaker{tnsWsUrl: "ws://truenas/api/current"}
+	for i := 0; i < breakerThreshold; i++ {
+		other.record(NewCsiError(codes.Unauthenticated, errors.New("bad api key")))
+	}
+	assert.Nil(t, other.allow())
+
+	// Half-open: a single probe is let through once the delay has expired
+	b.openUntil = time.Now().Add(-time.Second)
+	assert.Nil(t, b.allow())
+	assert.NotNil(t, b.allow())
+
+	// A failed probe opens the breaker for longer
+	b.record(unavailable)
+	assert.Greater(t, time.Until(b.openUntil), breakerBaseDelay)
+
+	// A successful probe closes it
+	b.openUntil = time.Now().Add(-time.Second)
+	assert.Nil(t, b.allow())
+	b.record(nil)
+	assert.Nil(t, b.allow())
+	assert.Equal(t, 0, b.failures)
+}
+
+func TestCircuitBreakerConnections(t *testing.T) {
+	f := newFakeTruenas(t)
+	defer f.server.Close()
+
+	// A caller that gave up while connecting is not a failure of the server
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, csiErr := newClient(ctx, f.url(), &Credentials{ApiKey: "good-key"})
+	if assert.NotNil(t, csiErr) {
+		assert.Equal(t, codes.Canceled, csiErr.Code)
+	}
+	assert.Equal(t, 0, breakerFor(f.url()).failures)
+
+	// A server that accepts the connection then drops it during the login opens the breaker
+	for i := 0; i < breakerThreshold; i++ {
+		_, csiErr = newClient(context.Background(), f.url(), &Credentials{ApiKey: "drop-key"})
+		if assert.NotNil(t, csiErr) {
+			assert.Equal(t, codes.Unavailable, csiErr.Code)
+		}
+	}
+	_, csiErr = newClient(context.Background(), f.url(), &Credentials{ApiKey: "good-key"})
+	if assert.NotNil(t, csiErr) {
+		assert.Contains(t, csiErr.Error(), "next connection attempt")
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	f := newFakeTruenas(t)
+	defer f.server.Close()
+
+	client, csiErr := GetClient(context.Background(), f.url(), &Credentials{ApiKey: "good-key"})
+	if csiErr != nil {
+		t.Fatalf("GetClient failed: %v", csiErr)
+	}
+	defer ReleaseClient(client)
+
+	// A non idempotent call is not retried and reported as Unavailable
+	_, err := callTS[string](context.Background(), client, "test.drop", []interface{}{})
+	assert.True(t, isConnectionError(err))
+	assert.Equal(t, codes.Unavailable, NewCsiError(codes.Internal, err).Code)
+
+	// An idempotent call reconnects
+	res, err := callTS[string](context.Background(), client, "test.query", []interface{}{})
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", res)
+	assert.True(t, client.isAlive())
+}
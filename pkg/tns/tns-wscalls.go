@@ -19,13 +19,14 @@ Truenas Scale WS client
 */
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"strconv"
 	"strings"
 
 	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
 	"google.golang.org/grpc/codes"
 	"k8s.io/klog/v2"
 )
@@ -34,19 +35,38 @@ import (
 // Datasets
 // --------
 
-func TNSDatasetCreate(client *Client, driverName string, dsName string, reqCapacity int64, parameters map[string]string) (*TNSDataset, *CsiError) {
-	klog.V(2).Infof("### TNSDatasetCreate dsName: %s reqCapacity: %d parameters: %s", dsName, reqCapacity, parameters)
+// VolumeIDProperty is the ZFS user property holding the CSI volume id of the datasets created by the driver
+const VolumeIDProperty = "org.titou10.tns-csi:volume_id"
+
+// TNSDatasetCreate creates a dataset with the properties given (eg compression), the others are inherited.
+// Its size is its refquota or its quota, also reserved with thick provisioning. With encryption, the dataset is its own encryption root
+func TNSDatasetCreate(ctx context.Context, client *Client, driverName string, dsName string, volumeID string, reqCapacity int64, space SpaceOptions, properties map[string]interface{}, encryption *EncryptionOptions, parameters map[string]string) (*TNSDataset, *CsiError) {
+	klog.V(2).Infof("### TNSDatasetCreate dsName: %s volumeID: %s reqCapacity: %d space: %+v properties: %v encrypted: %t parameters: %s", dsName, volumeID, reqCapacity, space, properties, encryption != nil, parameters)
 	defer klog.V(2).Info("### TNSDatasetCreate")
 
-	params := []interface{}{
-		map[string]interface{}{
-			"name":     dsName,
-			"refquota": reqCapacity,
-			"type":     "FILESYSTEM",
-			"comments": driverName,
+	dataset := map[string]interface{}{
+		"name":     dsName,
+		"type":     "FILESYSTEM",
+		"comments": driverName,
+		"user_properties": []map[string]string{
+			{"key": VolumeIDProperty, "value": volumeID},
 		},
 	}
-	ds, err := callTS[TNSDataset](client, "pool.dataset.create", params)
+	for name, value := range space.sizeProperties(reqCapacity) {
+		dataset[name] = value
+	}
+	for name, value := range properties {
+		dataset[name] = value
+	}
+	if encryption != nil {
+		dataset["encryption"] = true
+		dataset["inherit_encryption"] = false
+		dataset["encryption_options"] = encryption
+	}
+	params := []interface{}{
+		dataset,
+	}
+	ds, err := callTS[TNSDataset](ctx, client, "pool.dataset.create", params)
 	if err != nil {
 
 		if customErr, ok := err.(CustomError); ok {
@@ -61,6 +81,14 @@ func TNSDatasetCreate(client *Client, driverName string, dsName string, reqCapac
 				// [11] VALIDATION EAGAIN: [EINVAL] pool_dataset_create.name: Path xxx already exists
 				return nil, NewCsiError(codes.AlreadyExists, err)
 
+			case strings.Contains(reason, "out of space"):
+				// Thick provisioning: the reservation is larger than the available space of the pool
+				return nil, NewCsiError(codes.ResourceExhausted, err)
+
+			case customErr.Type == "VALIDATION":
+				// [22] VALIDATION EINVAL: [EINVAL] pool_dataset_create.recordsize: Invalid choice: 3K
+				return nil, NewCsiError(codes.InvalidArgument, err)
+
 			default:
 				csiErr := NewCsiError(codes.Internal, err)
 				klog.Errorf("Dataset creation failed: %v", csiErr)
@@ -76,7 +104,54 @@ func TNSDatasetCreate(client *Client, driverName string, dsName string, reqCapac
 	return &ds, nil
 }
 
-func TNSDatasetSetPermissions(client *Client, dsMountPoint string, parameters map[string]string) *CsiError {
+// TNSZvolCreate creates a zvol for a block volume. The size must be a multiple of the volblocksize
+func TNSZvolCreate(ctx context.Context, client *Client, driverName string, dsName string, volumeID string, size int64, sparse bool) (*TNSDataset, *CsiError) {
+	klog.V(2).Infof("### TNSZvolCreate dsName: %s volumeID: %s size: %d sparse: %t", dsName, volumeID, size, sparse)
+	defer klog.V(2).Info("### TNSZvolCreate")
+
+	params := []interface{}{
+		map[string]interface{}{
+			"name":     dsName,
+			"volsize":  size,
+			"type":     "VOLUME",
+			"sparse":   sparse,
+			"comments": driverName,
+			"user_properties": []map[string]string{
+				{"key": VolumeIDProperty, "value": volumeID},
+			},
+		},
+	}
+	ds, err := callTS[TNSDataset](ctx, client, "pool.dataset.create", params)
+	if err != nil {
+
+		if customErr, ok := err.(CustomError); ok {
+			reason := strings.ToLower(customErr.Reason)
+
+			switch {
+			case strings.Contains(reason, "already exists"):
+				// [11] VALIDATION EAGAIN: [EINVAL] pool_dataset_create.name: Path xxx already exists
+				return nil, NewCsiError(codes.AlreadyExists, err)
+
+			case customErr.Type == "VALIDATION":
+				// [22] VALIDATION EINVAL: [EINVAL] pool_dataset_create.volsize: Volume size should be a multiple of volume block size
+				return nil, NewCsiError(codes.InvalidArgument, err)
+
+			default:
+				csiErr := NewCsiError(codes.Internal, err)
+				klog.Errorf("Zvol creation failed: %v", csiErr)
+				return nil, csiErr
+			}
+
+		} else {
+			return nil, NewCsiError(codes.Internal, err)
+		}
+	}
+
+	klog.V(2).Infof("++ Zvol creation successful: %v", ds)
+	return &ds, nil
+}
+
+func TNSDatasetSetPermissions(ctx context.Context, client *Client, dsMountPoint string, parameters map[string]string) *CsiError {
 	klog.V(2).Infof("### TNSDatasetSetPermissions dsMountPoint: %s parameters: %s", dsMountPoint, parameters)
 	defer klog.V(2).Info("### TNSDatasetSetPermissions")
 
@@ -99,7 +174,7 @@ func TNSDatasetSetPermissions(client *Client, dsMountPoint string, parameters ma
 			data["gid"] = num
 		}
 	}
-	res, err := callTS[uint32](client, "filesystem.setperm", params)
+	res, err := callTS[uint32](ctx, client, "filesystem.setperm", params)
 	if err != nil {
 		csiErr := NewCsiError(codes.Internal, err)
 		klog.Errorf("Dataset Set permission failed: %s", csiErr)
@@ -110,14 +185,14 @@ func TNSDatasetSetPermissions(client *Client, dsMountPoint string, parameters ma
 	return nil
 }
 
-func TNSDatasetGetPermissions(client *Client, dsMountPoint string) (*TNSDatasetStats, *CsiError) {
+func TNSDatasetGetPermissions(ctx context.Context, client *Client, dsMountPoint string) (*TNSDatasetStats, *CsiError) {
 	klog.V(2).Infof("### TNSDatasetGetPermissions dsMountPoint: %s", dsMountPoint)
 	defer klog.V(2).Info("### TNSDatasetGetPermissions")
 
 	params := []interface{}{
 		dsMountPoint,
 	}
-	res, err := callTS[TNSDatasetStats](client, "filesystem.stat", params)
+	res, err := callTS[TNSDatasetStats](ctx, client, "filesystem.stat", params)
 	if err != nil {
 		csiErr := NewCsiError(codes.Internal, err)
 		klog.Errorf("Dataset Get permission failed: %s", csiErr)
@@ -128,18 +203,17 @@ func TNSDatasetGetPermissions(client *Client, dsMountPoint string) (*TNSDatasetS
 	return &res, nil
 }
 
-func TNSDatasetSetSize(client *Client, dsName string, newSize int64) (*TNSDataset, *CsiError) {
-	klog.V(2).Infof("### TNSDatasetSetSize dsName: %s newSize: %d", dsName, newSize)
+// TNSDatasetSetSize sets the refquota or the quota of the dataset, and its reservation with thick provisioning
+func TNSDatasetSetSize(ctx context.Context, client *Client, dsName string, space SpaceOptions, newSize int64) (*TNSDataset, *CsiError) {
+	klog.V(2).Infof("### TNSDatasetSetSize dsName: %s space: %+v newSize: %d", dsName, space, newSize)
 	defer klog.V(2).Info("### TNSDatasetSetSize")
 
 	params := []interface{}{
 		dsName,
-		map[string]interface{}{
-			"refquota": newSize,
-		},
+		space.sizeProperties(newSize),
 	}
 
-	res, err := callTS[TNSDataset](client, "pool.dataset.update", params)
+	res, err := callTS[TNSDataset](ctx, client, "pool.dataset.update", params)
 	if err != nil {
 		csiErr := NewCsiError(codes.Internal, err)
 		klog.Errorf("Dataset Update Size failed: %v", csiErr)
@@ -150,14 +224,75 @@ func TNSDatasetSetSize(client *Client, dsName string, newSize int64) (*TNSDatase
 	return &res, nil
 }
 
-func TNSDatasetPromote(client *Client, dsName string) *CsiError {
+func TNSDatasetUpdate(ctx context.Context, client *Client, dsName string, properties map[string]interface{}) (*TNSDataset, *CsiError) {
+	klog.V(2).Infof("### TNSDatasetUpdate dsName: %s properties: %v", dsName, properties)
+	defer klog.V(2).Info("### TNSDatasetUpdate")
+
+	params := []interface{}{
+		dsName,
+		properties,
+	}
+
+	res, err := callTS[TNSDataset](ctx, client, "pool.dataset.update", params)
+	if err != nil {
+
+		if customErr, ok := err.(CustomError); ok {
+			reason := strings.ToLower(customErr.Reason)
+
+			switch {
+			case strings.Contains(reason, "does not exist"):
+				// [2] VALIDATION ENOENT: [ENOENT] None: PoolDataset xxxx does not exist
+				return nil, NewCsiError(codes.NotFound, err)
+
+			case customErr.Type == "VALIDATION":
+				// [22] VALIDATION EINVAL: [EINVAL] pool_dataset_update.sync: Invalid choice: xxx
+				return nil, NewCsiError(codes.InvalidArgument, err)
+
+			default:
+				csiErr := NewCsiError(codes.Internal, err)
+				klog.Errorf("Dataset Update failed: %v", csiErr)
+				return nil, csiErr
+			}
+
+		} else {
+			return nil, NewCsiError(codes.Internal, err)
+		}
+	}
+
+	klog.V(3).Infof("++ Dataset Update OK: %v", res)
+	return &res, nil
+}
+
+func TNSZvolSetSize(ctx context.Context, client *Client, dsName string, newSize int64) (*TNSDataset, *CsiError) {
+	klog.V(2).Infof("### TNSZvolSetSize dsName: %s newSize: %d", dsName, newSize)
+	defer klog.V(2).Info("### TNSZvolSetSize")
+
+	params := []interface{}{
+		dsName,
+		map[string]interface{}{
+			"volsize": newSize,
+		},
+	}
+
+	res, err := callTS[TNSDataset](ctx, client, "pool.dataset.update", params)
+	if err != nil {
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("Zvol Update Size failed: %v", csiErr)
+		return nil, csiErr
+	}
+
+	klog.V(3).Infof("++ Zvol Update Size OK: %v", res)
+	return &res, nil
+}
+
+func TNSDatasetPromote(ctx context.Context, client *Client, dsName string) *CsiError {
 	klog.V(2).Infof("### TNSDatasetPromote dsName: %s", dsName)
 	defer klog.V(2).Info("### TNSDatasetPromote")
 
 	params := []interface{}{
 		dsName,
 	}
-	res, err := callTS[bool](client, "pool.dataset.promote", params)
+	res, err := callTS[bool](ctx, client, "pool.dataset.promote", params)
 	if err != nil {
 		csiErr := NewCsiError(codes.Internal, err)
 		klog.Errorf("Dataset Promote failed: %v", csiErr)
@@ -168,14 +303,14 @@ func TNSDatasetPromote(client *Client, dsName string) *CsiError {
 	return nil
 }
 
-func TNSDatasetDelete(client *Client, dsName string) *CsiError {
+func TNSDatasetDelete(ctx context.Context, client *Client, dsName string) *CsiError {
 	klog.V(2).Infof("### TNSDatasetDelete dsName: %s", dsName)
 	defer klog.V(2).Info("### TNSDatasetDelete")
 
 	params := []interface{}{
 		dsName,
 	}
-	res, err := callTS[bool](client, "pool.dataset.delete", params)
+	res, err := callTS[bool](ctx, client, "pool.dataset.delete", params)
 	if err != nil {
 
 		if customErr, ok := err.(CustomError); ok {
@@ -208,14 +343,51 @@ func TNSDatasetDelete(client *Client, dsName string) *CsiError {
 	return nil
 }
 
-func TNSDatasetGet(client *Client, dsName string) (*TNSDataset, *CsiError) {
+// TNSDatasetUnlockJob unlocks an encrypted dataset with its passphrase or its hex key. Its shares are enabled again
+func TNSDatasetUnlockJob(ctx context.Context, client *Client, dsName string, passphrase string, key string) (*int, *CsiError) {
+	klog.V(2).Infof("### TNSDatasetUnlockJob dsName: %s", dsName)
+	defer klog.V(2).Info("### TNSDatasetUnlockJob")
+
+	dataset := map[string]interface{}{
+		"name": dsName,
+	}
+	if passphrase != "" {
+		dataset["passphrase"] = passphrase
+	} else {
+		dataset["key"] = key
+	}
+	params := []interface{}{
+		dsName,
+		map[string]interface{}{
+			"recursive":          false,
+			"toggle_attachments": true,
+			"datasets":           []map[string]interface{}{dataset},
+		},
+	}
+
+	jobID, err := callTS[int](ctx, client, "pool.dataset.unlock", params)
+	if err != nil {
+		if customErr, ok := err.(CustomError); ok && customErr.Type == "VALIDATION" {
+			// [22] VALIDATION EINVAL: [EINVAL] unlock_options.datasets.0.passphrase: Passphrase must be at least 8 characters
+			return nil, NewCsiError(codes.InvalidArgument, err)
+		}
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("Dataset Unlock failed: %v", csiErr)
+		return nil, csiErr
+	}
+
+	klog.Infof("Job unlock dataset OK: %d", jobID)
+	return &jobID, nil
+}
+
+func TNSDatasetGet(ctx context.Context, client *Client, dsName string) (*TNSDataset, *CsiError) {
 	klog.V(2).Infof("### TNSDatasetGet dsName: %s", dsName)
 	defer klog.V(2).Info("### TNSDatasetGet")
 
 	params := []interface{}{
 		dsName,
 	}
-	res, err := callTS[TNSDataset](client, "pool.dataset.get_instance", params)
+	res, err := callTS[TNSDataset](ctx, client, "pool.dataset.get_instance", params)
 	if err != nil {
 
 		if customErr, ok := err.(CustomError); ok {
@@ -225,7 +397,7 @@ func TNSDatasetGet(client *Client, dsName string) (*TNSDataset, *CsiError) {
 			case strings.Contains(reason, "does not exist"):
 				// [2] VALIDATION ENOENT: [ENOENT] None: PoolDataset xxxx does not exist
 				klog.Errorf("++ Dataset does not exist. %v", customErr.Reason)
-				return nil, NewCsiError(codes.Internal, err)
+				return nil, NewCsiError(codes.NotFound, err)
 
 			default:
 				csiErr := NewCsiError(codes.Internal, err)
@@ -242,6 +414,36 @@ func TNSDatasetGet(client *Client, dsName string) (*TNSDataset, *CsiError) {
 	return &res, nil
 }
 
+// TNSDatasetQueryChildren returns all the datasets under rootDataset created by the driver, sorted by name
+func TNSDatasetQueryChildren(ctx context.Context, client *Client, driverName string, rootDataset string) ([]TNSDataset, *CsiError) {
+	klog.V(2).Infof("### TNSDatasetQueryChildren driverName: %s rootDataset: %s", driverName, rootDataset)
+	defer klog.V(2).Info("### TNSDatasetQueryChildren")
+
+	params := []interface{}{
+		[][]interface{}{
+			{"name", "^", rootDataset + "/"},
+		},
+		map[string]interface{}{
+			"order_by": []string{"name"},
+		},
+	}
+	res, err := callTS[[]TNSDataset](ctx, client, "pool.dataset.query", params)
+	if err != nil {
+		return nil, NewCsiError(codes.Internal, err)
+	}
+
+	// The comments are set by TNSDatasetCreate
+	datasets := []TNSDataset{}
+	for _, ds := range res {
+		if ds.Comments.Value == driverName {
+			datasets = append(datasets, ds)
+		}
+	}
+
+	klog.V(3).Infof("++ Dataset Query OK: %d/%d dataset(s) created by the driver", len(datasets), len(res))
+	return datasets, nil
+}
+
 // func TNSDatasetClone(client *Client, srcDsName string, dstDsName string) *CsiError {
 // 	klog.V(2).Infof("### TNSDatasetClone srcdsName: %s dstdsName: %s", srcDsName, dstDsName)
 // 	defer klog.V(2).Info("### TNSDatasetClone")
@@ -289,7 +491,7 @@ func TNSDatasetGet(client *Client, dsName string) (*TNSDataset, *CsiError) {
 // Snapshots
 // --------
 
-func TNSSnapshotCreate(client *Client, dsName string, snapshotName string) (*TNSSnapshot, *CsiError) {
+func TNSSnapshotCreate(ctx context.Context, client *Client, dsName string, snapshotName string) (*TNSSnapshot, *CsiError) {
 	klog.V(2).Infof("### TNSSnapshotCreate dsName: %s snapshotName: %s", dsName, snapshotName)
 	defer klog.V(2).Info("### TNSSnapshotCreate")
 
@@ -299,7 +501,7 @@ func TNSSnapshotCreate(client *Client, dsName string, snapshotName string) (*TNS
 			"name":    snapshotName,
 		},
 	}
-	res, err := callTS[TNSSnapshot](client, "zfs.snapshot.create", params)
+	res, err := callTS[TNSSnapshot](ctx, client, "zfs.snapshot.create", params)
 	if err != nil {
 		if customErr, ok := err.(CustomError); ok {
 			reason := strings.ToLower(customErr.Reason)
@@ -324,14 +526,19 @@ func TNSSnapshotCreate(client *Client, dsName string, snapshotName string) (*TNS
 	return &res, nil
 }
 
-func TNSSnapshotDelete(client *Client, snapshotName string) (*bool, *CsiError) {
-	klog.V(2).Infof("### TNSSnapshotCreate snapshotName: %s", snapshotName)
+// TNSSnapshotDelete deletes a snapshot. When deferred, a snapshot with clones is only marked and
+// is destroyed with its last clone (zfs destroy -d)
+func TNSSnapshotDelete(ctx context.Context, client *Client, snapshotName string, deferred bool) (*bool, *CsiError) {
+	klog.V(2).Infof("### TNSSnapshotDelete snapshotName: %s deferred: %t", snapshotName, deferred)
 	defer klog.V(2).Info("### TNSSnapshotDelete")
 
 	params := []interface{}{
 		snapshotName,
+		map[string]interface{}{
+			"defer": deferred,
+		},
 	}
-	res, err := callTS[bool](client, "zfs.snapshot.delete", params)
+	res, err := callTS[bool](ctx, client, "zfs.snapshot.delete", params)
 	if err != nil {
 
 		if customErr, ok := err.(CustomError); ok {
@@ -343,6 +550,11 @@ func TNSSnapshotDelete(client *Client, snapshotName string) (*bool, *CsiError) {
 				klog.Warningf("++ Snapshot does not exist, continue. %v", customErr.Reason)
 				res = true
 				return &res, nil
+			case strings.Contains(reason, "dependent clones"):
+				// [16]  EBUSY: [EBUSY] Failed to delete snapshot: cannot destroy 'xxx': snapshot has dependent clones
+				csiErr := NewCsiError(codes.FailedPrecondition, err)
+				klog.Errorf("++ Snapshot has dependent clones: %s", csiErr)
+				return nil, csiErr
 			default:
 				csiErr := NewCsiError(codes.Internal, err)
 				klog.Errorf("Snapshot Delete failed: %v", csiErr)
@@ -359,14 +571,14 @@ func TNSSnapshotDelete(client *Client, snapshotName string) (*bool, *CsiError) {
 	klog.V(2).Infof("++ Snapshot Delete OK: %v", res)
 	return &res, nil
 }
-func TNSSnapshotGet(client *Client, snapshotName string) (*TNSSnapshot, *CsiError) {
+func TNSSnapshotGet(ctx context.Context, client *Client, snapshotName string) (*TNSSnapshot, *CsiError) {
 	klog.V(2).Infof("### TNSSnapshotGet snapshotName: %s", snapshotName)
 	defer klog.V(2).Info("### TNSSnapshotGet")
 
 	params := []interface{}{
 		snapshotName,
 	}
-	res, err := callTS[TNSSnapshot](client, "zfs.snapshot.get_instance", params)
+	res, err := callTS[TNSSnapshot](ctx, client, "zfs.snapshot.get_instance", params)
 	if err != nil {
 
 		if customErr, ok := err.(CustomError); ok {
@@ -393,7 +605,7 @@ func TNSSnapshotGet(client *Client, snapshotName string) (*TNSSnapshot, *CsiErro
 	return &res, nil
 }
 
-func TNSDatasetDestroySnapshotsJob(client *Client, dsName string) (*int, *CsiError) {
+func TNSDatasetDestroySnapshotsJob(ctx context.Context, client *Client, dsName string) (*int, *CsiError) {
 	klog.V(2).Infof("### TNSDatasetDestroySnapshotsJob dsName: %s", dsName)
 	defer klog.V(2).Info("### TNSDatasetDestroySnapshotsJob")
 
@@ -401,7 +613,7 @@ func TNSDatasetDestroySnapshotsJob(client *Client, dsName string) (*int, *CsiErr
 		dsName,
 	}
 
-	jobID, err := callTS[int](client, "pool.dataset.destroy_snapshots", params)
+	jobID, err := callTS[int](ctx, client, "pool.dataset.destroy_snapshots", params)
 	if err != nil {
 		return nil, NewCsiError(codes.Internal, err)
 	}
@@ -409,7 +621,7 @@ func TNSDatasetDestroySnapshotsJob(client *Client, dsName string) (*int, *CsiErr
 	klog.Infof("Job delete snapshots OK: %d", jobID)
 	return &jobID, nil
 }
-func TNSSnapshotClone(client *Client, sourceSnapshotName string, targetDsName string) *CsiError {
+func TNSSnapshotClone(ctx context.Context, client *Client, sourceSnapshotName string, targetDsName string) *CsiError {
 	klog.V(2).Infof("### TNSSnapshotClone sourceSnapshotName: %s targetDsName: %s", sourceSnapshotName, targetDsName)
 	defer klog.V(2).Info("### TNSSnapshotClone")
 
@@ -419,8 +631,12 @@ func TNSSnapshotClone(client *Client, sourceSnapshotName string, targetDsName st
 			"dataset_dst": targetDsName,
 		},
 	}
-	res, err := callTS[bool](client, "zfs.snapshot.clone", params)
+	res, err := callTS[bool](ctx, client, "zfs.snapshot.clone", params)
 	if err != nil {
+		if customErr, ok := err.(CustomError); ok && strings.Contains(strings.ToLower(customErr.Reason), "already exists") {
+			// [17]  EEXIST: [EEXIST] Failed to clone snapshot: dataset already exists
+			return NewCsiError(codes.AlreadyExists, err)
+		}
 		csiErr := NewCsiError(codes.Internal, err)
 		klog.Errorf("Snapshot Clone failed: %v", csiErr)
 		return csiErr
@@ -429,32 +645,34 @@ func TNSSnapshotClone(client *Client, sourceSnapshotName string, targetDsName st
 	return nil
 }
 
-// func TNSSnapshotGet(client *Client, dsName string) ([]TNSSnapshot, *CsiError) {
-// 	klog.V(2).Infof("### TNSSnapshotGet dsName: %s", dsName)
-// 	defer klog.V(2).Info("### TNSSnapshotGet")
+// TNSSnapshotQuery returns the snapshots matching the filters, sorted by name
+func TNSSnapshotQuery(ctx context.Context, client *Client, filters [][]interface{}) ([]TNSSnapshot, *CsiError) {
+	klog.V(2).Infof("### TNSSnapshotQuery filters: %v", filters)
+	defer klog.V(2).Info("### TNSSnapshotQuery")
 
-// 	params := []interface{}{
-// 		dsName, // The dataset name
-// 		map[string]interface{}{
-// 			"select": map[string]bool{"name": true}, // Correct selection format
-// 		},
-// 	}
+	params := []interface{}{
+		filters,
+		map[string]interface{}{
+			"order_by": []string{"name"},
+		},
+	}
 
-// 	snapshots, err := callTS[[]TNSSnapshot](client, "zfs.snapshot.query", params)
-// 	if err != nil {
-// 		csiErr := NewCsiError(codes.Internal, err)
-// 		klog.Errorf("Snapshot Get failed: %v", csiErr)
-// 		return nil, csiErr
-// 	}
+	snapshots, err := callTS[[]TNSSnapshot](ctx, client, "zfs.snapshot.query", params)
+	if err != nil {
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("Snapshot Query failed: %v", csiErr)
+		return nil, csiErr
+	}
 
-// 	return snapshots, nil
-// }
+	klog.V(3).Infof("++ Snapshot Query OK: %d snapshot(s)", len(snapshots))
+	return snapshots, nil
+}
 
 // ---------
 // NFS Share
 // ---------
 
-func TNSShareNfsCreate(client *Client, dsMountPoint string, parameters map[string]string) (*string, *CsiError) {
+func TNSShareNfsCreate(ctx context.Context, client *Client, dsMountPoint string, parameters map[string]string) (*string, *CsiError) {
 	klog.V(2).Infof("### TNSShareNfsCreate dsMountPoint: %s parameters: %s", dsMountPoint, parameters)
 	defer klog.V(2).Info("### TNSShareNfsCreate")
 
@@ -490,7 +708,7 @@ func TNSShareNfsCreate(client *Client, dsMountPoint string, parameters map[strin
 		data["hosts"] = strings.Split(p, ",")
 	}
 
-	nfs, err := callTS[TNSNFSShare](client, "sharing.nfs.create", params)
+	nfs, err := callTS[TNSNFSShare](ctx, client, "sharing.nfs.create", params)
 	if err != nil {
 		csiErr := NewCsiError(codes.Internal, err)
 		klog.Errorf("NFS Share Create failed: %s", csiErr)
@@ -501,7 +719,7 @@ func TNSShareNfsCreate(client *Client, dsMountPoint string, parameters map[strin
 	return &nfs.Path, nil
 }
 
-func TNSShareNfsGet(client *Client, mountPoint string) (*TNSNFSShare, *CsiError) {
+func TNSShareNfsGet(ctx context.Context, client *Client, mountPoint string) (*TNSNFSShare, *CsiError) {
 	klog.V(2).Infof("### TNSShareNfsGet dsName: %s", mountPoint)
 	defer klog.V(2).Info("### TNSShareNfsGet")
 
@@ -511,7 +729,7 @@ func TNSShareNfsGet(client *Client, mountPoint string) (*TNSNFSShare, *CsiError)
 		},
 	}
 
-	shares, err := callTS[[]TNSNFSShare](client, "sharing.nfs.query", params)
+	shares, err := callTS[[]TNSNFSShare](ctx, client, "sharing.nfs.query", params)
 	if err != nil {
 		csiErr := NewCsiError(codes.Internal, err)
 		klog.Errorf("NFS Share Get failed: %s", csiErr)
@@ -525,11 +743,587 @@ func TNSShareNfsGet(client *Client, mountPoint string) (*TNSNFSShare, *CsiError)
 	}
 }
 
+func TNSShareNfsUpdate(ctx context.Context, client *Client, id uint, properties map[string]interface{}) *CsiError {
+	klog.V(2).Infof("### TNSShareNfsUpdate id: %d properties: %v", id, properties)
+	defer klog.V(2).Info("### TNSShareNfsUpdate")
+
+	params := []interface{}{
+		id,
+		properties,
+	}
+
+	nfs, err := callTS[TNSNFSShare](ctx, client, "sharing.nfs.update", params)
+	if err != nil {
+		if customErr, ok := err.(CustomError); ok && customErr.Type == "VALIDATION" {
+			// [22] VALIDATION EINVAL: [EINVAL] sharingnfs_update.networks.0: Invalid IP or network
+			return NewCsiError(codes.InvalidArgument, err)
+		}
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("NFS Share Update failed: %s", csiErr)
+		return csiErr
+	}
+
+	klog.V(3).Infof("++ NFS Share update OK: %v", nfs)
+	return nil
+}
+
+// ---------
+// SMB Share
+// ---------
+
+func TNSShareSmbCreate(ctx context.Context, client *Client, name string, dsMountPoint string, opts *SMBShareOptions) (*TNSSMBShare, *CsiError) {
+	klog.V(2).Infof("### TNSShareSmbCreate name: %s dsMountPoint: %s", name, dsMountPoint)
+	defer klog.V(2).Info("### TNSShareSmbCreate")
+
+	data := map[string]interface{}{
+		"name": name,
+		"path": dsMountPoint,
+	}
+	if opts.Browsable != nil {
+		data["browsable"] = *opts.Browsable
+	}
+	if len(opts.HostsAllow) > 0 {
+		data["hostsallow"] = opts.HostsAllow
+	}
+	if len(opts.HostsDeny) > 0 {
+		data["hostsdeny"] = opts.HostsDeny
+	}
+	params := []interface{}{
+		data,
+	}
+
+	smb, err := callTS[TNSSMBShare](ctx, client, "sharing.smb.create", params)
+	if err != nil {
+		if customErr, ok := err.(CustomError); ok && customErr.Type == "VALIDATION" {
+			// [22] VALIDATION EINVAL: [EINVAL] sharingsmb_create.hostsallow.0: Invalid IP or network
+			return nil, NewCsiError(codes.InvalidArgument, err)
+		}
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("SMB Share Create failed: %s", csiErr)
+		return nil, csiErr
+	}
+
+	klog.V(3).Infof("++ SMB Share create OK: %v", smb)
+	return &smb, nil
+}
+
+func TNSShareSmbGet(ctx context.Context, client *Client, mountPoint string) (*TNSSMBShare, *CsiError) {
+	klog.V(2).Infof("### TNSShareSmbGet mountPoint: %s", mountPoint)
+	defer klog.V(2).Info("### TNSShareSmbGet")
+
+	params := []interface{}{
+		[]interface{}{
+			[]interface{}{"path", "=", mountPoint},
+		},
+	}
+
+	shares, err := callTS[[]TNSSMBShare](ctx, client, "sharing.smb.query", params)
+	if err != nil {
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("SMB Share Get failed: %s", csiErr)
+		return nil, csiErr
+	}
+	klog.V(3).Info("++ SMB Share Get OK")
+	if len(shares) == 0 {
+		return nil, nil
+	}
+	return &shares[0], nil
+}
+
+// TNSShareSmbSetAcl replaces the ACL of the share. This is the share ACL, not the ACL of the dataset
+func TNSShareSmbSetAcl(ctx context.Context, client *Client, name string, acl []TNSSMBShareAce) *CsiError {
+	klog.V(2).Infof("### TNSShareSmbSetAcl name: %s acl: %v", name, acl)
+	defer klog.V(2).Info("### TNSShareSmbSetAcl")
+
+	params := []interface{}{
+		map[string]interface{}{
+			"share_name": name,
+			"share_acl":  acl,
+		},
+	}
+
+	_, err := callTS[interface{}](ctx, client, "sharing.smb.setacl", params)
+	if err != nil {
+		if customErr, ok := err.(CustomError); ok && customErr.Type == "VALIDATION" {
+			// eg unknown user or group id
+			return NewCsiError(codes.InvalidArgument, err)
+		}
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("SMB Share Set ACL failed: %s", csiErr)
+		return csiErr
+	}
+
+	klog.V(3).Info("++ SMB Share Set ACL OK")
+	return nil
+}
+
+// -----
+// iSCSI
+// -----
+
+func TNSIscsiGlobalConfigGet(ctx context.Context, client *Client) (*TNSIscsiGlobalConfig, *CsiError) {
+	klog.V(2).Info("### TNSIscsiGlobalConfigGet")
+	defer klog.V(2).Info("### TNSIscsiGlobalConfigGet")
+
+	res, err := callTS[TNSIscsiGlobalConfig](ctx, client, "iscsi.global.config", []interface{}{})
+	if err != nil {
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("iSCSI Global Config failed: %s", csiErr)
+		return nil, csiErr
+	}
+
+	klog.V(3).Infof("++ iSCSI Global Config OK: %v", res)
+	return &res, nil
+}
+
+// TNSIscsiTargetGet returns the target with the given name, nil if it does not exist
+func TNSIscsiTargetGet(ctx context.Context, client *Client, name string) (*TNSIscsiTarget, *CsiError) {
+	klog.V(2).Infof("### TNSIscsiTargetGet name: %s", name)
+	defer klog.V(2).Info("### TNSIscsiTargetGet")
+
+	params := []interface{}{
+		[][]interface{}{
+			{"name", "=", name},
+		},
+	}
+	targets, err := callTS[[]TNSIscsiTarget](ctx, client, "iscsi.target.query", params)
+	if err != nil {
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("iSCSI Target Get failed: %s", csiErr)
+		return nil, csiErr
+	}
+
+	klog.V(3).Info("++ iSCSI Target Get OK")
+	if len(targets) == 0 {
+		return nil, nil
+	}
+	return &targets[0], nil
+}
+
+func TNSIscsiTargetCreate(ctx context.Context, client *Client, name string, portalID int, initiatorID int) (*TNSIscsiTarget, *CsiError) {
+	klog.V(2).Infof("### TNSIscsiTargetCreate name: %s portalID: %d initiatorID: %d", name, portalID, initiatorID)
+	defer klog.V(2).Info("### TNSIscsiTargetCreate")
+
+	group := map[string]interface{}{
+		"portal":     portalID,
+		"authmethod": "NONE",
+	}
+	if initiatorID > 0 {
+		group["initiator"] = initiatorID
+	}
+	params := []interface{}{
+		map[string]interface{}{
+			"name":   name,
+			"mode":   "ISCSI",
+			"groups": []interface{}{group},
+		},
+	}
+
+	target, err := callTS[TNSIscsiTarget](ctx, client, "iscsi.target.create", params)
+	if err != nil {
+		if customErr, ok := err.(CustomError); ok && customErr.Type == "VALIDATION" {
+			// [22] VALIDATION EINVAL: [EINVAL] iscsi_target_create.groups.0.portal: 9 Portal not found in database
+			return nil, NewCsiError(codes.InvalidArgument, err)
+		}
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("iSCSI Target Create failed: %s", csiErr)
+		return nil, csiErr
+	}
+
+	klog.V(3).Infof("++ iSCSI Target create OK: %v", target)
+	return &target, nil
+}
+
+// TNSIscsiTargetDelete deletes the target and its associations with extents
+func TNSIscsiTargetDelete(ctx context.Context, client *Client, id int) *CsiError {
+	klog.V(2).Infof("### TNSIscsiTargetDelete id: %d", id)
+	defer klog.V(2).Info("### TNSIscsiTargetDelete")
+
+	params := []interface{}{
+		id,
+		true, // force, even if the target is in use
+	}
+	res, err := callTS[bool](ctx, client, "iscsi.target.delete", params)
+	if err != nil {
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("iSCSI Target Delete failed: %s", csiErr)
+		return csiErr
+	}
+
+	klog.V(3).Infof("++ iSCSI Target Delete OK: %t", res)
+	return nil
+}
+
+// TNSIscsiExtentGet returns the extent with the given name, nil if it does not exist
+func TNSIscsiExtentGet(ctx context.Context, client *Client, name string) (*TNSIscsiExtent, *CsiError) {
+	klog.V(2).Infof("### TNSIscsiExtentGet name: %s", name)
+	defer klog.V(2).Info("### TNSIscsiExtentGet")
+
+	params := []interface{}{
+		[][]interface{}{
+			{"name", "=", name},
+		},
+	}
+	extents, err := callTS[[]TNSIscsiExtent](ctx, client, "iscsi.extent.query", params)
+	if err != nil {
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("iSCSI Extent Get failed: %s", csiErr)
+		return nil, csiErr
+	}
+
+	klog.V(3).Info("++ iSCSI Extent Get OK")
+	if len(extents) == 0 {
+		return nil, nil
+	}
+	return &extents[0], nil
+}
+
+func TNSIscsiExtentCreate(ctx context.Context, client *Client, name string, zvolName string) (*TNSIscsiExtent, *CsiError) {
+	klog.V(2).Infof("### TNSIscsiExtentCreate name: %s zvolName: %s", name, zvolName)
+	defer klog.V(2).Info("### TNSIscsiExtentCreate")
+
+	params := []interface{}{
+		map[string]interface{}{
+			"name": name,
+			"type": "DISK",
+			"disk": "zvol/" + zvolName,
+		},
+	}
+
+	extent, err := callTS[TNSIscsiExtent](ctx, client, "iscsi.extent.create", params)
+	if err != nil {
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("iSCSI Extent Create failed: %s", csiErr)
+		return nil, csiErr
+	}
+
+	klog.V(3).Infof("++ iSCSI Extent create OK: %v", extent)
+	return &extent, nil
+}
+
+func TNSIscsiExtentDelete(ctx context.Context, client *Client, id int) *CsiError {
+	klog.V(2).Infof("### TNSIscsiExtentDelete id: %d", id)
+	defer klog.V(2).Info("### TNSIscsiExtentDelete")
+
+	params := []interface{}{
+		id,
+		false, // remove: the zvol is deleted with the dataset
+		true,  // force, even if the extent is in use
+	}
+	res, err := callTS[bool](ctx, client, "iscsi.extent.delete", params)
+	if err != nil {
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("iSCSI Extent Delete failed: %s", csiErr)
+		return csiErr
+	}
+
+	klog.V(3).Infof("++ iSCSI Extent Delete OK: %t", res)
+	return nil
+}
+
+// TNSIscsiTargetExtentGet returns the association of the target and the extent, nil if it does not exist
+func TNSIscsiTargetExtentGet(ctx context.Context, client *Client, targetID int, extentID int) (*TNSIscsiTargetExtent, *CsiError) {
+	klog.V(2).Infof("### TNSIscsiTargetExtentGet targetID: %d extentID: %d", targetID, extentID)
+	defer klog.V(2).Info("### TNSIscsiTargetExtentGet")
+
+	params := []interface{}{
+		[][]interface{}{
+			{"target", "=", targetID},
+			{"extent", "=", extentID},
+		},
+	}
+	targetExtents, err := callTS[[]TNSIscsiTargetExtent](ctx, client, "iscsi.targetextent.query", params)
+	if err != nil {
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("iSCSI Target Extent Get failed: %s", csiErr)
+		return nil, csiErr
+	}
+
+	klog.V(3).Info("++ iSCSI Target Extent Get OK")
+	if len(targetExtents) == 0 {
+		return nil, nil
+	}
+	return &targetExtents[0], nil
+}
+
+func TNSIscsiTargetExtentCreate(ctx context.Context, client *Client, targetID int, extentID int, lunID int) (*TNSIscsiTargetExtent, *CsiError) {
+	klog.V(2).Infof("### TNSIscsiTargetExtentCreate targetID: %d extentID: %d lunID: %d", targetID, extentID, lunID)
+	defer klog.V(2).Info("### TNSIscsiTargetExtentCreate")
+
+	params := []interface{}{
+		map[string]interface{}{
+			"target": targetID,
+			"extent": extentID,
+			"lunid":  lunID,
+		},
+	}
+
+	targetExtent, err := callTS[TNSIscsiTargetExtent](ctx, client, "iscsi.targetextent.create", params)
+	if err != nil {
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("iSCSI Target Extent Create failed: %s", csiErr)
+		return nil, csiErr
+	}
+
+	klog.V(3).Infof("++ iSCSI Target Extent create OK: %v", targetExtent)
+	return &targetExtent, nil
+}
+
+// --------
+// NVMe-oF
+// --------
+
+// TNSNvmetSubsysGet returns the subsystem with the given name, nil if it does not exist
+func TNSNvmetSubsysGet(ctx context.Context, client *Client, name string) (*TNSNvmetSubsys, *CsiError) {
+	klog.V(2).Infof("### TNSNvmetSubsysGet name: %s", name)
+	defer klog.V(2).Info("### TNSNvmetSubsysGet")
+
+	params := []interface{}{
+		[][]interface{}{
+			{"name", "=", name},
+		},
+	}
+	subsystems, err := callTS[[]TNSNvmetSubsys](ctx, client, "nvmet.subsys.query", params)
+	if err != nil {
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("NVMe Subsystem Get failed: %s", csiErr)
+		return nil, csiErr
+	}
+
+	klog.V(3).Info("++ NVMe Subsystem Get OK")
+	if len(subsystems) == 0 {
+		return nil, nil
+	}
+	return &subsystems[0], nil
+}
+
+func TNSNvmetSubsysCreate(ctx context.Context, client *Client, name string) (*TNSNvmetSubsys, *CsiError) {
+	klog.V(2).Infof("### TNSNvmetSubsysCreate name: %s", name)
+	defer klog.V(2).Info("### TNSNvmetSubsysCreate")
+
+	params := []interface{}{
+		map[string]interface{}{
+			"name":           name,
+			"allow_any_host": true,
+		},
+	}
+
+	subsys, err := callTS[TNSNvmetSubsys](ctx, client, "nvmet.subsys.create", params)
+	if err != nil {
+		if customErr, ok := err.(CustomError); ok && customErr.Type == "VALIDATION" {
+			return nil, NewCsiError(codes.InvalidArgument, err)
+		}
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("NVMe Subsystem Create failed: %s", csiErr)
+		return nil, csiErr
+	}
+
+	klog.V(3).Infof("++ NVMe Subsystem create OK: %v", subsys)
+	return &subsys, nil
+}
+
+// TNSNvmetSubsysDelete deletes the subsystem with its namespaces and its associations with ports
+func TNSNvmetSubsysDelete(ctx context.Context, client *Client, id int) *CsiError {
+	klog.V(2).Infof("### TNSNvmetSubsysDelete id: %d", id)
+	defer klog.V(2).Info("### TNSNvmetSubsysDelete")
+
+	params := []interface{}{
+		id,
+		map[string]interface{}{
+			"force": true, // even if it has namespaces or is exported on ports
+		},
+	}
+	_, err := callTS[interface{}](ctx, client, "nvmet.subsys.delete", params)
+	if err != nil {
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("NVMe Subsystem Delete failed: %s", csiErr)
+		return csiErr
+	}
+
+	klog.V(3).Info("++ NVMe Subsystem Delete OK")
+	return nil
+}
+
+// TNSNvmetNamespaceGet returns the namespace of the subsystem for the zvol, nil if it does not exist
+func TNSNvmetNamespaceGet(ctx context.Context, client *Client, subsysID int, zvolName string) (*TNSNvmetNamespace, *CsiError) {
+	klog.V(2).Infof("### TNSNvmetNamespaceGet subsysID: %d zvolName: %s", subsysID, zvolName)
+	defer klog.V(2).Info("### TNSNvmetNamespaceGet")
+
+	params := []interface{}{
+		[][]interface{}{
+			{"subsys.id", "=", subsysID},
+			{"device_path", "=", "zvol/" + zvolName},
+		},
+	}
+	namespaces, err := callTS[[]TNSNvmetNamespace](ctx, client, "nvmet.namespace.query", params)
+	if err != nil {
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("NVMe Namespace Get failed: %s", csiErr)
+		return nil, csiErr
+	}
+
+	klog.V(3).Info("++ NVMe Namespace Get OK")
+	if len(namespaces) == 0 {
+		return nil, nil
+	}
+	return &namespaces[0], nil
+}
+
+func TNSNvmetNamespaceCreate(ctx context.Context, client *Client, subsysID int, zvolName string) (*TNSNvmetNamespace, *CsiError) {
+	klog.V(2).Infof("### TNSNvmetNamespaceCreate subsysID: %d zvolName: %s", subsysID, zvolName)
+	defer klog.V(2).Info("### TNSNvmetNamespaceCreate")
+
+	params := []interface{}{
+		map[string]interface{}{
+			"subsys_id":   subsysID,
+			"device_type": "ZVOL",
+			"device_path": "zvol/" + zvolName,
+		},
+	}
+
+	namespace, err := callTS[TNSNvmetNamespace](ctx, client, "nvmet.namespace.create", params)
+	if err != nil {
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("NVMe Namespace Create failed: %s", csiErr)
+		return nil, csiErr
+	}
+
+	klog.V(3).Infof("++ NVMe Namespace create OK: %v", namespace)
+	return &namespace, nil
+}
+
+// TNSNvmetPortSubsysGet returns the association of the port and the subsystem, nil if it does not exist
+func TNSNvmetPortSubsysGet(ctx context.Context, client *Client, portID int, subsysID int) (*TNSNvmetPortSubsys, *CsiError) {
+	klog.V(2).Infof("### TNSNvmetPortSubsysGet portID: %d subsysID: %d", portID, subsysID)
+	defer klog.V(2).Info("### TNSNvmetPortSubsysGet")
+
+	params := []interface{}{
+		[][]interface{}{
+			{"port.id", "=", portID},
+			{"subsys.id", "=", subsysID},
+		},
+	}
+	portSubsystems, err := callTS[[]TNSNvmetPortSubsys](ctx, client, "nvmet.port_subsys.query", params)
+	if err != nil {
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("NVMe Port Subsystem Get failed: %s", csiErr)
+		return nil, csiErr
+	}
+
+	klog.V(3).Info("++ NVMe Port Subsystem Get OK")
+	if len(portSubsystems) == 0 {
+		return nil, nil
+	}
+	return &portSubsystems[0], nil
+}
+
+func TNSNvmetPortSubsysCreate(ctx context.Context, client *Client, portID int, subsysID int) (*TNSNvmetPortSubsys, *CsiError) {
+	klog.V(2).Infof("### TNSNvmetPortSubsysCreate portID: %d subsysID: %d", portID, subsysID)
+	defer klog.V(2).Info("### TNSNvmetPortSubsysCreate")
+
+	params := []interface{}{
+		map[string]interface{}{
+			"port_id":   portID,
+			"subsys_id": subsysID,
+		},
+	}
+
+	portSubsys, err := callTS[TNSNvmetPortSubsys](ctx, client, "nvmet.port_subsys.create", params)
+	if err != nil {
+		if customErr, ok := err.(CustomError); ok && customErr.Type == "VALIDATION" {
+			// eg the port does not exist
+			return nil, NewCsiError(codes.InvalidArgument, err)
+		}
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("NVMe Port Subsystem Create failed: %s", csiErr)
+		return nil, csiErr
+	}
+
+	klog.V(3).Infof("++ NVMe Port Subsystem create OK: %v", portSubsys)
+	return &portSubsys, nil
+}
+
+// ---------------
+// Pools, services
+// ---------------
+
+// TNSPoolGet returns the pool, nil when it does not exist
+func TNSPoolGet(ctx context.Context, client *Client, name string) (*TNSPool, *CsiError) {
+	klog.V(2).Infof("### TNSPoolGet name: %s", name)
+	defer klog.V(2).Info("### TNSPoolGet")
+
+	params := []interface{}{
+		[][]interface{}{
+			{"name", "=", name},
+		},
+	}
+	pools, err := callTS[[]TNSPool](ctx, client, "pool.query", params)
+	if err != nil {
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("Pool Get failed: %s", csiErr)
+		return nil, csiErr
+	}
+
+	klog.V(3).Infof("++ Pool Get OK: %v", pools)
+	if len(pools) == 0 {
+		return nil, nil
+	}
+	return &pools[0], nil
+}
+
+// TNSServiceGet returns the service, nil when it does not exist (eg nvmet before 25.10)
+func TNSServiceGet(ctx context.Context, client *Client, service string) (*TNSService, *CsiError) {
+	klog.V(2).Infof("### TNSServiceGet service: %s", service)
+	defer klog.V(2).Info("### TNSServiceGet")
+
+	params := []interface{}{
+		[][]interface{}{
+			{"service", "=", service},
+		},
+	}
+	services, err := callTS[[]TNSService](ctx, client, "service.query", params)
+	if err != nil {
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("Service Get failed: %s", csiErr)
+		return nil, csiErr
+	}
+
+	klog.V(3).Infof("++ Service Get OK: %v", services)
+	if len(services) == 0 {
+		return nil, nil
+	}
+	return &services[0], nil
+}
+
+// TNSServiceStart starts the service. Depending on the version of Truenas Scale, the result is a boolean
+// or the id of a job, returned when it is one. The state of the service must then be queried again
+func TNSServiceStart(ctx context.Context, client *Client, service string) (*int, *CsiError) {
+	klog.V(2).Infof("### TNSServiceStart service: %s", service)
+	defer klog.V(2).Info("### TNSServiceStart")
+
+	params := []interface{}{
+		service,
+	}
+	res, err := callTS[any](ctx, client, "service.start", params)
+	if err != nil {
+		csiErr := NewCsiError(codes.Internal, err)
+		klog.Errorf("Service Start failed: %s", csiErr)
+		return nil, csiErr
+	}
+
+	klog.V(3).Infof("++ Service Start OK: %v", res)
+	if jobID, ok := res.(float64); ok {
+		id := int(jobID)
+		return &id, nil
+	}
+	return nil, nil
+}
+
 // -----
 // Other
 // -----
 
-func TNSOneTimeReplicationJob(client *Client, srcDsName, snapshotName string, destDsName string) (*int, *CsiError) {
+func TNSOneTimeReplicationJob(ctx context.Context, client *Client, srcDsName, snapshotName string, destDsName string) (*int, *CsiError) {
 	klog.V(2).Infof("### TNSOneTimeReplicationJob srcDsName: %s snapshotName: %s destDsName: %s", srcDsName, snapshotName, destDsName)
 	defer klog.V(2).Info("### TNSOneTimeReplicationJob")
 
@@ -547,7 +1341,7 @@ func TNSOneTimeReplicationJob(client *Client, srcDsName, snapshotName string, de
 		},
 	}
 
-	jobID, err := callTS[int](client, "replication.run_onetime", params)
+	jobID, err := callTS[int](ctx, client, "replication.run_onetime", params)
 	if err != nil {
 		return nil, NewCsiError(codes.Internal, err)
 	}
@@ -555,7 +1349,7 @@ func TNSOneTimeReplicationJob(client *Client, srcDsName, snapshotName string, de
 	return &jobID, nil
 }
 
-func TNSGetJobStatus(client *Client, jobID int) (*TNSJobStatus, *CsiError) {
+func TNSGetJobStatus(ctx context.Context, client *Client, jobID int) (*TNSJobStatus, *CsiError) {
 	klog.V(2).Infof("### TNSGetJobStatus jobID: %d", jobID)
 	defer klog.V(2).Info("### TNSGetJobStatus")
 
@@ -564,7 +1358,7 @@ func TNSGetJobStatus(client *Client, jobID int) (*TNSJobStatus, *CsiError) {
 			{"id", "=", jobID},
 		},
 	}
-	jobs, err := callTS[[]TNSJobStatus](client, "core.get_jobs", params)
+	jobs, err := callTS[[]TNSJobStatus](ctx, client, "core.get_jobs", params)
 	if err != nil {
 		return nil, NewCsiError(codes.Internal, err)
 	}
@@ -576,11 +1370,87 @@ func TNSGetJobStatus(client *Client, jobID int) (*TNSJobStatus, *CsiError) {
 	return &jobs[0], nil
 }
 
+func TNSCoreSubscribe(ctx context.Context, client *Client, collection string) *CsiError {
+	klog.V(2).Infof("### TNSCoreSubscribe collection: %s", collection)
+	defer klog.V(2).Info("### TNSCoreSubscribe")
+
+	params := []interface{}{collection}
+	_, err := callTS[interface{}](ctx, client, "core.subscribe", params)
+	if err != nil {
+		return NewCsiError(codes.Internal, err)
+	}
+
+	return nil
+}
+
+func TNSJobAbort(ctx context.Context, client *Client, jobID int) *CsiError {
+	klog.V(2).Infof("### TNSJobAbort jobID: %d", jobID)
+	defer klog.V(2).Info("### TNSJobAbort")
+
+	params := []interface{}{jobID}
+	_, err := callTS[interface{}](ctx, client, "core.job_abort", params)
+	if err != nil {
+		return NewCsiError(codes.Internal, err)
+	}
+
+	return nil
+}
+
 // ----------------------
 // Calls to Truenas Scale
 // ----------------------
 
-func callTS[T any](c *Client, method string, params interface{}) (T, error) {
+func callTS[T any](ctx context.Context, c *Client, method string, params interface{}) (T, error) {
+	result, err := doCallTS[T](ctx, c, method, params)
+
+	// The WebSocket has been lost (eg Truenas Scale rebooting). Retry the calls that can safely be sent again
+	for retry := 1; err != nil && isConnectionError(err) && isIdempotentMethod(method) && retry <= maxCallRetries; retry++ {
+		c.pendingMu.Lock()
+		lost := c.done
+		c.pendingMu.Unlock()
+
+		delay := retryDelay(retry)
+		klog.Warningf("Call to %s failed: %v. Retry %d/%d in %s", method, err, retry, maxCallRetries, delay)
+		if sleepErr := sleepContext(ctx, delay); sleepErr != nil {
+			return result, sleepErr
+		}
+		if csiErr := c.reconnect(ctx, lost); csiErr != nil {
+			klog.Warningf("Reconnect failed: %v", csiErr)
+			if csiErr.Code != codes.Unavailable {
+				return result, csiErr.Err
+			}
+			err = csiErr.Err
+			continue
+		}
+		result, err = doCallTS[T](ctx, c, method, params)
+	}
+
+	// The session may have lost its authentication (eg api key rotated then restored, middleware restart)
+	// Login again once with the api key of the connection and retry
+	if err != nil && isNotAuthenticatedError(err) && method != "auth.login_with_api_key" {
+		c.mu.Lock()
+		apiKey := c.apiKey
+		c.mu.Unlock()
+		if apiKey == "" {
+			return result, err
+		}
+
+		klog.Warningf("Session not authenticated when calling %s. Login again", method)
+		if csiErr := TNSLogin(ctx, c, apiKey); csiErr != nil {
+			// Drop the connection, ReleaseClient will remove it from the pool
+			c.mu.Lock()
+			c.apiKey = ""
+			c.mu.Unlock()
+			c.closeConn()
+			return result, err
+		}
+		return doCallTS[T](ctx, c, method, params)
+	}
+
+	return result, err
+}
+
+func doCallTS[T any](ctx context.Context, c *Client, method string, params interface{}) (T, error) {
 
 	var result T
 
@@ -600,19 +1470,17 @@ func callTS[T any](c *Client, method string, params interface{}) (T, error) {
 		klog.Errorf("Failed to encode JSON: %v", err)
 		return result, err
 	}
-	if request.Method != "auth.login_with_api_key" {
-		// Do not log apiKey
+	if isSensitiveRequest(request.Method, jsonData) {
+		// Do not log apiKey and encryption keys
+		klog.V(2).Infof("S: %s (params not logged)", request.Method)
+	} else {
 		klog.V(2).Infof("S: %s", jsonData)
 	}
-	if err := c.conn.WriteMessage(websocket.TextMessage, jsonData); err != nil {
-		klog.Errorf("Failed to send message: %v", err)
-		return result, err
-	}
 
-	klog.V(3).Infof("Message sent, waiting for response...")
-	_, response, err := c.conn.ReadMessage()
+	klog.V(3).Infof("Sending message %s and waiting for response...", request.ID)
+	response, err := c.roundTrip(ctx, request.ID, jsonData)
 	if err != nil {
-		klog.Errorf("Failed to read response: %v", err)
+		klog.Errorf("Failed to call %s: %v", method, err)
 		return result, err
 	}
 
@@ -646,23 +1514,48 @@ func callTS[T any](c *Client, method string, params interface{}) (T, error) {
 	return result, nil
 }
 
-func TNSLogin(legacyTns bool, conn *websocket.Conn, apiKey string) *CsiError {
-	klog.V(2).Infof("### TNSLogin legacyTns? %t", legacyTns)
-	defer klog.V(2).Info("### TNSLogin")
+func isNotAuthenticatedError(err error) bool {
+	if customErr, ok := err.(CustomError); ok {
+		return strings.Contains(strings.ToLower(customErr.Reason), "not authenticated")
+	}
+	return false
+}
 
-	// Build temp client
-	tempClient := &Client{
-		legacyTns: legacyTns,
-		conn:      conn,
+// isSensitiveRequest returns true when the params of the request contain an api key or an encryption key
+func isSensitiveRequest(method string, jsonData []byte) bool {
+	switch method {
+	case "auth.login_with_api_key", "pool.dataset.unlock":
+		return true
 	}
+	return bytes.Contains(jsonData, []byte(`"encryption_options"`))
+}
+
+func TNSLogin(ctx context.Context, client *Client, apiKey string) *CsiError {
+	klog.V(2).Infof("### TNSLogin legacyTns? %t", client.legacyTns)
+	defer klog.V(2).Info("### TNSLogin")
 
 	// Login with API key
 	params := []interface{}{
 		apiKey,
 	}
-	res, err := callTS[bool](tempClient, "auth.login_with_api_key", params)
+	res, err := callTS[bool](ctx, client, "auth.login_with_api_key", params)
 	if err != nil {
-		csiError := NewCsiError(codes.Unauthenticated, err)
+		// Only a refusal of Truenas Scale means that the api key is not valid. The connection errors and the
+		// errors of the context are kept as such by NewCsiError
+		code := codes.Internal
+		var serverErr CustomError
+		if errors.As(err, &serverErr) {
+			code = codes.Unauthenticated
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		csiError := NewCsiError(code, err)
+		klog.Errorf("Login failed: %s", csiError)
+		return csiError
+	}
+	if !res {
+		csiError := NewCsiError(codes.Unauthenticated, errors.New("login with api key refused"))
 		klog.Errorf("Login failed: %s", csiError)
 		return csiError
 	}